@@ -118,7 +118,7 @@ func (d dbCFG) chunk_size_mb() (max int) {
 // webhook_listener_config loads the shared PubSub listener configuration from
 // the config file and the encrypted database, returning the values needed by
 // core.ConfigureWebhookListener.
-func (d dbCFG) webhook_listener_config() (enabled bool, scheme, bind, path, sig_header, token_header, public_url, tls_cert, tls_key, secret, token string, workers int, self_register bool) {
+func (d dbCFG) webhook_listener_config() (enabled bool, scheme, bind, path, sig_header, token_header, public_url, tls_cert, tls_key, secret, token, admin_path, admin_token string, workers int, self_register bool) {
 	enabled = global.cfg.GetBool("pubsub_listener", "enabled")
 	scheme = global.cfg.Get("pubsub_listener", "scheme")
 	bind = global.cfg.Get("pubsub_listener", "bind")
@@ -128,6 +128,7 @@ func (d dbCFG) webhook_listener_config() (enabled bool, scheme, bind, path, sig_
 	public_url = global.cfg.Get("pubsub_listener", "public_url")
 	tls_cert = global.cfg.Get("pubsub_listener", "tls_cert")
 	tls_key = global.cfg.Get("pubsub_listener", "tls_key")
+	admin_path = global.cfg.Get("pubsub_listener", "admin_path")
 	self_register = global.cfg.GetBool("pubsub_listener", "self_register")
 	if w := global.cfg.GetInt("pubsub_listener", "workers"); w > 0 {
 		workers = int(w)
@@ -136,6 +137,7 @@ func (d dbCFG) webhook_listener_config() (enabled bool, scheme, bind, path, sig_
 	}
 	global.db.Get("kitebroker", "webhook_secret", &secret)
 	global.db.Get("kitebroker", "webhook_token", &token)
+	global.db.Get("kitebroker", "webhook_admin_token", &admin_token)
 	return
 }
 
@@ -144,7 +146,7 @@ func (d dbCFG) webhook_listener_config() (enabled bool, scheme, bind, path, sig_
 // validation) until a webhook task actually hosts itself, at which point the
 // listener uses these settings.
 func configure_webhook_listener() {
-	enabled, scheme, bind, path, sig_header, token_header, public_url, tls_cert, tls_key, secret, token, workers, self_register := dbConfig.webhook_listener_config()
+	enabled, scheme, bind, path, sig_header, token_header, public_url, tls_cert, tls_key, secret, token, admin_path, admin_token, workers, self_register := dbConfig.webhook_listener_config()
 
 	// When self-registering, generate and persist a secret and token if none
 	// are configured, so deliveries are authenticated by default. They are
@@ -162,6 +164,10 @@ func configure_webhook_listener() {
 		}
 	}
 
+	// Credentials replaced by a recent `pubsub_webhooks --rotate_secret` stay
+	// valid until the rotation window closes.
+	creds := LoadWebhookCredentials()
+
 	if err := ConfigureWebhookListener(WebhookListenerConfig{
 		Enabled:      enabled,
 		Scheme:       scheme,
@@ -169,6 +175,9 @@ func configure_webhook_listener() {
 		Path:         path,
 		Secret:       secret,
 		Token:        token,
+		PrevSecret:   creds.PrevSecret,
+		PrevToken:    creds.PrevToken,
+		PrevUntil:    creds.PrevUntil,
 		SigHeader:    sig_header,
 		TokenHeader:  token_header,
 		Workers:      workers,
@@ -176,6 +185,8 @@ func configure_webhook_listener() {
 		TLSKey:       tls_key,
 		SelfRegister: self_register,
 		PublicURL:    public_url,
+		AdminPath:    admin_path,
+		AdminToken:   admin_token,
 	}); err != nil {
 		Critical(err)
 	}
@@ -552,9 +563,10 @@ func config_api(configure_api bool) {
 	// PubSub listener (webhook receiver) configuration. These are shared
 	// infrastructure settings used by webhook-driven tasks; individual webhook
 	// tasks only declare the subjects they consume.
-	var webhook_secret, webhook_token string
+	var webhook_secret, webhook_token, webhook_admin_token string
 	global.db.Get("kitebroker", "webhook_secret", &webhook_secret)
 	global.db.Get("kitebroker", "webhook_token", &webhook_token)
+	global.db.Get("kitebroker", "webhook_admin_token", &webhook_admin_token)
 
 	pubsub := nfo.NewOptions("  [PubSub Listener (Webhook Receiver)]  ", "(selection or 'q' to return to previous)", 'q')
 	// Master switch. When disabled, webhook-capable tasks fall back to polling,
@@ -589,6 +601,10 @@ func config_api(configure_api bool) {
 	pubsub.ShowWhen(enabled_when)
 	pubsub_tls_key := pubsub.String("TLS Key File", global.cfg.Get("pubsub_listener", "tls_key"), "Path to the TLS private key. (optional)", false)
 	pubsub.ShowWhen(enabled_when)
+	pubsub.SecretVar(&webhook_admin_token, "Status Endpoint Token", webhook_admin_token, "Bearer token required by the listener status endpoint. (leave blank to disable the endpoint)")
+	pubsub.ShowWhen(enabled_when)
+	pubsub_admin_path := pubsub.String("Status Endpoint Path", firstSet(global.cfg.Get("pubsub_listener", "admin_path"), "/status"), "URL path of the listener status endpoint. (ie.. /status)", false)
+	pubsub.ShowWhen(func() bool { return *pubsub_enabled && !IsBlank(webhook_admin_token) })
 	setup.Options("PubSub Listener (Webhook Receiver)", pubsub, false)
 
 	setup.Func("Clear current authorization token(s).", func() bool {
@@ -642,6 +658,7 @@ func config_api(configure_api bool) {
 		Critical(global.cfg.Set("pubsub_listener", "public_url", *pubsub_public_url))
 		Critical(global.cfg.Set("pubsub_listener", "tls_cert", *pubsub_tls_cert))
 		Critical(global.cfg.Set("pubsub_listener", "tls_key", *pubsub_tls_key))
+		Critical(global.cfg.Set("pubsub_listener", "admin_path", *pubsub_admin_path))
 		// Persist or clear the webhook secret/token: a blank field removes any
 		// stored value rather than leaving the previous one in place.
 		if !IsBlank(webhook_secret) {
@@ -654,6 +671,11 @@ func config_api(configure_api bool) {
 		} else {
 			global.db.Unset("kitebroker", "webhook_token")
 		}
+		if !IsBlank(webhook_admin_token) {
+			global.db.CryptSet("kitebroker", "webhook_admin_token", &webhook_admin_token)
+		} else {
+			global.db.Unset("kitebroker", "webhook_admin_token")
+		}
 
 		Critical(global.cfg.TrimSave())
 	}
@@ -224,6 +224,7 @@ var (
 	Info            = nfo.Aux             // Log as standrd INFO
 	HumanSize       = nfo.HumanSize       // Convert bytes int64 to B/KB/MB/GB/TB.
 	ConfirmDefault  = nfo.ConfirmDefault  // Yes/No prompt with a default answer.
+	GetSecret       = nfo.GetSecret       // Prompt for input without echoing it.
 )
 
 var (
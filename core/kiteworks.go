@@ -242,6 +242,45 @@ type KiteWebhook struct {
 	Status        KiteWebhookStatus `json:"status"`
 }
 
+// MatchesURL reports whether the webhook delivers to webhook_url. URLs are
+// compared case-insensitively, ignoring surrounding space and a trailing slash.
+func (w KiteWebhook) MatchesURL(webhook_url string) bool {
+	norm := func(u string) string {
+		return strings.TrimSuffix(strings.TrimSpace(u), "/")
+	}
+	return strings.EqualFold(norm(w.URL), norm(webhook_url))
+}
+
+// HasSubscriptions reports whether the webhook's subscriptions are the same set
+// as subscriptions, regardless of order, case, or duplicates.
+func (w KiteWebhook) HasSubscriptions(subscriptions []string) bool {
+	set := func(subs []string) map[string]struct{} {
+		out := make(map[string]struct{}, len(subs))
+		for _, s := range subs {
+			if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+				out[s] = struct{}{}
+			}
+		}
+		return out
+	}
+	have, want := set(w.Subscriptions), set(subscriptions)
+	if len(have) != len(want) {
+		return false
+	}
+	for s := range want {
+		if _, ok := have[s]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Failing reports whether the appliance has marked the webhook as failing
+// delivery.
+func (w KiteWebhook) Failing() bool {
+	return strings.EqualFold(w.Status.Status, WEBHOOK_STATUS_ERROR)
+}
+
 // Webhooks retrieves all PubSub webhooks, paginating through the result set.
 // It accepts optional query parameters to filter the results.
 func (K KWSession) Webhooks(params ...interface{}) (webhooks []KiteWebhook, err error) {
@@ -462,6 +501,17 @@ func (s kw_rest_folder) AddUsersToFolder(emails []string, role_id int, notify bo
 	return
 }
 
+// AddGroupsToFolder grants groups a role on the folder.
+func (s kw_rest_folder) AddGroupsToFolder(group_ids []string, role_id int, notify bool, notify_files_added bool, params ...interface{}) (err error) {
+	params = SetParams(PostJSON{"notify": notify, "notifyFileAdded": notify_files_added, "groupIds": group_ids, "roleId": role_id}, Query{"updateIfExists": true, "partialSuccess": true}, params)
+	err = s.Call(APIRequest{
+		Method: "POST",
+		Path:   SetPath("/rest/folders/%s/members", s.folder_id),
+		Params: params,
+	})
+	return
+}
+
 // RemoveUsersFromFolder
 func (s kw_rest_folder) RemoveUserFromFolder(user_id string, params ...interface{}) (err error) {
 	return s.Call(APIRequest{
@@ -875,6 +925,24 @@ func (s kw_rest_admin) Profiles(params ...interface{}) (profiles []KWProfile, er
 	return
 }
 
+// KiteGroup is a Kiteworks LDAP group or distribution list.
+type KiteGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// Groups lists the groups that can be granted access to folders.
+func (s kw_rest_admin) Groups(params ...interface{}) (groups []KiteGroup, err error) {
+	err = s.DataCall(APIRequest{
+		Method: "GET",
+		Path:   "/rest/admin/groups",
+		Params: SetParams(params),
+		Output: &groups,
+	}, -1, 1000)
+	return
+}
+
 // kw_rest_file represents a file command within the Kite REST API.
 type kw_rest_file struct {
 	file_id string
@@ -1122,6 +1190,42 @@ func (s kw_rest_file) Recover(params ...interface{}) (err error) {
 	})
 }
 
+// Rename renames the file.
+func (s kw_rest_file) Rename(name string) (err error) {
+	return s.Call(APIRequest{
+		Method: "PUT",
+		Path:   SetPath("/rest/files/%s", s.file_id),
+		Params: SetParams(PostJSON{"name": name}),
+	})
+}
+
+// SetDescription sets the file's description.
+func (s kw_rest_file) SetDescription(desc string) (err error) {
+	return s.Call(APIRequest{
+		Method: "PUT",
+		Path:   SetPath("/rest/files/%s", s.file_id),
+		Params: SetParams(PostJSON{"description": desc}),
+	})
+}
+
+// SetExpiry sets the file's expiration date.
+func (s kw_rest_file) SetExpiry(expire time.Time) (err error) {
+	return s.Call(APIRequest{
+		Method: "PUT",
+		Path:   SetPath("/rest/files/%s", s.file_id),
+		Params: SetParams(PostJSON{"expire": WriteKWTime(expire)}),
+	})
+}
+
+// MoveToFolder moves the file to the specified folder ID.
+func (s kw_rest_file) MoveToFolder(folder_id string) (err error) {
+	return s.Call(APIRequest{
+		Method: "POST",
+		Path:   SetPath("/rest/files/%s/actions/move", s.file_id),
+		Params: SetParams(PostJSON{"destinationFolderId": folder_id}),
+	})
+}
+
 // MoveToFolder moves the folder to the specified folder ID.
 func (s kw_rest_folder) MoveToFolder(folder_id string) (err error) {
 	return s.Call(APIRequest{
@@ -1182,7 +1286,7 @@ func (K KWSession) MyUser() (user KiteUser, err error) {
 // It includes send and folder usage and allowance details.
 type KiteQuota struct {
 	SendUsed      int `json:"send_quota_used"`
-	FolderUsed    int `json:"folder_quota_users"`
+	FolderUsed    int `json:"folder_quota_used"`
 	FolderAllowed int `json:"folder_quota_allowed"`
 	SendAllowed   int `json:"send_quota_allowed"`
 }
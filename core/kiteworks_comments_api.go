@@ -78,13 +78,20 @@ func (s kw_rest_file) Comments(params ...interface{}) (result []KiteComment, err
 	return
 }
 
-// AddCommentReply adds a reply to an existing comment on the file.
-func (s kw_rest_file) AddCommentReply(parent_id int, contents string) (err error) {
-	return s.Call(APIRequest{
+// AddCommentReply adds a reply to an existing comment on the file, or a
+// top-level comment when parent_id is 0, and returns the new comment.
+func (s kw_rest_file) AddCommentReply(parent_id int, contents string) (result KiteComment, err error) {
+	body := PostJSON{"contents": contents}
+	if parent_id > 0 {
+		body["parentId"] = parent_id
+	}
+	err = s.Call(APIRequest{
 		Method: "POST",
 		Path:   SetPath("/rest/files/%s/comments", s.file_id),
-		Params: SetParams(PostJSON{"parentId": parent_id, "contents": contents}),
+		Params: SetParams(body, Query{"returnEntity": true}),
+		Output: &result,
 	})
+	return
 }
 
 // Comments retrieves comments on the folder.
@@ -0,0 +1,30 @@
+package core
+
+// KiteTask represents a task on a file.
+type KiteTask struct {
+	ID         int    `json:"id"`
+	ObjectID   string `json:"objectId,omitempty"`
+	UserID     string `json:"userId,omitempty"`
+	AssigneeID string `json:"assigneeId,omitempty"`
+	Contents   string `json:"contents,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Due        string `json:"due,omitempty"`
+	Created    string `json:"created,omitempty"`
+	Modified   string `json:"modified,omitempty"`
+}
+
+// Completed reports whether the task has been completed.
+func (t KiteTask) Completed() bool {
+	return t.Status == "completed"
+}
+
+// Tasks retrieves the tasks on the file.
+func (s kw_rest_file) Tasks(params ...interface{}) (result []KiteTask, err error) {
+	err = s.DataCall(APIRequest{
+		Method: "GET",
+		Path:   SetPath("/rest/files/%s/tasks", s.file_id),
+		Params: SetParams(params),
+		Output: &result,
+	}, -1, 1000)
+	return
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"fmt"
+)
+
+// KiteFileVersion represents a version of a file.
+type KiteFileVersion struct {
+	ID             string `json:"id"`
+	FileID         string `json:"fileId,omitempty"`
+	Name           string `json:"name,omitempty"`
+	Size           int64  `json:"size,omitempty"`
+	Fingerprint    string `json:"fingerprint,omitempty"`
+	Created        string `json:"created,omitempty"`
+	Modified       string `json:"modified,omitempty"`
+	ClientModified string `json:"clientModified,omitempty"`
+	UserID         string `json:"userId,omitempty"`
+	Current        bool   `json:"isCurrent,omitempty"`
+}
+
+// Versions retrieves the versions of the file.
+func (s kw_rest_file) Versions(params ...interface{}) (result []KiteFileVersion, err error) {
+	err = s.DataCall(APIRequest{
+		Method: "GET",
+		Path:   SetPath("/rest/files/%s/versions", s.file_id),
+		Params: SetParams(params),
+		Output: &result,
+	}, -1, 1000)
+	return
+}
+
+// QDownloadVersion downloads the content of a version of a file.
+func (K KWSession) QDownloadVersion(file_id string, version *KiteFileVersion) (ReadSeekCloser, error) {
+	if version == nil {
+		return nil, fmt.Errorf("nil version provided.")
+	}
+
+	req, err := K.NewRequest("GET", SetPath("/rest/files/%s/versions/%s/content", file_id, version.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Accellion-Version", fmt.Sprintf("%d", DEFAULT_KWAPI_VERSION))
+
+	if err = K.SetToken(K.Username, req); err != nil {
+		return nil, err
+	}
+
+	downloader := K.WebDownload(req)
+	downloader.Seek(-500, -500)
+
+	return downloader, nil
+}
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A migration copies users, folders, files, permissions, comments and tasks
+// from another system into Kiteworks. Each source system implements
+// MigrationSource, and the MigrationEngine does the rest: it creates and
+// verifies destination users, walks the source folder trees, creates the
+// destination folders, maps folder members, uploads files and their versions,
+// posts comments and tasks, keeps resume state, and produces the pre-migration
+// report.
+
+// MigrationUser is a user on the migration source.
+type MigrationUser struct {
+	ID    string // Source user id.
+	Email string // Login email, used as the Kiteworks username.
+	Name  string // Display name.
+	Home  string // Source id of the user's root folder, when the source has one.
+}
+
+// MigrationMember is a member of a source folder. Role is the name of the
+// Kiteworks role to grant, resolved against the destination's roles; RoleID,
+// when set, is used as-is instead. SourceRole is the member's role or
+// permission bits as the source names them, which a mapping's source role
+// table may grant as another role. A member with neither Role nor RoleID has
+// no access on the source and is removed from the destination folder. A
+// group member has a blank User and names the group with Group and GroupID,
+// which sources implementing MigrationGroupSource can expand into its users.
+type MigrationMember struct {
+	User       string
+	Role       string
+	RoleID     int
+	SourceRole string
+	Group      string
+	GroupID    string
+}
+
+// MigrationSource is the source side of a migration. Folders and files are
+// described with the Sync* objects; their SrcID is whatever the source needs to
+// find the object again and FullPath is the folder's path relative to the
+// user's root, which becomes its Kiteworks path.
+//
+// Methods are called concurrently, for different users and folders.
+type MigrationSource interface {
+	// Name returns the display name of the source system, e.g. "Box.com".
+	Name() string
+	// Users returns all users on the source.
+	Users() ([]MigrationUser, error)
+	// Root returns the user's root folder. Its files are migrated into
+	// FullPath (skipped when blank), and the folder itself is never created
+	// or given members.
+	Root(user MigrationUser) (SyncFolder, error)
+	// Folders returns the folders within a folder that are to be migrated.
+	Folders(user MigrationUser, folder SyncFolder) ([]SyncFolder, error)
+	// Files returns the files within a folder.
+	Files(user MigrationUser, folder SyncFolder) ([]SyncFile, error)
+	// Members returns the folder's members, other than the user.
+	Members(user MigrationUser, folder SyncFolder) ([]MigrationMember, error)
+	// Versions returns the file's versions, oldest first. A source without
+	// version history returns nil and the current content is migrated.
+	Versions(user MigrationUser, file SyncFile) ([]SyncVersion, error)
+	// Comments returns the file's comments, oldest first.
+	Comments(user MigrationUser, file SyncFile) ([]SyncComment, error)
+	// Open opens a version of a file for download.
+	Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error)
+}
+
+// MigrationTaskSource is implemented by sources that have file tasks.
+type MigrationTaskSource interface {
+	// Tasks returns the file's tasks, oldest first.
+	Tasks(user MigrationUser, file SyncFile) ([]SyncTask, error)
+}
+
+// MigrationGroupSource is implemented by sources whose folder members may be
+// groups.
+type MigrationGroupSource interface {
+	// GroupMembers returns the emails of a group's members, or
+	// ErrGroupNotExpandable when the source cannot list them.
+	GroupMembers(user MigrationUser, group_id string) ([]string, error)
+}
+
+// MigrationFolderReleaser is implemented by sources that hold a folder's
+// listing between its Files and Folders calls.
+type MigrationFolderReleaser interface {
+	// Release is called once the walk is done with the folder, however its
+	// walk ended.
+	Release(user MigrationUser, folder SyncFolder)
+}
+
+// MigrationRoleSource is implemented by sources that grant folder members
+// Kiteworks roles by name, so preflight can check the destination has them.
+type MigrationRoleSource interface {
+	// RoleNames returns the role names Members may give.
+	RoleNames() []string
+}
+
+// MigrationTreeSource is implemented by sources whose folders are modified
+// whenever anything beneath them is, so a delta run can pass over the whole
+// subtree of a folder unmodified since the user's last run.
+type MigrationTreeSource interface {
+	// TreeModified reports whether folder modification times cover their
+	// subtrees.
+	TreeModified() bool
+}
+
+// MigrationUserHook is implemented by sources that need to act once a user's
+// Kiteworks account has been created or verified.
+type MigrationUserHook interface {
+	UserReady(user MigrationUser, dst *KiteUser) error
+}
+
+// MigrationTaskPolicy sets what is done with source file tasks, by state:
+// "import" creates a Kiteworks task, "comment" posts the task as a comment and
+// "drop" discards it.
+type MigrationTaskPolicy struct {
+	Current    string
+	Overdue    string
+	Completed  string
+	NoDueDate  string
+	FutureDays int // Due date given to imported tasks that are overdue or have none.
+}
+
+// DefaultMigrationTaskPolicy imports open tasks and keeps completed ones as comments.
+func DefaultMigrationTaskPolicy() MigrationTaskPolicy {
+	return MigrationTaskPolicy{
+		Current:    "import",
+		Overdue:    "import",
+		Completed:  "comment",
+		NoDueDate:  "import",
+		FutureDays: 7,
+	}
+}
+
+// disposition returns the policy's disposition for a task.
+func (p MigrationTaskPolicy) disposition(task *SyncTask) string {
+	switch {
+	case task.Completed:
+		return strings.ToLower(p.Completed)
+	case task.Due.IsZero():
+		return strings.ToLower(p.NoDueDate)
+	case task.Due.After(time.Now()):
+		return strings.ToLower(p.Current)
+	default:
+		return strings.ToLower(p.Overdue)
+	}
+}
+
+// FilterInvalidChars escapes characters Kiteworks does not allow in file and
+// folder names.
+func FilterInvalidChars(input string) string {
+	var output []rune
+	for _, v := range input {
+		switch v {
+		case '\\', '*', '?', '"', '<', '>', '|':
+			output = append(output, []rune(url.QueryEscape(string(v)))...)
+		default:
+			output = append(output, v)
+		}
+	}
+	return string(output)
+}
+
+// migrationDate formats a time as YYYY-MM-DD.
+func migrationDate(input time.Time) string {
+	return input.UTC().Format("2006-01-02")
+}
+
+// migrationTaskString describes a source task, for posting as a comment or as
+// the message of an imported task.
+func migrationTaskString(source string, task *SyncTask, for_import bool) string {
+	source = strings.ToLower(source)
+
+	var insert string
+	if !for_import {
+		insert = fmt.Sprintf(" assigned to %s,", strings.Join(task.AssignedTo, ", "))
+	}
+
+	due := task.Due.UTC()
+	now := time.Now().UTC()
+
+	switch {
+	case task.Completed:
+		return fmt.Sprintf("[%s] %s task: \"%s\", created by %s,%s and completed on %s.", migrationDate(task.Created), source, task.Message, task.Creator, insert, migrationDate(task.CompletedOn))
+	case due.IsZero():
+		return fmt.Sprintf("[%s] %s task: \"%s\", created by %s,%s and had no due date.", migrationDate(task.Created), source, task.Message, task.Creator, insert)
+	case due.Before(now) || migrationDate(due) == migrationDate(now):
+		return fmt.Sprintf("[%s] %s task: \"%s\", created by %s,%s and was due on %s.", migrationDate(task.Created), source, task.Message, task.Creator, insert, migrationDate(due))
+	default:
+		if for_import {
+			return fmt.Sprintf("[%s] %s task: \"%s\".", migrationDate(task.Created), source, task.Message)
+		}
+		return fmt.Sprintf("[%s] %s task: \"%s\", created by %s, assigned to %s, and is due on %s.", migrationDate(task.Created), source, task.Message, task.Creator, strings.Join(task.AssignedTo, ", "), migrationDate(due))
+	}
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// migrationSeen is a source item seen by a user's migration, kept so that a
+// delta run can tell which items have since been deleted on the source.
+type migrationSeen struct {
+	Folder bool   `json:"folder,omitempty"`
+	Path   string `json:"path"`
+	DestID string `json:"dest_id,omitempty"`
+	Run    int64  `json:"run"`
+}
+
+// markKey is the high-water mark key of a source user.
+func (E *MigrationEngine) markKey(user MigrationUser) string {
+	return strings.ToLower(user.Email)
+}
+
+// seenTable holds the items seen on a source user's migrations, keyed by
+// source id. It is per source user, so consolidated users keep their own.
+func (E *MigrationEngine) seenTable(user MigrationUser) Table {
+	return E.db.Sub("migration_seen").Table(strings.ToLower(user.Email))
+}
+
+// see records a source item as present in this run.
+func (R *migrationRun) see(src_id string, folder bool, path, dest_id string) {
+	if R.run == 0 {
+		return
+	}
+	R.seen.Set(src_id, &migrationSeen{
+		Folder: folder,
+		Path:   strings.Trim(path, "/"),
+		DestID: dest_id,
+		Run:    R.run,
+	})
+}
+
+// unchangedFolder reports whether a folder's members were synced and the
+// folder is not modified since the high-water mark.
+func (R *migrationRun) unchangedFolder(folder *SyncFolder) bool {
+	var state SyncFolder
+	if R.mark.IsZero() || folder.Modified.IsZero() || folder.Modified.After(R.mark) {
+		return false
+	}
+	return R.folders.Get(R.stateKey(folder.SrcID), &state) && state.SyncedPermissions
+}
+
+// errUnchangedTree is returned by processFolder for a folder whose subtree is
+// unchanged since the high-water mark, so the walk passes over its contents.
+var errUnchangedTree = errors.New("folder unchanged since last run")
+
+// unchangedTree reports whether the source's folder modification times cover
+// their subtrees, so an unchanged folder's contents need not be walked.
+func (R *migrationRun) unchangedTree() bool {
+	src, ok := R.Source.(MigrationTreeSource)
+	return ok && src.TreeModified()
+}
+
+// keep records an unchanged subtree that is not walked, so the items seen
+// within it by earlier runs are not taken as deleted.
+func (R *migrationRun) keep(folder *SyncFolder) {
+	R.lock.Lock()
+	R.kept = append(R.kept, strings.Trim(folder.FullPath, "/")+"/")
+	R.lock.Unlock()
+}
+
+// inKept reports whether path lies within an unchanged subtree.
+func (R *migrationRun) inKept(path string) bool {
+	R.lock.RLock()
+	defer R.lock.RUnlock()
+	for _, p := range R.kept {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// unchangedFile reports whether a file was fully copied to dest under its
+// current name and is not modified since the high-water mark.
+func (R *migrationRun) unchangedFile(dest *KiteObject, state, file *SyncFile) bool {
+	if R.mark.IsZero() || file.Modified.IsZero() || file.Modified.After(R.mark) {
+		return false
+	}
+	return !IsBlank(state.DestID) && !IsBlank(state.SyncedVersionID) && state.DestFolderID == dest.ID && state.Name == file.Name
+}
+
+// relocateFile moves or renames the destination copy of a file that was moved
+// or renamed on the source since it was copied.
+func (R *migrationRun) relocateFile(dest *KiteObject, state, file *SyncFile) error {
+	if !IsBlank(state.DestFolderID) && state.DestFolderID != dest.ID {
+		if err := R.sess.File(state.DestID).MoveToFolder(dest.ID); err != nil {
+			return fmt.Errorf("Error moving %s to /%s: %v", file.Name, dest.Path, err)
+		}
+		Log("[%s]: Moved %s to /%s.", R.username, file.Name, dest.Path)
+		state.DestFolderID = dest.ID
+	}
+	if state.Name != file.Name {
+		if err := R.sess.File(state.DestID).Rename(FilterInvalidChars(file.Name)); err != nil {
+			return fmt.Errorf("Error renaming %s to %s: %v", state.Name, file.Name, err)
+		}
+		Log("[%s]: Renamed %s to %s.", R.username, state.Name, file.Name)
+		state.Name = file.Name
+	}
+	return nil
+}
+
+// gone returns the items seen by an earlier run but not by this one, parents
+// before their contents, keyed by source id. Items within an unchanged
+// subtree that was not walked are not gone.
+func (R *migrationRun) gone() (ids []string, items map[string]migrationSeen) {
+	items = make(map[string]migrationSeen)
+	for _, id := range R.seen.Keys() {
+		var item migrationSeen
+		if R.seen.Get(id, &item) && item.Run != R.run && !R.inKept(item.Path) {
+			ids = append(ids, id)
+			items[id] = item
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return items[ids[i]].Path < items[ids[j]].Path
+	})
+	return
+}
+
+// propagateDeletes removes, or moves to the holding folder, the destination
+// copies of items deleted on the source since the last run. Items inside a
+// removed folder go with it.
+func (R *migrationRun) propagateDeletes() {
+	ids, items := R.gone()
+	if len(ids) == 0 {
+		return
+	}
+
+	var holding *KiteObject
+	if !IsBlank(R.Holding) {
+		var err error
+		if holding, err = R.ResolvePath(R.Holding); err != nil {
+			Err("[%s]: %v, source deletions not applied.", R.username, err)
+			return
+		}
+	}
+
+	var removed []string
+	for _, id := range ids {
+		item := items[id]
+		var parent_removed bool
+		for _, p := range removed {
+			if strings.HasPrefix(item.Path, p+"/") {
+				parent_removed = true
+				break
+			}
+		}
+		if !parent_removed && !IsBlank(item.DestID) && (holding == nil || item.DestID != holding.ID) {
+			if err := R.removeDest(item, holding); err != nil {
+				Err("[%s]: Error removing /%s, deleted on %s: %v", R.username, item.Path, R.Source.Name(), err)
+				continue
+			}
+			R.tally.deleted.Add(1)
+			if item.Folder {
+				removed = append(removed, item.Path)
+			}
+		}
+		R.seen.Unset(id)
+		if item.Folder {
+			R.folders.Unset(R.stateKey(id))
+		} else {
+			R.files.Unset(R.stateKey(id))
+		}
+	}
+}
+
+// removeDest deletes the destination copy of an item, or moves it to holding.
+// An item already gone from the destination is not an error.
+func (R *migrationRun) removeDest(item migrationSeen, holding *KiteObject) (err error) {
+	switch {
+	case holding != nil && item.Folder:
+		Log("[%s]: /%s deleted on %s, moving to /%s.", R.username, item.Path, R.Source.Name(), holding.Path)
+		err = R.sess.Folder(item.DestID).MoveToFolder(holding.ID)
+	case holding != nil:
+		Log("[%s]: /%s deleted on %s, moving to /%s.", R.username, item.Path, R.Source.Name(), holding.Path)
+		err = R.sess.File(item.DestID).MoveToFolder(holding.ID)
+	case item.Folder:
+		Log("[%s]: /%s deleted on %s, deleting.", R.username, item.Path, R.Source.Name())
+		err = R.sess.Folder(item.DestID).Delete()
+	default:
+		Log("[%s]: /%s deleted on %s, deleting.", R.username, item.Path, R.Source.Name())
+		err = R.sess.File(item.DestID).Delete()
+	}
+	if IsAPIError(err, "ERR_ENTITY_DELETED", "ERR_ENTITY_NOT_FOUND", "ERR_ENTITY_PARENT_FOLDER_DELETED") {
+		return nil
+	}
+	return err
+}
+
+// RunDeltaReport reports, without copying anything, the delta remaining for
+// each user since their high-water mark: files created or modified on the
+// source, their size, and items deleted on the source. It is meant to time
+// the final cutover.
+func (E *MigrationEngine) RunDeltaReport() error {
+	users, err := E.SourceUsers()
+	if err != nil {
+		return err
+	}
+	name := E.Source.Name()
+
+	report := E.task.Report
+	user_tally := report.Tally("Users")
+	file_tally := report.Tally("Delta Files")
+	size_tally := report.Tally("Delta Size", HumanSize)
+	deleted_tally := report.Tally("Source Deletions")
+
+	PleaseWait.Set(func() string {
+		return fmt.Sprintf("Scanning .. [ Users: %d | Delta Files: %d (%s) ]", user_tally.Value(), file_tally.Value(), HumanSize(size_tally.Value()))
+	}, []string{"[>  ]", "[>> ]", "[>>>]", "[ >>]", "[  >]", "[  <]", "[ <<]", "[<<<]", "[<< ]", "[<  ]"})
+	PleaseWait.Show()
+
+	Log("Calculating %s delta for %d users...", name, len(users))
+
+	wg := NewLimitGroup(10)
+	for _, u := range users {
+		wg.Add(1)
+		go func(user MigrationUser) {
+			defer wg.Done()
+			user_tally.Add(1)
+			username := E.destUser(user.Email)
+
+			var mark time.Time
+			E.marks.Get(E.markKey(user), &mark)
+
+			var (
+				files   int64
+				size    int64
+				visited = make(map[string]struct{})
+				lock    sync.Mutex
+			)
+			visit := func(src_id string) {
+				lock.Lock()
+				visited[src_id] = struct{}{}
+				lock.Unlock()
+			}
+			R := &migrationRun{MigrationEngine: E, user: user, username: username}
+
+			skipped, _, err := E.walk(user, func(folder *SyncFolder) error {
+				visit(folder.SrcID)
+				return nil
+			}, func(folder *SyncFolder, file *SyncFile) error {
+				visit(file.SrcID)
+				var state SyncFile
+				if R.files.Get(R.stateKey(file.SrcID), &state) && !IsBlank(state.SyncedVersionID) && state.Name == file.Name && !mark.IsZero() && !file.Modified.IsZero() && !file.Modified.After(mark) {
+					return nil
+				}
+				lock.Lock()
+				files++
+				size += file.Size
+				lock.Unlock()
+				return nil
+			})
+			if err != nil {
+				Err("[%s]: %v", username, err)
+				return
+			}
+
+			file_tally.Add64(files)
+			size_tally.Add64(size)
+
+			since := "no complete run yet"
+			if !mark.IsZero() {
+				since = "since " + mark.Local().Format(time.RFC1123)
+			}
+			if skipped > 0 {
+				Log("[%s]: %d new or changed file(s), %s, %s; %d folder(s) could not be read, deletions not counted.", username, files, HumanSize(size), since, skipped)
+				return
+			}
+			var deleted int64
+			seen := E.seenTable(user)
+			for _, id := range seen.Keys() {
+				if _, ok := visited[id]; !ok {
+					deleted++
+				}
+			}
+			deleted_tally.Add64(deleted)
+			Log("[%s]: %d new or changed file(s), %s, %d deleted on %s, %s.", username, files, HumanSize(size), deleted, name, since)
+		}(u)
+	}
+	wg.Wait()
+	Log("\n=== Delta Report Complete ===")
+	return nil
+}
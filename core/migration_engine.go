@@ -0,0 +1,1128 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MigrationEngine migrates the users of a MigrationSource into Kiteworks.
+type MigrationEngine struct {
+	Source          MigrationSource
+	ProfileID       int                 // Profile given to migrated users; 0 leaves it to the appliance's profile mapping.
+	Users           []string            // Source users to migrate; all users when empty.
+	Tasks           MigrationTaskPolicy // Handling of source file tasks.
+	Preflight       MigrationPreflight  // Destination limits checked by RunPreflight.
+	DestEmail       func(string) string // Maps a source user's email to their Kiteworks username; nil uses Mapping.
+	Mapping         *MigrationMapping   // User, path and role remapping; nil keeps the source's.
+	Delta           bool                // Copy only items created or modified since the user's last complete run, and propagate source deletions.
+	Holding         string              // Folder that items deleted on the source are moved to by a delta run; blank deletes them.
+	MapGroups       bool                // Grant source groups as the Kiteworks groups of the same name, when there is one.
+	MaxVersions     int                 // Newest versions of a file to copy; 0 copies all.
+	VersionComments bool                // Comment each copied version's original uploader and time on the destination file.
+	RetryFailed     bool                // Migrate only the users whose last recorded migration failed.
+	Limits          MigrationLimits     // Source API limits the walks' concurrency is planned from.
+	task            *KiteBrokerTask
+	db              Database
+	files           Table
+	folders         Table
+	marks           Table
+	run_id          string
+	run_started     time.Time
+	journal         Table
+	journal_seq     int64
+	groups          migrationGroups
+	roles           migrationRoleCatalog
+	status          Table
+	status_mu       sync.Mutex
+	user_progress   sync.Map
+	failed          map[string]struct{}
+	failed_mu       sync.RWMutex
+	tally_reg       sync.Once
+	plan            *migrationPlanner
+	plan_once       sync.Once
+	plan_report     sync.Once
+	tally           struct {
+		users       Tally
+		failed      Tally
+		folders     Tally
+		files       Tally
+		transferred Tally
+		bytes       Tally
+		comments    Tally
+		tasks       Tally
+		delta       Tally
+		deleted     Tally
+	}
+}
+
+// NewMigrationEngine returns an engine migrating from source on behalf of
+// task. Resume state is kept in db, the migration's own database.
+func NewMigrationEngine(task *KiteBrokerTask, source MigrationSource, db Database) *MigrationEngine {
+	return &MigrationEngine{
+		Source:    source,
+		Tasks:     DefaultMigrationTaskPolicy(),
+		Preflight: DefaultMigrationPreflight(),
+		task:      task,
+		db:        db,
+		files:     db.Table("migration_files"),
+		folders:   db.Table("migration_folders"),
+		marks:     db.Table("migration_marks"),
+		status:    statusTable(db),
+		failed:    make(map[string]struct{}),
+	}
+}
+
+// SetProfile sets the destination profile for migrated users by name. The
+// profile must be allowed to create folders.
+func (E *MigrationEngine) SetProfile(name string) error {
+	profile, err := E.task.KW.Admin().FindProfile(name)
+	if err != nil {
+		return err
+	}
+	if profile.Features.FolderCreate == 0 {
+		return fmt.Errorf("Destination profile does not have permission to create folders")
+	}
+	E.ProfileID = profile.ID
+	return nil
+}
+
+// destUser returns the Kiteworks username of a source user.
+func (E *MigrationEngine) destUser(email string) string {
+	if E.DestEmail != nil {
+		return strings.ToLower(E.DestEmail(email))
+	}
+	return E.Mapping.User(email)
+}
+
+// DestPath returns the destination path of a source folder path.
+func (E *MigrationEngine) DestPath(path string) string {
+	return E.Mapping.Path(path)
+}
+
+// DestMembers returns the members of a source folder as they are granted on
+// the destination, with their users and roles remapped. Roles are left by
+// name, for SyncMembers to resolve.
+func (E *MigrationEngine) DestMembers(members []MigrationMember) []MigrationMember {
+	output := make([]MigrationMember, 0, len(members))
+	for _, m := range members {
+		m.User = E.destUser(m.User)
+		if role, ok := E.Mapping.SourceRole(m.SourceRole); ok {
+			m.Role, m.RoleID = role, 0
+		}
+		if m.RoleID != 0 && IsBlank(m.Role) {
+			if name, ok := E.roleName(m.RoleID); ok {
+				m.Role, m.RoleID = name, 0
+			}
+		}
+		if !IsBlank(m.Role) {
+			m.Role = E.Mapping.Role(m.Role)
+		}
+		output = append(output, m)
+	}
+	return output
+}
+
+// IgnoreUser reports whether a user failed set up and is skipped.
+func (E *MigrationEngine) IgnoreUser(email string) bool {
+	E.failed_mu.RLock()
+	defer E.failed_mu.RUnlock()
+	_, ok := E.failed[strings.ToLower(email)]
+	return ok
+}
+
+// SetIgnoreUser marks a user as failed, so the rest of the migration skips it.
+func (E *MigrationEngine) SetIgnoreUser(email string) {
+	E.FailUser(email, "could not be set up on Kiteworks")
+}
+
+// SourceUsers returns the source users selected for migration.
+func (E *MigrationEngine) SourceUsers() ([]MigrationUser, error) {
+	all_users, err := E.Source.Users()
+	if err != nil {
+		return nil, err
+	}
+	if len(E.Users) == 0 {
+		return all_users, nil
+	}
+	filter := make(map[string]struct{})
+	for _, e := range E.Users {
+		filter[strings.ToLower(e)] = struct{}{}
+	}
+	var users []MigrationUser
+	for _, u := range all_users {
+		if _, ok := filter[strings.ToLower(u.Email)]; ok {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+// EnsureUser makes sure a Kiteworks user exists for username, creating it
+// when needed, and that it is verified, not suspended and, when profile_id is
+// set, on that profile.
+func (E *MigrationEngine) EnsureUser(username string, profile_id int) (kw_user *KiteUser, err error) {
+	admin := E.task.KW.Admin()
+
+	kw_user, err = admin.FindUser(username, true)
+	if err != nil && err != ERR_NO_USER_FOUND {
+		return nil, fmt.Errorf("Error finding user: %v", err)
+	}
+	if kw_user == nil {
+		Log("[%s]: Creating user on Kiteworks..", username)
+		if kw_user, err = admin.NewUser(username, profile_id, true, false); err != nil {
+			if !IsAPIError(err, "ERR_ENTITY_EXISTS") {
+				return nil, fmt.Errorf("Failed to create user: %v", err)
+			}
+			if kw_user, err = admin.FindUser(username, true); err != nil {
+				return nil, fmt.Errorf("Error finding user: %v", err)
+			}
+		} else {
+			E.Journal(MigrationJournalEntry{Kind: JournalUser, Owner: username, ID: kw_user.ID, Name: username})
+		}
+	} else {
+		Log("[%s]: User already exists on Kiteworks.", username)
+	}
+
+	if kw_user.Suspended || !kw_user.Verified {
+		if kw_user.Suspended {
+			Log("[%s]: User suspended on Kiteworks, re-enabling.", username)
+		}
+		if !kw_user.Verified {
+			Log("[%s]: User unverified on Kiteworks, verifying.", username)
+		}
+		if err := admin.UpdateUser(kw_user.ID, SetParams(PostJSON{"suspended": false, "verified": true})); err != nil {
+			return nil, fmt.Errorf("Error updating user: %v", err)
+		}
+		kw_user.Suspended = false
+		kw_user.Verified = true
+	}
+
+	if profile_id > 0 && kw_user.UserTypeID != profile_id {
+		if err := admin.UpdateUserProfile(profile_id, []string{kw_user.ID}); err != nil {
+			return nil, fmt.Errorf("Error updating user profile: %v", err)
+		}
+		kw_user.UserTypeID = profile_id
+	}
+	return kw_user, nil
+}
+
+// registerTallies adds the migration's counters to the task report.
+func (E *MigrationEngine) registerTallies() {
+	report := E.task.Report
+	E.tally.users = report.Tally("Synced Users")
+	E.tally.failed = report.Tally("Failed Users")
+	E.tally.folders = report.Tally("Synced Folders")
+	E.tally.files = report.Tally("Synced Files")
+	E.tally.transferred = report.Tally("Files Transferred")
+	E.tally.bytes = report.Tally("Data Transferred", HumanSize)
+	E.tally.comments = report.Tally("Synced Comments")
+	if _, ok := E.Source.(MigrationTaskSource); ok {
+		E.tally.tasks = report.Tally("Synced Tasks")
+	}
+	if E.Delta {
+		E.tally.delta = report.Tally("Delta Files")
+		E.tally.deleted = report.Tally("Source Deletions")
+	}
+}
+
+// Run migrates the selected users: their Kiteworks accounts are created or
+// verified first, then each user's folders and files are copied.
+func (E *MigrationEngine) Run() (err error) {
+	users, err := E.SourceUsers()
+	if err != nil {
+		return err
+	}
+	name := E.Source.Name()
+
+	if E.RetryFailed {
+		users = E.retryUsers(users)
+		if len(users) == 0 {
+			Log("No failed %s users to retry.", name)
+			return nil
+		}
+		Log("Retrying %d failed %s user(s).", len(users), name)
+	}
+
+	E.tally_reg.Do(E.registerTallies)
+	if IsBlank(E.run_id) {
+		E.BeginRun()
+	}
+	for _, u := range users {
+		E.updateStatus(u.Email, func(s *MigrationUserStatus) {
+			s.State = MigrationPending
+			s.Reason = NONE
+		})
+	}
+
+	message := func() string {
+		return fmt.Sprintf("Working .. [ Folders: %d | Files: %d | Files Transferred: %d (%s) ]", E.tally.folders.Value(), E.tally.files.Value(), E.tally.transferred.Value(), HumanSize(E.tally.bytes.Value()))
+	}
+	PleaseWait.Set(message, []string{"[>  ]", "[>> ]", "[>>>]", "[ >>]", "[  >]", "[  <]", "[ <<]", "[<<<]", "[<< ]", "[<  ]"})
+	PleaseWait.Show()
+
+	Log("Starting %s Migration...", name)
+	Log("- Found %d %s users.", len(users), name)
+	Log("\n=== Creating/Verifying %s users on Kiteworks. ===\n\n", name)
+
+	wg := NewLimitGroup(25)
+	for _, u := range users {
+		wg.Add(1)
+		go func(user MigrationUser) {
+			defer wg.Done()
+			E.prepareUser(user)
+		}(u)
+	}
+	wg.Wait()
+
+	Log("\n=== Users created/verified. Starting folder sync. ===\n\n")
+	for _, u := range users {
+		if E.IgnoreUser(u.Email) {
+			E.tally.failed.Add(1)
+			continue
+		}
+		wg.Add(1)
+		go func(user MigrationUser) {
+			defer wg.Done()
+			E.StartUser(user.Email)
+			err := E.MigrateUser(user)
+			if err != nil {
+				Err("[%s]: %v", user.Email, err)
+			}
+			E.FinishUser(user.Email, err)
+		}(u)
+	}
+	wg.Wait()
+	E.saveThroughput()
+	Log("\n=== Migration Complete ===")
+	return nil
+}
+
+// prepareUser creates or verifies the Kiteworks account for a source user,
+// marking the user failed when that is not possible.
+func (E *MigrationEngine) prepareUser(user MigrationUser) {
+	username := E.destUser(user.Email)
+	if IsBlank(username) {
+		Err("[%s]: Skipping user with no login.", user.ID)
+		E.FailUser(user.Email, "no login")
+		return
+	}
+	kw_user, err := E.EnsureUser(username, E.ProfileID)
+	if err != nil {
+		Err("[%s]: %v (skipping)", username, err)
+		E.FailUser(user.Email, err.Error())
+		return
+	}
+	if hook, ok := E.Source.(MigrationUserHook); ok {
+		if err := hook.UserReady(user, kw_user); err != nil {
+			Err("[%s]: %v", username, err)
+		}
+	}
+}
+
+// migrationRun is the state of a single user's migration.
+type migrationRun struct {
+	*MigrationEngine
+	user       MigrationUser
+	username   string
+	sess       KWSession
+	folder_map map[string]*KiteObject
+	lock       sync.RWMutex
+	mark       time.Time // Start of the user's last complete run.
+	run        int64     // Id of this run, recorded on the items it saw.
+	seen       Table
+	kept       []string           // Paths of unchanged subtrees a delta run did not walk.
+	prog       *migrationProgress // The user's progress, for --status.
+}
+
+// MigrateUser copies a user's folders and files, whose Kiteworks account must
+// already exist. A run that reads the whole source tree becomes the user's
+// high-water mark; a delta run then removes items no longer on the source.
+func (E *MigrationEngine) MigrateUser(user MigrationUser) error {
+	E.tally.users.Add(1)
+	username := E.destUser(user.Email)
+	started := time.Now().UTC()
+	run := &migrationRun{
+		MigrationEngine: E,
+		user:            user,
+		username:        username,
+		sess:            E.task.KW.Session(username),
+		folder_map:      make(map[string]*KiteObject),
+		run:             started.UnixNano(),
+		seen:            E.seenTable(user),
+		prog:            E.progress(user.Email),
+	}
+	E.marks.Get(E.markKey(user), &run.mark)
+
+	skipped, failed, err := E.walk(user, run.processFolder, run.processFile)
+	if err != nil {
+		return err
+	}
+	if skipped > 0 {
+		return fmt.Errorf("%d folder(s) could not be read, high-water mark not updated", skipped)
+	}
+	if E.Delta {
+		run.propagateDeletes()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be copied, high-water mark not updated", failed)
+	}
+	E.marks.Set(E.markKey(user), &started)
+	return nil
+}
+
+// ResolvePath returns the destination folder for a source path, creating it
+// when needed.
+func (R *migrationRun) ResolvePath(path string) (*KiteObject, error) {
+	path = FilterInvalidChars(strings.Trim(R.DestPath(path), "/"))
+
+	R.lock.RLock()
+	if folder, found := R.folder_map[path]; found {
+		R.lock.RUnlock()
+		return folder, nil
+	}
+	R.lock.RUnlock()
+
+	folder, err := R.ResolveFolder(R.sess, "0", path)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving path %s for user '%s': %v", path, R.username, err)
+	}
+
+	R.lock.Lock()
+	R.folder_map[path] = &folder
+	R.lock.Unlock()
+	return &folder, nil
+}
+
+// countBytes counts bytes transferred for the user.
+func (R *migrationRun) countBytes(n int) {
+	R.tally.bytes.Add(n)
+	atomic.AddInt64(&R.prog.bytes, int64(n))
+}
+
+// stateKey is the resume state key for a source object of the user.
+func (R *migrationRun) stateKey(src_id string) string {
+	return fmt.Sprintf("%s:%s", R.username, src_id)
+}
+
+// processFolder creates a source folder on Kiteworks and syncs its members.
+func (R *migrationRun) processFolder(folder *SyncFolder) error {
+	R.tally.folders.Add(1)
+	atomic.AddInt64(&R.prog.folders, 1)
+	R.updateStatus(R.user.Email, nil)
+
+	dest, err := R.ResolvePath(folder.FullPath)
+	if err != nil {
+		return err
+	}
+	folder.DestID = dest.ID
+	R.see(folder.SrcID, true, folder.FullPath, dest.ID)
+
+	if R.Delta && R.unchangedFolder(folder) {
+		if R.unchangedTree() {
+			R.keep(folder)
+			return errUnchangedTree
+		}
+		return nil
+	}
+
+	Log("[%s]: %s: %s -> Kiteworks: /%s", R.username, R.Source.Name(), folder.FullPath, dest.Path)
+
+	members, err := R.resolveMembers(R.user, *folder)
+	if err != nil {
+		return err
+	}
+	if err := R.SyncMembers(R.sess, R.username, dest, R.DestMembers(members)); err != nil {
+		return err
+	}
+	folder.SyncedPermissions = true
+	R.folders.Set(R.stateKey(folder.SrcID), folder)
+	return nil
+}
+
+// SyncMembers grants the members of a source folder on its destination folder,
+// skipping grants already in place, and removes members that have no access
+// on the source. owner is the destination folder's owner. Members naming a
+// Kiteworks group by GroupID are granted as that group.
+func (E *MigrationEngine) SyncMembers(sess KWSession, owner string, dest *KiteObject, members []MigrationMember) (err error) {
+	if len(members) == 0 {
+		return nil
+	}
+
+	perm_map := make(map[int][]string)
+	group_map := make(map[int][]string)
+	var remove []string
+	var counter int
+	for _, m := range members {
+		email := strings.ToLower(m.User)
+		is_group := IsBlank(email) && !IsBlank(m.GroupID)
+		if !is_group && (IsBlank(email) || email == owner) {
+			continue
+		}
+		role_id := m.RoleID
+		if role_id == 0 && !IsBlank(m.Role) {
+			var ok bool
+			if role_id, ok = E.roleID(m.Role); !ok {
+				Err("[%s]: %s - Kiteworks has no role %q for %s, skipping.", owner, dest.Path, m.Role, email+m.Group)
+				continue
+			}
+		}
+		if is_group {
+			// Kiteworks does not list group grants with the folder's
+			// members, so they are granted again on every run and not
+			// journaled; they go with the folders a run created.
+			if role_id != 0 {
+				group_map[role_id] = append(group_map[role_id], m.GroupID)
+			}
+			continue
+		}
+		if role_id == 0 {
+			remove = append(remove, email)
+			continue
+		}
+		perm_map[role_id] = append(perm_map[role_id], email)
+		counter++
+	}
+
+	existing, _ := sess.Folder(dest.ID).Members()
+	roles_before := make(map[string]int)
+	for _, m := range existing {
+		roles_before[strings.ToLower(m.User.Email)] = m.RoleID
+	}
+	counter -= SkipExistingPerms(perm_map, existing)
+	if counter > 0 {
+		Log("[%s]: %s - Adding %d permissions to folder.", owner, dest.Path, counter)
+	}
+	for role_id, emails := range perm_map {
+		err = sess.Folder(dest.ID).AddUsersToFolder(emails, role_id, false, true)
+		if err != nil {
+			if IsAPIError(err, "ERR_ENTITY_ROLE_IS_ASSIGNED") {
+				Debug("[%s]: %s - Role %d already assigned to %v, skipping.", owner, dest.Path, role_id, emails)
+			} else {
+				Err("[%s]: Error adding users to folder %s: %v", owner, dest.Path, err)
+			}
+			continue
+		}
+		for _, email := range emails {
+			E.Journal(MigrationJournalEntry{Kind: JournalGrant, Owner: owner, ID: dest.ID, Name: email, PrevRoleID: roles_before[email]})
+		}
+	}
+
+	for role_id, group_ids := range group_map {
+		Debug("[%s]: %s - Granting %d group(s) role %d.", owner, dest.Path, len(group_ids), role_id)
+		if err := sess.Folder(dest.ID).AddGroupsToFolder(group_ids, role_id, false, true); err != nil && !IsAPIError(err, "ERR_ENTITY_ROLE_IS_ASSIGNED") {
+			Err("[%s]: Error adding groups to folder %s: %v", owner, dest.Path, err)
+		}
+	}
+
+	for _, email := range remove {
+		for _, m := range existing {
+			if !strings.EqualFold(m.User.Email, email) {
+				continue
+			}
+			Log("[%s]: Removing %s from %s.", owner, email, dest.Path)
+			if err := sess.Folder(dest.ID).RemoveUserFromFolder(m.User.ID, Query{"downgradeNested": true}); err != nil {
+				Err("[%s]: Error removing user (%s) from folder %s: %v", owner, email, dest.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// processFile copies a source file into its destination folder.
+func (R *migrationRun) processFile(folder *SyncFolder, file *SyncFile) error {
+	dest, err := R.ResolvePath(folder.FullPath)
+	if err != nil {
+		return err
+	}
+
+	R.tally.files.Add(1)
+
+	var state SyncFile
+	key := R.stateKey(file.SrcID)
+	if R.Delta {
+		if R.files.Get(key, &state) && R.unchangedFile(dest, &state, file) {
+			R.see(file.SrcID, false, folder.FullPath+"/"+file.Name, state.DestID)
+			return nil
+		}
+		R.tally.delta.Add(1)
+	}
+
+	_, err = R.syncFile(dest, folder, file)
+	R.files.Get(key, &state)
+	R.see(file.SrcID, false, folder.FullPath+"/"+file.Name, state.DestID)
+	return err
+}
+
+// SyncFile copies a source file into dest, a folder of the Kiteworks user of
+// sess, for migrations that resolve their own destination folders. It returns
+// the destination file when a version was uploaded.
+func (E *MigrationEngine) SyncFile(user MigrationUser, sess KWSession, dest *KiteObject, folder *SyncFolder, file *SyncFile) (*KiteObject, error) {
+	E.tally_reg.Do(E.registerTallies)
+	return E.fileRun(user, sess).syncFile(dest, folder, file)
+}
+
+// AdoptFile records dest_file, a copy of the source file's current version
+// made outside the engine, as the file's destination. Its versions are taken
+// as copied, so a following SyncFile copies only comments and tasks. A file
+// that already has resume state is left as is.
+func (E *MigrationEngine) AdoptFile(user MigrationUser, sess KWSession, folder *SyncFolder, file *SyncFile, dest_file *KiteObject) error {
+	R := E.fileRun(user, sess)
+	key := R.stateKey(file.SrcID)
+	if R.files.Get(key, nil) {
+		return nil
+	}
+
+	versions, err := R.versions(file)
+	if err != nil {
+		return err
+	}
+	state := *file
+	state.SrcFolderID = folder.SrcID
+	state.DestFolderID = dest_file.ParentID
+	state.DestID = dest_file.ID
+	state.ParentOwner = R.username
+	for _, v := range versions {
+		v.DestID = dest_file.ID
+		state.Versions = append(state.Versions, v)
+	}
+	state.SyncedVersionID = versions[len(versions)-1].SrcID
+	R.files.Set(key, &state)
+	return nil
+}
+
+// ResetFile drops the resume state of a source file whose destination copy
+// was removed, so the next SyncFile copies it again.
+func (E *MigrationEngine) ResetFile(user MigrationUser, sess KWSession, file *SyncFile) {
+	R := E.fileRun(user, sess)
+	R.files.Unset(R.stateKey(file.SrcID))
+}
+
+// fileRun returns a migrationRun for copying single files as sess's user.
+func (E *MigrationEngine) fileRun(user MigrationUser, sess KWSession) *migrationRun {
+	return &migrationRun{
+		MigrationEngine: E,
+		user:            user,
+		username:        strings.ToLower(sess.Username),
+		sess:            sess,
+		folder_map:      make(map[string]*KiteObject),
+		prog:            E.progress(user.Email),
+	}
+}
+
+// versions returns the file's source versions, or its current content as the
+// only version when the source has no version history.
+func (R *migrationRun) versions(file *SyncFile) ([]SyncVersion, error) {
+	var versions []SyncVersion
+	err := R.planner().call(func() (err error) {
+		versions, err = R.Source.Versions(R.user, *file)
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting versions for %s: %v", file.Name, err)
+	}
+	if len(versions) == 0 {
+		versions = []SyncVersion{{
+			SrcID:    file.SrcID,
+			Ver:      1,
+			Name:     file.Name,
+			Created:  file.Created,
+			Modified: file.Modified,
+			Size:     file.Size,
+		}}
+	}
+	return versions, nil
+}
+
+// syncFile uploads a source file's versions to dest, then posts its comments
+// and tasks. Progress is recorded after every step, so a rerun picks up where
+// an interrupted one stopped.
+func (R *migrationRun) syncFile(dest *KiteObject, folder *SyncFolder, file *SyncFile) (last *KiteObject, err error) {
+	key := R.stateKey(file.SrcID)
+	var state SyncFile
+	if !R.files.Get(key, &state) {
+		state = *file
+	} else if !IsBlank(state.DestID) {
+		if err := R.relocateFile(dest, &state, file); err != nil {
+			return nil, err
+		}
+	}
+	state.SrcFolderID = folder.SrcID
+	state.DestFolderID = dest.ID
+	state.ParentOwner = R.username
+
+	versions, err := R.versions(file)
+	if err != nil {
+		return nil, err
+	}
+	auto_version := len(versions) > 1
+
+	// Resume after the last version uploaded by a previous run.
+	var start int
+	for i, v := range versions {
+		if !IsBlank(state.SyncedVersionID) && v.SrcID == state.SyncedVersionID {
+			start = i + 1
+		}
+	}
+	if R.MaxVersions > 0 && len(versions)-R.MaxVersions > start {
+		start = len(versions) - R.MaxVersions
+	}
+
+	// A copy requeued by --verify keeps its destination file, and gets the
+	// current content uploaded as a new version on top.
+	if !IsBlank(state.DestID) && IsBlank(state.SyncedVersionID) {
+		start, auto_version = len(versions)-1, true
+	}
+
+	// Without version history, a change to the source is only seen in its
+	// modification time; upload the content again as a new version.
+	if start == len(versions) && len(versions) == 1 && versions[0].SrcID == file.SrcID && !state.Modified.IsZero() && !file.Modified.IsZero() && !state.Modified.Equal(file.Modified) {
+		start, auto_version = 0, true
+	}
+
+	for _, ver := range versions[start:] {
+		uploaded, err := R.uploadVersion(R.uploader(ver), dest, file, ver, auto_version)
+		if e, ok := err.(sourceOpenError); ok {
+			return last, e.err
+		}
+		// The uploader may not exist, or have access, on the destination.
+		if err != nil && !IsAPIError(err, "ERR_ENTITY_EXISTS") && !IsBlank(ver.Uploader) && R.destUser(ver.Uploader) != R.username {
+			Debug("[%s]: Could not upload %s v%d as %s, uploading as owner: %v", R.username, ver.Name, ver.Ver, ver.Uploader, err)
+			uploaded, err = R.uploadVersion(R.sess, dest, file, ver, auto_version)
+			if e, ok := err.(sourceOpenError); ok {
+				return last, e.err
+			}
+		}
+		// A failed version stops the file, so the next run resumes from it.
+		if err != nil {
+			if !IsAPIError(err, "ERR_ENTITY_EXISTS") {
+				return last, fmt.Errorf("Error uploading %s v%d: %v", ver.Name, ver.Ver, err)
+			}
+			continue
+		}
+		if uploaded != nil {
+			R.tally.transferred.Add(1)
+			atomic.AddInt64(&R.prog.files, 1)
+			if IsBlank(state.DestID) {
+				R.journalFile(R.username, uploaded, auto_version)
+			}
+			state.DestID = uploaded.ID
+			ver.DestID = uploaded.ID
+			last = uploaded
+			if R.VersionComments && !IsBlank(ver.Uploader) {
+				note := fmt.Sprintf("Version %d uploaded by %s on %s.", ver.Ver, ver.Uploader, ver.Modified.Format(time.RFC1123))
+				if err := R.sess.File(uploaded.ID).AddComment(note); err != nil {
+					Err("[%s]: Error commenting on %s v%d: %v", R.username, ver.Name, ver.Ver, err)
+				}
+			}
+		}
+		state.SyncedVersionID = ver.SrcID
+		state.Versions = append(state.Versions, ver)
+		state.Modified, state.Size = file.Modified, file.Size
+		R.files.Set(key, &state)
+	}
+
+	if IsBlank(state.DestID) {
+		return last, nil
+	}
+	R.files.Set(key, &state)
+
+	if last != nil && !IsBlank(file.Description) {
+		if err := R.sess.File(state.DestID).SetDescription(file.Description); err != nil {
+			Err("[%s]: Error setting description of %s: %v", R.username, file.Name, err)
+		}
+	}
+
+	var comments []SyncComment
+	err = R.planner().call(func() (err error) {
+		comments, err = R.Source.Comments(R.user, *file)
+		return
+	})
+	if err != nil {
+		Err("[%s]: Error getting comments for %s: %v", R.username, file.Name, err)
+	} else {
+		R.syncComments(&state, comments)
+		R.files.Set(key, &state)
+	}
+
+	if src, ok := R.Source.(MigrationTaskSource); ok {
+		var tasks []SyncTask
+		err := R.planner().call(func() (err error) {
+			tasks, err = src.Tasks(R.user, *file)
+			return
+		})
+		if err != nil {
+			Err("[%s]: Error getting tasks for %s: %v", R.username, file.Name, err)
+		} else {
+			R.syncTasks(&state, tasks)
+			R.files.Set(key, &state)
+		}
+	}
+	return last, nil
+}
+
+// uploader returns the session to upload a version with: the version's
+// uploader when the source names one, otherwise the owner.
+func (R *migrationRun) uploader(ver SyncVersion) KWSession {
+	if IsBlank(ver.Uploader) {
+		return R.sess
+	}
+	uploader := R.destUser(ver.Uploader)
+	if uploader == R.username {
+		return R.sess
+	}
+	return R.task.KW.Session(uploader)
+}
+
+// sourceOpenError is a failure to open a version on the source, which stops
+// the file rather than skipping the version.
+type sourceOpenError struct {
+	err error
+}
+
+func (e sourceOpenError) Error() string {
+	return e.err.Error()
+}
+
+// uploadVersion uploads a version of a source file to dest, retrying
+// transient errors.
+func (R *migrationRun) uploadVersion(sess KWSession, dest *KiteObject, file *SyncFile, ver SyncVersion, auto_version bool) (*KiteObject, error) {
+	retry := R.task.KW.InitRetry(sess.Username, fmt.Sprintf("%s - upload - %s/%s", sess.Username, dest.Name, ver.Name))
+	for {
+		var dl ReadSeekCloser
+		err := R.planner().call(func() (err error) {
+			dl, err = R.Source.Open(R.user, *file, ver)
+			return
+		})
+		if err == nil && ver.Size == UnknownSize {
+			dl, ver.Size, err = spoolDownload(dl)
+		}
+		if err != nil {
+			return nil, sourceOpenError{fmt.Errorf("Error downloading %s v%d: %v", ver.Name, ver.Ver, err)}
+		}
+		uploaded, err := sess.Upload(FilterInvalidChars(ver.Name), ver.Size, ver.Modified, false, auto_version, true, *dest, TransferCounter(dl, R.countBytes))
+		dl.Close()
+		if retry.CheckForRetry(err) {
+			continue
+		}
+		return uploaded, err
+	}
+}
+
+// spooledFile is a temporary file removed when closed.
+type spooledFile struct {
+	*os.File
+}
+
+func (f spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// spoolDownload copies a download of unknown size to a temporary file,
+// returning the file, rewound, and its size. The download is closed.
+func spoolDownload(dl ReadSeekCloser) (ReadSeekCloser, int64, error) {
+	defer dl.Close()
+	f, err := os.CreateTemp("", "kitebroker-spool-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	spool := spooledFile{f}
+	size, err := io.Copy(f, dl)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, 0, err
+	}
+	return spool, size, nil
+}
+
+// resumeIndex returns the index following the item with id last, or 0 when
+// last is blank or not found.
+func resumeIndex(ids []string, last string) int {
+	if IsBlank(last) {
+		return 0
+	}
+	for i, id := range ids {
+		if id == last {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// syncComments posts source comments on the destination file.
+func (R *migrationRun) syncComments(state *SyncFile, comments []SyncComment) {
+	ids := make([]string, len(comments))
+	for i, c := range comments {
+		ids[i] = c.ID
+	}
+	// Replies are posted under the destination copy of their parent comment.
+	dest_ids := make(map[string]int)
+	for _, c := range state.Comments {
+		if id, err := strconv.Atoi(c.DestID); err == nil {
+			dest_ids[c.ID] = id
+		}
+	}
+	for _, c := range comments[resumeIndex(ids, state.SyncedCommentID):] {
+		var parent_id int
+		if !IsBlank(c.ParentID) {
+			parent_id = dest_ids[c.ParentID]
+		}
+		// The source names the comment's author in the message.
+		if creator := R.destUser(c.Creator); !IsBlank(c.Creator) && creator != strings.ToLower(c.Creator) {
+			c.Message = strings.Replace(c.Message, c.Creator, creator, 1)
+			c.Creator = creator
+		}
+		posted, err := R.sess.File(state.DestID).AddCommentReply(parent_id, c.Message)
+		if err != nil {
+			Err("[%s]: Error posting comment: %v", R.username, err)
+			return
+		}
+		if posted.ID > 0 {
+			c.DestID = strconv.Itoa(posted.ID)
+			dest_ids[c.ID] = posted.ID
+		}
+		R.tally.comments.Add(1)
+		state.SyncedCommentID = c.ID
+		state.Comments = append(state.Comments, c)
+	}
+}
+
+// syncTasks imports, comments or drops source tasks according to the task policy.
+func (R *migrationRun) syncTasks(state *SyncFile, tasks []SyncTask) {
+	ids := make([]string, len(tasks))
+	for i, t := range tasks {
+		ids[i] = t.ID
+	}
+	for i := resumeIndex(ids, state.SyncedTaskID); i < len(tasks); i++ {
+		task := &tasks[i]
+		if !IsBlank(task.Creator) {
+			task.Creator = R.destUser(task.Creator)
+		}
+		assigned := make([]string, len(task.AssignedTo))
+		for j, a := range task.AssignedTo {
+			assigned[j] = R.destUser(a)
+		}
+		task.AssignedTo = assigned
+		switch R.Tasks.disposition(task) {
+		case "drop":
+			Log("[%s]: Drop Task: %s", R.username, migrationTaskString(R.Source.Name(), task, false))
+		case "comment":
+			if err := R.sess.File(state.DestID).AddComment(migrationTaskString(R.Source.Name(), task, false)); err != nil {
+				Err("[%s]: Error posting task as comment: %v", R.username, err)
+				return
+			}
+			R.tally.tasks.Add(1)
+		default:
+			R.importTask(state, task)
+		}
+		state.SyncedTaskID = task.ID
+		state.Tasks = append(state.Tasks, *task)
+	}
+}
+
+// importTask creates a source task on the destination file for each assignee.
+func (R *migrationRun) importTask(state *SyncFile, task *SyncTask) {
+	now := time.Now().UTC()
+	message := migrationTaskString(R.Source.Name(), task, true)
+
+	due := task.Due.UTC()
+	if due.IsZero() || due.Before(now) || migrationDate(due) == migrationDate(now) {
+		due = now.Add(time.Hour * 24 * time.Duration(R.Tasks.FutureDays))
+	}
+
+	for _, assignee := range task.AssignedTo {
+		assignee_user, err := R.EnsureUser(strings.ToLower(assignee), R.ProfileID)
+		if err != nil {
+			Err("[%s]: Error with task assignee %s: %v", R.username, assignee, err)
+			continue
+		}
+		if err := R.sess.File(state.DestID).AddTask(assignee_user.ID, migrationDate(due), message); err != nil {
+			Err("[%s]: Error importing task: %v", R.username, err)
+			continue
+		}
+		R.tally.tasks.Add(1)
+	}
+}
+
+// migrationWalker walks a user's source folder tree, calling folder_fn for
+// each folder below the root and file_fn for each file. Sibling folders and
+// files are processed concurrently, in pools sized by the engine's planner,
+// with large files in a lane of their own.
+type migrationWalker struct {
+	source    MigrationSource
+	user      MigrationUser
+	folder_fn func(*SyncFolder) error
+	file_fn   func(*SyncFolder, *SyncFile) error
+	planner   *migrationPlanner
+	large_at  int64 // Files of at least this size take the large file lane.
+	folders   LimitGroup
+	files     LimitGroup
+	large     LimitGroup
+	all_stop  int32
+	skipped   int32
+	failed    int32
+}
+
+// Walk walks the user's source folders. A folder_fn error skips the folder's
+// contents; returning an AbortError from either function stops the walk.
+func (E *MigrationEngine) Walk(user MigrationUser, folder_fn func(*SyncFolder) error, file_fn func(*SyncFolder, *SyncFile) error) error {
+	_, _, err := E.walk(user, folder_fn, file_fn)
+	return err
+}
+
+// walk is Walk, also returning the number of folders whose contents were
+// skipped, because they could not be read or folder_fn failed, and of files
+// file_fn failed on. A walk that skipped nothing saw every source item.
+func (E *MigrationEngine) walk(user MigrationUser, folder_fn func(*SyncFolder) error, file_fn func(*SyncFolder, *SyncFile) error) (skipped, failed int, err error) {
+	root, err := E.Source.Root(user)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error retrieving %s root folder: %v", E.Source.Name(), err)
+	}
+	planner := E.planner()
+	E.plan_report.Do(func() {
+		E.task.Report.Tally("Concurrency Plan", func(int64) string {
+			return planner.String()
+		})
+	})
+	plan := planner.begin()
+	defer planner.end()
+
+	w := &migrationWalker{
+		source:    E.Source,
+		user:      user,
+		folder_fn: folder_fn,
+		file_fn:   file_fn,
+		planner:   planner,
+		large_at:  E.Limits.largeFileSize(),
+		folders:   NewLimitGroup(plan.Folders),
+		files:     NewLimitGroup(plan.SmallFiles),
+		large:     NewLimitGroup(plan.LargeFiles),
+	}
+	w.walk(&root, true)
+	w.folders.Wait()
+	w.files.Wait()
+	w.large.Wait()
+	if w.stopped() {
+		atomic.AddInt32(&w.skipped, 1)
+	}
+	return int(atomic.LoadInt32(&w.skipped)), int(atomic.LoadInt32(&w.failed)), nil
+}
+
+// planner returns the engine's concurrency planner, which also paces the
+// engine's source calls.
+func (E *MigrationEngine) planner() *migrationPlanner {
+	E.plan_once.Do(func() {
+		E.plan = newMigrationPlanner(E.Limits, E.task.KW.GetTransferLimit())
+	})
+	return E.plan
+}
+
+// stopped reports whether the walk was aborted.
+func (w *migrationWalker) stopped() bool {
+	return atomic.LoadInt32(&w.all_stop) > 0
+}
+
+// check logs err against name, stopping the walk on an AbortError, and
+// reports whether err was nil.
+func (w *migrationWalker) check(name string, err error) bool {
+	err, abort := abortCheck(err)
+	if abort {
+		atomic.StoreInt32(&w.all_stop, 1)
+	}
+	if err != nil {
+		Err("[%s]: %s: %v", strings.ToLower(w.user.Email), name, err)
+		return false
+	}
+	return !abort
+}
+
+// file processes a file, counting it as failed when file_fn errs.
+func (w *migrationWalker) file(folder *SyncFolder, file *SyncFile) {
+	err := w.file_fn(folder, file)
+	if !w.check(folder.FullPath+"/"+file.Name, err) && err != nil {
+		atomic.AddInt32(&w.failed, 1)
+	}
+}
+
+// walk processes a folder, then its files and subfolders.
+func (w *migrationWalker) walk(folder *SyncFolder, root bool) {
+	if w.stopped() {
+		return
+	}
+	if r, ok := w.source.(MigrationFolderReleaser); ok {
+		defer r.Release(w.user, *folder)
+	}
+	if !root && w.folder_fn != nil {
+		err := w.folder_fn(folder)
+		if err == errUnchangedTree {
+			return
+		}
+		if !w.check(folder.FullPath, err) {
+			atomic.AddInt32(&w.skipped, 1)
+			return
+		}
+	}
+
+	if w.file_fn != nil && (!root || !IsBlank(folder.FullPath)) {
+		var files []SyncFile
+		err := w.planner.call(func() (err error) {
+			files, err = w.source.Files(w.user, *folder)
+			return
+		})
+		if !w.check(folder.FullPath, err) {
+			atomic.AddInt32(&w.skipped, 1)
+		} else {
+			for i := range files {
+				if w.stopped() {
+					return
+				}
+				file := &files[i]
+				lane := w.files
+				if file.Size >= w.large_at {
+					lane = w.large
+				}
+				lane.Add(1)
+				go func() {
+					defer lane.Done()
+					w.file(folder, file)
+				}()
+			}
+		}
+	}
+
+	var subs []SyncFolder
+	err := w.planner.call(func() (err error) {
+		subs, err = w.source.Folders(w.user, *folder)
+		return
+	})
+	if !w.check(folder.FullPath, err) {
+		atomic.AddInt32(&w.skipped, 1)
+		return
+	}
+	for i := range subs {
+		if w.stopped() {
+			return
+		}
+		sub := &subs[i]
+		// Without a free worker the subfolder is walked inline; waiting for
+		// one could deadlock, as every worker may be waiting the same way.
+		if w.folders.Try() {
+			go func() {
+				defer w.folders.Done()
+				w.walk(sub, false)
+			}()
+		} else {
+			w.walk(sub, false)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrGroupNotExpandable is returned by GroupMembers for a group whose members
+// the source cannot list. Unless it is granted as a Kiteworks group, the group
+// is left out of the folder's members, and pre-flight reports it.
+var ErrGroupNotExpandable = errors.New("group members cannot be listed")
+
+// migrationGroups resolves the source groups of a migration.
+type migrationGroups struct {
+	once       sync.Once
+	kw         map[string]KiteGroup // Kiteworks groups by lower-case name.
+	members    sync.Map             // Expanded members by source group id.
+	outcomes   sync.Map             // What became of each source group, by name.
+	unexpanded sync.Map             // Names of groups left out, as they could not be expanded.
+}
+
+// kiteGroup returns the Kiteworks group a source group is granted as: the one
+// the mapping names, or with MapGroups, the one of the same name. dest is the
+// name looked for, blank when the group is not mapped.
+func (E *MigrationEngine) kiteGroup(name string) (group KiteGroup, dest string, found bool) {
+	dest, mapped := E.Mapping.Group(name)
+	if !mapped {
+		if !E.MapGroups {
+			return KiteGroup{}, NONE, false
+		}
+		dest = name
+	}
+	E.groups.once.Do(func() {
+		E.groups.kw = make(map[string]KiteGroup)
+		groups, err := E.task.KW.Admin().Groups()
+		if err != nil {
+			Err("Error listing Kiteworks groups, source groups will be expanded: %v", err)
+			return
+		}
+		for _, g := range groups {
+			E.groups.kw[strings.ToLower(g.Name)] = g
+		}
+	})
+	group, found = E.groups.kw[strings.ToLower(dest)]
+	return group, dest, found
+}
+
+// groupMembers returns the members of a source group, expanding it once.
+func (E *MigrationEngine) groupMembers(user MigrationUser, group_id string) ([]string, error) {
+	if emails, ok := E.groups.members.Load(group_id); ok {
+		return emails.([]string), nil
+	}
+	src, ok := E.Source.(MigrationGroupSource)
+	if !ok {
+		return nil, fmt.Errorf("%s groups cannot be expanded", E.Source.Name())
+	}
+	emails, err := src.GroupMembers(user, group_id)
+	if err != nil {
+		return nil, err
+	}
+	E.groups.members.Store(group_id, emails)
+	return emails, nil
+}
+
+// resolveMembers returns the members of a source folder with its groups
+// resolved: a group granted as a Kiteworks group is kept, naming that group,
+// and any other is replaced by its members.
+func (E *MigrationEngine) resolveMembers(user MigrationUser, folder SyncFolder) ([]MigrationMember, error) {
+	members, err := E.Source.Members(user, folder)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]MigrationMember, 0, len(members))
+	for _, m := range members {
+		if IsBlank(m.Group) && IsBlank(m.GroupID) {
+			output = append(output, m)
+			continue
+		}
+		group, dest, found := E.kiteGroup(m.Group)
+		if found {
+			E.groupOutcome(m.Group, fmt.Sprintf("granted as Kiteworks group %s", group.Name))
+			m.Group, m.GroupID = group.Name, group.ID
+			output = append(output, m)
+			continue
+		}
+		emails, err := E.groupMembers(user, m.GroupID)
+		if err == ErrGroupNotExpandable {
+			E.groups.unexpanded.Store(m.Group, struct{}{})
+			E.groupOutcome(m.Group, "members cannot be listed, not granted; map it to a Kiteworks group")
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error expanding group %s: %v", m.Group, err)
+		}
+		if IsBlank(dest) {
+			E.groupOutcome(m.Group, fmt.Sprintf("expanded to %d member(s)", len(emails)))
+		} else {
+			E.groupOutcome(m.Group, fmt.Sprintf("no Kiteworks group %s, expanded to %d member(s)", dest, len(emails)))
+		}
+		for _, email := range emails {
+			output = append(output, MigrationMember{User: email, Role: m.Role, RoleID: m.RoleID, SourceRole: m.SourceRole})
+		}
+	}
+	return output, nil
+}
+
+// groupOutcome records what became of a source group, logging it the first
+// time.
+func (E *MigrationEngine) groupOutcome(name, outcome string) {
+	if _, loaded := E.groups.outcomes.LoadOrStore(name, outcome); !loaded {
+		Log("Group %s: %s.", name, outcome)
+	}
+}
+
+// preflightGroups reports the source groups seen that were left out of their
+// folders' members, being neither granted as a Kiteworks group nor expanded.
+func (E *MigrationEngine) preflightGroups() (findings []MigrationFinding) {
+	var names []string
+	E.groups.unexpanded.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		findings = append(findings, MigrationFinding{
+			Severity: PreflightWarning,
+			Check:    "group",
+			Detail:   fmt.Sprintf("%s group %q cannot be expanded and is not mapped to a Kiteworks group; its members will not be granted access.", E.Source.Name(), name),
+		})
+	}
+	return
+}
+
+// groupOutcomes returns what became of each source group seen, by name.
+func (E *MigrationEngine) groupOutcomes() (lines []string) {
+	E.groups.outcomes.Range(func(name, outcome interface{}) bool {
+		lines = append(lines, fmt.Sprintf("%s: %s", name, outcome))
+		return true
+	})
+	sort.Strings(lines)
+	return
+}
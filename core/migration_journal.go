@@ -0,0 +1,283 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of destination objects journaled by a migration run.
+const (
+	JournalUser   = "user"
+	JournalFolder = "folder"
+	JournalFile   = "file"
+	JournalGrant  = "grant"
+	JournalSSHKey = "ssh_key"
+)
+
+// journalSkew is how much earlier than the run's start, by the local clock, a
+// destination file may report being created and still count as the run's.
+const journalSkew = 10 * time.Minute
+
+// MigrationJournalEntry is a destination object created by a migration run.
+// Objects found already on the destination are never journaled, except for
+// grants that changed the role of an existing folder member, which are
+// journaled with the role to restore.
+type MigrationJournalEntry struct {
+	Kind       string    `json:"kind"`
+	Owner      string    `json:"owner"`                  // Kiteworks user the object was created as.
+	ID         string    `json:"id"`                     // User, folder, file or key id; for a grant, the folder's.
+	ParentID   string    `json:"parent_id,omitempty"`    // Folder holding a folder or file.
+	Name       string    `json:"name"`                   // Username, path, file name, grantee or key name.
+	PrevRoleID int       `json:"prev_role_id,omitempty"` // Role a grantee had before the grant.
+	Created    time.Time `json:"created"`
+}
+
+// migrationRunInfo describes a journaled migration run.
+type migrationRunInfo struct {
+	Source  string    `json:"source"`
+	Started time.Time `json:"started"`
+}
+
+// journalTable holds the journal of a run, keyed by sequence.
+func journalTable(db Database, run_id string) Table {
+	return db.Sub("migration_journal").Table(run_id)
+}
+
+// BeginRun starts journaling the destination objects created by the engine,
+// under a new run id that is logged and returned for --rollback.
+func (E *MigrationEngine) BeginRun() string {
+	E.run_started = time.Now().UTC()
+	E.run_id = E.run_started.Format("20060102-150405")
+	E.journal = journalTable(E.db, E.run_id)
+	E.db.Table("migration_runs").Set(E.run_id, &migrationRunInfo{
+		Source:  E.Source.Name(),
+		Started: E.run_started,
+	})
+	Log("Migration run %s; undo it with --rollback=%s.", E.run_id, E.run_id)
+	return E.run_id
+}
+
+// Journal records a destination object created by the current run. It does
+// nothing before BeginRun.
+func (E *MigrationEngine) Journal(entry MigrationJournalEntry) {
+	if IsBlank(E.run_id) {
+		return
+	}
+	entry.Created = time.Now().UTC()
+	E.journal.Set(fmt.Sprintf("%010d", atomic.AddInt64(&E.journal_seq, 1)), &entry)
+}
+
+// journalFile records a file uploaded as the first version of a source file,
+// unless the upload only added a version to a file that was already there.
+func (E *MigrationEngine) journalFile(owner string, file *KiteObject, auto_version bool) {
+	if IsBlank(E.run_id) {
+		return
+	}
+	if auto_version {
+		if created, err := ReadKWTime(file.Created); err == nil && created.Before(E.run_started.Add(-journalSkew)) {
+			return
+		}
+	}
+	E.Journal(MigrationJournalEntry{Kind: JournalFile, Owner: owner, ID: file.ID, ParentID: file.ParentID, Name: file.Name})
+}
+
+// ResolveFolder returns the folder at path below parent_id, creating the
+// folders missing along the way and journaling them.
+func (E *MigrationEngine) ResolveFolder(sess KWSession, parent_id, path string) (result KiteObject, err error) {
+	current_id := parent_id
+	for _, name := range SplitPath(path) {
+		result, err = sess.Folder(current_id).Find(name)
+		if err == ErrNotFound {
+			if result, err = sess.Folder(current_id).NewFolder(name); err == nil {
+				E.Journal(MigrationJournalEntry{Kind: JournalFolder, Owner: strings.ToLower(sess.Username), ID: result.ID, ParentID: current_id, Name: result.Path})
+			}
+		}
+		if err != nil {
+			return KiteObject{}, err
+		}
+		current_id = result.ID
+	}
+	return result, nil
+}
+
+// RollbackMigration undoes a migration run recorded in db, the migration's
+// database: the destination objects it created are removed newest first,
+// leaving what was already on the destination. Objects inside a removed
+// folder, or keys of a removed user, go with them. Resume state of the
+// removed objects is dropped so a later run copies them again. With dry_run
+// the actions are only logged.
+func RollbackMigration(task *KiteBrokerTask, db Database, run_id string, dry_run bool) error {
+	runs := db.Table("migration_runs")
+	var info migrationRunInfo
+	if !runs.Get(run_id, &info) {
+		known := runs.Keys()
+		if len(known) == 0 {
+			return fmt.Errorf("unknown run %q, no migration runs are recorded", run_id)
+		}
+		sort.Strings(known)
+		return fmt.Errorf("unknown run %q, recorded runs: %s", run_id, strings.Join(known, ", "))
+	}
+
+	journal := journalTable(db, run_id)
+	keys := journal.Keys()
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	entries := make(map[string]MigrationJournalEntry)
+	folders := make(map[string]struct{})
+	users := make(map[string]struct{})
+	for _, k := range keys {
+		var entry MigrationJournalEntry
+		if !journal.Get(k, &entry) {
+			continue
+		}
+		entries[k] = entry
+		switch entry.Kind {
+		case JournalFolder:
+			folders[entry.ID] = struct{}{}
+		case JournalUser:
+			users[entry.Name] = struct{}{}
+		}
+	}
+
+	report := task.Report
+	label := "Objects Removed"
+	prefix := NONE
+	if dry_run {
+		label = "Objects To Remove"
+		prefix = "[dry run] "
+	}
+	removed_tally := report.Tally(label)
+	failed_tally := report.Tally("Rollback Failures")
+
+	Log("%sRolling back %s migration run %s (started %s), %d object(s) journaled.", prefix, info.Source, run_id, info.Started.Local().Format(time.RFC1123), len(entries))
+
+	admin := task.KW.Admin()
+	files := make(map[string]struct{})
+	for _, k := range keys {
+		entry, ok := entries[k]
+		if !ok {
+			continue
+		}
+		sess := task.KW.Session(entry.Owner)
+
+		// covered is true when a removed folder or user takes the object with it.
+		var covered bool
+		var err error
+		switch entry.Kind {
+		case JournalFile:
+			files[entry.ID] = struct{}{}
+			if _, covered = folders[entry.ParentID]; !covered {
+				Log("%s[%s]: Deleting file %s.", prefix, entry.Owner, entry.Name)
+				if !dry_run {
+					err = sess.File(entry.ID).Delete()
+				}
+			}
+		case JournalGrant:
+			if _, covered = folders[entry.ID]; covered {
+				break
+			}
+			if entry.PrevRoleID != 0 {
+				Log("%s[%s]: Restoring the previous role of %s on folder %s.", prefix, entry.Owner, entry.Name, entry.ID)
+				if !dry_run {
+					err = sess.Folder(entry.ID).AddUsersToFolder([]string{entry.Name}, entry.PrevRoleID, false, false)
+				}
+			} else {
+				Log("%s[%s]: Removing %s from folder %s.", prefix, entry.Owner, entry.Name, entry.ID)
+				if !dry_run {
+					err = removeGrant(sess, entry)
+				}
+			}
+		case JournalSSHKey:
+			if _, covered = users[entry.Owner]; !covered {
+				Log("%s[%s]: Deleting SSH key '%s'.", prefix, entry.Owner, entry.Name)
+				if !dry_run {
+					var id int
+					if id, err = strconv.Atoi(entry.ID); err == nil {
+						err = sess.DeleteMySshPublicKey(id)
+					}
+				}
+			}
+		case JournalFolder:
+			if _, covered = folders[entry.ParentID]; !covered {
+				Log("%s[%s]: Deleting folder /%s.", prefix, entry.Owner, entry.Name)
+				if !dry_run {
+					err = sess.Folder(entry.ID).Delete()
+				}
+			}
+		case JournalUser:
+			Log("%s[%s]: Deleting user.", prefix, entry.Name)
+			if !dry_run {
+				err = admin.DeleteUser(KiteUser{ID: entry.ID})
+			}
+		default:
+			Err("Skipping journal entry of unknown kind %q.", entry.Kind)
+			continue
+		}
+		if err != nil && !IsAPIError(err, "ERR_ENTITY_DELETED", "ERR_ENTITY_NOT_FOUND", "ERR_ENTITY_PARENT_FOLDER_DELETED", "ERR_ENTITY_ROLE_IS_ASSIGNED") {
+			Err("[%s]: Error removing %s %s: %v", entry.Owner, entry.Kind, entry.Name, err)
+			failed_tally.Add(1)
+			continue
+		}
+		if !covered {
+			removed_tally.Add(1)
+		}
+		if !dry_run {
+			journal.Unset(k)
+		}
+	}
+
+	if dry_run {
+		Log("\n=== Rollback Dry Run Complete ===")
+		return nil
+	}
+
+	// Forget the removed objects, and everything inside removed folders.
+	state := db.Table("migration_files")
+	for _, k := range state.Keys() {
+		var f SyncFile
+		if !state.Get(k, &f) {
+			continue
+		}
+		_, in_folder := folders[f.DestFolderID]
+		_, removed := files[f.DestID]
+		if in_folder || removed {
+			state.Unset(k)
+		}
+	}
+	state = db.Table("migration_folders")
+	for _, k := range state.Keys() {
+		var f SyncFolder
+		if state.Get(k, &f) {
+			if _, ok := folders[f.DestID]; ok {
+				state.Unset(k)
+			}
+		}
+	}
+
+	if failed_tally.Value() > 0 {
+		Log("\n=== Rollback incomplete, run --rollback=%s again to retry the failures ===", run_id)
+		return nil
+	}
+	runs.Unset(run_id)
+	journal.Drop()
+	Log("\n=== Rollback Complete ===")
+	return nil
+}
+
+// removeGrant removes the grantee of a journaled grant from its folder.
+func removeGrant(sess KWSession, entry MigrationJournalEntry) error {
+	members, err := sess.Folder(entry.ID).Members()
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if strings.EqualFold(m.User.Email, entry.Name) {
+			return sess.Folder(entry.ID).RemoveUserFromFolder(m.User.ID, Query{"downgradeNested": true})
+		}
+	}
+	return nil
+}
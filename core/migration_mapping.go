@@ -0,0 +1,455 @@
+package core
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MigrationMapping rewrites source identities for the destination: user
+// emails, groups, folder paths and folder roles. It is read from a CSV file,
+// with one rule per line:
+//
+//	user,old@example.com,new@example.com
+//	user,@old-domain.com,@new-domain.com
+//	path,Shared/Finance,Finance
+//	regex,^Home/([^/]+),Users/$1
+//	role,collaborator,viewer
+//	source_role,co-owner,Collaborator
+//	source_role,0xb02,Viewer
+//	group,Finance Team,Finance
+//
+// or from a YAML file with the same rules:
+//
+//	users:
+//	  old@example.com: new@example.com
+//	  "@old-domain.com": "@new-domain.com"
+//	paths:
+//	  - prefix: Shared/Finance
+//	    dest: Finance
+//	  - regex: ^Home/([^/]+)
+//	    dest: Users/$1
+//	roles:
+//	  collaborator: viewer
+//	source_roles:
+//	  co-owner: Collaborator
+//	  "0xb02": Viewer
+//	groups:
+//	  Finance Team: Finance
+//
+// A user rule starting with @ moves a whole domain; several users may map to
+// the same destination user, consolidating them. Path rules are tried in
+// order against a folder's path relative to its owner's root, and the first
+// to match relocates the folder and everything below it. A role rule maps
+// the Kiteworks role a source grants to another. A source role rule takes
+// the source's own role name, or its permission bits as a number, and names
+// the Kiteworks role granted in place of the source's default; role rules
+// then apply to it. Roles are matched by name against the destination's,
+// and a role mapped to "none" removes the member. A group rule grants a
+// source group through an existing Kiteworks group rather than to each of
+// its members.
+type MigrationMapping struct {
+	users        map[string]string
+	domains      map[string]string
+	paths        []migrationPathRule
+	roles        map[string]string
+	source_roles map[string]string
+	groups       map[string]string
+}
+
+// migrationPathRule relocates folders by path prefix or regular expression.
+type migrationPathRule struct {
+	prefix string
+	regex  *regexp.Regexp
+	dest   string
+}
+
+// LoadMigrationMapping reads and validates a mapping file, as YAML when it
+// ends in .yaml or .yml and CSV otherwise.
+func LoadMigrationMapping(file string) (*MigrationMapping, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	M := &MigrationMapping{
+		users:        make(map[string]string),
+		domains:      make(map[string]string),
+		roles:        make(map[string]string),
+		source_roles: make(map[string]string),
+		groups:       make(map[string]string),
+	}
+
+	lower := strings.ToLower(file)
+	if strings.HasSuffix(lower, ".yaml") || strings.HasSuffix(lower, ".yml") {
+		err = M.readYAML(bufio.NewScanner(f))
+	} else {
+		err = M.readCSV(csv.NewReader(f))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return M, nil
+}
+
+// readCSV reads type,source,destination rules.
+func (M *MigrationMapping) readCSV(reader *csv.Reader) error {
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+		if len(record) == 1 && IsBlank(record[0]) {
+			continue
+		}
+		if len(record) != 3 {
+			return fmt.Errorf("line %d: expected type,source,destination", line)
+		}
+		kind := strings.ToLower(record[0])
+		if kind == "type" {
+			continue
+		}
+		if err := M.add(kind, record[1], record[2]); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+}
+
+// readYAML reads the users, paths, roles, source_roles and groups sections of
+// a YAML mapping file.
+// Only the block mappings and sequences shown on MigrationMapping are
+// understood.
+func (M *MigrationMapping) readYAML(scanner *bufio.Scanner) error {
+	var (
+		section string
+		rule    map[string]string
+		line    int
+		start   int
+	)
+
+	// flush adds the path rule being read.
+	flush := func() error {
+		if rule == nil {
+			return nil
+		}
+		defer func() { rule = nil }()
+		dest, has_dest := rule["dest"]
+		prefix, has_prefix := rule["prefix"]
+		regex, has_regex := rule["regex"]
+		if !has_dest || has_prefix == has_regex {
+			return fmt.Errorf("line %d: a path needs dest and either prefix or regex", start)
+		}
+		if has_prefix {
+			return M.add("path", prefix, dest)
+		}
+		return M.add("regex", regex, dest)
+	}
+
+	for scanner.Scan() {
+		line++
+		text := yamlStripComment(scanner.Text())
+		if IsBlank(text) {
+			continue
+		}
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		text = strings.TrimSpace(text)
+
+		if indent == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if !strings.HasSuffix(text, ":") {
+				return fmt.Errorf("line %d: expected users:, paths:, roles:, source_roles: or groups:", line)
+			}
+			section = strings.ToLower(strings.TrimSuffix(text, ":"))
+			switch section {
+			case "users", "paths", "roles", "source_roles", "groups":
+			default:
+				return fmt.Errorf("line %d: unknown section %q", line, section)
+			}
+			continue
+		}
+
+		if section == "paths" && strings.HasPrefix(text, "-") {
+			if err := flush(); err != nil {
+				return err
+			}
+			rule = make(map[string]string)
+			start = line
+			text = strings.TrimSpace(strings.TrimPrefix(text, "-"))
+			if IsBlank(text) {
+				continue
+			}
+		}
+
+		key, value, err := yamlKeyValue(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+
+		switch section {
+		case "users":
+			err = M.add("user", key, value)
+		case "roles":
+			err = M.add("role", key, value)
+		case "source_roles":
+			err = M.add("source_role", key, value)
+		case "groups":
+			err = M.add("group", key, value)
+		case "paths":
+			if rule == nil {
+				return fmt.Errorf("line %d: expected - prefix: or - regex:", line)
+			}
+			switch key {
+			case "prefix", "regex", "dest":
+				rule[key] = value
+			default:
+				return fmt.Errorf("line %d: unknown path field %q", line, key)
+			}
+		default:
+			return fmt.Errorf("line %d: entry outside of a section", line)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// yamlStripComment removes a # comment that is not inside quotes.
+func yamlStripComment(text string) string {
+	var quote rune
+	for i, c := range text {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return strings.TrimRight(text[:i], " \t")
+		}
+	}
+	return strings.TrimRight(text, " \t")
+}
+
+// yamlKeyValue splits a key: value line, unquoting both.
+func yamlKeyValue(text string) (key, value string, err error) {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			return yamlUnquote(text[:i]), yamlUnquote(text[i+1:]), nil
+		}
+	}
+	return NONE, NONE, fmt.Errorf("expected key: value")
+}
+
+// yamlUnquote trims a scalar and removes its quotes.
+func yamlUnquote(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// add validates and adds a rule.
+func (M *MigrationMapping) add(kind, src, dest string) error {
+	switch kind {
+	case "user":
+		src, dest = strings.ToLower(src), strings.ToLower(dest)
+		if strings.HasPrefix(src, "@") || strings.HasPrefix(dest, "@") {
+			if !strings.HasPrefix(src, "@") || !strings.HasPrefix(dest, "@") || len(src) < 2 || len(dest) < 2 {
+				return fmt.Errorf("domain rule %q -> %q must map one @domain to another", src, dest)
+			}
+			if _, ok := M.domains[src]; ok {
+				return fmt.Errorf("domain %s is mapped more than once", src)
+			}
+			M.domains[src] = dest
+			return nil
+		}
+		if !strings.Contains(src, "@") || !strings.Contains(dest, "@") {
+			return fmt.Errorf("user rule %q -> %q must map one email to another", src, dest)
+		}
+		if _, ok := M.users[src]; ok {
+			return fmt.Errorf("user %s is mapped more than once", src)
+		}
+		M.users[src] = dest
+	case "path", "prefix":
+		src, dest = strings.Trim(src, "/"), strings.Trim(dest, "/")
+		if IsBlank(src) || IsBlank(dest) {
+			return fmt.Errorf("path rule %q -> %q needs a source and destination folder", src, dest)
+		}
+		M.paths = append(M.paths, migrationPathRule{prefix: src, dest: dest})
+	case "regex":
+		re, err := regexp.Compile(src)
+		if err != nil {
+			return fmt.Errorf("regex %q: %v", src, err)
+		}
+		if IsBlank(strings.Trim(dest, "/")) {
+			return fmt.Errorf("regex rule %q needs a destination folder", src)
+		}
+		M.paths = append(M.paths, migrationPathRule{regex: re, dest: strings.Trim(dest, "/")})
+	case "role", "source_role":
+		src, dest = strings.ToLower(src), strings.ToLower(dest)
+		if IsBlank(src) || IsBlank(dest) {
+			return fmt.Errorf("%s rule %q -> %q needs a source and destination role", kind, src, dest)
+		}
+		table := M.roles
+		if kind == "source_role" {
+			table = M.source_roles
+			if bits, err := strconv.ParseInt(src, 0, 64); err == nil {
+				src = strconv.FormatInt(bits, 10)
+			}
+		}
+		if _, ok := table[src]; ok {
+			return fmt.Errorf("%s %s is mapped more than once", strings.Replace(kind, "_", " ", 1), src)
+		}
+		table[src] = dest
+	case "group":
+		if IsBlank(src) || IsBlank(dest) {
+			return fmt.Errorf("group rule %q -> %q needs a source and destination group", src, dest)
+		}
+		key := strings.ToLower(src)
+		if _, ok := M.groups[key]; ok {
+			return fmt.Errorf("group %s is mapped more than once", src)
+		}
+		M.groups[key] = dest
+	default:
+		return fmt.Errorf("unknown rule type %q, expected user, path, regex, role, source_role or group", kind)
+	}
+	return nil
+}
+
+// User returns the destination email of a source user.
+func (M *MigrationMapping) User(email string) string {
+	email = strings.ToLower(email)
+	if M == nil {
+		return email
+	}
+	if dest, ok := M.users[email]; ok {
+		return dest
+	}
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		if dest, ok := M.domains[email[i:]]; ok {
+			return email[:i] + dest
+		}
+	}
+	return email
+}
+
+// MapsUser reports whether a user or domain rule applies to email.
+func (M *MigrationMapping) MapsUser(email string) bool {
+	return M != nil && M.User(email) != strings.ToLower(email)
+}
+
+// Path returns the destination path of a source folder path.
+func (M *MigrationMapping) Path(path string) string {
+	if M == nil {
+		return path
+	}
+	trimmed := strings.Trim(path, "/")
+	for _, r := range M.paths {
+		if r.regex != nil {
+			if r.regex.MatchString(trimmed) {
+				return strings.Trim(r.regex.ReplaceAllString(trimmed, r.dest), "/")
+			}
+			continue
+		}
+		if trimmed == r.prefix {
+			return r.dest
+		}
+		if strings.HasPrefix(trimmed, r.prefix+"/") {
+			return r.dest + trimmed[len(r.prefix):]
+		}
+	}
+	return path
+}
+
+// Role returns the destination role name for a source role name; blank
+// means the member is removed.
+func (M *MigrationMapping) Role(name string) string {
+	if M == nil {
+		return name
+	}
+	dest, ok := M.roles[strings.ToLower(name)]
+	if !ok {
+		return name
+	}
+	if dest == "none" {
+		return NONE
+	}
+	return dest
+}
+
+// SourceRole returns the role granted in place of a source role or
+// permission bits, when the source role table maps it.
+func (M *MigrationMapping) SourceRole(role string) (string, bool) {
+	if M == nil || IsBlank(role) {
+		return NONE, false
+	}
+	dest, ok := M.source_roles[strings.ToLower(role)]
+	if !ok {
+		return NONE, false
+	}
+	if dest == "none" {
+		return NONE, true
+	}
+	return dest, true
+}
+
+// RoleNames returns the destination roles the mapping grants, lower-cased.
+func (M *MigrationMapping) RoleNames() (names []string) {
+	if M == nil {
+		return nil
+	}
+	seen := make(map[string]struct{})
+	for _, table := range []map[string]string{M.roles, M.source_roles} {
+		for _, dest := range table {
+			if _, ok := seen[dest]; ok || dest == "none" {
+				continue
+			}
+			seen[dest] = struct{}{}
+			names = append(names, dest)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// Group returns the Kiteworks group a source group is mapped to.
+func (M *MigrationMapping) Group(name string) (string, bool) {
+	if M == nil {
+		return NONE, false
+	}
+	dest, ok := M.groups[strings.ToLower(name)]
+	return dest, ok
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// The concurrency planner sizes each walk's folder and file pools from the
+// source's API limits and the latency observed calling it. With a request
+// rate, the pools are sized by Little's law, rate times latency, so the walk
+// keeps just enough requests in flight to reach the rate, and each source
+// call is paced to it. Files of at least LargeFileMB take a separate lane,
+// sized to the transfer limit, so big transfers neither queue behind small
+// files nor crowd them out. The budget is shared by the walks running at once.
+
+const (
+	defaultWalkPool    = 50                     // Folder and file pool of a walk without source limits.
+	defaultLargeFileMB = 64                     // Default size of a large file, in MB.
+	initialLatency     = 250 * time.Millisecond // Latency assumed until a source call is observed.
+	latencyWeight      = 0.2                    // Weight of each observation in the latency average.
+)
+
+// MigrationLimits are a migration source's API limits, which the engine
+// plans its concurrency from.
+type MigrationLimits struct {
+	RequestsPerSecond int // Source API requests per second; 0 is unlimited.
+	MaxConcurrent     int // Source API requests in flight; 0 leaves it to the planner.
+	LargeFileMB       int // Files of at least this size take the large file lane.
+}
+
+// RegisterFlags adds the source limit flags (--source_rate,
+// --source_concurrency, --large_file_mb) to a task's flag set, using the
+// current values as defaults.
+func (o *MigrationLimits) RegisterFlags(flags *FlagSet) {
+	if o.LargeFileMB == 0 {
+		o.LargeFileMB = defaultLargeFileMB
+	}
+	flags.IntVar(&o.RequestsPerSecond, "source_rate", o.RequestsPerSecond, "Source API requests per second to stay under. (0 is unlimited)")
+	flags.IntVar(&o.MaxConcurrent, "source_concurrency", o.MaxConcurrent, "Source API requests to have in flight at once. (0 plans it from --source_rate)")
+	flags.IntVar(&o.LargeFileMB, "large_file_mb", o.LargeFileMB, "Files of at least this size (MB) transfer in their own lane.")
+}
+
+// Validate checks the limit values, for use in a task's Init.
+func (o MigrationLimits) Validate() error {
+	if o.RequestsPerSecond < 0 {
+		return fmt.Errorf("--source_rate cannot be negative.")
+	}
+	if o.MaxConcurrent < 0 {
+		return fmt.Errorf("--source_concurrency cannot be negative.")
+	}
+	if o.LargeFileMB < 0 {
+		return fmt.Errorf("--large_file_mb cannot be negative.")
+	}
+	return nil
+}
+
+// limited reports whether any source limit is set.
+func (o MigrationLimits) limited() bool {
+	return o.RequestsPerSecond > 0 || o.MaxConcurrent > 0
+}
+
+// largeFileSize returns the size in bytes of a large file.
+func (o MigrationLimits) largeFileSize() int64 {
+	if o.LargeFileMB <= 0 {
+		return defaultLargeFileMB * 1024 * 1024
+	}
+	return int64(o.LargeFileMB) * 1024 * 1024
+}
+
+// MigrationConcurrency is the concurrency planned for a walk.
+type MigrationConcurrency struct {
+	Folders    int // Folders listed at once.
+	SmallFiles int // Small files copied at once.
+	LargeFiles int // Large files copied at once.
+}
+
+// migrationPlanner plans the concurrency of an engine's walks.
+type migrationPlanner struct {
+	limits    MigrationLimits
+	transfers int // Transfers the destination allows at once.
+	lock      sync.Mutex
+	latency   time.Duration
+	observed  bool
+	walks     int
+	next      time.Time // When the next paced request may start.
+	last      MigrationConcurrency
+}
+
+// newMigrationPlanner returns a planner for the limits, with the transfer
+// limit of the destination.
+func newMigrationPlanner(limits MigrationLimits, transfers int) *migrationPlanner {
+	if transfers < 1 {
+		transfers = 1
+	}
+	return &migrationPlanner{
+		limits:    limits,
+		transfers: transfers,
+		latency:   initialLatency,
+	}
+}
+
+// begin plans the concurrency of a walk starting, which is counted among
+// the running walks until end is called.
+func (P *migrationPlanner) begin() MigrationConcurrency {
+	P.lock.Lock()
+	defer P.lock.Unlock()
+	P.walks++
+
+	plan := MigrationConcurrency{
+		Folders:    defaultWalkPool,
+		SmallFiles: defaultWalkPool,
+		LargeFiles: P.transfers / P.walks,
+	}
+	if plan.LargeFiles < 1 {
+		plan.LargeFiles = 1
+	}
+	if P.limits.limited() {
+		budget := defaultWalkPool
+		if P.limits.RequestsPerSecond > 0 {
+			budget = int(math.Ceil(float64(P.limits.RequestsPerSecond)*P.latency.Seconds())) + 1
+		}
+		if P.limits.MaxConcurrent > 0 && P.limits.MaxConcurrent < budget {
+			budget = P.limits.MaxConcurrent
+		}
+		// Each walk needs a folder and a file worker at the least.
+		if budget = budget / P.walks; budget < 2 {
+			budget = 2
+		}
+		plan.Folders = budget / 4
+		if plan.Folders < 1 {
+			plan.Folders = 1
+		}
+		plan.SmallFiles = budget - plan.Folders
+	}
+	if plan != P.last {
+		Debug("Migration concurrency: %s", P.describe(plan))
+	}
+	P.last = plan
+	return plan
+}
+
+// end counts a walk as finished.
+func (P *migrationPlanner) end() {
+	P.lock.Lock()
+	P.walks--
+	P.lock.Unlock()
+}
+
+// pace waits until a source request may start without exceeding the rate.
+func (P *migrationPlanner) pace() {
+	if P.limits.RequestsPerSecond <= 0 {
+		return
+	}
+	interval := time.Second / time.Duration(P.limits.RequestsPerSecond)
+
+	P.lock.Lock()
+	now := time.Now()
+	if P.next.Before(now) {
+		P.next = now
+	}
+	start := P.next
+	P.next = P.next.Add(interval)
+	P.lock.Unlock()
+
+	time.Sleep(start.Sub(now))
+}
+
+// call makes a paced source call, observing its latency.
+func (P *migrationPlanner) call(fn func() error) error {
+	P.pace()
+	start := time.Now()
+	err := fn()
+	P.observe(time.Since(start))
+	return err
+}
+
+// observe adds the latency of a source call to the average.
+func (P *migrationPlanner) observe(latency time.Duration) {
+	P.lock.Lock()
+	defer P.lock.Unlock()
+	if !P.observed {
+		P.latency = latency
+		P.observed = true
+		return
+	}
+	P.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(P.latency))
+}
+
+// describe formats a plan with the limits and latency it was planned from.
+func (P *migrationPlanner) describe(plan MigrationConcurrency) string {
+	var basis string
+	switch {
+	case !P.limits.limited():
+		basis = "no source limits"
+	case P.limits.RequestsPerSecond > 0:
+		basis = fmt.Sprintf("%d req/s at %v latency", P.limits.RequestsPerSecond, P.latency.Round(time.Millisecond))
+	default:
+		basis = fmt.Sprintf("%d requests in flight", P.limits.MaxConcurrent)
+	}
+	return fmt.Sprintf("folders %d, small files %d, large files %d (>= %d MB), transfers %d; %s", plan.Folders, plan.SmallFiles, plan.LargeFiles, P.limits.largeFileSize()/(1024*1024), P.transfers, basis)
+}
+
+// String describes the last plan, for the task report.
+func (P *migrationPlanner) String() string {
+	P.lock.Lock()
+	defer P.lock.Unlock()
+	return P.describe(P.last)
+}
@@ -0,0 +1,298 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// MigrationPreflight sets the destination limits checked by a pre-flight scan.
+type MigrationPreflight struct {
+	MaxNameLength int   // Longest file or folder name, in characters.
+	MaxPathLength int   // Longest destination path, in characters.
+	MaxFileSize   int64 // Largest file the destination accepts, in bytes; 0 is unchecked.
+}
+
+// DefaultMigrationPreflight returns the default pre-flight limits.
+func DefaultMigrationPreflight() MigrationPreflight {
+	return MigrationPreflight{
+		MaxNameLength: 255,
+		MaxPathLength: 2048,
+	}
+}
+
+// Pre-flight finding severities. A blocking finding will fail the migration;
+// a warning will not, but changes what arrives on Kiteworks.
+const (
+	PreflightBlocking = "blocking"
+	PreflightWarning  = "warning"
+)
+
+// MigrationFinding is a problem found by a pre-flight scan or a verification.
+type MigrationFinding struct {
+	User     string `json:"user"`
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Path     string `json:"path,omitempty"`
+	Detail   string `json:"detail"`
+}
+
+// migrationPreflightUser collects a user's pre-flight findings.
+type migrationPreflightUser struct {
+	username string
+	findings []MigrationFinding
+	lock     sync.Mutex
+}
+
+// add records a finding.
+func (p *migrationPreflightUser) add(severity, check, path, format string, args ...interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.findings = append(p.findings, MigrationFinding{
+		User:     p.username,
+		Severity: severity,
+		Check:    check,
+		Path:     path,
+		Detail:   fmt.Sprintf(format, args...),
+	})
+}
+
+// RunPreflight scans the selected source users with the report crawl, checks
+// their content and Kiteworks accounts against the destination, and writes
+// the findings to output, as JSON when it ends in .json and CSV otherwise.
+// Nothing is migrated. It fails when there are blocking findings.
+func (E *MigrationEngine) RunPreflight(output string) (err error) {
+	users, err := E.SourceUsers()
+	if err != nil {
+		return err
+	}
+	name := E.Source.Name()
+
+	report := E.task.Report
+	E.tally.users = report.Tally("Users")
+	E.tally.folders = report.Tally("Folders")
+	E.tally.files = report.Tally("Files")
+	E.tally.bytes = report.Tally("Total Size", HumanSize)
+	E.tally.comments = report.Tally("Comments")
+	if _, ok := E.Source.(MigrationTaskSource); ok {
+		E.tally.tasks = report.Tally("Tasks")
+	}
+	blocking := report.Tally("Blocking Findings")
+	warnings := report.Tally("Warnings")
+
+	profiles, err := E.task.KW.Profiles()
+	if err != nil {
+		return fmt.Errorf("Error reading destination profiles: %v", err)
+	}
+	if E.ProfileID > 0 {
+		if p, ok := profiles[E.ProfileID]; ok && p.Features.FolderCreate == 0 {
+			return fmt.Errorf("Destination profile '%s' does not have permission to create folders", p.Name)
+		}
+	}
+
+	role_findings, err := E.preflightRoles()
+	if err != nil {
+		return err
+	}
+
+	Log("Running %s Pre-Flight Checks...", name)
+
+	var (
+		results []*migrationPreflightUser
+		lock    sync.Mutex
+	)
+
+	wg := NewLimitGroup(10)
+	for _, u := range users {
+		wg.Add(1)
+		go func(user MigrationUser) {
+			defer wg.Done()
+			username := strings.ToLower(user.Email)
+			if IsBlank(username) {
+				return
+			}
+			E.tally.users.Add(1)
+			p := &migrationPreflightUser{username: username}
+			ur := &migrationUserReport{perms: make(map[string][]migrationReportPerm)}
+			if err := E.reportUser(user, ur); err != nil {
+				p.add(PreflightBlocking, "source", NONE, "Error reading source: %v", err)
+			}
+			total := E.preflightContent(p, ur)
+			E.preflightUser(p, profiles, total)
+			lock.Lock()
+			results = append(results, p)
+			lock.Unlock()
+		}(u)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].username < results[j].username })
+
+	group_findings := E.preflightGroups()
+
+	findings := append(role_findings, group_findings...)
+	Log("\n=== %s Pre-Flight Findings ===\n", name)
+	for _, f := range role_findings {
+		Log("[roles]: %s", f.Detail)
+	}
+	for _, f := range group_findings {
+		Log("[groups]: %s", f.Detail)
+	}
+	blocking.Add(len(role_findings))
+	warnings.Add(len(group_findings))
+	for _, p := range results {
+		var b, w int
+		for _, f := range p.findings {
+			if f.Severity == PreflightBlocking {
+				b++
+			} else {
+				w++
+			}
+		}
+		blocking.Add(b)
+		warnings.Add(w)
+		if b+w == 0 {
+			Log("[%s]: OK", p.username)
+			continue
+		}
+		Log("[%s]: %d blocking, %d warning(s)", p.username, b, w)
+		findings = append(findings, p.findings...)
+	}
+
+	if err := writeMigrationFindings(output, findings); err != nil {
+		return err
+	}
+	Log("\nPre-flight findings written to %s.", output)
+
+	if blocking.Value() > 0 {
+		return fmt.Errorf("pre-flight found %d blocking issue(s), see %s", blocking.Value(), output)
+	}
+	return nil
+}
+
+// preflightContent checks a user's source folders and files against the
+// destination limits, and returns their total size.
+func (E *MigrationEngine) preflightContent(p *migrationPreflightUser, ur *migrationUserReport) (total int64) {
+	limits := E.Preflight
+	names := make(map[string]string) // lowercase destination path -> source path
+
+	sort.Slice(ur.entries, func(i, j int) bool { return ur.entries[i].Path < ur.entries[j].Path })
+
+	for _, e := range ur.entries {
+		src_path := strings.Trim(e.Path, "/")
+		base := path.Base(src_path)
+
+		dest_base := FilterInvalidChars(base)
+		if dest_base != base {
+			p.add(PreflightWarning, "invalid_characters", src_path, "'%s' will be renamed to '%s'.", base, dest_base)
+		}
+		if n := utf8.RuneCountInString(dest_base); limits.MaxNameLength > 0 && n > limits.MaxNameLength {
+			p.add(PreflightBlocking, "name_too_long", src_path, "Name is %d characters, the limit is %d.", n, limits.MaxNameLength)
+		}
+
+		// The whole remapped path is filtered, as ResolvePath does.
+		dest_path := FilterInvalidChars(strings.Trim(E.DestPath(src_path), "/"))
+		if n := utf8.RuneCountInString(dest_path); limits.MaxPathLength > 0 && n > limits.MaxPathLength {
+			p.add(PreflightBlocking, "path_too_long", src_path, "Path is %d characters, the limit is %d.", n, limits.MaxPathLength)
+		}
+
+		key := strings.ToLower(dest_path)
+		if prev, ok := names[key]; ok && prev != src_path {
+			p.add(PreflightBlocking, "case_conflict", src_path, "Conflicts with '%s', names differing only by case cannot coexist.", prev)
+		} else {
+			names[key] = src_path
+		}
+
+		if !e.IsFile {
+			continue
+		}
+		total += e.Size
+		if limits.MaxFileSize > 0 && e.Size > limits.MaxFileSize {
+			p.add(PreflightBlocking, "file_too_large", src_path, "File is %s, the limit is %s.", HumanSize(e.Size), HumanSize(limits.MaxFileSize))
+		}
+	}
+	return total
+}
+
+// preflightUser checks the user's Kiteworks account: that the profile it will
+// have can create folders, and that its quota can hold total bytes.
+func (E *MigrationEngine) preflightUser(p *migrationPreflightUser, profiles map[int]KWProfile, total int64) {
+	username := E.destUser(p.username)
+	kw_user, err := E.task.KW.Admin().FindUser(username)
+	if err != nil && err != ERR_NO_USER_FOUND {
+		p.add(PreflightBlocking, "user", NONE, "Error finding %s on Kiteworks: %v", username, err)
+		return
+	}
+
+	profile_id := E.ProfileID
+	if kw_user == nil {
+		p.add(PreflightWarning, "user", NONE, "%s does not exist on Kiteworks and will be created.", username)
+	} else {
+		if kw_user.Deleted || kw_user.Deactivated {
+			p.add(PreflightBlocking, "user", NONE, "%s is deleted or deactivated on Kiteworks.", username)
+		}
+		if profile_id == 0 {
+			profile_id = kw_user.UserTypeID
+		}
+	}
+
+	profile, ok := profiles[profile_id]
+	if !ok {
+		if profile_id > 0 {
+			p.add(PreflightWarning, "profile", NONE, "Profile %d of %s was not found.", profile_id, username)
+		}
+		return
+	}
+	if profile.Features.FolderCreate == 0 {
+		p.add(PreflightBlocking, "profile", NONE, "Profile '%s' of %s cannot create folders.", profile.Name, username)
+	}
+
+	if kw_user != nil {
+		quota, err := E.task.KW.Session(username).MyQuota()
+		if err != nil {
+			p.add(PreflightWarning, "quota", NONE, "Error reading quota of %s: %v", username, err)
+			return
+		}
+		if quota.FolderAllowed > 0 {
+			if free := int64(quota.FolderAllowed - quota.FolderUsed); total > free {
+				p.add(PreflightBlocking, "quota", NONE, "Migrating %s, but only %s of quota is free.", HumanSize(total), HumanSize(free))
+			}
+		}
+		return
+	}
+	if profile.Features.MaxStorage > 0 && total > profile.Features.MaxStorage {
+		p.add(PreflightBlocking, "quota", NONE, "Migrating %s, but profile '%s' allows %s.", HumanSize(total), profile.Name, HumanSize(profile.Features.MaxStorage))
+	}
+}
+
+// writeMigrationFindings writes pre-flight findings to a JSON or CSV file.
+func writeMigrationFindings(output string, findings []MigrationFinding) error {
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(strings.ToLower(output), ".json") {
+		if findings == nil {
+			findings = []MigrationFinding{}
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(findings)
+	}
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"User", "Severity", "Check", "Path", "Detail"})
+	for _, v := range findings {
+		w.Write([]string{v.User, v.Severity, v.Check, v.Path, v.Detail})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,292 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// migrationReportEntry is a folder or file found on the source.
+type migrationReportEntry struct {
+	Path   string
+	IsFile bool
+	Size   int64
+}
+
+// migrationReportPerm is a member of a shared source folder.
+type migrationReportPerm struct {
+	Email string
+	Role  string
+}
+
+// migrationUserReport collects a user's source content for the report.
+type migrationUserReport struct {
+	entries []migrationReportEntry
+	perms   map[string][]migrationReportPerm
+	lock    sync.Mutex
+}
+
+// migrationTreeNode is a folder or file in the report's tree view.
+type migrationTreeNode struct {
+	name        string
+	size        int64
+	isFile      bool
+	isShared    bool
+	fileCount   int
+	folderCount int
+	userCount   int
+	perms       []migrationReportPerm
+	children    []*migrationTreeNode
+}
+
+// RunReport walks the selected source users without migrating anything, and
+// shows each user's folders, files and folder members as a tree.
+func (E *MigrationEngine) RunReport() (err error) {
+	users, err := E.SourceUsers()
+	if err != nil {
+		return err
+	}
+	name := E.Source.Name()
+
+	report := E.task.Report
+	E.tally.users = report.Tally("Users")
+	E.tally.folders = report.Tally("Folders")
+	E.tally.files = report.Tally("Files")
+	E.tally.bytes = report.Tally("Total Size", HumanSize)
+	E.tally.comments = report.Tally("Comments")
+	_, has_tasks := E.Source.(MigrationTaskSource)
+	if has_tasks {
+		E.tally.tasks = report.Tally("Tasks")
+	}
+
+	Log("Generating %s Report...", name)
+
+	reports := make(map[string]*migrationUserReport)
+	var reports_lock sync.Mutex
+
+	wg := NewLimitGroup(10)
+	for _, u := range users {
+		wg.Add(1)
+		go func(user MigrationUser) {
+			defer wg.Done()
+			username := strings.ToLower(user.Email)
+			if IsBlank(username) {
+				return
+			}
+			E.tally.users.Add(1)
+			ur := &migrationUserReport{perms: make(map[string][]migrationReportPerm)}
+			if err := E.reportUser(user, ur); err != nil {
+				Err("[%s]: %v", username, err)
+				return
+			}
+			reports_lock.Lock()
+			reports[username] = ur
+			reports_lock.Unlock()
+		}(u)
+	}
+	wg.Wait()
+
+	var emails []string
+	for email := range reports {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	Log("\n=== %s Content Overview ===\n", name)
+	for _, email := range emails {
+		ur := reports[email]
+		if len(ur.entries) == 0 {
+			continue
+		}
+		root := buildMigrationTree(ur.entries, ur.perms)
+		root.tally()
+		Log("[%s]:", email)
+		root.print("")
+		Log("")
+	}
+
+	if outcomes := E.groupOutcomes(); len(outcomes) > 0 {
+		Log("=== %s Groups ===\n", name)
+		for _, line := range outcomes {
+			Log("%s", line)
+		}
+		Log("")
+	}
+	return nil
+}
+
+// reportUser walks a single user's source content into ur.
+func (E *MigrationEngine) reportUser(user MigrationUser, ur *migrationUserReport) error {
+	username := strings.ToLower(user.Email)
+	_, has_tasks := E.Source.(MigrationTaskSource)
+
+	folder_fn := func(folder *SyncFolder) error {
+		E.tally.folders.Add(1)
+		Log("[%s]: Folder - %s", username, folder.FullPath)
+
+		members, err := E.resolveMembers(user, *folder)
+		if err != nil {
+			Err("[%s]: Error reading members of %s: %v", username, folder.FullPath, err)
+		}
+		var perms []migrationReportPerm
+		for _, m := range members {
+			email := strings.ToLower(m.User)
+			if IsBlank(email) && !IsBlank(m.GroupID) {
+				email = "group " + m.Group
+			}
+			if IsBlank(email) || email == username {
+				continue
+			}
+			role := m.Role
+			if m.RoleID > 0 && IsBlank(role) {
+				role = E.roleLabel(m.RoleID)
+			}
+			if IsBlank(role) {
+				role = "No Access"
+			}
+			perms = append(perms, migrationReportPerm{Email: email, Role: role})
+		}
+
+		ur.lock.Lock()
+		defer ur.lock.Unlock()
+		ur.entries = append(ur.entries, migrationReportEntry{Path: folder.FullPath})
+		if len(perms) > 0 {
+			ur.perms[strings.Trim(folder.FullPath, "/")] = perms
+		}
+		return nil
+	}
+
+	file_fn := func(folder *SyncFolder, file *SyncFile) error {
+		size := file.Size
+		versions, err := E.Source.Versions(user, *file)
+		if err != nil {
+			return err
+		}
+		if len(versions) > 0 && versions[len(versions)-1].Size != UnknownSize {
+			size = versions[len(versions)-1].Size
+		}
+		E.tally.files.Add(1)
+		E.tally.bytes.Add64(size)
+		Log("[%s]: File - %s/%s (%s)", username, folder.FullPath, file.Name, HumanSize(size))
+
+		ur.lock.Lock()
+		ur.entries = append(ur.entries, migrationReportEntry{Path: folder.FullPath + "/" + file.Name, IsFile: true, Size: size})
+		ur.lock.Unlock()
+
+		if comments, err := E.Source.Comments(user, *file); err == nil {
+			E.tally.comments.Add(len(comments))
+		}
+		if has_tasks {
+			if tasks, err := E.Source.(MigrationTaskSource).Tasks(user, *file); err == nil {
+				E.tally.tasks.Add(len(tasks))
+			}
+		}
+		return nil
+	}
+
+	return E.Walk(user, folder_fn, file_fn)
+}
+
+// buildMigrationTree builds the tree view from a user's report entries,
+// attaching members to their shared folders.
+func buildMigrationTree(entries []migrationReportEntry, perms map[string][]migrationReportPerm) *migrationTreeNode {
+	root := &migrationTreeNode{}
+	nodes := make(map[string]*migrationTreeNode)
+	for _, e := range entries {
+		parts := strings.Split(strings.Trim(e.Path, "/"), "/")
+		current := root
+		for i, part := range parts {
+			key := strings.Join(parts[:i+1], "/")
+			child, ok := nodes[key]
+			if !ok {
+				child = &migrationTreeNode{name: part}
+				if i == len(parts)-1 && e.IsFile {
+					child.isFile = true
+					child.size = e.Size
+				}
+				nodes[key] = child
+				current.children = append(current.children, child)
+			}
+			current = child
+		}
+	}
+
+	for path, p := range perms {
+		if n, ok := nodes[path]; ok {
+			n.isShared = true
+			n.perms = append([]migrationReportPerm(nil), p...)
+			sort.Slice(n.perms, func(i, j int) bool {
+				return n.perms[i].Email < n.perms[j].Email
+			})
+		}
+	}
+
+	root.sort()
+	return root
+}
+
+// sort orders the tree's children: folders first, then alphabetically.
+func (node *migrationTreeNode) sort() {
+	sort.Slice(node.children, func(i, j int) bool {
+		if node.children[i].isFile != node.children[j].isFile {
+			return !node.children[i].isFile
+		}
+		return node.children[i].name < node.children[j].name
+	})
+	for _, c := range node.children {
+		c.sort()
+	}
+}
+
+// tally sums sizes, file, folder and member counts for each folder in the tree.
+func (node *migrationTreeNode) tally() (size int64, files, folders, users int) {
+	if node.isFile {
+		return node.size, 1, 0, 0
+	}
+	users = len(node.perms)
+	for _, c := range node.children {
+		s, f, d, u := c.tally()
+		size += s
+		files += f
+		folders += d
+		users += u
+		if !c.isFile {
+			folders++
+		}
+	}
+	node.size = size
+	node.fileCount = files
+	node.folderCount = folders
+	node.userCount = users
+	return
+}
+
+// print logs the tree using box-drawing characters.
+func (node *migrationTreeNode) print(prefix string) {
+	for i, child := range node.children {
+		last := i == len(node.children)-1
+		connector := "├── "
+		child_prefix := prefix + "│   "
+		if last {
+			connector = "└── "
+			child_prefix = prefix + "    "
+		}
+		if child.isFile {
+			Log("%s%s[F] %s (%s)", prefix, connector, child.name, HumanSize(child.size))
+			continue
+		}
+		tag := "[D]"
+		if child.isShared {
+			tag = "[S]"
+		}
+		Log("%s%s%s %s (%d folders, %d files, %d users, %s)", prefix, connector, tag, child.name, child.folderCount, child.fileCount, child.userCount, HumanSize(child.size))
+		for j, p := range child.perms {
+			perm_connector := "├── "
+			if j == len(child.perms)-1 && len(child.children) == 0 {
+				perm_connector = "└── "
+			}
+			Log("%s%s[U] %s (%s)", child_prefix, perm_connector, p.Email, p.Role)
+		}
+		child.print(child_prefix)
+	}
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// migrationRoleCatalog holds the destination's folder roles, read once.
+type migrationRoleCatalog struct {
+	once  sync.Once
+	ids   map[string]int // Role ids by lower-case name.
+	names map[int]string // Role names by id.
+	err   error
+}
+
+// loadRoles reads the destination's folder roles, the first time it is called.
+func (E *MigrationEngine) loadRoles() error {
+	E.roles.once.Do(func() {
+		roles, err := E.task.KW.FolderRoles()
+		if err != nil {
+			E.roles.err = fmt.Errorf("Error reading Kiteworks folder roles: %v", err)
+			Err("%v", E.roles.err)
+			return
+		}
+		E.roles.ids = make(map[string]int)
+		E.roles.names = make(map[int]string)
+		for _, r := range roles {
+			E.roles.ids[strings.ToLower(r.Name)] = r.ID
+			E.roles.names[r.ID] = r.Name
+		}
+	})
+	return E.roles.err
+}
+
+// roleID returns the id of the destination role called name.
+func (E *MigrationEngine) roleID(name string) (int, bool) {
+	if E.loadRoles() != nil {
+		return 0, false
+	}
+	id, ok := E.roles.ids[strings.ToLower(name)]
+	return id, ok
+}
+
+// roleName returns the name of a destination role id.
+func (E *MigrationEngine) roleName(id int) (string, bool) {
+	if E.loadRoles() != nil {
+		return NONE, false
+	}
+	name, ok := E.roles.names[id]
+	return name, ok
+}
+
+// roleLabel names a destination role id for display.
+func (E *MigrationEngine) roleLabel(id int) string {
+	if name, ok := E.roleName(id); ok {
+		return name
+	}
+	return fmt.Sprintf("role %d", id)
+}
+
+// preflightRoles returns a blocking finding for each role the mapping or the
+// source grants that the destination does not have.
+func (E *MigrationEngine) preflightRoles() (findings []MigrationFinding, err error) {
+	if err := E.loadRoles(); err != nil {
+		return nil, err
+	}
+	var available []string
+	for _, name := range E.roles.names {
+		available = append(available, name)
+	}
+	sort.Strings(available)
+
+	// Roles granted, with who grants them.
+	granted := make(map[string]string)
+	for _, name := range E.Mapping.RoleNames() {
+		granted[name] = "The mapping"
+	}
+	if src, ok := E.Source.(MigrationRoleSource); ok {
+		for _, name := range src.RoleNames() {
+			// The mapping's roles table may rename the source's roles.
+			name = strings.ToLower(E.Mapping.Role(name))
+			if _, ok := granted[name]; !ok && !IsBlank(name) {
+				granted[name] = E.Source.Name()
+			}
+		}
+	}
+	var names []string
+	for name := range granted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := E.roles.ids[name]; ok {
+			continue
+		}
+		findings = append(findings, MigrationFinding{
+			Severity: PreflightBlocking,
+			Check:    "role",
+			Detail:   fmt.Sprintf("%s grants role %q, which Kiteworks does not have; available roles: %s.", granted[name], name, strings.Join(available, ", ")),
+		})
+	}
+	return findings, nil
+}
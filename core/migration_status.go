@@ -0,0 +1,249 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// Migration states of a source user, as recorded for --status.
+const (
+	MigrationPending    = "pending"
+	MigrationInProgress = "in progress"
+	MigrationDone       = "done"
+	MigrationFailed     = "failed"
+)
+
+// MigrationUserStatus is the recorded progress of a source user's migration.
+// Counts accumulate across runs.
+type MigrationUserStatus struct {
+	Email    string    `json:"email"`
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"` // Why the user failed.
+	Folders  int64     `json:"folders"`
+	Files    int64     `json:"files"` // Files transferred.
+	Bytes    int64     `json:"bytes"` // Bytes transferred.
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// migrationThroughput is what all runs transferred, and the time they took.
+type migrationThroughput struct {
+	Bytes   int64         `json:"bytes"`
+	Files   int64         `json:"files"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// migrationProgress counts a user's progress not yet saved to its status.
+type migrationProgress struct {
+	folders int64
+	files   int64
+	bytes   int64
+}
+
+// statusTable holds the users' MigrationUserStatus, by lower-case email.
+func statusTable(db Database) Table {
+	return db.Table("migration_status")
+}
+
+// progress returns the unsaved progress counters of a user.
+func (E *MigrationEngine) progress(email string) *migrationProgress {
+	p, _ := E.user_progress.LoadOrStore(strings.ToLower(email), new(migrationProgress))
+	return p.(*migrationProgress)
+}
+
+// updateStatus applies fn to a user's recorded status, saving the progress
+// counted since it was last updated.
+func (E *MigrationEngine) updateStatus(email string, fn func(s *MigrationUserStatus)) {
+	email = strings.ToLower(email)
+	if IsBlank(email) {
+		return
+	}
+	E.status_mu.Lock()
+	defer E.status_mu.Unlock()
+	var s MigrationUserStatus
+	if !E.status.Get(email, &s) {
+		s = MigrationUserStatus{Email: email, State: MigrationPending}
+	}
+	p := E.progress(email)
+	s.Folders += atomic.SwapInt64(&p.folders, 0)
+	s.Files += atomic.SwapInt64(&p.files, 0)
+	s.Bytes += atomic.SwapInt64(&p.bytes, 0)
+	if fn != nil {
+		fn(&s)
+	}
+	E.status.Set(email, &s)
+}
+
+// StartUser records that a user's migration has begun.
+func (E *MigrationEngine) StartUser(email string) {
+	E.updateStatus(email, func(s *MigrationUserStatus) {
+		s.State = MigrationInProgress
+		s.Reason = NONE
+		s.Started = time.Now().UTC()
+		s.Finished = time.Time{}
+	})
+}
+
+// FinishUser records the outcome of a user's migration, failed when err is
+// not nil, and the throughput of the run so far.
+func (E *MigrationEngine) FinishUser(email string, err error) {
+	E.updateStatus(email, func(s *MigrationUserStatus) {
+		s.State = MigrationDone
+		s.Reason = NONE
+		if err != nil {
+			s.State = MigrationFailed
+			s.Reason = err.Error()
+		}
+		s.Finished = time.Now().UTC()
+	})
+	E.saveThroughput()
+}
+
+// FailUser marks a user as failed for reason, so the rest of the migration
+// skips it and a later --retry_failed picks it up again.
+func (E *MigrationEngine) FailUser(email, reason string) {
+	E.failed_mu.Lock()
+	E.failed[strings.ToLower(email)] = struct{}{}
+	E.failed_mu.Unlock()
+	E.updateStatus(email, func(s *MigrationUserStatus) {
+		s.State = MigrationFailed
+		s.Reason = reason
+		s.Finished = time.Now().UTC()
+	})
+}
+
+// LastFailed reports whether a user's last recorded migration failed.
+func (E *MigrationEngine) LastFailed(email string) bool {
+	var s MigrationUserStatus
+	return E.status.Get(strings.ToLower(email), &s) && s.State == MigrationFailed
+}
+
+// retryUsers returns the users whose last recorded migration failed.
+func (E *MigrationEngine) retryUsers(users []MigrationUser) (retry []MigrationUser) {
+	for _, u := range users {
+		if E.LastFailed(u.Email) {
+			retry = append(retry, u)
+		}
+	}
+	return
+}
+
+// saveThroughput adds what the current run has transferred, and its time, to
+// the totals of earlier runs.
+func (E *MigrationEngine) saveThroughput() {
+	if E.run_started.IsZero() {
+		return
+	}
+	E.status_mu.Lock()
+	defer E.status_mu.Unlock()
+	E.tally_reg.Do(E.registerTallies)
+	run := migrationThroughput{
+		Bytes:   E.tally.bytes.Value(),
+		Files:   E.tally.transferred.Value(),
+		Elapsed: time.Since(E.run_started),
+	}
+	E.db.Table("migration_throughput").Set(E.run_id, &run)
+}
+
+// RunStatus prints the recorded state of each selected source user, with the
+// throughput of the runs so far and an estimate of the time remaining.
+// Nothing is migrated.
+func (E *MigrationEngine) RunStatus() error {
+	name := E.Source.Name()
+
+	statuses := make(map[string]MigrationUserStatus)
+	for _, k := range E.status.Keys() {
+		var s MigrationUserStatus
+		if E.status.Get(k, &s) {
+			statuses[k] = s
+		}
+	}
+	if users, err := E.SourceUsers(); err != nil {
+		Err("Error reading %s users, showing recorded users only: %v", name, err)
+	} else {
+		for _, u := range users {
+			email := strings.ToLower(u.Email)
+			if _, ok := statuses[email]; !ok && !IsBlank(email) {
+				statuses[email] = MigrationUserStatus{Email: email, State: MigrationPending}
+			}
+		}
+	}
+	if len(E.Users) > 0 {
+		selected := make(map[string]MigrationUserStatus)
+		for _, e := range E.Users {
+			if s, ok := statuses[strings.ToLower(e)]; ok {
+				selected[s.Email] = s
+			}
+		}
+		statuses = selected
+	}
+
+	emails := make([]string, 0, len(statuses))
+	for email := range statuses {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	var buffer bytes.Buffer
+	text := tabwriter.NewWriter(&buffer, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(text, "User\tState\tFolders\tFiles\tSize\tTime\t\n")
+	counts := make(map[string]int)
+	for _, email := range emails {
+		s := statuses[email]
+		counts[s.State]++
+		var elapsed string
+		switch {
+		case s.Started.IsZero():
+		case s.Finished.IsZero():
+			elapsed = fmt.Sprintf("since %s", s.Started.Local().Format("2006-01-02 15:04"))
+		default:
+			elapsed = s.Finished.Sub(s.Started).Round(time.Second).String()
+		}
+		state := s.State
+		if s.State == MigrationFailed && !IsBlank(s.Reason) {
+			state = fmt.Sprintf("%s: %s", s.State, s.Reason)
+		}
+		fmt.Fprintf(text, "%s\t%s\t%d\t%d\t%s\t%s\t\n", s.Email, state, s.Folders, s.Files, HumanSize(s.Bytes), elapsed)
+	}
+	text.Flush()
+
+	var total migrationThroughput
+	runs := E.db.Table("migration_throughput")
+	for _, k := range runs.Keys() {
+		var run migrationThroughput
+		if runs.Get(k, &run) {
+			total.Bytes += run.Bytes
+			total.Files += run.Files
+			total.Elapsed += run.Elapsed
+		}
+	}
+
+	Log("=== %s Migration Status ===\n", name)
+	Log("%s", strings.TrimRight(buffer.String(), "\n"))
+	Log("\nUsers: %d done, %d in progress, %d pending, %d failed.", counts[MigrationDone], counts[MigrationInProgress], counts[MigrationPending], counts[MigrationFailed])
+	if total.Elapsed < time.Second {
+		Log("Throughput: no transfers recorded yet.")
+		return nil
+	}
+	seconds := total.Elapsed.Seconds()
+	Log("Throughput: %s in %d file(s) over %s, %s/s.", HumanSize(total.Bytes), total.Files, total.Elapsed.Round(time.Second), HumanSize(int64(float64(total.Bytes)/seconds)))
+	remaining := counts[MigrationPending] + counts[MigrationInProgress]
+	switch {
+	case remaining == 0:
+		Log("ETA: no users remaining.")
+	case counts[MigrationDone] == 0:
+		Log("ETA: unknown until a user completes.")
+	default:
+		per_user := time.Duration(float64(total.Elapsed) / float64(counts[MigrationDone]))
+		Log("ETA: about %s for %d remaining user(s), at %s per user.", (per_user * time.Duration(remaining)).Round(time.Minute), remaining, per_user.Round(time.Second))
+	}
+	if counts[MigrationFailed] > 0 {
+		Log("Re-run the %d failed user(s) with --retry_failed.", counts[MigrationFailed])
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verification finding severities. A mismatch is something the migration did
+// not copy as it is on the source, and is re-queued by RunVerify; a warning is
+// a difference that another migration run would not change.
+const (
+	VerifyMismatch = "mismatch"
+	VerifyWarning  = "warning"
+)
+
+// verifyDest is a source folder and the contents of its destination copy.
+type verifyDest struct {
+	folder    SyncFolder
+	dest      *KiteObject // nil when the folder is missing on the destination.
+	files     []KiteObject
+	matched   map[string]struct{} // Destination files matched to a source file.
+	src_files int
+	once      sync.Once
+	lock      sync.Mutex
+}
+
+// verifyRun is the state of a single user's verification.
+type verifyRun struct {
+	*MigrationEngine
+	*migrationPreflightUser
+	user    MigrationUser
+	sess    KWSession
+	requeue bool
+	folders map[string]*verifyDest
+	lock    sync.Mutex
+	tally   struct {
+		folders  Tally
+		files    Tally
+		requeued Tally
+	}
+}
+
+// RunVerify walks the selected source users alongside their Kiteworks copies,
+// found through the resume state of earlier migrations, and compares folder
+// trees, file counts, sizes, modified times, fingerprints where the source has
+// them, and folder members. Discrepancies are written to output, as JSON when
+// it ends in .json and CSV otherwise. With requeue, the resume state of every
+// mismatched folder and file is reset, so the next migration copies them
+// again; destination files that differ from the source get a new version.
+func (E *MigrationEngine) RunVerify(output string, requeue bool) (err error) {
+	users, err := E.SourceUsers()
+	if err != nil {
+		return err
+	}
+	name := E.Source.Name()
+
+	report := E.task.Report
+	users_verified := report.Tally("Users Verified")
+	folders := report.Tally("Folders Verified")
+	files := report.Tally("Files Verified")
+	mismatches := report.Tally("Mismatches")
+	warnings := report.Tally("Warnings")
+	var requeued Tally
+	if requeue {
+		requeued = report.Tally("Re-queued")
+	}
+
+	Log("Verifying %s Migration...", name)
+
+	var (
+		results []*migrationPreflightUser
+		lock    sync.Mutex
+	)
+
+	wg := NewLimitGroup(10)
+	for _, u := range users {
+		wg.Add(1)
+		go func(user MigrationUser) {
+			defer wg.Done()
+			if IsBlank(user.Email) {
+				return
+			}
+			username := E.destUser(strings.ToLower(user.Email))
+			R := &verifyRun{
+				MigrationEngine:        E,
+				migrationPreflightUser: &migrationPreflightUser{username: username},
+				user:                   user,
+				sess:                   E.task.KW.Session(username),
+				requeue:                requeue,
+				folders:                make(map[string]*verifyDest),
+			}
+			R.tally.folders = folders
+			R.tally.files = files
+			R.tally.requeued = requeued
+			if err := R.verifyUser(); err != nil {
+				R.add(VerifyMismatch, "user", NONE, "%v", err)
+			}
+			users_verified.Add(1)
+			lock.Lock()
+			results = append(results, R.migrationPreflightUser)
+			lock.Unlock()
+		}(u)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].username < results[j].username })
+
+	var findings []MigrationFinding
+	Log("\n=== %s Verification ===\n", name)
+	for _, p := range results {
+		sort.SliceStable(p.findings, func(i, j int) bool { return p.findings[i].Path < p.findings[j].Path })
+		var m, w int
+		for _, f := range p.findings {
+			if f.Severity == VerifyMismatch {
+				m++
+			} else {
+				w++
+			}
+		}
+		mismatches.Add(m)
+		warnings.Add(w)
+		if m+w == 0 {
+			Log("[%s]: OK", p.username)
+			continue
+		}
+		Log("[%s]: %d mismatch(es), %d warning(s)", p.username, m, w)
+		findings = append(findings, p.findings...)
+	}
+
+	if err := writeMigrationFindings(output, findings); err != nil {
+		return err
+	}
+	Log("\nVerification report written to %s.", output)
+
+	if mismatches.Value() > 0 {
+		if requeue {
+			Log("Re-queued %d item(s), run --migrate to copy them again.", requeued.Value())
+		}
+		return fmt.Errorf("verification found %d mismatch(es), see %s", mismatches.Value(), output)
+	}
+	return nil
+}
+
+// verifyUser compares a user's source folders and files to the destination.
+func (R *verifyRun) verifyUser() error {
+	kw_user, err := R.task.KW.Admin().FindUser(R.username)
+	if err != nil {
+		if err == ERR_NO_USER_FOUND {
+			return fmt.Errorf("%s does not exist on Kiteworks", R.username)
+		}
+		return fmt.Errorf("Error finding %s on Kiteworks: %v", R.username, err)
+	}
+	if kw_user.Deleted {
+		return fmt.Errorf("%s is deleted on Kiteworks", R.username)
+	}
+
+	if err := R.Walk(R.user, R.verifyFolder, R.verifyFile); err != nil {
+		return err
+	}
+
+	for _, f := range R.folders {
+		if f.dest == nil {
+			continue
+		}
+		for _, v := range f.files {
+			if _, ok := f.matched[v.ID]; !ok {
+				R.add(VerifyWarning, "extra_file", strings.Trim(f.folder.FullPath+"/"+v.Name, "/"), "File is on the destination but not on the source.")
+			}
+		}
+		if len(f.files) != f.src_files {
+			R.add(VerifyWarning, "file_count", strings.Trim(f.folder.FullPath, "/"), "Source has %d file(s), destination has %d.", f.src_files, len(f.files))
+		}
+	}
+	return nil
+}
+
+// stateKey is the resume state key for a source object of the user.
+func (R *verifyRun) stateKey(src_id string) string {
+	return fmt.Sprintf("%s:%s", R.username, src_id)
+}
+
+// destFolder returns the source folder's entry, finding its destination copy
+// and listing its files the first time it is asked for.
+func (R *verifyRun) destFolder(folder *SyncFolder) *verifyDest {
+	R.lock.Lock()
+	f, ok := R.folders[folder.SrcID]
+	if !ok {
+		f = &verifyDest{folder: *folder, matched: make(map[string]struct{})}
+		R.folders[folder.SrcID] = f
+	}
+	R.lock.Unlock()
+
+	f.once.Do(func() {
+		f.dest = R.findFolder(folder)
+		if f.dest == nil {
+			return
+		}
+		files, err := R.sess.Folder(f.dest.ID).Files()
+		if err != nil {
+			Err("[%s]: %s: %v", R.username, folder.FullPath, err)
+			return
+		}
+		f.files = files
+	})
+	return f
+}
+
+// findFolder returns the destination copy of a source folder: the folder
+// recorded in the resume state when it is still there, otherwise the folder
+// at the source folder's path. It returns nil when neither is found.
+func (R *verifyRun) findFolder(folder *SyncFolder) *KiteObject {
+	var state SyncFolder
+	if R.MigrationEngine.folders.Get(R.stateKey(folder.SrcID), &state) && !IsBlank(state.DestID) {
+		if dest, err := R.sess.Folder(state.DestID).Info(); err == nil && !dest.Deleted {
+			return &dest
+		}
+	}
+	path := FilterInvalidChars(strings.Trim(R.DestPath(folder.FullPath), "/"))
+	if IsBlank(path) {
+		return nil
+	}
+	dest, err := R.sess.Folder("0").Find(path)
+	if err != nil {
+		if err != ErrNotFound {
+			Err("[%s]: %s: %v", R.username, folder.FullPath, err)
+		}
+		return nil
+	}
+	return &dest
+}
+
+// verifyFolder checks that a source folder is on the destination, with the
+// same members.
+func (R *verifyRun) verifyFolder(folder *SyncFolder) error {
+	R.tally.folders.Add(1)
+	src_path := strings.Trim(folder.FullPath, "/")
+
+	f := R.destFolder(folder)
+	if f.dest == nil {
+		R.add(VerifyMismatch, "missing_folder", src_path, "Folder is not on the destination.")
+		R.requeueFolder(folder)
+		return nil
+	}
+
+	members, err := R.resolveMembers(R.user, *folder)
+	if err != nil {
+		R.add(VerifyWarning, "source", src_path, "Error reading source members: %v", err)
+		return nil
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	existing, err := R.sess.Folder(f.dest.ID).Members()
+	if err != nil {
+		R.add(VerifyWarning, "members", src_path, "Error reading destination members: %v", err)
+		return nil
+	}
+	dest_roles := make(map[string]int)
+	for _, m := range existing {
+		dest_roles[strings.ToLower(m.User.Email)] = m.RoleID
+	}
+
+	var mismatched bool
+	for _, m := range R.DestMembers(members) {
+		email := strings.ToLower(m.User)
+		if IsBlank(email) || email == R.username {
+			continue
+		}
+		role_id := m.RoleID
+		if role_id == 0 && !IsBlank(m.Role) {
+			var ok bool
+			if role_id, ok = R.roleID(m.Role); !ok {
+				continue
+			}
+		}
+		dest_role, found := dest_roles[email]
+		if role_id == 0 {
+			if found {
+				R.add(VerifyMismatch, "member_extra", src_path, "%s has no access on the source, but is %s on the destination.", email, R.roleLabel(dest_role))
+				mismatched = true
+			}
+			continue
+		}
+		switch {
+		case !found:
+			R.add(VerifyMismatch, "member_missing", src_path, "%s is %s on the source, but not a member on the destination.", email, R.roleLabel(role_id))
+			mismatched = true
+		case dest_role != role_id:
+			R.add(VerifyMismatch, "member_role", src_path, "%s is %s on the source, but %s on the destination.", email, R.roleLabel(role_id), R.roleLabel(dest_role))
+			mismatched = true
+		}
+	}
+	if mismatched {
+		R.requeueFolder(folder)
+	}
+	return nil
+}
+
+// verifyFile checks that a source file is on the destination, and that its
+// size, modified time and fingerprint match.
+func (R *verifyRun) verifyFile(folder *SyncFolder, file *SyncFile) error {
+	R.tally.files.Add(1)
+	src_path := strings.Trim(folder.FullPath+"/"+file.Name, "/")
+
+	f := R.destFolder(folder)
+	f.lock.Lock()
+	f.src_files++
+	f.lock.Unlock()
+
+	var state SyncFile
+	R.files.Get(R.stateKey(file.SrcID), &state)
+
+	var dest *KiteObject
+	name := FilterInvalidChars(file.Name)
+	for i, v := range f.files {
+		if (!IsBlank(state.DestID) && v.ID == state.DestID) || (dest == nil && v.Name == name) {
+			dest = &f.files[i]
+		}
+	}
+	if dest == nil {
+		R.add(VerifyMismatch, "missing_file", src_path, "File is not on the destination.")
+		R.requeueFile(src_path, file, nil)
+		return nil
+	}
+	f.lock.Lock()
+	f.matched[dest.ID] = struct{}{}
+	f.lock.Unlock()
+
+	var mismatched bool
+	if dest.Size != file.Size {
+		R.add(VerifyMismatch, "size", src_path, "Source is %d bytes, destination is %d bytes.", file.Size, dest.Size)
+		mismatched = true
+	}
+	if !IsBlank(file.Fingerprint) && !IsBlank(dest.Fingerprint) && !strings.EqualFold(file.Fingerprint, dest.Fingerprint) {
+		R.add(VerifyMismatch, "fingerprint", src_path, "Source fingerprint %s, destination fingerprint %s.", file.Fingerprint, dest.Fingerprint)
+		mismatched = true
+	}
+	if modified, err := ReadKWTime(dest.ClientModified); err == nil && !file.Modified.IsZero() && modified.Unix() != file.Modified.Unix() {
+		R.add(VerifyWarning, "modified", src_path, "Source modified %s, destination modified %s.", file.Modified.UTC().Format("2006-01-02 15:04:05"), modified.UTC().Format("2006-01-02 15:04:05"))
+	}
+	if mismatched {
+		R.requeueFile(src_path, file, dest)
+	}
+	return nil
+}
+
+// requeueFolder drops the resume state of a mismatched folder.
+func (R *verifyRun) requeueFolder(folder *SyncFolder) {
+	if !R.requeue {
+		return
+	}
+	R.MigrationEngine.folders.Unset(R.stateKey(folder.SrcID))
+	R.tally.requeued.Add(1)
+}
+
+// requeueFile resets the resume state of a mismatched file. A file missing
+// from the destination is copied again; one with a differing destination
+// copy, dest, gets its current content uploaded as a new version on top.
+func (R *verifyRun) requeueFile(src_path string, file *SyncFile, dest *KiteObject) {
+	if !R.requeue {
+		return
+	}
+	key := R.stateKey(file.SrcID)
+	var state SyncFile
+	if dest == nil || !R.files.Get(key, &state) {
+		R.files.Unset(key)
+	} else {
+		Log("[%s]: Queueing a new version of %s.", R.username, src_path)
+		state.DestID = dest.ID
+		state.SyncedVersionID = ""
+		state.Modified = time.Time{}
+		R.files.Set(key, &state)
+	}
+	R.tally.requeued.Add(1)
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"time"
+)
+
+// Webhook delivery credentials are stored encrypted in the "kitebroker" table
+// of the global database. During a rotation the credentials being replaced are
+// kept alongside the new ones until the rotation window closes, so deliveries
+// signed before the appliance picked up the new secret are still accepted.
+
+// WebhookCredentials holds the listener's current and, during a rotation
+// window, previous delivery credentials.
+type WebhookCredentials struct {
+	Secret     string    // Current signing secret.
+	Token      string    // Current delivery token.
+	PrevSecret string    // Secret replaced by the last rotation.
+	PrevToken  string    // Token replaced by the last rotation.
+	PrevUntil  time.Time // End of the rotation window; the previous values are ignored after it.
+}
+
+// InRotation reports whether the previous credentials are still accepted.
+func (c WebhookCredentials) InRotation() bool {
+	return time.Now().Before(c.PrevUntil)
+}
+
+// LoadWebhookCredentials reads the stored webhook credentials.
+func LoadWebhookCredentials() (c WebhookCredentials) {
+	if globalDB == nil {
+		return
+	}
+	globalDB.Get("kitebroker", "webhook_secret", &c.Secret)
+	globalDB.Get("kitebroker", "webhook_token", &c.Token)
+	globalDB.Get("kitebroker", "webhook_secret_prev", &c.PrevSecret)
+	globalDB.Get("kitebroker", "webhook_token_prev", &c.PrevToken)
+	var until string
+	if globalDB.Get("kitebroker", "webhook_rotation_until", &until) {
+		if t, err := time.Parse(time.RFC3339, until); err == nil {
+			c.PrevUntil = t
+		}
+	}
+	return
+}
+
+// SaveWebhookCredentials stores c as the webhook credentials, and applies them
+// to the listener when it is running in this process.
+func SaveWebhookCredentials(c WebhookCredentials) {
+	if globalDB == nil {
+		return
+	}
+	for key, val := range map[string]string{
+		"webhook_secret":      c.Secret,
+		"webhook_token":       c.Token,
+		"webhook_secret_prev": c.PrevSecret,
+		"webhook_token_prev":  c.PrevToken,
+	} {
+		if IsBlank(val) {
+			globalDB.Unset("kitebroker", key)
+		} else {
+			globalDB.CryptSet("kitebroker", key, &val)
+		}
+	}
+	if c.PrevUntil.IsZero() {
+		globalDB.Unset("kitebroker", "webhook_rotation_until")
+	} else {
+		globalDB.Set("kitebroker", "webhook_rotation_until", c.PrevUntil.UTC().Format(time.RFC3339))
+	}
+	listener.reload()
+}
+
+// RotateWebhookCredentials stores secret and token as the current webhook
+// credentials, keeping the ones they replace valid for grace. A blank token
+// leaves the current token in place. The replaced credentials are returned so
+// a failed rotation can be reverted with SaveWebhookCredentials.
+func RotateWebhookCredentials(secret, token string, grace time.Duration) (prev WebhookCredentials) {
+	prev = LoadWebhookCredentials()
+	if IsBlank(token) {
+		token = prev.Token
+	}
+	SaveWebhookCredentials(WebhookCredentials{
+		Secret:     secret,
+		Token:      token,
+		PrevSecret: prev.Secret,
+		PrevToken:  prev.Token,
+		PrevUntil:  time.Now().Add(grace),
+	})
+	return
+}
+
+// ReloadWebhookListener re-reads the stored webhook credentials and the TLS
+// certificate and key of a running listener. It is also triggered by SIGHUP,
+// and the listener checks for changes every WebhookReloadInterval.
+func ReloadWebhookListener() {
+	listener.reload()
+}
@@ -84,10 +84,12 @@ func RegisteredWebhookTasks() []WebhookTask {
 	return registeredWebhookTks
 }
 
-// webhookRegistration pairs a subject pattern with its handler.
+// webhookRegistration pairs a subject pattern with its handler, and the name
+// of the webhook task hosting it, if any.
 type webhookRegistration struct {
 	pattern string
 	handler WebhookHandler
+	task    string
 }
 
 var (
@@ -102,7 +104,15 @@ var (
 func RegisterWebhookHandler(subjectPattern string, handler WebhookHandler) {
 	webhookRegMu.Lock()
 	defer webhookRegMu.Unlock()
-	webhookHandlers = append(webhookHandlers, webhookRegistration{subjectPattern, handler})
+	webhookHandlers = append(webhookHandlers, webhookRegistration{pattern: subjectPattern, handler: handler})
+}
+
+// registerTaskHandler registers handler for subjectPattern on behalf of the
+// named webhook task.
+func registerTaskHandler(task, subjectPattern string, handler WebhookHandler) {
+	webhookRegMu.Lock()
+	defer webhookRegMu.Unlock()
+	webhookHandlers = append(webhookHandlers, webhookRegistration{pattern: subjectPattern, handler: handler, task: task})
 }
 
 // SubjectMatch reports whether subject matches pattern using NATS subject
@@ -153,6 +163,13 @@ func DispatchWebhookEvent(event WebhookEvent, kw KWSession) (matched int, errs [
 	copy(regs, webhookHandlers)
 	webhookRegMu.RUnlock()
 
+	return dispatchWebhookEvent(regs, event, kw)
+}
+
+// dispatchWebhookEvent runs each registration in regs whose pattern matches the
+// event's subject. It backs DispatchWebhookEvent and the activity poller, which
+// dispatches to a single task's registration.
+func dispatchWebhookEvent(regs []webhookRegistration, event WebhookEvent, kw KWSession) (matched int, errs []error) {
 	for _, reg := range regs {
 		if !SubjectMatch(reg.pattern, event.Subject) {
 			continue
@@ -164,3 +181,19 @@ func DispatchWebhookEvent(event WebhookEvent, kw KWSession) (matched int, errs [
 	}
 	return
 }
+
+// webhookHandlerNames describes each registered handler, in registration
+// order: the webhook task hosting it, or its subject pattern when it was
+// registered directly.
+func webhookHandlerNames() (names []string) {
+	webhookRegMu.RLock()
+	defer webhookRegMu.RUnlock()
+	for _, reg := range webhookHandlers {
+		if IsBlank(reg.task) {
+			names = append(names, reg.pattern)
+		} else {
+			names = append(names, reg.task)
+		}
+	}
+	return
+}
@@ -24,6 +24,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -38,37 +39,48 @@ const maxDeliveryBytes = 8 << 20 // 8 MB
 // how to authenticate deliveries) and are configured once via --setup, not
 // per webhook task.
 type WebhookListenerConfig struct {
-	Enabled      bool   // Whether webhook delivery is enabled; when false, tasks fall back to polling.
-	Scheme       string // "https" (default) or "http"; http is for use behind a TLS-terminating proxy.
-	Bind         string // Address and port to listen on, e.g. "0.0.0.0:8080".
-	Path         string // URL path that receives deliveries, e.g. "/webhook".
-	Secret       string // Shared secret for HMAC-SHA256 signature verification.
-	Token        string // Shared token expected on each delivery.
-	SigHeader    string // Header carrying the HMAC signature.
-	TokenHeader  string // Header carrying the shared token.
-	Workers      int    // Max deliveries handled concurrently.
-	TLSCert      string // TLS certificate file (optional).
-	TLSKey       string // TLS private key file (optional).
-	SelfRegister bool   // Register/unregister with the appliance automatically.
-	PublicURL    string // Public URL the appliance should deliver to.
+	Enabled      bool      // Whether webhook delivery is enabled; when false, tasks fall back to polling.
+	Scheme       string    // "https" (default) or "http"; http is for use behind a TLS-terminating proxy.
+	Bind         string    // Address and port to listen on, e.g. "0.0.0.0:8080".
+	Path         string    // URL path that receives deliveries, e.g. "/webhook".
+	Secret       string    // Shared secret for HMAC-SHA256 signature verification.
+	Token        string    // Shared token expected on each delivery.
+	PrevSecret   string    // Previous secret, still accepted until PrevUntil.
+	PrevToken    string    // Previous token, still accepted until PrevUntil.
+	PrevUntil    time.Time // End of the secret/token rotation window.
+	SigHeader    string    // Header carrying the HMAC signature.
+	TokenHeader  string    // Header carrying the shared token.
+	Workers      int       // Max deliveries handled concurrently.
+	TLSCert      string    // TLS certificate file (optional).
+	TLSKey       string    // TLS private key file (optional).
+	SelfRegister bool      // Register/unregister with the appliance automatically.
+	PublicURL    string    // Public URL the appliance should deliver to.
+	AdminPath    string    // URL path of the status endpoint, e.g. "/status".
+	AdminToken   string    // Bearer token required by the status endpoint; blank disables it.
 }
 
 // webhookListener is the process-wide singleton that owns the HTTP server and
 // routes deliveries to hosted webhook tasks via the handler registry.
 type webhookListener struct {
-	mu         sync.Mutex
-	cfg        WebhookListenerConfig
-	configured bool
-	started    bool
-	srv        *http.Server
-	done       chan struct{} // closed when the listener has shut down.
-	doneOnce   sync.Once
-	limiter    LimitGroup
+	mu              sync.Mutex
+	cfg             WebhookListenerConfig
+	configured      bool
+	started         bool
+	srv             *http.Server
+	done            chan struct{} // closed when the listener has shut down.
+	doneOnce        sync.Once
+	limiter         LimitGroup
 	subjects        map[string]struct{} // union of hosted tasks' subjects, for self-register
 	selfHookID      string
 	selfHookAdopted bool // true when we reused a pre-existing webhook (do not delete on exit)
 	selfKW          KWSession
-	warnUnauth sync.Once
+	warnUnauth      sync.Once
+
+	// reloadMu guards the credentials in cfg and the TLS certificate, both of
+	// which may be swapped while deliveries are being verified.
+	reloadMu sync.RWMutex
+	cert     *tls.Certificate
+	certMod  time.Time // newest modification time of the loaded cert/key files.
 
 	report     *TaskReport
 	received   Tally
@@ -76,6 +88,14 @@ type webhookListener struct {
 	dispatched Tally
 	unmatched  Tally
 	handlerErr Tally
+
+	// Live state reported by the status endpoint.
+	startedAt time.Time
+	tasks     []string      // names of hosted webhook tasks.
+	queued    int64         // deliveries waiting for a free worker.
+	active    int64         // deliveries being dispatched.
+	recentMu  sync.Mutex    // guards recent.
+	recent    []statusEvent // last recentEventLimit deliveries, oldest first.
 }
 
 var listener = &webhookListener{subjects: make(map[string]struct{}), done: make(chan struct{})}
@@ -117,6 +137,19 @@ func ConfigureWebhookListener(cfg WebhookListenerConfig) error {
 	if cfg.SelfRegister && IsBlank(cfg.PublicURL) {
 		return fmt.Errorf("webhook self_register requires a public_url")
 	}
+	// The status endpoint is only served with an admin token, so its path is
+	// left alone otherwise.
+	if !IsBlank(cfg.AdminToken) {
+		if IsBlank(cfg.AdminPath) {
+			cfg.AdminPath = "/status"
+		}
+		if cfg.AdminPath[0] != '/' {
+			return fmt.Errorf("webhook listener admin_path must begin with '/'")
+		}
+		if cfg.AdminPath == cfg.Path {
+			return fmt.Errorf("webhook listener admin_path must differ from path")
+		}
+	}
 
 	listener.mu.Lock()
 	defer listener.mu.Unlock()
@@ -134,6 +167,14 @@ func WebhookListenerEnabled() bool {
 	return listener.configured && listener.cfg.Enabled
 }
 
+// WebhookListenerPublicURL returns the configured public URL the appliance
+// delivers to, or an empty string when none is configured.
+func WebhookListenerPublicURL() string {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	return listener.cfg.PublicURL
+}
+
 // WebhookListenerStarted reports whether the HTTP listener has actually been
 // started (i.e. a task is being hosted in the background). The menu uses this,
 // after a task's Main returns, to decide whether the task is now listening
@@ -178,8 +219,9 @@ func HostWebhookTask(task WebhookTask, kw KWSession) error {
 	for _, subject := range subjects {
 		listener.subjects[subject] = struct{}{}
 	}
+	listener.tasks = append(listener.tasks, task.Name())
 	t := task
-	RegisterWebhookHandler(SubjectAll, func(ev WebhookEvent, _ KWSession) error {
+	registerTaskHandler(task.Name(), SubjectAll, func(ev WebhookEvent, _ KWSession) error {
 		return t.Handle(ev)
 	})
 	Log("Hosting webhook task %q (subscriptions: %s).", task.Name(), strings.Join(subjects, ", "))
@@ -234,6 +276,10 @@ func (l *webhookListener) start() error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc(l.cfg.Path, l.handleDelivery)
+	if !IsBlank(l.cfg.AdminToken) {
+		mux.HandleFunc(l.cfg.AdminPath, l.handleStatus)
+	}
+	l.startedAt = time.Now()
 	l.srv = &http.Server{
 		Addr:              l.cfg.Bind,
 		Handler:           mux,
@@ -246,6 +292,7 @@ func (l *webhookListener) start() error {
 	// certificate so deliveries are never accepted over plaintext by default.
 	serve_tls := l.cfg.Scheme != "http"
 	cert_file, key_file := l.cfg.TLSCert, l.cfg.TLSKey
+	var watch_cert bool
 	if serve_tls && IsBlank(cert_file) {
 		cert, err := l.selfSignedCert()
 		if err != nil {
@@ -253,7 +300,18 @@ func (l *webhookListener) start() error {
 		}
 		l.srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 		Warn("No TLS certificate configured; using a generated self-signed certificate. Configure tls_cert/tls_key via --setup for a trusted certificate.")
+	} else if serve_tls {
+		// Serve the configured certificate through GetCertificate so it can be
+		// swapped when the files are replaced on disk (or on SIGHUP) without
+		// restarting the listener.
+		if err := l.loadCert(); err != nil {
+			return err
+		}
+		l.srv.TLSConfig = &tls.Config{GetCertificate: l.getCertificate}
+		cert_file, key_file = "", ""
+		watch_cert = true
 	}
+	go l.watchReload(watch_cert)
 
 	// On SIGINT, stop accepting, drain in-flight deliveries, and clean up. The
 	// callback returns false so the signal goroutine does NOT terminate the
@@ -272,11 +330,18 @@ func (l *webhookListener) start() error {
 		return false
 	})
 
+	// On SIGHUP, pick up rotated credentials and certificate files in place.
+	nfo.SignalCallback(syscall.SIGHUP, func() bool {
+		Log("Reload requested; reloading webhook credentials and TLS certificate ...")
+		l.reload()
+		return false
+	})
+
 	go func() {
 		var err error
 		if serve_tls {
-			// cert_file/key_file are empty when serving with the in-memory
-			// self-signed certificate set on TLSConfig above.
+			// cert_file/key_file are empty when serving the certificate set
+			// on TLSConfig above (self-signed, or reloadable from disk).
 			err = l.srv.ListenAndServeTLS(cert_file, key_file)
 		} else {
 			err = l.srv.ListenAndServe()
@@ -294,6 +359,9 @@ func (l *webhookListener) start() error {
 		scheme = "http"
 	}
 	Log("Listening for webhook deliveries on %s://%s%s", scheme, l.cfg.Bind, l.cfg.Path)
+	if !IsBlank(l.cfg.AdminToken) {
+		Log("Listener status available on %s://%s%s", scheme, l.cfg.Bind, l.cfg.AdminPath)
+	}
 	Log("Press Ctrl+C to stop the listener.")
 	return nil
 }
@@ -460,14 +528,19 @@ func (l *webhookListener) handleDelivery(w http.ResponseWriter, r *http.Request)
 
 	ev := bodyToEvent(body, r.Header)
 	l.received.Add(1)
+	l.recordEvent(ev)
 
 	// Acknowledge promptly so the appliance is not blocked on handler work;
 	// dispatch runs asynchronously, bounded by the limiter.
 	w.WriteHeader(http.StatusOK)
 
+	atomic.AddInt64(&l.queued, 1)
 	l.limiter.Add(1)
+	atomic.AddInt64(&l.queued, -1)
+	atomic.AddInt64(&l.active, 1)
 	go func() {
 		defer l.limiter.Done()
+		defer atomic.AddInt64(&l.active, -1)
 		matched, errs := DispatchWebhookEvent(ev, l.selfKW)
 		if matched == 0 {
 			l.unmatched.Add(1)
@@ -482,31 +555,53 @@ func (l *webhookListener) handleDelivery(w http.ResponseWriter, r *http.Request)
 }
 
 // verify checks the delivery against the configured secret and/or token. When
-// neither is configured it accepts all deliveries and warns once.
+// neither is configured it accepts all deliveries and warns once. During a
+// rotation window the previous secret and token are accepted as well.
 func (l *webhookListener) verify(body []byte, hdr http.Header) bool {
-	haveSecret := !IsBlank(l.cfg.Secret)
-	haveToken := !IsBlank(l.cfg.Token)
+	secrets, tokens := l.credentials()
 
-	if !haveSecret && !haveToken {
+	if len(secrets) == 0 && len(tokens) == 0 {
 		l.warnUnauth.Do(func() {
 			Warn("Webhook listener is running unauthenticated; configure a secret and/or token via --setup to verify deliveries.")
 		})
 		return true
 	}
 
-	if haveSecret && !l.verifySignature(body, hdr) {
+	if len(secrets) > 0 && !l.verifySignature(body, hdr, secrets) {
 		return false
 	}
-	if haveToken && !l.verifyToken(hdr) {
+	if len(tokens) > 0 && !l.verifyToken(hdr, tokens) {
 		return false
 	}
 	return true
 }
 
+// credentials returns the secrets and tokens currently accepted: the current
+// ones, plus the previous ones until the rotation window closes.
+func (l *webhookListener) credentials() (secrets, tokens []string) {
+	l.reloadMu.RLock()
+	defer l.reloadMu.RUnlock()
+
+	in_rotation := time.Now().Before(l.cfg.PrevUntil)
+	if !IsBlank(l.cfg.Secret) {
+		secrets = append(secrets, l.cfg.Secret)
+		if in_rotation && !IsBlank(l.cfg.PrevSecret) && l.cfg.PrevSecret != l.cfg.Secret {
+			secrets = append(secrets, l.cfg.PrevSecret)
+		}
+	}
+	if !IsBlank(l.cfg.Token) {
+		tokens = append(tokens, l.cfg.Token)
+		if in_rotation && !IsBlank(l.cfg.PrevToken) && l.cfg.PrevToken != l.cfg.Token {
+			tokens = append(tokens, l.cfg.PrevToken)
+		}
+	}
+	return
+}
+
 // verifySignature compares the HMAC-SHA256 of the body against the signature
-// header, accepting either hex or base64 encoding. SHA256 is the only
-// algorithm Kiteworks uses for webhook signatures.
-func (l *webhookListener) verifySignature(body []byte, hdr http.Header) bool {
+// header, accepting either hex or base64 encoding and any of the given
+// secrets. SHA256 is the only algorithm Kiteworks uses for webhook signatures.
+func (l *webhookListener) verifySignature(body []byte, hdr http.Header, secrets []string) bool {
 	provided := strings.TrimSpace(hdr.Get(l.cfg.SigHeader))
 	if IsBlank(provided) {
 		return false
@@ -516,23 +611,153 @@ func (l *webhookListener) verifySignature(body []byte, hdr http.Header) bool {
 		provided = strings.TrimSpace(provided[eq+1:])
 	}
 
-	mac := hmac.New(sha256.New, []byte(l.cfg.Secret))
-	mac.Write(body)
-	sum := mac.Sum(nil)
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		sum := mac.Sum(nil)
 
-	expectedHex := hex.EncodeToString(sum)
-	expectedB64 := base64.StdEncoding.EncodeToString(sum)
+		expectedHex := hex.EncodeToString(sum)
+		expectedB64 := base64.StdEncoding.EncodeToString(sum)
 
-	return constantTimeEqual(provided, expectedHex) || constantTimeEqual(provided, expectedB64)
+		if constantTimeEqual(provided, expectedHex) || constantTimeEqual(provided, expectedB64) {
+			return true
+		}
+	}
+	return false
 }
 
-// verifyToken compares the token header against the configured token,
-// tolerating a "Bearer " prefix.
-func (l *webhookListener) verifyToken(hdr http.Header) bool {
+// verifyToken compares the token header against the given tokens, tolerating
+// a "Bearer " prefix.
+func (l *webhookListener) verifyToken(hdr http.Header, tokens []string) bool {
 	provided := strings.TrimSpace(hdr.Get(l.cfg.TokenHeader))
 	provided = strings.TrimPrefix(provided, "Bearer ")
 	provided = strings.TrimSpace(provided)
-	return constantTimeEqual(provided, l.cfg.Token)
+	for _, token := range tokens {
+		if constantTimeEqual(provided, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload re-reads the stored credentials and the configured TLS certificate.
+// It is a no-op unless the listener is running.
+func (l *webhookListener) reload() {
+	l.mu.Lock()
+	started := l.started
+	l.mu.Unlock()
+	if !started {
+		return
+	}
+	l.reloadCredentials()
+	if l.cfg.Scheme != "http" && !IsBlank(l.cfg.TLSCert) {
+		if err := l.loadCert(); err != nil {
+			Err("Webhook listener: %v; continuing with the previous certificate.", err)
+		}
+	}
+}
+
+// reloadCredentials replaces the listener's secret and token with the stored
+// webhook credentials.
+func (l *webhookListener) reloadCredentials() {
+	if globalDB == nil {
+		return
+	}
+	creds := LoadWebhookCredentials()
+	l.reloadMu.Lock()
+	defer l.reloadMu.Unlock()
+	if creds.Secret == l.cfg.Secret && creds.Token == l.cfg.Token && creds.PrevUntil.Equal(l.cfg.PrevUntil) {
+		return
+	}
+	l.cfg.Secret, l.cfg.Token = creds.Secret, creds.Token
+	l.cfg.PrevSecret, l.cfg.PrevToken, l.cfg.PrevUntil = creds.PrevSecret, creds.PrevToken, creds.PrevUntil
+	if creds.InRotation() {
+		Log("Webhook credentials reloaded; previous credentials accepted until %s.", creds.PrevUntil.Local().Format(time.RFC1123))
+	} else {
+		Log("Webhook credentials reloaded.")
+	}
+}
+
+// certFilesModified returns the newest modification time of the configured
+// certificate and key files.
+func (l *webhookListener) certFilesModified() (mod time.Time, err error) {
+	for _, f := range []string{l.cfg.TLSCert, l.cfg.TLSKey} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return mod, err
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod, nil
+}
+
+// loadCert loads the configured certificate and key, replacing the one being
+// served. A pair that fails to load leaves the current certificate in place.
+func (l *webhookListener) loadCert() error {
+	mod, err := l.certFilesModified()
+	if err != nil {
+		return fmt.Errorf("could not read TLS certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(l.cfg.TLSCert, l.cfg.TLSKey)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate %s: %w", l.cfg.TLSCert, err)
+	}
+	l.reloadMu.Lock()
+	reloaded := l.cert != nil
+	l.cert = &cert
+	l.certMod = mod
+	l.reloadMu.Unlock()
+	if reloaded {
+		Log("Webhook listener TLS certificate reloaded from %s.", l.cfg.TLSCert)
+	}
+	return nil
+}
+
+// getCertificate serves the currently loaded certificate to each handshake.
+func (l *webhookListener) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.reloadMu.RLock()
+	defer l.reloadMu.RUnlock()
+	return l.cert, nil
+}
+
+// WebhookReloadInterval is how often a running listener checks the stored
+// credentials, and the certificate files, for changes.
+const WebhookReloadInterval = 5 * time.Second
+
+// watchReload reloads the stored credentials when another process rotates
+// them, and with watch_cert the certificate when its files change on disk,
+// until the listener shuts down. Files are compared by modification time; a
+// renewal that rewrites the cert and key in two steps is picked up once both
+// load.
+func (l *webhookListener) watchReload(watch_cert bool) {
+	ticker := time.NewTicker(WebhookReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.reloadCredentials()
+			if !watch_cert {
+				continue
+			}
+			mod, err := l.certFilesModified()
+			if err != nil {
+				continue
+			}
+			l.reloadMu.RLock()
+			changed := mod.After(l.certMod)
+			l.reloadMu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := l.loadCert(); err != nil {
+				Debug("Webhook listener: %v", err)
+			}
+		}
+	}
 }
 
 // constantTimeEqual reports whether a and b are equal without leaking timing.
@@ -565,15 +790,24 @@ func (l *webhookListener) selfRegister() error {
 	}
 
 	// Look for an existing webhook with the same URL so we reuse it instead of
-	// registering a duplicate (e.g. after a crash that skipped cleanup).
-	existing, err := l.findWebhookByURL(l.cfg.PublicURL)
+	// registering a duplicate (e.g. after a crash that skipped cleanup). Any
+	// further registrations for the URL are duplicates and are removed, since
+	// each would deliver every event again.
+	existing, err := l.findWebhooksByURL(l.cfg.PublicURL)
 	if err != nil {
 		return fmt.Errorf("self-register: %w", err)
 	}
-	if existing != nil {
-		webhook, err := l.selfKW.Webhook(existing.ID).Update(l.cfg.PublicURL, subs, opts)
+	if len(existing) > 0 {
+		for _, dup := range existing[1:] {
+			if err := l.selfKW.Webhook(dup.ID).Delete(); err != nil {
+				Err("self-register: removing duplicate webhook %s: %v", dup.ID, err)
+				continue
+			}
+			Log("Removed duplicate webhook %s -> %s.", dup.ID, dup.URL)
+		}
+		webhook, err := l.selfKW.Webhook(existing[0].ID).Update(l.cfg.PublicURL, subs, opts)
 		if err != nil {
-			return fmt.Errorf("self-register: updating existing webhook %s: %w", existing.ID, err)
+			return fmt.Errorf("self-register: updating existing webhook %s: %w", existing[0].ID, err)
 		}
 		// We adopted a pre-existing registration; leave it in place on shutdown.
 		l.selfHookID = webhook.ID
@@ -592,19 +826,19 @@ func (l *webhookListener) selfRegister() error {
 	return nil
 }
 
-// findWebhookByURL returns the first existing webhook whose URL matches the
-// given url (case-insensitive), or nil when none exists.
-func (l *webhookListener) findWebhookByURL(url string) (*KiteWebhook, error) {
+// findWebhooksByURL returns the existing webhooks whose URL matches the given
+// url (see KiteWebhook.MatchesURL), in the order the appliance lists them.
+func (l *webhookListener) findWebhooksByURL(url string) (found []KiteWebhook, err error) {
 	webhooks, err := l.selfKW.Webhooks()
 	if err != nil {
 		return nil, err
 	}
-	for i := range webhooks {
-		if strings.EqualFold(strings.TrimSpace(webhooks[i].URL), strings.TrimSpace(url)) {
-			return &webhooks[i], nil
+	for _, w := range webhooks {
+		if w.MatchesURL(url) {
+			found = append(found, w)
 		}
 	}
-	return nil, nil
+	return found, nil
 }
 
 // selfUnregister removes the webhook created by selfRegister. A registration we
@@ -0,0 +1,364 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file provides the polling transport for webhook tasks. When inbound
+// HTTP is unavailable (no listener configured, or the appliance cannot reach
+// us), the admin activity log is read instead and each entry is converted into
+// a synthetic WebhookEvent shaped like a webhook delivery. The event is then
+// dispatched to the task's Handle exactly as the listener would, so a webhook
+// task behaves identically with or without the listener.
+
+// pollCursorKey is the default database key holding the timestamp of the last
+// processed activity for a polled webhook task.
+const pollCursorKey = "webhook_poll_cursor"
+
+// pollMaxAttempts is the default number of passes an activity is dispatched on
+// before a handler that keeps failing on it is given up on.
+const pollMaxAttempts = 5
+
+// WebhookPollOptions controls how a webhook task polls the activity log when
+// the webhook listener is not enabled.
+type WebhookPollOptions struct {
+	LookbackHours int      // Hours to scan back on the first run (no saved cursor).
+	PageSize      int      // Activities retrieved per API page (1-1000).
+	EventFilters  []string // Optional activity eventFilters:in, to narrow the scan.
+	CursorKey     string   // Database key for the task's cursor; defaults to webhook_poll_cursor.
+	MaxAttempts   int      // Passes a failing activity is dispatched on before it is dropped; defaults to 5.
+}
+
+// RegisterFlags adds the polling fallback flags (--lookback_hours, --page_size)
+// to a task's flag set, using the current option values as defaults.
+func (o *WebhookPollOptions) RegisterFlags(flags *FlagSet) {
+	if o.LookbackHours == 0 {
+		o.LookbackHours = 24
+	}
+	if o.PageSize == 0 {
+		o.PageSize = 1000
+	}
+	flags.IntVar(&o.LookbackHours, "lookback_hours", o.LookbackHours, "Polling fallback: on the first run (no saved cursor), how many hours back to scan.")
+	flags.IntVar(&o.PageSize, "page_size", o.PageSize, "Polling fallback: number of activities to retrieve per API page.")
+}
+
+// Validate checks the option values, for use in a task's Init.
+func (o WebhookPollOptions) Validate() error {
+	if o.PageSize < 1 || o.PageSize > 1000 {
+		return fmt.Errorf("--page_size must be between 1 and 1000.")
+	}
+	if o.LookbackHours < 0 {
+		return fmt.Errorf("--lookback_hours cannot be negative.")
+	}
+	return nil
+}
+
+// RunWebhookTask runs a webhook task over whichever transport is configured:
+// when the webhook listener is enabled the task is hosted on it, otherwise a
+// single pass over the activity log is made (run the task with --repeat to
+// keep polling).
+func RunWebhookTask(task WebhookTask, opts WebhookPollOptions) error {
+	if WebhookListenerEnabled() {
+		Log("Webhook delivery is enabled; hosting %q on the listener.", task.Name())
+		return HostWebhookTask(task, task.Get().KW)
+	}
+	Log("Webhook delivery is not enabled; polling the activity log for %q.", task.Name())
+	return PollWebhookTask(task, opts)
+}
+
+// PollWebhookTask scans the admin activity log since the task's persisted
+// cursor, converts each entry into a synthetic WebhookEvent, and dispatches it
+// to the task's Handle. The cursor is saved in the task's database afterwards
+// so the next pass resumes where this one stopped, or at the oldest activity a
+// handler failed on.
+func PollWebhookTask(task WebhookTask, opts WebhookPollOptions) (err error) {
+	T := task.Get()
+
+	if opts.PageSize < 1 || opts.PageSize > 1000 {
+		opts.PageSize = 1000
+	}
+	if IsBlank(opts.CursorKey) {
+		opts.CursorKey = pollCursorKey
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = pollMaxAttempts
+	}
+
+	now := time.Now().UTC()
+	var since time.Time
+	var saved string
+	if T.DB.Get("kitebroker", opts.CursorKey, &saved) && !IsBlank(saved) {
+		if t, perr := time.Parse(time.RFC3339, saved); perr == nil {
+			since = t
+		}
+	}
+	if since.IsZero() {
+		since = now.Add(-time.Duration(opts.LookbackHours) * time.Hour)
+	}
+
+	Log("Scanning activity log from %s to %s ...", since.Format(time.RFC3339), now.Format(time.RFC3339))
+
+	query := Query{
+		"startDateTime": since.Format("2006-01-02T15:04:05.000Z"),
+		"endDateTime":   now.Format("2006-01-02T15:04:05.000Z"),
+		"orderBy":       "created:asc",
+		"compact":       false,
+	}
+	if len(opts.EventFilters) > 0 {
+		query["eventFilters:in"] = strings.Join(opts.EventFilters, ",")
+	}
+
+	return pollActivities(task, opts, since, func(offset int) (activities []map[string]interface{}, err error) {
+		err = T.KW.Admin().Activities(&activities, offset, opts.PageSize, query)
+		return
+	})
+}
+
+// pollActivities dispatches the activities fetch returns, a page at a time,
+// and saves the cursor the next pass starts from.
+//
+// Each activity a handler fails on has its attempts counted in the task's
+// database. Once an activity has failed opts.MaxAttempts times it is logged as
+// dropped and the cursor moves past it, so one bad activity cannot hold the
+// cursor back forever.
+func pollActivities(task WebhookTask, opts WebhookPollOptions, since time.Time, fetch func(offset int) ([]map[string]interface{}, error)) (err error) {
+	T := task.Get()
+
+	polled := T.Report.Tally("Activities Polled")
+	dispatched := T.Report.Tally("Events Dispatched")
+	handler_err := T.Report.Tally("Handler Errors")
+	dropped := T.Report.Tally("Activities Dropped")
+
+	attempts := T.DB.Table(opts.CursorKey + "_attempts")
+
+	// Polled events are routed through the same dispatcher the listener uses,
+	// but scoped to this task alone: each polled task keeps its own cursor, so
+	// its events must not be fanned out to other hosted tasks.
+	regs := []webhookRegistration{{pattern: SubjectAll, task: task.Name(), handler: func(ev WebhookEvent, _ KWSession) error {
+		return task.Handle(ev)
+	}}}
+
+	new_cursor := since
+	var failed bool
+	var retry_from time.Time // Created time of the oldest activity to redeliver.
+	offset := 0
+	for {
+		var activities []map[string]interface{}
+		if activities, err = fetch(offset); err != nil {
+			return err
+		}
+
+		for _, activity := range activities {
+			polled.Add(1)
+			created, perr := ReadKWTime(pollStr(activity, "created"))
+			if perr == nil && created.After(new_cursor) {
+				new_cursor = created
+			}
+			var activity_failed bool
+			for _, ev := range activityToEvents(T.KW, activity) {
+				matched, errs := dispatchWebhookEvent(regs, ev, T.KW)
+				dispatched.Add(matched)
+				for _, e := range errs {
+					handler_err.Add(1)
+					Err("[%s] %v", ev.Subject, e)
+					activity_failed = true
+				}
+			}
+			id := pollActivityID(activity)
+			var count int
+			if !activity_failed {
+				if attempts.Get(id, &count) {
+					attempts.Unset(id)
+				}
+				continue
+			}
+			attempts.Get(id, &count)
+			if count++; count >= opts.MaxAttempts {
+				dropped.Add(1)
+				Err("Dropping activity %s (%s) after %d failed attempts.", id, pollStr(activity, "eventName"), count)
+				attempts.Unset(id)
+				continue
+			}
+			attempts.Set(id, count)
+			failed = true
+			if perr == nil && (retry_from.IsZero() || created.Before(retry_from)) {
+				retry_from = created
+			}
+		}
+
+		if len(activities) < opts.PageSize {
+			break
+		}
+		offset += opts.PageSize
+	}
+
+	// Persist the cursor just past the newest activity so the next pass does
+	// not re-fetch it. When a handler failed, the cursor stops at the oldest
+	// failed activity not yet dropped, so the next pass redelivers it; activities
+	// logged after it are redelivered as well, so handlers must tolerate
+	// seeing an event twice.
+	switch {
+	case !failed:
+		T.DB.Set("kitebroker", opts.CursorKey, new_cursor.Add(time.Millisecond).UTC().Format(time.RFC3339Nano))
+	case !retry_from.IsZero():
+		Notice("Handler errors occurred; the next pass resumes from %s to redeliver them.", retry_from.UTC().Format(time.RFC3339))
+		T.DB.Set("kitebroker", opts.CursorKey, retry_from.UTC().Format(time.RFC3339Nano))
+	default:
+		Notice("Handler errors occurred on an activity without a timestamp; the cursor was left unchanged.")
+	}
+	return nil
+}
+
+// pollActivityID returns the key an activity's failed attempts are counted
+// under: its id, or its timestamp and event name when it has none.
+func pollActivityID(activity map[string]interface{}) string {
+	if id := pollStr(activity, "id"); !IsBlank(id) {
+		return id
+	}
+	return pollStr(activity, "created") + "/" + pollStr(activity, "eventName")
+}
+
+// activitySubjects maps activity-log event names onto the webhook event_name
+// taxonomy. An upload is logged once, after it completes, whereas the appliance
+// delivers add_file_version followed by filehash_generated; both are
+// synthesized so handlers keyed on either see the upload. Event names not
+// listed here are already shared between the two and pass through unchanged.
+var activitySubjects = map[string][]string{
+	"add_file":         {"add_file_version", "filehash_generated"},
+	"add_file_version": {"add_file_version", "filehash_generated"},
+	"upload":           {"add_file_version", "filehash_generated"},
+	"ec_upload_file":   {"add_file_version", "filehash_generated"},
+	"upload_to_tray":   {"add_file_version", "filehash_generated"},
+}
+
+// activityToEvents converts an admin activity entry into the synthetic
+// WebhookEvent(s) a webhook delivery would have produced. Data is normalized to
+// the webhook payload.data shape (numeric ids, file.size, file.path and
+// file.file_uploader); Raw holds an equivalent delivery envelope.
+func activityToEvents(kw KWSession, activity map[string]interface{}) (events []WebhookEvent) {
+	name := strings.TrimSpace(pollStr(activity, "eventName"))
+	if IsBlank(name) {
+		return nil
+	}
+	subjects, ok := activitySubjects[name]
+	if !ok {
+		subjects = []string{name}
+	}
+
+	data, _ := activity["data"].(map[string]interface{})
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	for _, obj := range []string{"file", "folder", "parent_folder"} {
+		if m, ok := data[obj].(map[string]interface{}); ok {
+			normalizePollID(m)
+		}
+	}
+
+	if file, ok := data["file"].(map[string]interface{}); ok {
+		if IsBlank(pollStr(file, "path")) && !IsBlank(pollStr(activity, "fileSourceLocation")) {
+			file["path"] = pollStr(activity, "fileSourceLocation")
+		}
+		if _, ok := file["file_uploader"]; !ok && !IsBlank(pollStr(activity, "userName")) {
+			file["file_uploader"] = map[string]interface{}{"name": pollStr(activity, "userName")}
+		}
+		// filehash_generated carries the finalized size; confirm it when the
+		// activity did not record one.
+		if _, ok := file["size"]; !ok && subjects[len(subjects)-1] == "filehash_generated" {
+			id := pollStr(file, "id")
+			if IsBlank(id) {
+				return nil
+			}
+			info, err := kw.File(id).Info()
+			if err != nil {
+				Debug("[%s] could not confirm size for file %s: %v", name, id, err)
+				return nil
+			}
+			if info.Deleted || info.PermDeleted {
+				return nil
+			}
+			file["size"] = info.Size
+			if IsBlank(pollStr(file, "name")) {
+				file["name"] = info.Name
+			}
+			if IsBlank(pollStr(file, "path")) {
+				file["path"] = info.Path
+			}
+		}
+	}
+
+	var when time.Time
+	if t, err := ReadKWTime(pollStr(activity, "created")); err == nil {
+		when = t
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		Debug("[%s] could not encode activity data: %v", name, err)
+		return nil
+	}
+
+	for _, subject := range subjects {
+		var envelope struct {
+			Payload struct {
+				EventName string          `json:"event_name"`
+				Created   float64         `json:"created"`
+				Data      json.RawMessage `json:"data"`
+			} `json:"payload"`
+		}
+		envelope.Payload.EventName = subject
+		envelope.Payload.Data = body
+		if !when.IsZero() {
+			envelope.Payload.Created = float64(when.UnixNano()) / 1e9
+		}
+		raw, _ := json.Marshal(envelope)
+		events = append(events, WebhookEvent{
+			Subject:   subject,
+			Event:     name,
+			Timestamp: when,
+			Data:      body,
+			Raw:       raw,
+		})
+	}
+	return
+}
+
+// normalizePollID converts a numeric-string "id" to a number, matching the
+// integer ids carried on webhook deliveries.
+func normalizePollID(m map[string]interface{}) {
+	if s, ok := m["id"].(string); ok {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			m["id"] = n
+		}
+	}
+	if up, ok := m["file_uploader"].(map[string]interface{}); ok {
+		normalizePollID(up)
+	}
+	if s, ok := m["size"].(string); ok {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			m["size"] = n
+		}
+	}
+}
+
+// pollStr extracts a string value from an activity map by key.
+func pollStr(m map[string]interface{}, key string) string {
+	if m == nil {
+		return ""
+	}
+	if v, ok := m[key]; ok && v != nil {
+		switch s := v.(type) {
+		case string:
+			return s
+		case float64:
+			return strconv.FormatFloat(s, 'f', -1, 64)
+		default:
+			return fmt.Sprintf("%v", v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// pollTestTask is a webhook task whose handler fails on the activity ids in
+// fail, a number of times each (-1 fails forever).
+type pollTestTask struct {
+	KiteBrokerTask
+	fail    map[string]int
+	handled map[string]int
+}
+
+func (T *pollTestTask) Name() string       { return "poll_test" }
+func (T *pollTestTask) Desc() string       { return "" }
+func (T *pollTestTask) Init() error        { return nil }
+func (T *pollTestTask) Main() error        { return nil }
+func (T *pollTestTask) Subjects() []string { return []string{SubjectAll} }
+
+func (T *pollTestTask) Handle(event WebhookEvent) error {
+	var data struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		return err
+	}
+	id := data.Name
+	T.handled[id]++
+	if n := T.fail[id]; n != 0 {
+		T.fail[id] = n - 1
+		return fmt.Errorf("handler failed on %s", id)
+	}
+	return nil
+}
+
+// newPollTestTask returns a task with an in-memory database.
+func newPollTestTask(fail map[string]int) *pollTestTask {
+	T := &pollTestTask{fail: fail, handled: make(map[string]int)}
+	T.DB = OpenCache()
+	T.Report = NewTaskReport("poll_test", "cli", nil)
+	return T
+}
+
+// pollTestBase is the created time of the first test activity.
+var pollTestBase = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// pollTestActivity returns an activity created secs after pollTestBase. Its
+// data is named after its id, so Handle can tell the activities apart.
+func pollTestActivity(id string, secs int) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        id,
+		"eventName": "add_folder",
+		"created":   WriteKWTime(pollTestBase.Add(time.Duration(secs) * time.Second)),
+		"data":      map[string]interface{}{"name": id},
+	}
+}
+
+// poll makes one pass over activities and returns the saved cursor.
+func (T *pollTestTask) poll(t *testing.T, opts WebhookPollOptions, activities []map[string]interface{}) time.Time {
+	t.Helper()
+	err := pollActivities(T, opts, pollTestBase, func(offset int) ([]map[string]interface{}, error) {
+		return activities, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved string
+	T.DB.Get("kitebroker", opts.CursorKey, &saved)
+	cursor, err := time.Parse(time.RFC3339Nano, saved)
+	if err != nil {
+		t.Fatalf("cursor %q: %v", saved, err)
+	}
+	return cursor
+}
+
+func TestPollRedelivery(t *testing.T) {
+	T := newPollTestTask(map[string]int{"2": 1, "3": 1})
+	opts := WebhookPollOptions{PageSize: 1000, CursorKey: pollCursorKey, MaxAttempts: 3}
+
+	// Activity 3 was created before activity 2 but is listed after it; the
+	// next pass must resume from the older of the two.
+	activities := []map[string]interface{}{
+		pollTestActivity("1", 1),
+		pollTestActivity("2", 30),
+		pollTestActivity("3", 20),
+		pollTestActivity("4", 40),
+	}
+
+	cursor := T.poll(t, opts, activities)
+	if want := pollTestBase.Add(20 * time.Second); !cursor.Equal(want) {
+		t.Errorf("cursor after failures = %s, want %s", cursor, want)
+	}
+	if n := T.DB.Table(pollCursorKey + "_attempts").CountKeys(); n != 2 {
+		t.Errorf("%d attempt counts recorded, want 2", n)
+	}
+
+	cursor = T.poll(t, opts, activities)
+	if want := pollTestBase.Add(40*time.Second + time.Millisecond); !cursor.Equal(want) {
+		t.Errorf("cursor after redelivery = %s, want %s", cursor, want)
+	}
+	if T.handled["2"] != 2 || T.handled["3"] != 2 {
+		t.Errorf("failed activities handled %d and %d times, want 2", T.handled["2"], T.handled["3"])
+	}
+	if n := T.DB.Table(pollCursorKey + "_attempts").CountKeys(); n != 0 {
+		t.Errorf("%d attempt counts left after redelivery, want 0", n)
+	}
+}
+
+func TestPollGiveUp(t *testing.T) {
+	T := newPollTestTask(map[string]int{"2": -1})
+	opts := WebhookPollOptions{PageSize: 1000, CursorKey: pollCursorKey, MaxAttempts: 3}
+
+	activities := []map[string]interface{}{
+		pollTestActivity("1", 1),
+		pollTestActivity("2", 10),
+		pollTestActivity("3", 20),
+	}
+
+	for pass := 1; pass < opts.MaxAttempts; pass++ {
+		cursor := T.poll(t, opts, activities)
+		if want := pollTestBase.Add(10 * time.Second); !cursor.Equal(want) {
+			t.Fatalf("pass %d: cursor = %s, want %s", pass, cursor, want)
+		}
+	}
+
+	cursor := T.poll(t, opts, activities)
+	if want := pollTestBase.Add(20*time.Second + time.Millisecond); !cursor.Equal(want) {
+		t.Errorf("cursor after giving up = %s, want %s", cursor, want)
+	}
+	if n := T.handled["2"]; n != opts.MaxAttempts {
+		t.Errorf("failing activity handled %d times, want %d", n, opts.MaxAttempts)
+	}
+	if n := T.Report.Tally("Activities Dropped").Value(); n != 1 {
+		t.Errorf("%d activities dropped, want 1", n)
+	}
+	if n := T.DB.Table(pollCursorKey + "_attempts").CountKeys(); n != 0 {
+		t.Errorf("%d attempt counts left after giving up, want 0", n)
+	}
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The listener's status endpoint lets an operator check a running listener
+// without tailing its logs. It is served on the delivery port at AdminPath,
+// only when an AdminToken is configured, and every request must present that
+// token as a bearer token.
+
+// recentEventLimit is the number of recent deliveries kept for the status
+// endpoint.
+const recentEventLimit = 50
+
+// redactedValue replaces sensitive values in reported events.
+const redactedValue = "[redacted]"
+
+// statusEvent is a delivery as reported by the status endpoint.
+type statusEvent struct {
+	Received  time.Time       `json:"received"`
+	Subject   string          `json:"subject"`
+	Timestamp time.Time       `json:"timestamp,omitempty"`
+	WebhookID string          `json:"webhook_id,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// listenerStatus is the status endpoint's response.
+type listenerStatus struct {
+	Started  time.Time `json:"started"`
+	Uptime   string    `json:"uptime"`
+	Counters struct {
+		Received      int64 `json:"received"`
+		Rejected      int64 `json:"rejected"`
+		Dispatched    int64 `json:"dispatched"`
+		Unmatched     int64 `json:"unmatched"`
+		HandlerErrors int64 `json:"handler_errors"`
+	} `json:"counters"`
+	Tasks         []string `json:"tasks"`
+	Handlers      []string `json:"handlers"`
+	Subscriptions []string `json:"subscriptions"`
+	Queue         struct {
+		Waiting int64 `json:"waiting"`
+		Active  int64 `json:"active"`
+		Workers int   `json:"workers"`
+	} `json:"queue"`
+	RecentEvents []statusEvent `json:"recent_events"`
+}
+
+// recordEvent adds a delivery to the recent events, redacting its payload
+// when it is recorded so nothing sensitive is held in memory.
+func (l *webhookListener) recordEvent(ev WebhookEvent) {
+	se := statusEvent{
+		Received:  time.Now(),
+		Subject:   ev.Subject,
+		Timestamp: ev.Timestamp,
+		WebhookID: ev.WebhookID,
+		Data:      redactJSON(ev.Data),
+	}
+	l.recentMu.Lock()
+	defer l.recentMu.Unlock()
+	l.recent = append(l.recent, se)
+	if len(l.recent) > recentEventLimit {
+		l.recent = l.recent[len(l.recent)-recentEventLimit:]
+	}
+}
+
+// handleStatus serves the listener's counters, hosted handlers, queue depth,
+// and recent deliveries as JSON. An optional ?limit=N caps the number of
+// recent events returned.
+func (l *webhookListener) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	provided := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(r.Header.Get("Authorization")), "Bearer "))
+	if !constantTimeEqual(provided, l.cfg.AdminToken) {
+		Err("Rejected listener status request from %s: invalid token.", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := recentEventLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < limit {
+			limit = n
+		}
+	}
+
+	var st listenerStatus
+	st.Started = l.startedAt
+	st.Uptime = time.Since(l.startedAt).Round(time.Second).String()
+	st.Counters.Received = l.received.Value()
+	st.Counters.Rejected = l.rejected.Value()
+	st.Counters.Dispatched = l.dispatched.Value()
+	st.Counters.Unmatched = l.unmatched.Value()
+	st.Counters.HandlerErrors = l.handlerErr.Value()
+	st.Handlers = webhookHandlerNames()
+	st.Queue.Waiting = atomic.LoadInt64(&l.queued)
+	st.Queue.Active = atomic.LoadInt64(&l.active)
+	st.Queue.Workers = l.cfg.Workers
+
+	l.mu.Lock()
+	st.Tasks = append([]string(nil), l.tasks...)
+	for s := range l.subjects {
+		st.Subscriptions = append(st.Subscriptions, s)
+	}
+	l.mu.Unlock()
+
+	l.recentMu.Lock()
+	recent := l.recent
+	if len(recent) > limit {
+		recent = recent[len(recent)-limit:]
+	}
+	st.RecentEvents = append([]statusEvent{}, recent...)
+	l.recentMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(st)
+}
+
+// sensitiveKeys are payload keys whose values are always redacted.
+var sensitiveKeys = map[string]struct{}{
+	"email":      {},
+	"emails":     {},
+	"user_email": {},
+	"useremail":  {},
+	"ip":         {},
+	"ipaddress":  {},
+	"ip_address": {},
+	"token":      {},
+	"secret":     {},
+	"password":   {},
+	"signature":  {},
+}
+
+// personKeys are payload keys holding a person; their names are redacted too.
+var personKeys = map[string]struct{}{
+	"user":          {},
+	"owner":         {},
+	"creator":       {},
+	"file_uploader": {},
+	"member":        {},
+}
+
+// redactJSON returns a copy of a JSON payload with sensitive values replaced.
+// A payload that is not valid JSON is dropped entirely.
+func redactJSON(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil
+	}
+	out, err := json.Marshal(redactValue(v, false))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// redactValue walks a decoded JSON value, redacting sensitive keys. person is
+// set inside an object describing a person, whose name is redacted as well.
+func redactValue(v interface{}, person bool) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			key := strings.ToLower(k)
+			if _, ok := sensitiveKeys[key]; ok {
+				t[k] = redactedValue
+				continue
+			}
+			if person && key == "name" {
+				t[k] = redactedValue
+				continue
+			}
+			_, is_person := personKeys[key]
+			t[k] = redactValue(val, is_person)
+		}
+		return t
+	case []interface{}:
+		for i := range t {
+			t[i] = redactValue(t[i], person)
+		}
+		return t
+	default:
+		return v
+	}
+}
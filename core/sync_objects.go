@@ -12,6 +12,8 @@ type SyncFile struct {
 	DestID          string        `json:"dest_id,omitempty"`
 	Created         time.Time     `json:"created"`
 	Modified        time.Time     `json:"modified"`
+	Size            int64         `json:"size,omitempty"`
+	Fingerprint     string        `json:"fingerprint,omitempty"` // Source checksum comparable to the Kiteworks fingerprint, when available.
 	SrcFolderID     string        `json:"parent_id,omitempty"`
 	DestFolderID    string        `json:"kw_folder_id,omitempty"`
 	ParentOwner     string        `json:"parent_owner"`
@@ -71,9 +73,14 @@ type SyncVersion struct {
 	Name     string    `json:"name"`
 	Created  time.Time `json:"utc_created"`
 	Modified time.Time `json:"utc_modified"`
-	Size     int64     `json:"size"`
+	Size     int64     `json:"size"` // UnknownSize when the source cannot tell it before download.
 }
 
+// UnknownSize is the Size of a SyncVersion whose content is generated on
+// download, such as an exported document. The engine spools such versions to
+// a temporary file to learn their size before uploading them.
+const UnknownSize = -1
+
 // SyncComment represents a comment associated with a synced file.
 type SyncComment struct {
 	ID       string    `json:"id"`
@@ -82,4 +89,6 @@ type SyncComment struct {
 	Message  string    `json:"message"`
 	Original string    `json:"original_message"`
 	Flag     int       `json:"flag,omitempty"`
+	ParentID string    `json:"parent_id,omitempty"` // Comment replied to, for threaded comments.
+	DestID   string    `json:"dest_id,omitempty"`
 }
@@ -10,9 +10,17 @@ import (
 	_ "github.com/cmcoffee/kitebroker/tasks/admin/files_and_folders"
 	_ "github.com/cmcoffee/kitebroker/tasks/admin/pubsub"
 	_ "github.com/cmcoffee/kitebroker/tasks/admin/users"
-	_ "github.com/cmcoffee/kitebroker/tasks/migration/kiteworks"
+	_ "github.com/cmcoffee/kitebroker/tasks/migration/archive"
 	_ "github.com/cmcoffee/kitebroker/tasks/migration/box"
+	_ "github.com/cmcoffee/kitebroker/tasks/migration/dropbox"
+	_ "github.com/cmcoffee/kitebroker/tasks/migration/filesystem"
+	_ "github.com/cmcoffee/kitebroker/tasks/migration/gdrive"
+	_ "github.com/cmcoffee/kitebroker/tasks/migration/kiteworks"
 	_ "github.com/cmcoffee/kitebroker/tasks/migration/quatrix"
+	_ "github.com/cmcoffee/kitebroker/tasks/migration/s3"
+	_ "github.com/cmcoffee/kitebroker/tasks/migration/sftp"
+	_ "github.com/cmcoffee/kitebroker/tasks/migration/sharepoint"
+	_ "github.com/cmcoffee/kitebroker/tasks/migration/webdav"
 	_ "github.com/cmcoffee/kitebroker/tasks/sync/kiteworks_mirror"
 	_ "github.com/cmcoffee/kitebroker/tasks/user"
 )
@@ -0,0 +1,590 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterWebhookTask(new(FolderPolicyTask)) }
+
+// Kiteworks event names the policy reacts to. File rules act on
+// filehash_generated, which arrives once per upload after the file is
+// finalized (see triggerEvent); folder creation and member changes only
+// trigger the protected-folder audit.
+var (
+	policyFolderEvents = map[string]struct{}{"add_folder": {}}
+	policyMemberEvents = map[string]struct{}{"add_user_to_folder": {}}
+)
+
+// folderPolicy is the --rules file: a list of file rules plus the set of
+// protected folders external members may not be added to.
+type folderPolicy struct {
+	Rules     []policyRule `json:"rules"`
+	Protected struct {
+		Folders         []string `json:"folders"`          // Folder paths, e.g. "Finance" or "Legal/Contracts".
+		InternalDomains []string `json:"internal_domains"` // E-mail domains considered internal.
+	} `json:"protected"`
+}
+
+// policyRule is applied to each file added under Folder whose name matches
+// Pattern. Every action is optional.
+type policyRule struct {
+	Folder         string `json:"folder"`          // Folder path the rule covers, including subfolders; blank covers all.
+	Pattern        string `json:"pattern"`         // File name glob, e.g. "*.pdf"; blank matches every file.
+	Rename         string `json:"rename"`          // New name; {name}, {base}, {ext}, and {date} are expanded.
+	DatedSubfolder string `json:"dated_subfolder"` // Move into a subfolder named by this Go time layout, e.g. "2006/01".
+	ExpireDays     int    `json:"expire_days"`     // Set the file to expire this many days after it was added.
+	Comment        string `json:"comment"`         // Comment to add to the file.
+}
+
+// FolderPolicyTask enforces folder policy the moment content arrives: files
+// are renamed, filed into dated subfolders, given an expiry, or commented on
+// according to the rules file, and external members newly added to protected
+// folders are removed. With --batch the same rules are applied to existing
+// content by crawling each user's folders.
+type FolderPolicyTask struct {
+	input struct {
+		rules   string
+		batch   bool
+		users   []string
+		dry_run bool
+		poll    WebhookPollOptions
+	}
+	policy    folderPolicy
+	applied   Table // file id -> time the rules were applied, so files are processed once.
+	baselines Table // protected folder id -> member e-mails already accepted.
+	emails    map[string]string
+	emailsMu  sync.Mutex
+	auditMu   sync.Mutex
+	checked   Tally
+	renamed   Tally
+	moved     Tally
+	expired   Tally
+	commented Tally
+	removed   Tally
+	KiteBrokerTask
+}
+
+func (T *FolderPolicyTask) Name() string { return "folder_policy" }
+
+func (T *FolderPolicyTask) Desc() string {
+	return "PubSub: Apply folder policy rules (rename, dated subfolders, expiry, comments, protected members) as content arrives."
+}
+
+// Subjects declares the file/folder event families to subscribe to when hosting
+// the webhook listener.
+func (T *FolderPolicyTask) Subjects() []string {
+	return []string{
+		"file_folder_modify.>",
+		"file_folder_manage.>",
+	}
+}
+
+func (T *FolderPolicyTask) Init() (err error) {
+	T.Flags.StringVar(&T.input.rules, "rules", "<policy.json>", "Policy rules file.")
+	T.Flags.BoolVar(&T.input.batch, "batch", "Apply the rules to existing content in the folders of --users instead of waiting for events.")
+	T.Flags.MultiVar(&T.input.users, "users", "<user@domain.com>", "Users whose folders are crawled in --batch mode.")
+	T.Flags.BoolVar(&T.input.dry_run, "dry_run", "Log the actions the rules would take without applying them.")
+	T.input.poll.RegisterFlags(&T.Flags)
+	T.Flags.Order("rules", "batch", "users", "dry_run", "lookback_hours", "page_size")
+	if err = T.Flags.Parse(); err != nil {
+		return err
+	}
+
+	if IsBlank(T.input.rules) {
+		return fmt.Errorf("--rules is required.")
+	}
+	if T.input.batch && len(T.input.users) == 0 {
+		return fmt.Errorf("--batch requires --users.")
+	}
+	if err = T.loadPolicy(); err != nil {
+		return err
+	}
+	return T.input.poll.Validate()
+}
+
+// loadPolicy reads and validates the --rules file.
+func (T *FolderPolicyTask) loadPolicy() (err error) {
+	data, err := os.ReadFile(T.input.rules)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, &T.policy); err != nil {
+		return fmt.Errorf("Could not parse %s: %w", T.input.rules, err)
+	}
+	for i, r := range T.policy.Rules {
+		if !IsBlank(r.Pattern) {
+			if _, err := path.Match(r.Pattern, ""); err != nil {
+				return fmt.Errorf("%s: rule %d: invalid pattern %q: %w", T.input.rules, i+1, r.Pattern, err)
+			}
+		}
+		if strings.Contains(r.Rename, "/") {
+			return fmt.Errorf("%s: rule %d: rename cannot contain '/'; use dated_subfolder to move files.", T.input.rules, i+1)
+		}
+		if r.ExpireDays < 0 {
+			return fmt.Errorf("%s: rule %d: expire_days cannot be negative.", T.input.rules, i+1)
+		}
+	}
+	if len(T.policy.Protected.Folders) > 0 && len(T.policy.Protected.InternalDomains) == 0 {
+		return fmt.Errorf("%s: protected folders require at least one internal_domains entry.", T.input.rules)
+	}
+	if len(T.policy.Rules) == 0 && len(T.policy.Protected.Folders) == 0 {
+		return fmt.Errorf("%s: no rules or protected folders defined.", T.input.rules)
+	}
+	return nil
+}
+
+func (T *FolderPolicyTask) Main() (err error) {
+	T.applied = T.DB.Table("folder_policy_applied")
+	T.baselines = T.DB.Table("folder_policy_members")
+	T.emails = make(map[string]string)
+
+	// Tallies bind lazily in Handle, to whichever report the transport
+	// leaves the task with (the listener's shared report when hosted).
+	T.checked = Tally{}
+
+	T.seedBaselines()
+
+	if T.input.batch {
+		T.ensureTallies()
+		return T.runBatch()
+	}
+	return RunWebhookTask(T, T.input.poll)
+}
+
+// ensureTallies initializes the report tallies once, regardless of transport.
+func (T *FolderPolicyTask) ensureTallies() {
+	if T.checked.Name() != NONE {
+		return
+	}
+	T.checked = T.Report.Tally("Files Checked")
+	T.renamed = T.Report.Tally("Files Renamed")
+	T.moved = T.Report.Tally("Files Moved")
+	T.expired = T.Report.Tally("File Expiry Set")
+	T.commented = T.Report.Tally("Comments Added")
+	T.removed = T.Report.Tally("External Members Removed")
+}
+
+// policyData is the subset of a delivery's payload.data we read.
+type policyData struct {
+	File struct {
+		ID       json.Number `json:"id"`
+		Name     string      `json:"name"`
+		Path     string      `json:"path"`
+		Uploader struct {
+			ID json.Number `json:"id"`
+		} `json:"file_uploader"`
+	} `json:"file"`
+	Folder struct {
+		ID   json.Number `json:"id"`
+		Path string      `json:"path"`
+	} `json:"folder"`
+	ParentFolder struct {
+		ID   json.Number `json:"id"`
+		Path string      `json:"path"`
+	} `json:"parent_folder"`
+	User struct {
+		ID json.Number `json:"id"`
+	} `json:"user"`
+}
+
+// Handle applies the policy to a single delivery (or polled activity).
+func (T *FolderPolicyTask) Handle(ev WebhookEvent) (err error) {
+	subject := strings.ToLower(ev.Subject)
+	_, folder_event := policyFolderEvents[subject]
+	_, member_event := policyMemberEvents[subject]
+	if subject != triggerEvent && !folder_event && !member_event {
+		return nil
+	}
+
+	T.ensureTallies()
+
+	var d policyData
+	if derr := ev.DecodeData(&d); derr != nil {
+		Debug("[%s] could not decode payload data: %v", ev.Subject, derr)
+		return nil
+	}
+
+	sess, err := T.actor(firstSet(d.File.Uploader.ID.String(), d.User.ID.String()))
+	if err != nil {
+		return err
+	}
+
+	if subject == triggerEvent {
+		if IsBlank(d.File.ID.String()) {
+			return nil
+		}
+		file, err := sess.File(d.File.ID.String()).Info()
+		if err != nil {
+			return fmt.Errorf("file %s: %w", d.File.ID, err)
+		}
+		if file.Deleted || file.PermDeleted {
+			return nil
+		}
+		folder, err := sess.Folder(file.ParentID).Info()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+		if err = T.applyRules(sess, &file, folder); err != nil {
+			return err
+		}
+		return T.auditMembers(sess, folder, false)
+	}
+
+	folder_id := firstSet(d.Folder.ID.String(), d.ParentFolder.ID.String())
+	if IsBlank(folder_id) {
+		return nil
+	}
+	folder, err := sess.Folder(folder_id).Info()
+	if err != nil {
+		return fmt.Errorf("folder %s: %w", folder_id, err)
+	}
+	return T.auditMembers(sess, folder, member_event)
+}
+
+// actor returns a session for the user behind an event, falling back to the
+// task's own session when the event does not identify one.
+func (T *FolderPolicyTask) actor(user_id string) (*KWSession, error) {
+	if IsBlank(user_id) {
+		return &T.KW, nil
+	}
+
+	T.emailsMu.Lock()
+	email, ok := T.emails[user_id]
+	T.emailsMu.Unlock()
+
+	if !ok {
+		user, err := T.KW.Admin().UserByID(user_id)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", user_id, err)
+		}
+		email = user.Email
+		T.emailsMu.Lock()
+		T.emails[user_id] = email
+		T.emailsMu.Unlock()
+	}
+
+	sess := T.KW.Session(email)
+	return &sess, nil
+}
+
+// runBatch applies the policy to the existing content of each --users
+// account's folders, returning an error when any of it could not be
+// processed.
+func (T *FolderPolicyTask) runBatch() (err error) {
+	var failed int32
+	for _, email := range T.input.users {
+		sess := T.KW.Session(email)
+		folders, err := sess.OwnedFolders()
+		if err != nil {
+			Err("%s: %v", email, err)
+			atomic.AddInt32(&failed, 1)
+			continue
+		}
+		Log("Applying folder policy to %d folder(s) owned by %s ...", len(folders), email)
+
+		// Folder paths are cached so each file's rules can be matched without
+		// looking its parent up again.
+		var paths sync.Map
+		for _, f := range folders {
+			paths.Store(f.ID, f)
+		}
+
+		// The crawler logs each error; they are counted so the batch run
+		// reports failure.
+		sess.FolderCrawler(func(sess *KWSession, obj *KiteObject) (err error) {
+			defer func() {
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+			}()
+			if obj.Type == "d" {
+				paths.Store(obj.ID, *obj)
+				return T.auditMembers(sess, *obj, false)
+			}
+			if v, ok := paths.Load(obj.ParentID); ok {
+				return T.applyRules(sess, obj, v.(KiteObject))
+			}
+			folder, err := sess.Folder(obj.ParentID).Info()
+			if err != nil {
+				return err
+			}
+			return T.applyRules(sess, obj, folder)
+		}, folders...)
+	}
+	if n := atomic.LoadInt32(&failed); n > 0 {
+		return fmt.Errorf("folder policy could not be applied to %d item(s).", n)
+	}
+	return nil
+}
+
+// inFolder reports whether folder_path is folder or one of its subfolders.
+func inFolder(folder_path, folder string) bool {
+	folder = strings.Trim(folder, "/")
+	if IsBlank(folder) {
+		return true
+	}
+	folder_path = strings.ToLower(strings.Trim(folder_path, "/"))
+	folder = strings.ToLower(folder)
+	return folder_path == folder || strings.HasPrefix(folder_path, folder+"/")
+}
+
+// applyRules runs every matching rule against a file in folder. Each file is
+// processed once; later events for the same file (such as new versions) and
+// batch re-runs leave it alone.
+func (T *FolderPolicyTask) applyRules(sess *KWSession, file *KiteObject, folder KiteObject) (err error) {
+	if len(T.policy.Rules) == 0 {
+		return nil
+	}
+	var applied_at string
+	if T.applied.Get(file.ID, &applied_at) {
+		return nil
+	}
+	T.checked.Add(1)
+
+	added := time.Now()
+	if t, err := ReadKWTime(file.Created); err == nil {
+		added = t
+	}
+
+	var matched bool
+	for _, r := range T.policy.Rules {
+		if !inFolder(folder.Path, r.Folder) {
+			continue
+		}
+		if !IsBlank(r.Pattern) {
+			if ok, _ := path.Match(strings.ToLower(r.Pattern), strings.ToLower(file.Name)); !ok {
+				continue
+			}
+		}
+		matched = true
+
+		if !IsBlank(r.Rename) {
+			if err = T.rename(sess, file, r.Rename, added); err != nil {
+				return err
+			}
+		}
+		if !IsBlank(r.DatedSubfolder) {
+			if err = T.moveDated(sess, file, folder, added.Format(r.DatedSubfolder)); err != nil {
+				return err
+			}
+		}
+		if r.ExpireDays > 0 {
+			expire := added.Add(time.Duration(r.ExpireDays) * 24 * time.Hour)
+			Log("%s: %s/%s: setting expiry to %s.", sess.Username, folder.Path, file.Name, expire.Format("2006-01-02"))
+			if !T.input.dry_run {
+				if err = sess.File(file.ID).SetExpiry(expire); err != nil {
+					return fmt.Errorf("%s: set expiry: %w", file.Name, err)
+				}
+				T.expired.Add(1)
+			}
+		}
+		if !IsBlank(r.Comment) {
+			Log("%s: %s/%s: adding comment.", sess.Username, folder.Path, file.Name)
+			if !T.input.dry_run {
+				if err = sess.File(file.ID).AddComment(r.Comment); err != nil {
+					return fmt.Errorf("%s: add comment: %w", file.Name, err)
+				}
+				T.commented.Add(1)
+			}
+		}
+	}
+
+	if matched && !T.input.dry_run {
+		T.applied.Set(file.ID, time.Now().UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// rename renames a file according to a rename template.
+func (T *FolderPolicyTask) rename(sess *KWSession, file *KiteObject, template string, added time.Time) error {
+	ext := path.Ext(file.Name)
+	name := strings.NewReplacer(
+		"{name}", file.Name,
+		"{base}", strings.TrimSuffix(file.Name, ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+		"{date}", added.Format("2006-01-02"),
+	).Replace(template)
+	if IsBlank(name) || name == file.Name {
+		return nil
+	}
+
+	Log("%s: renaming %s to %s.", sess.Username, file.Name, name)
+	if T.input.dry_run {
+		return nil
+	}
+	if err := sess.File(file.ID).Rename(name); err != nil {
+		return fmt.Errorf("%s: rename: %w", file.Name, err)
+	}
+	file.Name = name
+	T.renamed.Add(1)
+	return nil
+}
+
+// moveDated moves a file into the dated subfolder of folder, creating it as
+// needed. Files already filed under that subfolder are left in place.
+func (T *FolderPolicyTask) moveDated(sess *KWSession, file *KiteObject, folder KiteObject, stamp string) error {
+	stamp = strings.Trim(stamp, "/")
+	if IsBlank(stamp) || strings.HasSuffix(strings.ToLower(folder.Path), "/"+strings.ToLower(stamp)) {
+		return nil
+	}
+
+	Log("%s: moving %s into %s/%s.", sess.Username, file.Name, folder.Path, stamp)
+	if T.input.dry_run {
+		return nil
+	}
+	dest, err := sess.Folder(folder.ID).ResolvePath(stamp)
+	if err != nil {
+		return fmt.Errorf("%s/%s: %w", folder.Path, stamp, err)
+	}
+	if err = sess.File(file.ID).MoveToFolder(dest.ID); err != nil {
+		return fmt.Errorf("%s: move: %w", file.Name, err)
+	}
+	file.ParentID = dest.ID
+	T.moved.Add(1)
+	return nil
+}
+
+// protectedRoot returns the protected folder path covering folder_path, if any.
+func (T *FolderPolicyTask) protectedRoot(folder_path string) (string, bool) {
+	for _, p := range T.policy.Protected.Folders {
+		if !IsBlank(strings.Trim(p, "/")) && inFolder(folder_path, p) {
+			return strings.Trim(p, "/"), true
+		}
+	}
+	return NONE, false
+}
+
+// isInternal reports whether email belongs to one of the internal domains.
+func (T *FolderPolicyTask) isInternal(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range T.policy.Protected.InternalDomains {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// seedBaselines records the current members of each protected folder that has
+// no baseline yet, before any event is handled, so a member added by the first
+// event is audited rather than accepted. Folders the task's account cannot
+// find get their baseline on the first event instead.
+func (T *FolderPolicyTask) seedBaselines() {
+	for _, p := range T.policy.Protected.Folders {
+		root_path := strings.Trim(p, "/")
+		if IsBlank(root_path) {
+			continue
+		}
+		root, err := T.KW.Folder("0").Find(root_path)
+		if err != nil {
+			Debug("%s: baseline deferred to the first event: %v", root_path, err)
+			continue
+		}
+		var baseline []string
+		if T.baselines.Get(root.ID, &baseline) {
+			continue
+		}
+		members, err := T.KW.Folder(root.ID).Members()
+		if err != nil {
+			Err("%s: %v", root_path, err)
+			continue
+		}
+		for _, m := range members {
+			baseline = append(baseline, strings.ToLower(m.User.Email))
+		}
+		T.baselines.Set(root.ID, baseline)
+		Log("Recorded %d existing member(s) of protected folder %s.", len(baseline), root_path)
+	}
+}
+
+// auditMembers removes external members added to the protected folder
+// covering folder since it was first seen. Members present at that point are
+// recorded as the baseline and left alone, as are internal members added
+// later. A baseline first recorded for a member event leaves out the external
+// members, other than the folder's owner, as one of them is the member whose
+// addition raised the event.
+func (T *FolderPolicyTask) auditMembers(sess *KWSession, folder KiteObject, member_event bool) (err error) {
+	root_path, ok := T.protectedRoot(folder.Path)
+	if !ok {
+		return nil
+	}
+
+	root := folder
+	if !strings.EqualFold(strings.Trim(folder.Path, "/"), root_path) {
+		if root, err = sess.Folder("0").Find(root_path); err != nil {
+			return fmt.Errorf("%s: %w", root_path, err)
+		}
+	}
+
+	members, err := sess.Folder(root.ID).Members()
+	if err != nil {
+		return fmt.Errorf("%s: %w", root_path, err)
+	}
+
+	// Audits of the same folder are serialized so concurrent events do not
+	// race on its baseline.
+	T.auditMu.Lock()
+	defer T.auditMu.Unlock()
+
+	var baseline []string
+	if !T.baselines.Get(root.ID, &baseline) {
+		for _, m := range members {
+			email := strings.ToLower(m.User.Email)
+			if member_event && !T.isInternal(email) && m.User.ID != root.UserID {
+				continue
+			}
+			baseline = append(baseline, email)
+		}
+		T.baselines.Set(root.ID, baseline)
+		Log("Recorded %d existing member(s) of protected folder %s.", len(baseline), root_path)
+		if !member_event {
+			return nil
+		}
+	}
+
+	known := make(map[string]struct{}, len(baseline))
+	for _, e := range baseline {
+		known[e] = struct{}{}
+	}
+
+	changed := false
+	for _, m := range members {
+		email := strings.ToLower(m.User.Email)
+		if _, ok := known[email]; ok {
+			continue
+		}
+		if T.isInternal(email) {
+			known[email] = struct{}{}
+			baseline = append(baseline, email)
+			changed = true
+			continue
+		}
+		Notice("%s: removing external member %s from protected folder %s.", sess.Username, m.User.Email, root_path)
+		if T.input.dry_run {
+			continue
+		}
+		if err := sess.Folder(root.ID).RemoveUserFromFolder(m.User.ID); err != nil {
+			Err("%s: remove %s: %v", root_path, m.User.Email, err)
+			continue
+		}
+		T.removed.Add(1)
+	}
+	if changed {
+		T.baselines.Set(root.ID, baseline)
+	}
+	return nil
+}
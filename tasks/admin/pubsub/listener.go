@@ -13,7 +13,9 @@ import (
 //
 // Main is non-blocking: it hands the task to the shared listener and returns,
 // so multiple webhook tasks can be activated together (each from its own
-// task-file section) and all are served on the single configured port.
+// task-file section) and all are served on the single configured port. When the
+// listener is not enabled, RunWebhookTask instead polls the admin activity log
+// and feeds Handle the same events, so the task works without inbound HTTP.
 
 func init() { RegisterWebhookTask(new(FileEventReactor)) }
 
@@ -22,6 +24,7 @@ func init() { RegisterWebhookTask(new(FileEventReactor)) }
 type FileEventReactor struct {
 	input struct {
 		verbose bool
+		poll    WebhookPollOptions
 	}
 	KiteBrokerTask
 }
@@ -44,13 +47,18 @@ func (T *FileEventReactor) Subjects() []string {
 
 func (T *FileEventReactor) Init() (err error) {
 	T.Flags.BoolVar(&T.input.verbose, "verbose", "Log the full event payload for each delivery.")
-	T.Flags.Order("verbose")
-	return T.Flags.Parse()
+	T.input.poll.RegisterFlags(&T.Flags)
+	T.Flags.Order("verbose", "lookback_hours", "page_size")
+	if err = T.Flags.Parse(); err != nil {
+		return err
+	}
+	return T.input.poll.Validate()
 }
 
-// Main hands this task to the shared listener and returns immediately.
+// Main hands this task to the shared listener and returns immediately, or
+// polls the activity log when the listener is not enabled.
 func (T *FileEventReactor) Main() (err error) {
-	return HostWebhookTask(T, T.KW)
+	return RunWebhookTask(T, T.input.poll)
 }
 
 // Handle processes a single delivery. It may use T.KW, T.Report, and T.input
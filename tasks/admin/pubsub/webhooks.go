@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	. "github.com/cmcoffee/kitebroker/core"
 )
@@ -13,21 +14,31 @@ func init() { RegisterAdminTask(new(WebhookManagerTask)) }
 
 // webhookExport is the on-disk representation used for export and import.
 // The PubSub API never returns secret or token, so those are blank on export
-// and must be supplied in the file before importing.
+// and must be supplied in the file before importing. An entry without
+// "enabled" leaves the webhook's state as it is, or enabled when created.
 type webhookExport struct {
 	ID            string   `json:"id,omitempty"`
 	URL           string   `json:"url"`
 	Token         string   `json:"token,omitempty"`
 	Secret        string   `json:"secret,omitempty"`
-	Enabled       bool     `json:"enabled"`
+	Enabled       *bool    `json:"enabled,omitempty"`
 	Subscriptions []string `json:"subscriptions"`
 }
 
+// enabled returns the entry's enabled state, or fallback when it has none.
+func (w webhookExport) enabled(fallback bool) bool {
+	if w.Enabled == nil {
+		return fallback
+	}
+	return *w.Enabled
+}
+
 // WebhookManagerTask manages PubSub consumer webhooks: listing, exporting to
-// and importing from a file, and creating, updating, and deleting individual
-// webhooks.
+// and importing from a file, reconciling against a desired-state file, health
+// checking, rotating the listener's secret, and creating, updating, and
+// deleting individual webhooks.
 type WebhookManagerTask struct {
-	action string // resolved operation: list, export, import, create, update, or delete.
+	action string // resolved operation: list, export, import, sync, health, rotate_secret, create, update, or delete.
 	input  struct {
 		uuid          string
 		file          string
@@ -37,6 +48,9 @@ type WebhookManagerTask struct {
 		subscriptions []string
 		disable       bool
 		all           bool
+		dry_run       bool
+		prune         bool
+		grace_hours   int
 	}
 	KiteBrokerTask
 }
@@ -44,13 +58,16 @@ type WebhookManagerTask struct {
 func (T WebhookManagerTask) Name() string { return "pubsub_webhooks" }
 
 func (T WebhookManagerTask) Desc() string {
-	return "PubSub: Manage PubSub consumer webhooks (list/export/import/create/update/delete)."
+	return "PubSub: Manage PubSub consumer webhooks (list/export/import/sync/health/rotate_secret/create/update/delete)."
 }
 
 func (T *WebhookManagerTask) Init() (err error) {
 	do_list := T.Flags.Bool("list", "List all configured webhooks.")
 	do_export := T.Flags.Bool("export", "Export webhook(s) to --file (all, or one when --uuid is set).")
 	do_import := T.Flags.Bool("import", "Import and create webhooks from --file.")
+	do_sync := T.Flags.Bool("sync", "Reconcile the appliance's webhooks with the desired state in --file (create/update/delete).")
+	do_health := T.Flags.Bool("health", "Report webhooks the appliance has marked as failing.")
+	do_rotate := T.Flags.Bool("rotate_secret", "Rotate the listener's signing secret (and token, when set) on the appliance webhook and in the local config.")
 	do_create := T.Flags.Bool("create", "Create a new webhook.")
 	do_delete := T.Flags.Bool("delete", "Delete the webhook identified by --uuid.")
 	T.Flags.StringVar(&T.input.uuid, "uuid", "<uuid of webhook>", "Webhook UUID to act on (required for delete; optional for export; set with fields to update).")
@@ -61,7 +78,10 @@ func (T *WebhookManagerTask) Init() (err error) {
 	T.Flags.MultiVar(&T.input.subscriptions, "subscriptions", "<file_folder_modify.>", "Subscription pattern(s) (required for create and full update); use 'all' to subscribe to every subject.")
 	T.Flags.BoolVar(&T.input.disable, "disable", "Create or update the webhook in a disabled state.")
 	T.Flags.BoolVar(&T.input.all, "all", "With --delete, delete every webhook (prompts for confirmation).")
-	T.Flags.Order("list", "export", "import", "create", "delete", "uuid", "all", "file", "url", "secret", "token", "subscriptions", "disable")
+	T.Flags.BoolVar(&T.input.dry_run, "dry_run", "With --sync, show the plan without applying it.")
+	T.Flags.BoolVar(&T.input.prune, "prune", "With --sync, delete webhooks not in --file (prompts for confirmation).")
+	T.Flags.IntVar(&T.input.grace_hours, "grace_hours", 24, "With --rotate_secret, hours the listener keeps accepting the previous secret and token.")
+	T.Flags.Order("list", "export", "import", "sync", "health", "rotate_secret", "create", "delete", "uuid", "all", "file", "dry_run", "prune", "grace_hours", "url", "secret", "token", "subscriptions", "disable")
 	if err = T.Flags.Parse(); err != nil {
 		return err
 	}
@@ -80,6 +100,15 @@ func (T *WebhookManagerTask) Init() (err error) {
 	if *do_import {
 		actions = append(actions, "import")
 	}
+	if *do_sync {
+		actions = append(actions, "sync")
+	}
+	if *do_health {
+		actions = append(actions, "health")
+	}
+	if *do_rotate {
+		actions = append(actions, "rotate_secret")
+	}
 	if *do_create {
 		actions = append(actions, "create")
 	}
@@ -88,7 +117,7 @@ func (T *WebhookManagerTask) Init() (err error) {
 	}
 
 	if len(actions) > 1 {
-		return fmt.Errorf("Please specify only one of --list, --export, --import, --create, or --delete.")
+		return fmt.Errorf("Please specify only one of --list, --export, --import, --sync, --health, --rotate_secret, --create, or --delete.")
 	}
 
 	if len(actions) == 1 {
@@ -96,17 +125,25 @@ func (T *WebhookManagerTask) Init() (err error) {
 	} else if !IsBlank(T.input.uuid) && T.hasUpdatableField() {
 		T.action = "update"
 	} else {
-		return fmt.Errorf("No action specified. Use --list, --export, --import, --create, --delete, or set --uuid with fields (--url/--secret/--subscriptions/--token/--disable) to update.")
+		return fmt.Errorf("No action specified. Use --list, --export, --import, --sync, --health, --rotate_secret, --create, --delete, or set --uuid with fields (--url/--secret/--subscriptions/--token/--disable) to update.")
+	}
+
+	if T.input.prune && T.action != "sync" {
+		return fmt.Errorf("--prune requires --sync.")
 	}
 
 	// Per-action validation.
 	switch T.action {
-	case "export", "import":
+	case "export", "import", "sync":
 		if IsBlank(T.input.file) {
 			return fmt.Errorf("--file is required for %s.", T.action)
 		}
 	case "create":
 		return T.requireWebhookFields()
+	case "rotate_secret":
+		if T.input.grace_hours < 0 {
+			return fmt.Errorf("--grace_hours cannot be negative.")
+		}
 	case "delete":
 		if IsBlank(T.input.uuid) && !T.input.all {
 			return fmt.Errorf("delete requires --uuid=<uuid of webhook>, or --all to delete every webhook.")
@@ -156,6 +193,12 @@ func (T *WebhookManagerTask) Main() (err error) {
 		return T.export()
 	case "import":
 		return T.doImport()
+	case "sync":
+		return T.sync()
+	case "health":
+		return T.health()
+	case "rotate_secret":
+		return T.rotateSecret()
 	case "create":
 		return T.create()
 	case "update":
@@ -228,10 +271,11 @@ func (T *WebhookManagerTask) export() (err error) {
 
 	out := make([]webhookExport, 0, len(webhooks))
 	for _, w := range webhooks {
+		enabled := w.Enabled
 		out = append(out, webhookExport{
 			ID:            w.ID,
 			URL:           w.URL,
-			Enabled:       w.Enabled,
+			Enabled:       &enabled,
 			Subscriptions: w.Subscriptions,
 		})
 		exported.Add(1)
@@ -255,34 +299,21 @@ func (T *WebhookManagerTask) export() (err error) {
 func (T *WebhookManagerTask) doImport() (err error) {
 	imported := T.Report.Tally("Webhooks Imported")
 
-	data, err := os.ReadFile(T.input.file)
+	in, err := readWebhookFile(T.input.file)
 	if err != nil {
 		return err
 	}
-
-	var in []webhookExport
-	if err = json.Unmarshal(data, &in); err != nil {
-		return fmt.Errorf("Could not parse %s: %w", T.input.file, err)
-	}
 	if len(in) == 0 {
 		Notice("No webhooks found in %s.", T.input.file)
 		return nil
 	}
 
 	for i, w := range in {
-		w.Subscriptions = expandSubscriptions(w.Subscriptions)
 		if IsBlank(w.URL) || len(w.Subscriptions) == 0 {
 			Err("Entry %d (%s): skipping, url and subscriptions are required for import.", i+1, w.URL)
 			continue
 		}
-		opts := PostJSON{"enabled": w.Enabled}
-		if !IsBlank(w.Secret) {
-			opts["secret"] = w.Secret
-		}
-		if !IsBlank(w.Token) {
-			opts["token"] = w.Token
-		}
-		created, err := T.KW.CreateWebhook(w.URL, w.Subscriptions, opts)
+		created, err := T.KW.CreateWebhook(w.URL, w.Subscriptions, syncOptions(w, true))
 		if err != nil {
 			Err("Entry %d (%s): %v", i+1, w.URL, err)
 			continue
@@ -398,3 +429,77 @@ func (T *WebhookManagerTask) deleteAll() (err error) {
 	Log("Deleted %d of %d webhook(s).", deleted.Value(), len(webhooks))
 	return nil
 }
+
+// rotateSecret replaces the listener's signing secret, and its delivery token
+// when one is in use, on both the appliance webhook and the local config. The
+// local config is updated first, with the previous values still accepted for
+// --grace_hours, and the appliance is only patched once a listener running in
+// another process has had time to load the new values, so no delivery is
+// rejected while the appliance switches over. If the appliance update fails,
+// the local config is restored.
+func (T *WebhookManagerTask) rotateSecret() (err error) {
+	rotated := T.Report.Tally("Secrets Rotated")
+
+	target, err := T.rotationTarget()
+	if err != nil {
+		return err
+	}
+
+	current := LoadWebhookCredentials()
+	secret := T.input.secret
+	if IsBlank(secret) {
+		secret = string(RandBytes(40))
+	}
+	token := T.input.token
+	if IsBlank(token) && !IsBlank(current.Token) {
+		token = string(RandBytes(40))
+	}
+
+	prev := RotateWebhookCredentials(secret, token, time.Duration(T.input.grace_hours)*time.Hour)
+
+	// A listener in another process picks up stored credentials on its next
+	// reload check; the appliance must not sign with the new secret before then.
+	Log("Waiting for running listeners to load the new credentials ...")
+	time.Sleep(WebhookReloadInterval + time.Second)
+
+	payload := PostJSON{"secret": secret}
+	if !IsBlank(token) {
+		payload["token"] = token
+	}
+	if _, err = T.KW.Webhook(target.ID).Patch(payload); err != nil {
+		SaveWebhookCredentials(prev)
+		return fmt.Errorf("updating webhook %s: %w (local credentials left unchanged)", target.ID, err)
+	}
+
+	rotated.Add(1)
+	Log("Rotated the signing secret for webhook %s (%s).", target.ID, target.URL)
+	if !IsBlank(token) {
+		Log("Rotated the delivery token for webhook %s.", target.ID)
+	}
+	if T.input.grace_hours > 0 {
+		Log("The previous credentials are accepted for %d hour(s).", T.input.grace_hours)
+	}
+	return nil
+}
+
+// rotationTarget resolves the webhook whose secret is rotated: the one given
+// by --uuid, otherwise the one registered for the listener's public URL.
+func (T *WebhookManagerTask) rotationTarget() (target KiteWebhook, err error) {
+	if !IsBlank(T.input.uuid) {
+		return T.KW.Webhook(T.input.uuid).Info()
+	}
+	public_url := WebhookListenerPublicURL()
+	if IsBlank(public_url) {
+		return target, fmt.Errorf("--rotate_secret requires --uuid, or a listener public_url configured via --setup.")
+	}
+	webhooks, err := T.KW.Webhooks()
+	if err != nil {
+		return target, err
+	}
+	for _, w := range webhooks {
+		if w.MatchesURL(public_url) {
+			return w, nil
+		}
+	}
+	return target, fmt.Errorf("no webhook is registered for %s; use --uuid to select one.", public_url)
+}
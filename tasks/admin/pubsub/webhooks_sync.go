@@ -0,0 +1,296 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// webhookChange is a single step of a --sync plan.
+type webhookChange struct {
+	op      string        // create, update, or delete.
+	current KiteWebhook   // the appliance webhook acted on (update, delete).
+	desired webhookExport // the desired entry (create, update).
+	reason  string
+	prune   bool // a delete of a webhook missing from the desired state.
+}
+
+// readWebhookFile loads a webhook export/desired-state file.
+func readWebhookFile(file string) (out []webhookExport, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %w", file, err)
+	}
+	for i := range out {
+		out[i].Subscriptions = expandSubscriptions(out[i].Subscriptions)
+	}
+	return out, nil
+}
+
+// planSync diffs the appliance's webhooks against the desired state, matching
+// by URL and comparing subscription sets and, when the entry sets it, enabled
+// state.
+//
+// Secrets and tokens cannot be read back from the API, so they are sent with
+// every create and update when the entry sets them, but never cause an update
+// on their own.
+func planSync(current []KiteWebhook, desired []webhookExport) (changes []webhookChange, unchanged int, err error) {
+	claimed := make(map[string]struct{})
+
+	for i, d := range desired {
+		if IsBlank(d.URL) || len(d.Subscriptions) == 0 {
+			return nil, 0, fmt.Errorf("entry %d (%s): url and subscriptions are required.", i+1, d.URL)
+		}
+		for _, prev := range desired[:i] {
+			if (KiteWebhook{URL: prev.URL}).MatchesURL(d.URL) {
+				return nil, 0, fmt.Errorf("entry %d: %s is listed more than once.", i+1, d.URL)
+			}
+		}
+
+		var matches []KiteWebhook
+		for _, w := range current {
+			if w.MatchesURL(d.URL) {
+				matches = append(matches, w)
+			}
+		}
+		if len(matches) == 0 {
+			changes = append(changes, webhookChange{op: "create", desired: d, reason: "not registered"})
+			continue
+		}
+
+		// Keep the registration already in the desired state when there is
+		// one, so duplicates are removed without touching the good copy.
+		keep := matches[0]
+		for _, w := range matches {
+			if w.HasSubscriptions(d.Subscriptions) && w.Enabled == d.enabled(w.Enabled) {
+				keep = w
+				break
+			}
+		}
+		claimed[keep.ID] = struct{}{}
+
+		var reasons []string
+		if !keep.HasSubscriptions(d.Subscriptions) {
+			reasons = append(reasons, fmt.Sprintf("subscriptions %s -> %s", strings.Join(keep.Subscriptions, ","), strings.Join(d.Subscriptions, ",")))
+		}
+		if keep.Enabled != d.enabled(keep.Enabled) {
+			reasons = append(reasons, fmt.Sprintf("enabled %t -> %t", keep.Enabled, *d.Enabled))
+		}
+		if len(reasons) > 0 {
+			changes = append(changes, webhookChange{op: "update", current: keep, desired: d, reason: strings.Join(reasons, "; ")})
+		} else {
+			unchanged++
+		}
+
+		for _, w := range matches {
+			if w.ID == keep.ID {
+				continue
+			}
+			claimed[w.ID] = struct{}{}
+			changes = append(changes, webhookChange{op: "delete", current: w, reason: fmt.Sprintf("duplicate of %s", keep.ID)})
+		}
+	}
+
+	for _, w := range current {
+		if _, ok := claimed[w.ID]; !ok {
+			changes = append(changes, webhookChange{op: "delete", current: w, reason: "not in desired state", prune: true})
+		}
+	}
+	return changes, unchanged, nil
+}
+
+// sync reconciles the appliance's webhooks with the desired state in --file:
+// it shows the plan and, unless --dry_run is set, applies it. Webhooks missing
+// from the file are only deleted with --prune, after confirmation, so an empty
+// or truncated file cannot wipe the appliance's webhooks.
+func (T *WebhookManagerTask) sync() (err error) {
+	desired, err := readWebhookFile(T.input.file)
+	if err != nil {
+		return err
+	}
+	current, err := T.KW.Webhooks()
+	if err != nil {
+		return err
+	}
+
+	changes, unchanged, err := planSync(current, desired)
+	if err != nil {
+		return fmt.Errorf("%s: %w", T.input.file, err)
+	}
+
+	var kept []webhookChange
+	if !T.input.prune {
+		var applied []webhookChange
+		for _, c := range changes {
+			if c.prune {
+				kept = append(kept, c)
+			} else {
+				applied = append(applied, c)
+			}
+		}
+		changes = applied
+	}
+
+	counts := make(map[string]int)
+	for _, c := range changes {
+		counts[c.op]++
+	}
+	Log("Sync plan: %d to create, %d to update, %d to delete, %d unchanged.", counts["create"], counts["update"], counts["delete"], unchanged)
+	for _, c := range changes {
+		switch c.op {
+		case "create":
+			Log("  + create %s [%s]", c.desired.URL, strings.Join(c.desired.Subscriptions, ", "))
+		case "update":
+			Log("  ~ update %s  %s: %s", c.current.ID, c.current.URL, c.reason)
+		case "delete":
+			Log("  - delete %s  %s: %s", c.current.ID, c.current.URL, c.reason)
+		}
+	}
+	for _, c := range kept {
+		Log("  = keep %s  %s: %s (use --prune to delete)", c.current.ID, c.current.URL, c.reason)
+	}
+
+	if len(changes) == 0 {
+		if len(kept) > 0 {
+			Log("No changes to apply.")
+		} else {
+			Log("Webhooks already match %s.", T.input.file)
+		}
+		return nil
+	}
+	if T.input.dry_run {
+		Notice("Dry run; no changes were applied.")
+		return nil
+	}
+
+	var pruned int
+	for _, c := range changes {
+		if c.prune {
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		// Pause the loading animation so it doesn't clobber the prompt.
+		PleaseWait.Hide()
+		confirmed := ConfirmDefault(fmt.Sprintf("Delete %d of %d webhook(s) not in %s?", pruned, len(current), T.input.file), false)
+		PleaseWait.Show()
+		if !confirmed {
+			Notice("Aborted; no changes were applied.")
+			return nil
+		}
+	}
+
+	created := T.Report.Tally("Webhooks Created")
+	updated := T.Report.Tally("Webhooks Updated")
+	deleted := T.Report.Tally("Webhooks Deleted")
+
+	// Deletions run last, so a failed create or update never leaves a URL
+	// without a registration.
+	for _, op := range []string{"create", "update", "delete"} {
+		for _, c := range changes {
+			if c.op != op {
+				continue
+			}
+			switch op {
+			case "create":
+				w, err := T.KW.CreateWebhook(c.desired.URL, c.desired.Subscriptions, syncOptions(c.desired, true))
+				if err != nil {
+					Err("create %s: %v", c.desired.URL, err)
+					continue
+				}
+				created.Add(1)
+				Log("Created webhook %s (%s).", w.ID, w.URL)
+			case "update":
+				if _, err := T.KW.Webhook(c.current.ID).Patch(syncPatch(c.current, c.desired)); err != nil {
+					Err("update %s (%s): %v", c.current.ID, c.current.URL, err)
+					continue
+				}
+				updated.Add(1)
+				Log("Updated webhook %s (%s).", c.current.ID, c.current.URL)
+			case "delete":
+				if err := T.KW.Webhook(c.current.ID).Delete(); err != nil {
+					Err("delete %s (%s): %v", c.current.ID, c.current.URL, err)
+					continue
+				}
+				deleted.Add(1)
+				Log("Deleted webhook %s (%s).", c.current.ID, c.current.URL)
+			}
+		}
+	}
+	return nil
+}
+
+// syncOptions builds the optional create params for a desired entry, with
+// enabled as the state used when the entry does not set one.
+func syncOptions(w webhookExport, enabled bool) PostJSON {
+	opts := PostJSON{"enabled": w.enabled(enabled)}
+	if !IsBlank(w.Secret) {
+		opts["secret"] = w.Secret
+	}
+	if !IsBlank(w.Token) {
+		opts["token"] = w.Token
+	}
+	return opts
+}
+
+// syncPatch builds the partial update bringing current to the desired entry.
+// Only the fields that differ are sent, along with a secret or token when
+// the entry sets one, so those the file leaves out are kept.
+func syncPatch(current KiteWebhook, w webhookExport) PostJSON {
+	patch := make(PostJSON)
+	if current.URL != w.URL {
+		patch["url"] = w.URL
+	}
+	if !current.HasSubscriptions(w.Subscriptions) {
+		patch["subscriptions"] = w.Subscriptions
+	}
+	if enabled := w.enabled(current.Enabled); enabled != current.Enabled {
+		patch["enabled"] = enabled
+	}
+	if !IsBlank(w.Secret) {
+		patch["secret"] = w.Secret
+	}
+	if !IsBlank(w.Token) {
+		patch["token"] = w.Token
+	}
+	return patch
+}
+
+// health reports webhooks the appliance has marked as failing, along with
+// disabled webhooks, which receive no deliveries at all.
+func (T *WebhookManagerTask) health() (err error) {
+	healthy := T.Report.Tally("Webhooks Healthy")
+	failing := T.Report.Tally("Webhooks Failing")
+	disabled := T.Report.Tally("Webhooks Disabled")
+
+	webhooks, err := T.KW.Webhooks()
+	if err != nil {
+		return err
+	}
+	if len(webhooks) == 0 {
+		Notice("No webhooks are currently configured.")
+		return nil
+	}
+
+	for _, w := range webhooks {
+		switch {
+		case w.Failing():
+			failing.Add(1)
+			Err("Webhook %s (%s) is failing: %s", w.ID, w.URL, firstSet(w.Status.Description, "no description provided"))
+		case !w.Enabled:
+			disabled.Add(1)
+			Warn("Webhook %s (%s) is disabled.", w.ID, w.URL)
+		default:
+			healthy.Add(1)
+		}
+	}
+
+	Log("Checked %d webhook(s): %d healthy, %d failing, %d disabled.", len(webhooks), healthy.Value(), failing.Value(), disabled.Value())
+	return nil
+}
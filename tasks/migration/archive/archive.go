@@ -0,0 +1,435 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// An export archive is a tar or zip file holding the content of every
+// exported file version as versions/<file id>/<version id>, and
+// manifest.json describing the users, folders, files, versions, comments,
+// members and activity that the content belongs to. Entries are stored
+// uncompressed, so the import can read any of them in place.
+//
+// An encrypted archive is the tar or zip file encrypted with AES-256-CTR and
+// authenticated with HMAC-SHA256, both keyed from a passphrase by PBKDF2:
+//
+//	magic | salt | iv | ciphertext | hmac(magic | salt | iv | ciphertext)
+
+const (
+	archiveFormat = 1               // Version of the manifest layout.
+	manifestEntry = "manifest.json" // Name of the manifest entry.
+	encMagic      = "KBARCHIVE-ENC1\n"
+	encSaltLen    = 16
+	encIterations = 200000
+)
+
+// archiveManifest describes the content of an export archive.
+type archiveManifest struct {
+	Format   int             `json:"format"`
+	Server   string          `json:"server"`
+	Exported time.Time       `json:"exported"`
+	Users    []archiveUser   `json:"users"`
+	Folders  []archiveFolder `json:"folders"`
+	Files    []archiveFile   `json:"files"`
+}
+
+// archiveUser is an exported user.
+type archiveUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// archiveFolder is an exported folder. Path is relative to the export, and
+// KWPath is the folder's path on the server it was exported from.
+type archiveFolder struct {
+	ID          string          `json:"id"`
+	ParentID    string          `json:"parent_id,omitempty"` // Blank for the exported folders themselves.
+	Owner       string          `json:"owner"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Path        string          `json:"path"`
+	KWPath      string          `json:"kw_path"`
+	Created     time.Time       `json:"created"`
+	Modified    time.Time       `json:"modified"`
+	Members     []archiveMember `json:"members,omitempty"`
+	Activity    activitySummary `json:"activity"`
+}
+
+// archiveMember is a member of an exported folder.
+type archiveMember struct {
+	Email  string `json:"email"`
+	Role   string `json:"role"`
+	RoleID int    `json:"role_id"`
+}
+
+// archiveFile is an exported file.
+type archiveFile struct {
+	ID          string           `json:"id"`
+	FolderID    string           `json:"folder_id"`
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	Created     time.Time        `json:"created"`
+	Modified    time.Time        `json:"modified"`
+	Size        int64            `json:"size"`
+	Fingerprint string           `json:"fingerprint,omitempty"`
+	Versions    []archiveVersion `json:"versions"` // Oldest first; the last is the current content.
+	Comments    []archiveComment `json:"comments,omitempty"`
+	Activity    activitySummary  `json:"activity"`
+}
+
+// archiveVersion is an exported version of a file, stored as Entry.
+type archiveVersion struct {
+	ID          string    `json:"id"`
+	Entry       string    `json:"entry"`
+	Uploader    string    `json:"uploader,omitempty"`
+	Created     time.Time `json:"created"`
+	Modified    time.Time `json:"modified"`
+	Size        int64     `json:"size"`
+	Fingerprint string    `json:"fingerprint,omitempty"` // As reported by Kiteworks.
+	SHA256      string    `json:"sha256"`                // Of the stored content.
+}
+
+// archiveComment is a comment on an exported file.
+type archiveComment struct {
+	ID       string    `json:"id"`
+	ParentID string    `json:"parent_id,omitempty"`
+	Creator  string    `json:"creator"`
+	Created  time.Time `json:"created"`
+	Contents string    `json:"contents"`
+}
+
+// activitySummary summarizes the activity log of a folder or file.
+type activitySummary struct {
+	Count  int            `json:"count"`
+	First  time.Time      `json:"first,omitempty"`
+	Last   time.Time      `json:"last,omitempty"`
+	Events map[string]int `json:"events,omitempty"`
+}
+
+// summarizeActivity tallies activities by event.
+func summarizeActivity(activities []KiteActivity) (summary activitySummary) {
+	for _, a := range activities {
+		summary.Count++
+		if summary.Events == nil {
+			summary.Events = make(map[string]int)
+		}
+		summary.Events[a.Event]++
+		created, err := ReadKWTime(a.Created)
+		if err != nil {
+			continue
+		}
+		if summary.First.IsZero() || created.Before(summary.First) {
+			summary.First = created
+		}
+		if created.After(summary.Last) {
+			summary.Last = created
+		}
+	}
+	return
+}
+
+// versionEntry returns the archive entry of a file version.
+func versionEntry(file_id, version_id string) string {
+	return fmt.Sprintf("versions/%s/%s", file_id, version_id)
+}
+
+// archiveWriter writes the entries of an archive.
+type archiveWriter interface {
+	// Add stores size bytes read from src as the entry name.
+	Add(name string, size int64, modified time.Time, src io.Reader) error
+	Close() error
+}
+
+// newArchiveWriter returns a writer of the archive format named by the
+// extension of filename, ignoring a trailing ".enc".
+func newArchiveWriter(filename string, dst io.Writer) (archiveWriter, error) {
+	switch strings.ToLower(filepath.Ext(strings.TrimSuffix(filename, ".enc"))) {
+	case ".tar":
+		return &tarWriter{tar.NewWriter(dst)}, nil
+	case ".zip":
+		return &zipWriter{zip.NewWriter(dst)}, nil
+	default:
+		return nil, fmt.Errorf("%s: archive must be a .tar or .zip file", filename)
+	}
+}
+
+// tarWriter writes a tar archive.
+type tarWriter struct {
+	*tar.Writer
+}
+
+// Add stores an entry in the tar archive.
+func (T *tarWriter) Add(name string, size int64, modified time.Time, src io.Reader) error {
+	if err := T.WriteHeader(&tar.Header{
+		Name:    name,
+		Size:    size,
+		Mode:    0600,
+		ModTime: modified,
+		Format:  tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	n, err := io.Copy(T.Writer, src)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s: expected %d bytes, got %d", name, size, n)
+	}
+	return nil
+}
+
+// zipWriter writes a zip archive.
+type zipWriter struct {
+	*zip.Writer
+}
+
+// Add stores an entry in the zip archive.
+func (Z *zipWriter) Add(name string, size int64, modified time.Time, src io.Reader) error {
+	w, err := Z.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s: expected %d bytes, got %d", name, size, n)
+	}
+	return nil
+}
+
+// archiveEntry locates the content of an entry within the archive file.
+type archiveEntry struct {
+	offset int64
+	size   int64
+}
+
+// archiveReader reads the entries of a tar or zip archive in place.
+type archiveReader struct {
+	file    *os.File
+	entries map[string]archiveEntry
+}
+
+// nopCloser is an entry's content; closing it leaves the archive open.
+type nopCloser struct {
+	*io.SectionReader
+}
+
+// Close does nothing.
+func (nopCloser) Close() error { return nil }
+
+// openArchive indexes the entries of the tar or zip archive in f.
+func openArchive(f *os.File) (*archiveReader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	A := &archiveReader{file: f, entries: make(map[string]archiveEntry)}
+
+	if bytes.Equal(magic, []byte("PK\x03\x04")) {
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		for _, e := range zr.File {
+			if e.Method != zip.Store {
+				return nil, fmt.Errorf("%s: %s is compressed; only archives written by export can be imported", f.Name(), e.Name)
+			}
+			offset, err := e.DataOffset()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", f.Name(), err)
+			}
+			A.entries[e.Name] = archiveEntry{offset, int64(e.UncompressedSize64)}
+		}
+		return A, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// tar reads no further than each header, so the file's offset after Next
+	// is where the entry's content starts.
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		A.entries[hdr.Name] = archiveEntry{offset, hdr.Size}
+	}
+	return A, nil
+}
+
+// Open returns the content of an entry.
+func (A *archiveReader) Open(name string) (ReadSeekCloser, error) {
+	e, ok := A.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s not found in archive", A.file.Name(), name)
+	}
+	return nopCloser{io.NewSectionReader(A.file, e.offset, e.size)}, nil
+}
+
+// Manifest reads the archive's manifest.
+func (A *archiveReader) Manifest() (manifest *archiveManifest, err error) {
+	r, err := A.Open(manifestEntry)
+	if err != nil {
+		return nil, err
+	}
+	manifest = new(archiveManifest)
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("%s: %s: %v", A.file.Name(), manifestEntry, err)
+	}
+	if manifest.Format != archiveFormat {
+		return nil, fmt.Errorf("%s: unsupported archive format %d", A.file.Name(), manifest.Format)
+	}
+	return manifest, nil
+}
+
+// archiveKeys derives the cipher and MAC keys of an encrypted archive.
+func archiveKeys(passphrase string, salt []byte) (cipher_key, mac_key []byte) {
+	key := pbkdf2.Key([]byte(passphrase), salt, encIterations, 64, sha256.New)
+	return key[:32], key[32:]
+}
+
+// encryptWriter encrypts an archive as it is written.
+type encryptWriter struct {
+	dst    io.Writer
+	mac    hash.Hash
+	stream cipher.StreamWriter
+}
+
+// newEncryptWriter writes the header of an encrypted archive to dst, and
+// returns a writer encrypting the archive that follows it.
+func newEncryptWriter(dst io.Writer, passphrase string) (*encryptWriter, error) {
+	header := make([]byte, len(encMagic)+encSaltLen+aes.BlockSize)
+	copy(header, encMagic)
+	if _, err := rand.Read(header[len(encMagic):]); err != nil {
+		return nil, err
+	}
+	salt := header[len(encMagic) : len(encMagic)+encSaltLen]
+	iv := header[len(encMagic)+encSaltLen:]
+
+	cipher_key, mac_key := archiveKeys(passphrase, salt)
+	block, err := aes.NewCipher(cipher_key)
+	if err != nil {
+		return nil, err
+	}
+
+	E := &encryptWriter{dst: dst, mac: hmac.New(sha256.New, mac_key)}
+	out := io.MultiWriter(dst, E.mac)
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	E.stream = cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: out}
+	return E, nil
+}
+
+// Write encrypts p.
+func (E *encryptWriter) Write(p []byte) (int, error) {
+	return E.stream.Write(p)
+}
+
+// Close writes the MAC that ends the encrypted archive.
+func (E *encryptWriter) Close() error {
+	_, err := E.dst.Write(E.mac.Sum(nil))
+	return err
+}
+
+// isEncrypted reports whether f is an encrypted archive.
+func isEncrypted(f *os.File) bool {
+	magic := make([]byte, len(encMagic))
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return string(magic) == encMagic
+}
+
+// decryptArchive authenticates the encrypted archive src and decrypts it to
+// a temporary file, which the caller removes.
+func decryptArchive(src *os.File, passphrase string) (*os.File, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header_len := int64(len(encMagic) + encSaltLen + aes.BlockSize)
+	body_len := info.Size() - header_len - sha256.Size
+	if body_len < 0 {
+		return nil, fmt.Errorf("%s: truncated archive", src.Name())
+	}
+
+	header := make([]byte, header_len)
+	if _, err := src.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	salt := header[len(encMagic) : len(encMagic)+encSaltLen]
+	iv := header[len(encMagic)+encSaltLen:]
+	cipher_key, mac_key := archiveKeys(passphrase, salt)
+
+	mac := hmac.New(sha256.New, mac_key)
+	if _, err := io.Copy(mac, io.NewSectionReader(src, 0, header_len+body_len)); err != nil {
+		return nil, err
+	}
+	sum := make([]byte, sha256.Size)
+	if _, err := src.ReadAt(sum, header_len+body_len); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%s: wrong passphrase, or the archive has been altered", src.Name())
+	}
+
+	block, err := aes.NewCipher(cipher_key)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", "kitebroker-archive-*")
+	if err != nil {
+		return nil, err
+	}
+	plain := cipher.StreamReader{S: cipher.NewCTR(block, iv), R: io.NewSectionReader(src, header_len, body_len)}
+	if _, err := io.Copy(tmp, plain); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
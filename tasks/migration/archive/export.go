@@ -0,0 +1,427 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterAdminTask(new(ExportTask)) }
+
+// ExportTask writes users' folders, with every file version, comment, member
+// and an activity summary, to a portable archive.
+type ExportTask struct {
+	KiteBrokerTask
+	user_emails []string
+	folders     []string
+	out         string
+	encrypt     bool
+	passphrase  string
+	archive     archiveWriter
+	manifest    archiveManifest
+	lock        sync.Mutex // Guards archive and manifest.
+	emails      sync.Map   // User id -> email
+	file_count  Tally
+	data        Tally
+}
+
+// Name returns the name of this task.
+func (T *ExportTask) Name() string {
+	return "export"
+}
+
+// Desc returns a description of this task.
+func (T *ExportTask) Desc() string {
+	return "Files & Folders:Export folders, file versions, comments and members to a tar or zip archive."
+}
+
+// Init parses the flags, and prompts for the passphrase of an encrypted
+// archive.
+func (T *ExportTask) Init() (err error) {
+	T.Flags.MultiVar(&T.user_emails, "users", "<user@domain.com>", "User(s) whose owned folders are exported.")
+	T.Flags.MultiVar(&T.folders, "folders", "<folder path>", "Export only these folders of the users. (default: all owned folders)")
+	T.Flags.StringVar(&T.out, "out", "<export.tar|export.zip>", "Archive to write, as a tar or zip file.")
+	T.Flags.BoolVar(&T.encrypt, "encrypt", "Encrypt the archive with a passphrase.")
+	T.Flags.Order("users", "folders", "out", "encrypt")
+	if err = T.Flags.Parse(); err != nil {
+		return err
+	}
+
+	if len(T.user_emails) == 0 {
+		return fmt.Errorf("must specify at least one user to export.")
+	}
+	if IsBlank(T.out) {
+		return fmt.Errorf("must specify an archive to write with --out.")
+	}
+	if _, err := newArchiveWriter(T.out, io.Discard); err != nil {
+		return err
+	}
+	if _, err := os.Stat(T.out); err == nil {
+		return fmt.Errorf("%s already exists.", T.out)
+	}
+
+	if T.encrypt {
+		for {
+			T.passphrase = GetSecret("Archive passphrase: ")
+			if len(T.passphrase) < 8 {
+				Stdout("Passphrase must be at least 8 characters.")
+				continue
+			}
+			if GetSecret("Confirm passphrase: ") != T.passphrase {
+				Stdout("Passphrases do not match.")
+				continue
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// Main exports each user's folders to the archive.
+func (T *ExportTask) Main() (err error) {
+	f, err := os.Create(T.out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var dst io.Writer = f
+	var enc *encryptWriter
+	if T.encrypt {
+		if enc, err = newEncryptWriter(f, T.passphrase); err != nil {
+			return err
+		}
+		dst = enc
+	}
+	if T.archive, err = newArchiveWriter(T.out, dst); err != nil {
+		return err
+	}
+
+	T.manifest = archiveManifest{
+		Format:   archiveFormat,
+		Server:   T.KW.Server,
+		Exported: time.Now().UTC(),
+	}
+	T.file_count = T.Report.Tally("Files Exported")
+	T.data = T.Report.Tally("Data Exported", HumanSize)
+	users := T.Report.Tally("Users Exported")
+
+	user_getter, err := T.KW.Admin().Users(T.user_emails, 0, Query{"deleted": false})
+	if err != nil {
+		return err
+	}
+	for {
+		kw_users, err := user_getter.Next()
+		if err != nil {
+			return err
+		}
+		if len(kw_users) == 0 {
+			break
+		}
+		for _, user := range kw_users {
+			if err := T.exportUser(user); err != nil {
+				Err("[%s]: %v", user.Email, err)
+				continue
+			}
+			users.Add(1)
+		}
+	}
+
+	T.lock.Lock()
+	defer T.lock.Unlock()
+	sort.Slice(T.manifest.Folders, func(i, j int) bool { return T.manifest.Folders[i].Path < T.manifest.Folders[j].Path })
+	sort.Slice(T.manifest.Files, func(i, j int) bool { return T.manifest.Files[i].ID < T.manifest.Files[j].ID })
+	manifest, err := json.MarshalIndent(&T.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := T.archive.Add(manifestEntry, int64(len(manifest)), T.manifest.Exported, bytes.NewReader(manifest)); err != nil {
+		return err
+	}
+	if err := T.archive.Close(); err != nil {
+		return err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+	Log("Wrote %s: %d folder(s), %d file(s).", T.out, len(T.manifest.Folders), len(T.manifest.Files))
+	return f.Close()
+}
+
+// exportUser exports the user's owned folders, or the folders selected with
+// --folders.
+func (T *ExportTask) exportUser(user KiteUser) error {
+	sess := T.KW.Session(user.Email)
+	email := strings.ToLower(user.Email)
+
+	var top []KiteObject
+	if len(T.folders) > 0 {
+		for _, p := range T.folders {
+			folder, err := sess.Folder("0").Find(p)
+			if err != nil {
+				if err == ErrNotFound {
+					Notice("[%s]: Folder '%s' not found.", email, p)
+					continue
+				}
+				return err
+			}
+			if folder.Type != "d" {
+				Notice("[%s]: '%s' is not a folder.", email, p)
+				continue
+			}
+			top = append(top, folder)
+		}
+	} else {
+		folders, err := sess.TopFolders()
+		if err != nil {
+			return err
+		}
+		for _, f := range folders {
+			if f.CurrentUserRole.ID == 5 {
+				top = append(top, f)
+			}
+		}
+	}
+	if len(top) == 0 {
+		Log("[%s]: No folders to export.", email)
+		return nil
+	}
+
+	T.lock.Lock()
+	T.manifest.Users = append(T.manifest.Users, archiveUser{ID: user.ID, Email: email, Name: user.Name})
+	T.lock.Unlock()
+
+	// Folders are exported relative to the folders selected, and crawled in
+	// parallel, so their parents and paths are looked up by id.
+	var folder_paths sync.Map
+	for _, f := range top {
+		folder_paths.Store(f.ID, f.Name)
+	}
+
+	Log("[%s]: Exporting %d folder(s) to %s ..", email, len(top), T.out)
+	sess.FolderCrawler(func(sess *KWSession, obj *KiteObject) error {
+		switch obj.Type {
+		case "d":
+			return T.exportFolder(sess, email, obj, &folder_paths)
+		case "f":
+			return T.exportFile(sess, obj)
+		}
+		return nil
+	}, top...)
+	return nil
+}
+
+// exportFolder records a folder and its members in the manifest.
+func (T *ExportTask) exportFolder(sess *KWSession, owner string, folder *KiteObject, folder_paths *sync.Map) error {
+	folder_path, top := folder_paths.Load(folder.ID)
+	var parent_id string
+	if !top {
+		parent_path, ok := folder_paths.Load(folder.ParentID)
+		if !ok {
+			return fmt.Errorf("%s: parent folder not exported", folder.Path)
+		}
+		parent_id = folder.ParentID
+		folder_path = path.Join(parent_path.(string), folder.Name)
+		folder_paths.Store(folder.ID, folder_path)
+	}
+
+	created, _ := ReadKWTime(folder.Created)
+	modified, _ := ReadKWTime(folder.Modified)
+	record := archiveFolder{
+		ID:          folder.ID,
+		ParentID:    parent_id,
+		Owner:       owner,
+		Name:        folder.Name,
+		Description: folder.Description,
+		Path:        folder_path.(string),
+		KWPath:      folder.Path,
+		Created:     created,
+		Modified:    modified,
+	}
+
+	// The folder is recorded without members when they cannot be read, so
+	// its subfolders and files still have a parent in the archive.
+	members, err := sess.Folder(folder.ID).Members()
+	if err != nil {
+		Err("[%s]: %s: members: %v", owner, folder.Path, err)
+	}
+	for _, m := range members {
+		if IsBlank(m.User.Email) || strings.EqualFold(m.User.Email, owner) {
+			continue
+		}
+		record.Members = append(record.Members, archiveMember{
+			Email:  strings.ToLower(m.User.Email),
+			Role:   m.Role.Name,
+			RoleID: m.RoleID,
+		})
+	}
+
+	if activities, err := sess.Folder(folder.ID).Activities(); err != nil {
+		Err("[%s]: %s: activities: %v", owner, folder.Path, err)
+	} else {
+		record.Activity = summarizeActivity(activities)
+	}
+
+	T.lock.Lock()
+	T.manifest.Folders = append(T.manifest.Folders, record)
+	T.lock.Unlock()
+	return nil
+}
+
+// email returns the email of a user, or NONE when the user cannot be found.
+func (T *ExportTask) email(user_id string) string {
+	if IsBlank(user_id) {
+		return NONE
+	}
+	if v, ok := T.emails.Load(user_id); ok {
+		return v.(string)
+	}
+	user, err := T.KW.Admin().UserByID(user_id)
+	if err != nil {
+		Debug("User %s: %v", user_id, err)
+		return NONE
+	}
+	email := strings.ToLower(user.Email)
+	T.emails.Store(user_id, email)
+	return email
+}
+
+// exportFile stores every version of a file in the archive, and records the
+// file, its versions, comments and activity in the manifest.
+func (T *ExportTask) exportFile(sess *KWSession, file *KiteObject) error {
+	created, _ := ReadKWTime(file.Created)
+	modified, _ := ReadKWTime(file.Modified)
+	if client_modified, err := ReadKWTime(file.ClientModified); err == nil {
+		modified = client_modified
+	}
+	record := archiveFile{
+		ID:          file.ID,
+		FolderID:    file.ParentID,
+		Name:        file.Name,
+		Description: file.Description,
+		Created:     created,
+		Modified:    modified,
+		Size:        file.Size,
+		Fingerprint: file.Fingerprint,
+	}
+
+	versions, err := sess.File(file.ID).Versions()
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		versions = []KiteFileVersion{{ID: file.ID, Size: file.Size, Fingerprint: file.Fingerprint, Created: file.Created, ClientModified: file.ClientModified, UserID: file.UserID, Current: true}}
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Created < versions[j].Created })
+
+	for i, v := range versions {
+		v_created, _ := ReadKWTime(v.Created)
+		v_modified, err := ReadKWTime(v.ClientModified)
+		if err != nil {
+			if v_modified, err = ReadKWTime(v.Modified); err != nil {
+				v_modified = v_created
+			}
+		}
+		version := archiveVersion{
+			ID:          v.ID,
+			Entry:       versionEntry(file.ID, v.ID),
+			Uploader:    T.email(v.UserID),
+			Created:     v_created,
+			Modified:    v_modified,
+			Fingerprint: v.Fingerprint,
+		}
+
+		var dl ReadSeekCloser
+		if v.ID == file.ID {
+			dl, err = sess.QDownload(file)
+		} else {
+			dl, err = sess.QDownloadVersion(file.ID, &versions[i])
+		}
+		if err != nil {
+			return err
+		}
+		if version.Size, version.SHA256, err = T.store(version.Entry, v_modified, dl); err != nil {
+			return fmt.Errorf("%s: version %s: %v", file.Path, v.ID, err)
+		}
+		record.Versions = append(record.Versions, version)
+	}
+
+	comments, err := sess.File(file.ID).Comments()
+	if err != nil {
+		return err
+	}
+	sort.Slice(comments, func(i, j int) bool { return comments[i].ID < comments[j].ID })
+	for _, c := range comments {
+		creator := strings.ToLower(c.User.Email)
+		if IsBlank(creator) {
+			creator = T.email(c.UserID)
+		}
+		c_created, _ := ReadKWTime(c.Created)
+		comment := archiveComment{
+			ID:       strconv.Itoa(c.ID),
+			Creator:  creator,
+			Created:  c_created,
+			Contents: c.Contents,
+		}
+		if c.ParentID > 0 {
+			comment.ParentID = strconv.Itoa(c.ParentID)
+		}
+		record.Comments = append(record.Comments, comment)
+	}
+
+	if activities, err := sess.File(file.ID).Activities(); err != nil {
+		Err("[%s]: %s: activities: %v", sess.Username, file.Path, err)
+	} else {
+		record.Activity = summarizeActivity(activities)
+	}
+
+	T.lock.Lock()
+	T.manifest.Files = append(T.manifest.Files, record)
+	T.lock.Unlock()
+	T.file_count.Add(1)
+	Log("[%s]: Exported %s. (%d version(s))", sess.Username, file.Path, len(record.Versions))
+	return nil
+}
+
+// store spools a download to a temporary file, so downloads run in parallel
+// and a failed one leaves the archive intact, then adds it to the archive. It
+// returns the size and SHA-256 of the content.
+func (T *ExportTask) store(entry string, modified time.Time, dl ReadSeekCloser) (size int64, sum string, err error) {
+	defer dl.Close()
+
+	spool, err := os.CreateTemp("", "kitebroker-export-*")
+	if err != nil {
+		return 0, NONE, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+	if size, err = io.Copy(io.MultiWriter(spool, hash), dl); err != nil {
+		return 0, NONE, err
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return 0, NONE, err
+	}
+
+	T.lock.Lock()
+	defer T.lock.Unlock()
+	if err = T.archive.Add(entry, size, modified, TransferCounter(spool, T.data.Add)); err != nil {
+		return 0, NONE, err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,169 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterMigrationTask(new(ImportTask)) }
+
+// ImportTask restores an archive written by the export task to Kiteworks.
+type ImportTask struct {
+	KiteBrokerTask
+	import_db           Database
+	archive_file        string
+	passphrase          string
+	target_profile_name string
+	user_emails         []string
+	report              bool
+	preflight           string
+	max_file_size       int
+	rollback            string
+	max_versions        int
+	dry_run             bool
+	status              bool
+	retry_failed        bool
+	mapping_file        string
+	mapping             *MigrationMapping
+}
+
+// Name returns the name of this task.
+func (T *ImportTask) Name() string {
+	return "import"
+}
+
+// Desc returns a description of this task.
+func (T *ImportTask) Desc() string {
+	return "Restore users' folders, file versions, comments and members from an export archive to Kiteworks."
+}
+
+// Init parses the flags, and prompts for the passphrase of an encrypted
+// archive.
+func (T *ImportTask) Init() (err error) {
+	T.import_db = T.DB.Sub("import")
+
+	T.Flags.StringVar(&T.archive_file, "archive", "<export.tar|export.zip>", "Archive written by the export task.")
+	T.Flags.StringVar(&T.target_profile_name, "profile", "Standard", "Destination profile for restored users. (Needs permission to create folders)")
+	T.Flags.StringVar(&T.mapping_file, "mapping", "<mapping.csv>", "CSV or YAML file remapping users, folder paths and roles.")
+	T.Flags.MultiVar(&T.user_emails, "users", "<user@domain.com>", "User(s) to restore.")
+	migrate := T.Flags.Bool("migrate", "Perform the actual restore.")
+	T.Flags.BoolVar(&T.report, "report", "Generate a report of the archive's users, folders and files.")
+	T.Flags.StringVar(&T.preflight, "preflight", "<findings.csv>", "Check the archive and destination for problems, writing findings to a CSV or JSON file.")
+	T.Flags.IntVar(&T.max_file_size, "max_file_size", 0, "Largest file (MB) the destination accepts, checked by --preflight.")
+	T.Flags.IntVar(&T.max_versions, "max_versions", 0, "Restore at most this many of each file's newest versions. (0 restores all)")
+	T.Flags.StringVar(&T.rollback, "rollback", "<run id>", "Undo the users, folders, files, grants and keys created on Kiteworks by a restore run.")
+	T.Flags.BoolVar(&T.dry_run, "dry_run", "With --rollback, log what would be undone without changing anything.")
+	T.Flags.BoolVar(&T.status, "status", "Show each user's restore state, with throughput and an ETA.")
+	T.Flags.BoolVar(&T.retry_failed, "retry_failed", "With --migrate, restore only the users whose last restore failed.")
+	T.Flags.Order("archive", "migrate", "report", "preflight", "rollback", "status")
+	if err := T.Flags.Parse(); err != nil {
+		return err
+	}
+
+	if !IsBlank(T.mapping_file) {
+		mapping, err := LoadMigrationMapping(T.mapping_file)
+		if err != nil {
+			return err
+		}
+		T.mapping = mapping
+	}
+
+	var modes int
+	for _, m := range []bool{*migrate, T.report, !IsBlank(T.preflight), !IsBlank(T.rollback), T.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("--migrate, --report, --preflight, --rollback and --status are mutually exclusive, please specify only one")
+	}
+	if modes == 0 {
+		return fmt.Errorf("must specify either --migrate, --report, --preflight, --rollback or --status")
+	}
+	if T.dry_run && IsBlank(T.rollback) {
+		return fmt.Errorf("--dry_run requires --rollback")
+	}
+	if T.retry_failed && !*migrate {
+		return fmt.Errorf("--retry_failed requires --migrate")
+	}
+	if !IsBlank(T.rollback) {
+		return nil
+	}
+	if IsBlank(T.archive_file) {
+		return fmt.Errorf("--archive is required.")
+	}
+
+	f, err := os.Open(T.archive_file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if isEncrypted(f) {
+		T.passphrase = GetSecret("Archive passphrase: ")
+	}
+	return nil
+}
+
+// Main restores the archive, or runs its report, preflight or status.
+func (T *ImportTask) Main() (err error) {
+	if !IsBlank(T.rollback) {
+		return RollbackMigration(&T.KiteBrokerTask, T.import_db, T.rollback, T.dry_run)
+	}
+
+	f, err := os.Open(T.archive_file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if isEncrypted(f) {
+		Log("Decrypting %s ..", T.archive_file)
+		plain, err := decryptArchive(f, T.passphrase)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(plain.Name())
+		defer plain.Close()
+		f = plain
+	}
+
+	archive, err := openArchive(f)
+	if err != nil {
+		return err
+	}
+	manifest, err := archive.Manifest()
+	if err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		for _, v := range file.Versions {
+			if _, ok := archive.entries[v.Entry]; !ok {
+				Notice("%s: version %s of %s is missing from the archive.", T.archive_file, v.ID, file.Name)
+			}
+		}
+	}
+	Log("%s: exported from %s on %s, %d user(s), %d folder(s), %d file(s).", T.archive_file, manifest.Server, manifest.Exported.Local().Format("2006-01-02 15:04"), len(manifest.Users), len(manifest.Folders), len(manifest.Files))
+
+	engine := NewMigrationEngine(&T.KiteBrokerTask, newArchiveSource(archive, manifest), T.import_db)
+	engine.Users = T.user_emails
+	engine.Mapping = T.mapping
+	engine.RetryFailed = T.retry_failed
+	engine.MaxVersions = T.max_versions
+
+	if T.status {
+		return engine.RunStatus()
+	}
+	if T.report {
+		return engine.RunReport()
+	}
+	if err := engine.SetProfile(T.target_profile_name); err != nil {
+		return err
+	}
+	if !IsBlank(T.preflight) {
+		engine.Preflight.MaxFileSize = int64(T.max_file_size) * 1024 * 1024
+		return engine.RunPreflight(T.preflight)
+	}
+	return engine.Run()
+}
@@ -0,0 +1,191 @@
+package archive
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// archiveSource is an export archive as a MigrationSource. Folder and file
+// SrcIDs are their ids on the server they were exported from, and each
+// user's root is the pseudo folder "root:<email>".
+type archiveSource struct {
+	manifest *archiveManifest
+	archive  *archiveReader
+	folders  map[string][]archiveFolder // Parent id -> subfolders
+	files    map[string][]archiveFile   // Folder id -> files
+	members  map[string][]archiveMember // Folder id -> members
+	versions map[string][]archiveVersion
+}
+
+// rootPrefix prefixes the SrcID of a user's root.
+const rootPrefix = "root:"
+
+// newArchiveSource indexes the manifest of an archive.
+func newArchiveSource(archive *archiveReader, manifest *archiveManifest) *archiveSource {
+	S := &archiveSource{
+		manifest: manifest,
+		archive:  archive,
+		folders:  make(map[string][]archiveFolder),
+		files:    make(map[string][]archiveFile),
+		members:  make(map[string][]archiveMember),
+		versions: make(map[string][]archiveVersion),
+	}
+	for _, f := range manifest.Folders {
+		parent := f.ParentID
+		if IsBlank(parent) {
+			parent = rootPrefix + f.Owner
+		}
+		S.folders[parent] = append(S.folders[parent], f)
+		S.members[f.ID] = f.Members
+	}
+	for _, f := range manifest.Files {
+		S.files[f.FolderID] = append(S.files[f.FolderID], f)
+		S.versions[f.ID] = f.Versions
+	}
+	return S
+}
+
+// Name returns the source name.
+func (S *archiveSource) Name() string {
+	return "Kiteworks Archive"
+}
+
+// Users returns the exported users.
+func (S *archiveSource) Users() (users []MigrationUser, err error) {
+	for _, u := range S.manifest.Users {
+		users = append(users, MigrationUser{
+			ID:    u.ID,
+			Email: u.Email,
+			Name:  u.Name,
+		})
+	}
+	return
+}
+
+// Root returns the user's pseudo root, whose subfolders are the folders
+// exported for the user.
+func (S *archiveSource) Root(user MigrationUser) (SyncFolder, error) {
+	return SyncFolder{SrcID: rootPrefix + strings.ToLower(user.Email)}, nil
+}
+
+// Folders returns the subfolders of a folder.
+func (S *archiveSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	for _, f := range S.folders[folder.SrcID] {
+		folders = append(folders, SyncFolder{
+			Name:        f.Name,
+			Description: f.Description,
+			SrcID:       f.ID,
+			Created:     f.Created,
+			Modified:    f.Modified,
+			FullPath:    f.Path,
+			Owner:       user.Email,
+		})
+	}
+	return
+}
+
+// Files returns the files within a folder.
+func (S *archiveSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	for _, f := range S.files[folder.SrcID] {
+		files = append(files, SyncFile{
+			Name:        f.Name,
+			Description: f.Description,
+			SrcID:       f.ID,
+			Created:     f.Created,
+			Modified:    f.Modified,
+			Size:        f.Size,
+			Fingerprint: f.Fingerprint,
+			SrcFolderID: folder.SrcID,
+		})
+	}
+	return
+}
+
+// Members returns the folder's members, granted by role name since role ids
+// differ between appliances.
+func (S *archiveSource) Members(user MigrationUser, folder SyncFolder) (members []MigrationMember, err error) {
+	for _, m := range S.members[folder.SrcID] {
+		if strings.EqualFold(m.Email, user.Email) {
+			continue
+		}
+		member := MigrationMember{User: m.Email, Role: m.Role, SourceRole: m.Role}
+		if IsBlank(m.Role) {
+			member.RoleID = m.RoleID
+		}
+		members = append(members, member)
+	}
+	return
+}
+
+// RoleNames returns the role names granted to members in the archive.
+func (S *archiveSource) RoleNames() (names []string) {
+	seen := make(map[string]struct{})
+	for _, folder := range S.members {
+		for _, m := range folder {
+			if _, ok := seen[m.Role]; ok || IsBlank(m.Role) {
+				continue
+			}
+			seen[m.Role] = struct{}{}
+			names = append(names, m.Role)
+		}
+	}
+	return
+}
+
+// Versions returns the file's versions, oldest first.
+func (S *archiveSource) Versions(user MigrationUser, file SyncFile) (versions []SyncVersion, err error) {
+	for i, v := range S.versions[file.SrcID] {
+		versions = append(versions, SyncVersion{
+			SrcID:    v.ID,
+			Ver:      i + 1,
+			Uploader: v.Uploader,
+			Name:     file.Name,
+			Created:  v.Created,
+			Modified: v.Modified,
+			Size:     v.Size,
+		})
+	}
+	// The current version keeps the file's modified time, which is compared
+	// to find files already restored.
+	if len(versions) > 0 {
+		versions[len(versions)-1].Modified = file.Modified
+	}
+	return
+}
+
+// Comments returns the file's comments, oldest first.
+func (S *archiveSource) Comments(user MigrationUser, file SyncFile) (comments []SyncComment, err error) {
+	for _, f := range S.files[file.SrcFolderID] {
+		if f.ID != file.SrcID {
+			continue
+		}
+		for _, c := range f.Comments {
+			comments = append(comments, SyncComment{
+				ID:       c.ID,
+				ParentID: c.ParentID,
+				Created:  c.Created,
+				Creator:  c.Creator,
+				Message:  fmt.Sprintf("[%s] kiteworks comment created by (%s): %s", c.Created.UTC().Format("2006-01-02"), c.Creator, c.Contents),
+				Original: c.Contents,
+			})
+		}
+	}
+	return
+}
+
+// Open returns the archived content of a version of the file, or its current
+// content.
+func (S *archiveSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	versions := S.versions[file.SrcID]
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%s: no content in archive", file.Name)
+	}
+	for _, v := range versions {
+		if v.ID == version.SrcID {
+			return S.archive.Open(v.Entry)
+		}
+	}
+	return S.archive.Open(versions[len(versions)-1].Entry)
+}
@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	. "github.com/cmcoffee/kitebroker/core"
@@ -45,7 +44,8 @@ type BoxFile struct {
 	FileVersion struct {
 		ID string `json:"id"`
 	} `json:"file_version"`
-	TrashedAt interface{} `json:"trashed_at"`
+	ModifiedBy BoxUserRecord `json:"modified_by"`
+	TrashedAt  interface{}   `json:"trashed_at"`
 }
 
 // BoxFolder represents Box.com folder metadata.
@@ -54,6 +54,7 @@ type BoxFolder struct {
 	Name        string        `json:"name"`
 	Description string        `json:"description"`
 	Created     string        `json:"created_at"`
+	Modified    string        `json:"modified_at"`
 	OwnedBy     BoxUserRecord `json:"owned_by"`
 	Path        struct {
 		Entries []struct {
@@ -69,15 +70,22 @@ type BoxFolder struct {
 
 // BoxFolderItem represents a child item in a Box folder.
 type BoxFolderItem struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	Type string `json:"type"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	Created  string `json:"created_at"`
+	Modified string `json:"modified_at"`
 }
 
-// BoxPermission represents a folder permission mapping.
+// BoxPermission represents a folder collaboration, with the Box role mapped
+// to a Kiteworks role name. A group collaboration has a blank User.
 type BoxPermission struct {
-	User string `json:"username"`
-	Role int    `json:"role"`
+	User    string `json:"username"`
+	Group   string `json:"group,omitempty"`
+	GroupID string `json:"group_id,omitempty"`
+	Role    string `json:"role"`
+	BoxRole string `json:"box_role,omitempty"`
 }
 
 // BoxVersion represents a file version from Box.com.
@@ -88,10 +96,14 @@ type BoxVersion struct {
 	Modified time.Time `json:"utc_modified"`
 	Size     int64     `json:"size"`
 	Ver      int       `json:"version_num"`
+	Uploader string    `json:"uploader"`
 }
 
 // BoxComment represents a file comment from Box.com.
 type BoxComment struct {
+	ID      string
+	Created time.Time
+	Creator string
 	Message string
 }
 
@@ -290,6 +302,7 @@ func (B *BoxSession) Folder(folderID string) (*BoxFolder, error) {
 		ID          string        `json:"id"`
 		Description string        `json:"description"`
 		Created     string        `json:"created_at"`
+		Modified    string        `json:"modified_at"`
 		OwnedBy     BoxUserRecord `json:"owned_by"`
 		Path        struct {
 			Entries []struct {
@@ -310,6 +323,8 @@ func (B *BoxSession) Folder(folderID string) (*BoxFolder, error) {
 		BoxID:       folderID,
 		Name:        folder.Name,
 		Description: folder.Description,
+		Created:     folder.Created,
+		Modified:    folder.Modified,
 		BoxSession:  B,
 	}
 
@@ -342,30 +357,20 @@ func (fr *BoxFolder) getItems() error {
 
 	for {
 		var items struct {
-			Entries []struct {
-				Name string `json:"name"`
-				ID   string `json:"id"`
-				Type string `json:"type"`
-			} `json:"entries"`
-			Limit int `json:"limit"`
+			Entries []BoxFolderItem `json:"entries"`
+			Limit   int             `json:"limit"`
 		}
 
 		if err := fr.BoxSession.Call(APIRequest{
 			Method: "GET",
 			Path:   SetPath("/folders/%s/items", fr.BoxID),
-			Params: SetParams(Query{"limit": 100, "offset": offset}),
+			Params: SetParams(Query{"limit": 100, "offset": offset, "fields": "id,type,name,size,created_at,modified_at"}),
 			Output: &items,
 		}); err != nil {
 			return err
 		}
 
-		for _, x := range items.Entries {
-			fr.Items = append(fr.Items, BoxFolderItem{
-				ID:   x.ID,
-				Name: x.Name,
-				Type: x.Type,
-			})
-		}
+		fr.Items = append(fr.Items, items.Entries...)
 
 		if len(items.Entries) < 100 {
 			break
@@ -375,7 +380,7 @@ func (fr *BoxFolder) getItems() error {
 	return nil
 }
 
-// getPermissions retrieves folder collaborations from Box, expanding groups.
+// getPermissions retrieves folder collaborations from Box.
 func (fr *BoxFolder) getPermissions() error {
 	if fr.BoxID == "0" {
 		return nil
@@ -417,23 +422,17 @@ func (fr *BoxFolder) getPermissions() error {
 				user = x.Invited
 			}
 			fr.Permissions = append(fr.Permissions, BoxPermission{
-				User: strings.ToLower(user),
-				Role: MapPermission(x.Role),
+				User:    strings.ToLower(user),
+				Role:    MapPermissionName(x.Role),
+				BoxRole: strings.ToLower(x.Role),
 			})
 		case "group":
-			members, err := fr.BoxSession.GroupMembers(x.AccessibleBy.ID)
-			if err != nil {
-				return err
-			}
-			for _, user := range members {
-				if user == fr.Owner {
-					continue
-				}
-				fr.Permissions = append(fr.Permissions, BoxPermission{
-					User: strings.ToLower(user),
-					Role: MapPermission(x.Role),
-				})
-			}
+			fr.Permissions = append(fr.Permissions, BoxPermission{
+				Group:   x.AccessibleBy.Name,
+				GroupID: x.AccessibleBy.ID,
+				Role:    MapPermissionName(x.Role),
+				BoxRole: strings.ToLower(x.Role),
+			})
 		}
 	}
 	return nil
@@ -472,23 +471,8 @@ func (B *BoxSession) GroupMembers(groupID string) (users []string, err error) {
 	return
 }
 
-// MapPermission maps a Box.com role string to a Kiteworks role ID.
-func MapPermission(role string) int {
-	switch strings.ToLower(role) {
-	case "editor":
-		return 3 // collaborator
-	case "co-owner":
-		return 4 // manager
-	case "uploader", "viewer uploader", "previewer uploader":
-		return 7 // uploader
-	case "viewer", "previewer":
-		return 6 // viewer
-	default:
-		return 6 // viewer
-	}
-}
-
-// MapPermissionName maps a Box.com role string to a human-readable permission name.
+// MapPermissionName maps a Box.com role string to the name of the Kiteworks
+// role granted by default, which a mapping's source_role rules can override.
 func MapPermissionName(role string) string {
 	switch strings.ToLower(role) {
 	case "editor":
@@ -554,6 +538,7 @@ func (B *BoxSession) FileVersions(fileID string) (versions []BoxVersion, err err
 				Name:     x.Name,
 				Size:     x.Size,
 				Ver:      ver,
+				Uploader: x.ModifiedBy.Login,
 			})
 			ver++
 		}
@@ -575,6 +560,7 @@ func (B *BoxSession) FileVersions(fileID string) (versions []BoxVersion, err err
 		Name:     current.Name,
 		Size:     current.Size,
 		Ver:      ver,
+		Uploader: current.ModifiedBy.Login,
 	})
 
 	return
@@ -616,6 +602,9 @@ func (B *BoxSession) FileComments(fileID string) (comments []BoxComment, err err
 				return nil, err
 			}
 			comments = append(comments, BoxComment{
+				ID:      c.ID,
+				Created: createdTime,
+				Creator: getBoxLogin(c.Creator),
 				Message: fmt.Sprintf("[%s] box.com comment created by (%s): %s", dateString(createdTime), getBoxLogin(c.Creator), c.Message),
 			})
 		}
@@ -707,7 +696,17 @@ func (B *BoxSession) FileTasks(fileID string) (tasks []BoxTask, err error) {
 
 // Download returns a ReadSeekCloser for downloading a file from Box.com.
 func (B *BoxSession) Download(fileID string) (ReadSeekCloser, error) {
-	req, err := B.APIClient.NewRequest("GET", fmt.Sprintf("/2.0/files/%s/content", fileID))
+	return B.DownloadVersion(fileID, NONE)
+}
+
+// DownloadVersion downloads a version of a file from Box.com; a blank
+// versionID downloads the current version.
+func (B *BoxSession) DownloadVersion(fileID, versionID string) (ReadSeekCloser, error) {
+	path := fmt.Sprintf("/2.0/files/%s/content", fileID)
+	if versionID != NONE {
+		path = fmt.Sprintf("%s?version=%s", path, versionID)
+	}
+	req, err := B.APIClient.NewRequest("GET", path)
 	if err != nil {
 		return nil, err
 	}
@@ -720,227 +719,3 @@ func (B *BoxSession) Download(fileID string) (ReadSeekCloser, error) {
 	}
 	return B.APIClient.WebDownload(req), nil
 }
-
-// Files returns count of file items in a folder.
-func (f *BoxFolder) Files() int {
-	var n int
-	for _, v := range f.Items {
-		if v.Type == "file" {
-			n++
-		}
-	}
-	return n
-}
-
-// Folders returns count of folder items in a folder.
-func (f *BoxFolder) Folders() int {
-	var n int
-	for _, v := range f.Items {
-		if v.Type == "folder" {
-			n++
-		}
-	}
-	return n
-}
-
-// boxFolderCrawler traverses Box.com folder hierarchies concurrently.
-// It processes folders and files via a processor callback, using LimitGroups
-// to manage concurrency for both folder traversal and file processing.
-type boxFolderCrawler struct {
-	processor      func(*BoxSession, *BoxFolder, *BoxFolderItem) error
-	folder_limiter LimitGroup
-	file_chan      chan boxFileMsg
-	all_stop       int32
-}
-
-// boxFileMsg carries a file item along with the parent folder context.
-type boxFileMsg struct {
-	folder *BoxFolder
-	item   *BoxFolderItem
-}
-
-// abortError represents a custom error type to signal abort of the crawler.
-type abortError struct {
-	err error
-}
-
-// Error returns the error message.
-func (e abortError) Error() string {
-	if e.err != nil {
-		return e.err.Error()
-	}
-	return ""
-}
-
-// abortCheck checks if an error is of type abortError.
-func abortCheck(err error) (error, bool) {
-	if err == nil {
-		return nil, false
-	}
-	if e, ok := err.(abortError); !ok {
-		return err, false
-	} else {
-		return e.err, true
-	}
-}
-
-// FolderCrawler starts a concurrent folder crawler that traverses the provided
-// BoxFolder trees and calls the processor for each folder and file encountered.
-// For folders, the item argument is nil. For files, the folder argument is the parent.
-func (B *BoxSession) FolderCrawler(processor func(*BoxSession, *BoxFolder, *BoxFolderItem) error, folders ...*BoxFolder) {
-	crawler := new(boxFolderCrawler)
-	crawler.folder_limiter = NewLimitGroup(50)
-	file_limiter := NewLimitGroup(50)
-	crawler.processor = processor
-	crawler.file_chan = make(chan boxFileMsg, 1000)
-
-	file_limiter.Add(1)
-	go func(sess *BoxSession) {
-		defer file_limiter.Done()
-		for m := range crawler.file_chan {
-			if atomic.LoadInt32(&crawler.all_stop) > 0 || crawler.processor == nil {
-				continue
-			}
-			if file_limiter.Try() {
-				go func(sess *BoxSession, msg boxFileMsg) {
-					defer file_limiter.Done()
-					err, abort := abortCheck(processor(sess, msg.folder, msg.item))
-					if err != nil {
-						Err("%s - %s: %v", sess.UserID, msg.item.Name, err)
-					}
-					if abort {
-						atomic.StoreInt32(&crawler.all_stop, 1)
-					}
-				}(B, m)
-			} else {
-				err, abort := abortCheck(processor(sess, m.folder, m.item))
-				if err != nil {
-					Err("%s - %s: %v", sess.UserID, m.item.Name, err)
-				}
-				if abort {
-					atomic.StoreInt32(&crawler.all_stop, 1)
-				}
-			}
-		}
-	}(B)
-
-	for _, f := range folders {
-		crawler.folder_limiter.Add(1)
-		go func(sess *BoxSession, folder *BoxFolder) {
-			defer crawler.folder_limiter.Done()
-			crawler.process(sess, folder)
-		}(B, f)
-	}
-	crawler.folder_limiter.Wait()
-	close(crawler.file_chan)
-	file_limiter.Wait()
-}
-
-// process recursively traverses a BoxFolder and its subfolders.
-// It calls the processor for each folder, sends files to the file channel,
-// and spawns goroutines for subfolder traversal when concurrency permits.
-func (F *boxFolderCrawler) process(sess *BoxSession, folder *BoxFolder) {
-	var folders []*BoxFolder
-	folders = append(folders, folder)
-
-	var n int
-	var next []*BoxFolder
-
-	if folder == nil {
-		Err("Cannot process 'nil' folder.")
-		return
-	}
-
-	for {
-		if atomic.LoadInt32(&F.all_stop) > 0 {
-			return
-		}
-		if len(folders) < n+1 {
-			folders = folders[0:0]
-			if len(next) > 0 {
-				for i, o := range next {
-					if F.folder_limiter.Try() {
-						go func(sess *BoxSession, folder *BoxFolder) {
-							defer F.folder_limiter.Done()
-							F.process(sess, folder)
-						}(sess, o)
-					} else {
-						folders = append(folders, next[i:]...)
-						break
-					}
-				}
-				next = next[0:0]
-				n = 0
-				if len(folders) == 0 {
-					break
-				}
-			} else {
-				break
-			}
-		}
-
-		current := folders[n]
-
-		// Call processor for the folder itself (item=nil).
-		if F.processor != nil {
-			if atomic.LoadInt32(&F.all_stop) > 0 {
-				return
-			}
-			if err := F.processor(sess, current, nil); err != nil {
-				err, abort := abortCheck(err)
-				if err != nil {
-					Err("%s - %s: %v", sess.UserID, current.Name, err)
-				}
-				if abort {
-					atomic.StoreInt32(&F.all_stop, 1)
-					return
-				}
-			}
-		}
-
-		// Dispatch items: files to channel, folders to next queue.
-		for i := range current.Items {
-			item := &current.Items[i]
-			switch item.Type {
-			case "folder":
-				subFolder, err := sess.Folder(item.ID)
-				if err != nil {
-					Err("%s: %v", item.Name, err)
-					continue
-				}
-				next = append(next, subFolder)
-			case "file":
-				if atomic.LoadInt32(&F.all_stop) > 0 {
-					return
-				}
-				F.file_chan <- boxFileMsg{folder: current, item: item}
-			}
-		}
-		n++
-	}
-}
-
-// TaskString generates a message string for a Box task.
-func TaskString(task *BoxTask, forImport bool) string {
-	var insert string
-	if !forImport {
-		insert = fmt.Sprintf(" assigned to %s,", strings.Join(task.AssignedTo, ", "))
-	}
-
-	dueDate := task.Due.UTC()
-	nowDate := time.Now().UTC()
-
-	switch {
-	case task.Completed:
-		return fmt.Sprintf("[%s] box.com task: \"%s\", created by %s,%s and completed on %s.", dateString(task.Created), task.Message, task.Creator, insert, dateString(task.CompletedOn))
-	case dueDate.IsZero():
-		return fmt.Sprintf("[%s] box.com task: \"%s\", created by %s,%s and had no due date.", dateString(task.Created), task.Message, task.Creator, insert)
-	case dueDate.Unix() < nowDate.Unix() || dateString(dueDate) == dateString(nowDate):
-		return fmt.Sprintf("[%s] box.com task: \"%s\", created by %s,%s and was due on %s.", dateString(task.Created), task.Message, task.Creator, insert, dateString(task.Due))
-	default:
-		if forImport {
-			return fmt.Sprintf("[%s] box.com task: \"%s\".", dateString(task.Created), task.Message)
-		}
-		return fmt.Sprintf("[%s] box.com task: \"%s\", created by %s, assigned to %s, and is due on %s.", dateString(task.Created), task.Message, task.Creator, strings.Join(task.AssignedTo, ", "), dateString(task.Due.UTC()))
-	}
-}
@@ -0,0 +1,236 @@
+package box
+
+import (
+	"strings"
+	"sync"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// boxSource is the Box.com MigrationSource.
+//
+// A Box folder's items and collaborations come back together, so each folder
+// listed by Folders is held until the walk has read its members, files and
+// subfolders, rather than being requested again for each.
+type boxSource struct {
+	api     *BoxAPI
+	folders sync.Map
+}
+
+// Name returns the source name.
+func (S *boxSource) Name() string {
+	return "Box.com"
+}
+
+// Users returns all Box.com users.
+func (S *boxSource) Users() (users []MigrationUser, err error) {
+	box_users, err := S.api.Session("").Users()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range box_users {
+		users = append(users, MigrationUser{
+			ID:    u.ID,
+			Email: strings.ToLower(u.Login),
+			Name:  u.Name,
+			Home:  "0",
+		})
+	}
+	return
+}
+
+// folderKey is the cache key of a user's folder; folder ids are only unique
+// per user, as every user's root is "0".
+func folderKey(user MigrationUser, id string) string {
+	return user.ID + ":" + id
+}
+
+// folder returns a user's Box folder, from the cache when it is held.
+func (S *boxSource) folder(user MigrationUser, id string) (*BoxFolder, error) {
+	if f, ok := S.folders.Load(folderKey(user, id)); ok {
+		return f.(*BoxFolder), nil
+	}
+	f, err := S.api.Session(user.ID).Folder(id)
+	if err != nil {
+		return nil, err
+	}
+	S.folders.Store(folderKey(user, id), f)
+	return f, nil
+}
+
+// syncFolder describes a Box folder.
+func syncFolder(f *BoxFolder) SyncFolder {
+	created, _ := readBoxTime(f.Created)
+	modified, _ := readBoxTime(f.Modified)
+	return SyncFolder{
+		Name:        f.Name,
+		Description: f.Description,
+		SrcID:       f.BoxID,
+		Created:     created,
+		Modified:    modified,
+		FullPath:    f.FullPath,
+		Owner:       f.Owner,
+	}
+}
+
+// Root returns the user's "All Files" folder; files at the root of a Box
+// account are migrated into a folder of that name.
+func (S *boxSource) Root(user MigrationUser) (SyncFolder, error) {
+	f, err := S.folder(user, "0")
+	if err != nil {
+		return SyncFolder{}, err
+	}
+	return syncFolder(f), nil
+}
+
+// Folders returns the subfolders of a folder. At the root, only folders the
+// user owns are returned; folders shared with the user are migrated with
+// their owner.
+func (S *boxSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	f, err := S.folder(user, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	sess := S.api.Session(user.ID)
+	for _, item := range f.Items {
+		if item.Type != "folder" {
+			continue
+		}
+		sub, err := sess.Folder(item.ID)
+		if err != nil {
+			Err("[%s]: Error reading folder %s: %v", user.Email, item.Name, err)
+			continue
+		}
+		if folder.SrcID == "0" && sub.Owner != user.Email {
+			continue
+		}
+		S.folders.Store(folderKey(user, sub.BoxID), sub)
+		folders = append(folders, syncFolder(sub))
+	}
+	return
+}
+
+// Release drops the folder's held listing.
+func (S *boxSource) Release(user MigrationUser, folder SyncFolder) {
+	S.folders.Delete(folderKey(user, folder.SrcID))
+}
+
+// Files returns the files within a folder.
+func (S *boxSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	f, err := S.folder(user, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range f.Items {
+		if item.Type != "file" {
+			continue
+		}
+		created, _ := readBoxTime(item.Created)
+		modified, _ := readBoxTime(item.Modified)
+		files = append(files, SyncFile{
+			Name:        item.Name,
+			SrcID:       item.ID,
+			SrcFolderID: folder.SrcID,
+			Created:     created,
+			Modified:    modified,
+			Size:        item.Size,
+		})
+	}
+	return
+}
+
+// Members returns the folder's collaborators, users and groups.
+func (S *boxSource) Members(user MigrationUser, folder SyncFolder) (members []MigrationMember, err error) {
+	f, err := S.folder(user, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range f.Permissions {
+		members = append(members, MigrationMember{User: p.User, Role: p.Role, SourceRole: p.BoxRole, Group: p.Group, GroupID: p.GroupID})
+	}
+	return
+}
+
+// RoleNames returns the roles MapPermissionName grants.
+func (S *boxSource) RoleNames() []string {
+	return []string{"Collaborator", "Manager", "Uploader", "Viewer"}
+}
+
+// TreeModified reports true: Box updates a folder's modified_at whenever an
+// item anywhere beneath it changes.
+func (S *boxSource) TreeModified() bool {
+	return true
+}
+
+// GroupMembers returns the login emails of a Box group's members.
+func (S *boxSource) GroupMembers(user MigrationUser, group_id string) ([]string, error) {
+	return S.api.Session(user.ID).GroupMembers(group_id)
+}
+
+// Versions returns the file's versions, oldest first.
+func (S *boxSource) Versions(user MigrationUser, file SyncFile) (versions []SyncVersion, err error) {
+	box_versions, err := S.api.Session(user.ID).FileVersions(file.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range box_versions {
+		versions = append(versions, SyncVersion{
+			SrcID:    v.ID,
+			Ver:      v.Ver,
+			Name:     v.Name,
+			Created:  v.Created,
+			Modified: v.Modified,
+			Size:     v.Size,
+			Uploader: v.Uploader,
+		})
+	}
+	return
+}
+
+// Comments returns the file's comments.
+func (S *boxSource) Comments(user MigrationUser, file SyncFile) (comments []SyncComment, err error) {
+	box_comments, err := S.api.Session(user.ID).FileComments(file.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range box_comments {
+		comments = append(comments, SyncComment{
+			ID:      c.ID,
+			Created: c.Created,
+			Creator: c.Creator,
+			Message: c.Message,
+		})
+	}
+	return
+}
+
+// Tasks returns the file's tasks.
+func (S *boxSource) Tasks(user MigrationUser, file SyncFile) (tasks []SyncTask, err error) {
+	box_tasks, err := S.api.Session(user.ID).FileTasks(file.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range box_tasks {
+		tasks = append(tasks, SyncTask{
+			ID:          t.ID,
+			Action:      t.Action,
+			Created:     t.Created,
+			Creator:     t.Creator,
+			Due:         t.Due,
+			AssignedTo:  t.AssignedTo,
+			Completed:   t.Completed,
+			CompletedOn: t.CompletedOn,
+			Message:     t.Message,
+		})
+	}
+	return
+}
+
+// Open downloads a version of the file, or its current content when the
+// version is not one of Box's.
+func (S *boxSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	if IsBlank(version.SrcID) || version.SrcID == file.SrcID {
+		return S.api.Session(user.ID).Download(file.SrcID)
+	}
+	return S.api.Session(user.ID).DownloadVersion(file.SrcID, version.SrcID)
+}
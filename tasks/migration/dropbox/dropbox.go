@@ -0,0 +1,201 @@
+package dropbox
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterMigrationTask(new(DropboxMigrationTask)) }
+
+// DropboxMigrationTask migrates the members and team folders of a Dropbox
+// Business team to Kiteworks.
+type DropboxMigrationTask struct {
+	KiteBrokerTask
+	dropbox_db          Database
+	dropbox_config      Table
+	app_key             string
+	app_secret          string
+	refresh_token       string
+	access_token        string
+	api                 *DropboxAPI
+	target_profile_name string
+	user_emails         []string
+	team_folder_owner   string
+	report              bool
+	preflight           string
+	max_file_size       int
+	verify              string
+	requeue             bool
+	rollback            string
+	max_versions        int
+	dry_run             bool
+	status              bool
+	retry_failed        bool
+	mapping_file        string
+	mapping             *MigrationMapping
+	limits              MigrationLimits
+	map_groups          bool
+}
+
+// Name returns the name of this task.
+func (T *DropboxMigrationTask) Name() string {
+	return "dropbox"
+}
+
+// Desc returns a description of this task.
+func (T *DropboxMigrationTask) Desc() string {
+	return "Migrate users, team folders, files, revisions and sharing from Dropbox Business to Kiteworks."
+}
+
+// Init parses the flags and loads the stored Dropbox connection.
+func (T *DropboxMigrationTask) Init() (err error) {
+	T.dropbox_db = T.DB.Sub("dropbox")
+	T.dropbox_config = T.dropbox_db.Table("dropbox_config")
+	T.dropbox_config.Get("app_key", &T.app_key)
+	T.dropbox_config.Get("app_secret", &T.app_secret)
+	T.dropbox_config.Get("refresh_token", &T.refresh_token)
+	T.dropbox_config.Get("access_token", &T.access_token)
+
+	setup := T.Flags.Bool("setup", "Configure Dropbox Business Connection")
+	T.Flags.StringVar(&T.target_profile_name, "profile", "Standard", "Destination profile for migrated users. (Needs permission to create folders)")
+	T.Flags.StringVar(&T.mapping_file, "mapping", "<mapping.csv>", "CSV or YAML file remapping users, groups, folder paths and roles.")
+	T.Flags.BoolVar(&T.map_groups, "map_groups", "Grant source groups as the Kiteworks groups of the same name instead of their members.")
+	T.Flags.MultiVar(&T.user_emails, "users", "<user@domain.com>", "User(s) to migrate.")
+	T.Flags.StringVar(&T.team_folder_owner, "team_folder_owner", "<user@domain.com>", "Owner of the migrated team folders. (default: the team admin)")
+	migrate := T.Flags.Bool("migrate", "Perform the actual migration.")
+	T.Flags.BoolVar(&T.report, "report", "Generate a report of Dropbox users, folders and files.")
+	T.Flags.StringVar(&T.preflight, "preflight", "<findings.csv>", "Check the source and destination for problems, writing findings to a CSV or JSON file.")
+	T.Flags.IntVar(&T.max_file_size, "max_file_size", 0, "Largest file (MB) the destination accepts, checked by --preflight.")
+	T.Flags.StringVar(&T.verify, "verify", "<discrepancies.csv>", "Compare the migrated users with the source, writing discrepancies to a CSV or JSON file.")
+	T.Flags.BoolVar(&T.requeue, "requeue", "With --verify, re-queue mismatched folders and files for the next --migrate.")
+	T.Flags.IntVar(&T.max_versions, "max_versions", 0, "Copy at most this many of each file's newest revisions. (0 copies all)")
+	T.Flags.StringVar(&T.rollback, "rollback", "<run id>", "Undo the users, folders, files, grants and keys created on Kiteworks by a migration run.")
+	T.Flags.BoolVar(&T.dry_run, "dry_run", "With --rollback, log what would be undone without changing anything.")
+	T.Flags.BoolVar(&T.status, "status", "Show each user's migration state, with throughput and an ETA.")
+	T.Flags.BoolVar(&T.retry_failed, "retry_failed", "With --migrate, migrate only the users whose last migration failed.")
+	T.limits.RegisterFlags(&T.Flags)
+	T.Flags.Order("migrate", "report", "preflight", "verify", "rollback", "status")
+	if err := T.Flags.Parse(); err != nil {
+		return err
+	}
+	if err := T.limits.Validate(); err != nil {
+		return err
+	}
+
+	if *setup || (IsBlank(T.refresh_token) && IsBlank(T.access_token)) {
+		T.configureDropbox()
+	}
+
+	if !IsBlank(T.mapping_file) {
+		mapping, err := LoadMigrationMapping(T.mapping_file)
+		if err != nil {
+			return err
+		}
+		T.mapping = mapping
+	}
+
+	var modes int
+	for _, m := range []bool{*migrate, T.report, !IsBlank(T.preflight), !IsBlank(T.verify), !IsBlank(T.rollback), T.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("--migrate, --report, --preflight, --verify, --rollback and --status are mutually exclusive, please specify only one")
+	}
+	if modes == 0 {
+		return fmt.Errorf("must specify either --migrate, --report, --preflight, --verify, --rollback or --status")
+	}
+	if T.requeue && IsBlank(T.verify) {
+		return fmt.Errorf("--requeue requires --verify")
+	}
+	if T.dry_run && IsBlank(T.rollback) {
+		return fmt.Errorf("--dry_run requires --rollback")
+	}
+	if T.retry_failed && !*migrate {
+		return fmt.Errorf("--retry_failed requires --migrate")
+	}
+	T.team_folder_owner = strings.ToLower(T.team_folder_owner)
+	return nil
+}
+
+// configureDropbox prompts for the Dropbox team app's credentials, saves them
+// and exits.
+func (T *DropboxMigrationTask) configureDropbox() {
+	dropbox_auth := NewOptions("--- Dropbox Business Configuration ---", "(selection or 'q' to save & exit)", 'q')
+	dropbox_auth.StringVar(&T.app_key, "App Key", T.app_key, "Please input the team app's key.")
+	dropbox_auth.SecretVar(&T.app_secret, "App Secret", T.app_secret, "Please input the team app's secret.")
+	dropbox_auth.SecretVar(&T.refresh_token, "Refresh Token", T.refresh_token, "Please input the team app's refresh token. (leave blank to use an access token)")
+	dropbox_auth.SecretVar(&T.access_token, "Access Token", T.access_token, "Please input a long-lived access token, when there is no refresh token.")
+	if dropbox_auth.Select(false) {
+		T.dropbox_config.Set("app_key", &T.app_key)
+		T.dropbox_config.CryptSet("app_secret", &T.app_secret)
+		T.dropbox_config.CryptSet("refresh_token", &T.refresh_token)
+		T.dropbox_config.CryptSet("access_token", &T.access_token)
+	}
+	Exit(0)
+}
+
+// configure_api creates and configures the Dropbox API client.
+func (T *DropboxMigrationTask) configure_api() {
+	T.api = newDropboxAPI(dropboxAPIServer, dropboxContentServer, T.app_key, T.app_secret, T.refresh_token, T.access_token)
+	T.api.VerifySSL = true
+	T.api.ProxyURI = T.KW.ProxyURI
+	T.dropbox_db.Drop("tokens")
+
+	T.api.SetDatabase(T.dropbox_db)
+	T.api.MaxChunkSize = T.KW.MaxChunkSize
+	T.api.SetLimiter(T.KW.GetLimit())
+	T.api.SetTransferLimiter(T.KW.GetTransferLimit())
+	T.api.RequestTimeout = T.KW.RequestTimeout
+	T.api.ConnectTimeout = T.KW.ConnectTimeout
+}
+
+// Main runs the Dropbox report, migration, preflight or verification.
+func (T *DropboxMigrationTask) Main() (err error) {
+	if !IsBlank(T.rollback) {
+		return RollbackMigration(&T.KiteBrokerTask, T.dropbox_db, T.rollback, T.dry_run)
+	}
+	T.configure_api()
+
+	source := &dropboxSource{
+		api:         T.api,
+		team_owner:  T.team_folder_owner,
+		max_version: T.max_versions,
+	}
+	if IsBlank(source.team_owner) {
+		admin, err := T.api.Team().AuthenticatedAdmin()
+		if err != nil {
+			return fmt.Errorf("Error reading the Dropbox team admin: %v", err)
+		}
+		source.team_owner = strings.ToLower(admin.Email)
+	}
+
+	engine := NewMigrationEngine(&T.KiteBrokerTask, source, T.dropbox_db)
+	engine.Users = T.user_emails
+	engine.Mapping = T.mapping
+	engine.Limits = T.limits
+	engine.RetryFailed = T.retry_failed
+	engine.MapGroups = T.map_groups
+	engine.MaxVersions = T.max_versions
+
+	if T.status {
+		return engine.RunStatus()
+	}
+	if T.report {
+		return engine.RunReport()
+	}
+	if !IsBlank(T.verify) {
+		return engine.RunVerify(T.verify, T.requeue)
+	}
+	if err := engine.SetProfile(T.target_profile_name); err != nil {
+		return err
+	}
+	if !IsBlank(T.preflight) {
+		engine.Preflight.MaxFileSize = int64(T.max_file_size) * 1024 * 1024
+		return engine.RunPreflight(T.preflight)
+	}
+	return engine.Run()
+}
@@ -0,0 +1,398 @@
+package dropbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// Dropbox API hosts.
+const (
+	dropboxAPIServer     = "api.dropboxapi.com"
+	dropboxContentServer = "content.dropboxapi.com"
+)
+
+// dropboxPageLimit is the page size requested from Dropbox list calls.
+const dropboxPageLimit = 1000
+
+// DropboxAPI wraps an APIClient for Dropbox Business API access as a team
+// app. ContentServer is the host downloads are made from; both it and the
+// APIClient's Server can point at a local fake server, over TLS.
+type DropboxAPI struct {
+	*APIClient
+	ContentServer string
+}
+
+// DropboxSession is the DropboxAPI acting as a team member. With Admin set,
+// MemberID is a team admin whose access reaches team folders. Root, when
+// set, is the namespace paths are relative to, such as a team folder's.
+type DropboxSession struct {
+	MemberID string
+	Admin    bool
+	Root     string
+	*DropboxAPI
+}
+
+// dropboxTag is a Dropbox union value with no fields of interest.
+type dropboxTag struct {
+	Tag string `json:".tag"`
+}
+
+// DropboxMember is a member of the Dropbox team.
+type DropboxMember struct {
+	TeamMemberID string `json:"team_member_id"`
+	AccountID    string `json:"account_id"`
+	Email        string `json:"email"`
+	Name         struct {
+		DisplayName string `json:"display_name"`
+	} `json:"name"`
+	Status dropboxTag `json:"status"`
+}
+
+// DropboxTeamFolder is a folder owned by the team rather than a member.
+type DropboxTeamFolder struct {
+	ID     string     `json:"team_folder_id"`
+	Name   string     `json:"name"`
+	Status dropboxTag `json:"status"`
+}
+
+// DropboxEntry is the metadata of a file or folder. SharedFolderID is set on
+// the root folder of a shared folder.
+type DropboxEntry struct {
+	Tag            string `json:".tag"`
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	PathDisplay    string `json:"path_display"`
+	Rev            string `json:"rev"`
+	Size           int64  `json:"size"`
+	ClientModified string `json:"client_modified"`
+	ServerModified string `json:"server_modified"`
+	SharedFolderID string `json:"shared_folder_id"`
+	IsDownloadable *bool  `json:"is_downloadable"`
+	SharingInfo    struct {
+		ModifiedBy string `json:"modified_by"`
+	} `json:"sharing_info"`
+}
+
+// DropboxPermission is a member of a shared folder: a user, by email, or a
+// group, with its Dropbox access level.
+type DropboxPermission struct {
+	Email   string
+	Group   string
+	GroupID string
+	Access  string
+}
+
+// dropboxError parses a Dropbox API error response body and returns an
+// APIError named after its error summary, e.g. DROPBOX_PATH_NOT_FOUND.
+func dropboxError(body []byte) (e APIError) {
+	var dropbox_error *struct {
+		Summary string `json:"error_summary"`
+	}
+	json.Unmarshal(body, &dropbox_error)
+
+	if dropbox_error != nil && dropbox_error.Summary != NONE {
+		code := strings.TrimRight(dropbox_error.Summary, "./")
+		code = strings.ToUpper(strings.Replace(code, "/", "_", -1))
+		e.Register(fmt.Sprintf("DROPBOX_%s", code), dropbox_error.Summary)
+	}
+	return
+}
+
+// readDropboxTime parses a Dropbox timestamp.
+func readDropboxTime(input string) (time.Time, error) {
+	if input == NONE {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, input)
+}
+
+// newDropboxAPI returns a client of the Dropbox API at server, downloading
+// from content_server. With a refresh token, access tokens are obtained with
+// the app's key and secret; otherwise access_token is used as is.
+func newDropboxAPI(server, content_server, app_key, app_secret, refresh_token, access_token string) *DropboxAPI {
+	api := &DropboxAPI{
+		APIClient:     new(APIClient),
+		ContentServer: content_server,
+	}
+	api.Server = server
+	api.ErrorScanner = dropboxError
+	api.TokenErrorCodes = []string{"DROPBOX_INVALID_ACCESS_TOKEN", "DROPBOX_EXPIRED_ACCESS_TOKEN"}
+	api.RetryErrorCodes = []string{"DROPBOX_TOO_MANY_REQUESTS", "DROPBOX_TOO_MANY_WRITE_OPERATIONS", "DROPBOX_INTERNAL_ERROR", "HTTP_STATUS_500", "HTTP_STATUS_503"}
+	api.Retries = 3
+
+	if IsBlank(refresh_token) {
+		auth := &Auth{
+			AccessToken: access_token,
+			Expires:     99999999999999,
+		}
+		api.NewToken = func(username string) (*Auth, error) {
+			return auth, nil
+		}
+		return api
+	}
+
+	api.ReaquireToken = true
+	api.NewToken = func(username string) (*Auth, error) {
+		Debug("[dropbox]: Requesting access token.")
+		token := new(Auth)
+		err := api.Call(APIRequest{
+			Method: "POST",
+			Path:   "/oauth2/token",
+			Params: SetParams(PostForm{
+				"grant_type":    "refresh_token",
+				"refresh_token": refresh_token,
+				"client_id":     app_key,
+				"client_secret": app_secret,
+			}),
+			Output: token,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to request Dropbox token: %v", err)
+		}
+		token.RefreshToken = NONE
+		token.Expires = time.Now().Add(time.Duration(token.Expires) * time.Second).Unix()
+		return token, nil
+	}
+	return api
+}
+
+// Team returns a session acting as the team itself, for team calls.
+func (D *DropboxAPI) Team() *DropboxSession {
+	return &DropboxSession{DropboxAPI: D}
+}
+
+// Member returns a session acting as a team member.
+func (D *DropboxAPI) Member(member_id string) *DropboxSession {
+	return &DropboxSession{MemberID: member_id, DropboxAPI: D}
+}
+
+// TeamFolder returns a session acting as a team admin within a team folder.
+func (D *DropboxAPI) TeamFolder(admin_id, folder_id string) *DropboxSession {
+	return &DropboxSession{MemberID: admin_id, Admin: true, Root: folder_id, DropboxAPI: D}
+}
+
+// headers sets the headers selecting the member and namespace of the session.
+func (S *DropboxSession) headers(header http.Header) {
+	switch {
+	case IsBlank(S.MemberID):
+	case S.Admin:
+		header.Set("Dropbox-API-Select-Admin", S.MemberID)
+	default:
+		header.Set("Dropbox-API-Select-User", S.MemberID)
+	}
+	if !IsBlank(S.Root) {
+		header.Set("Dropbox-API-Path-Root", fmt.Sprintf(`{".tag": "namespace_id", "namespace_id": %q}`, S.Root))
+	}
+}
+
+// Call performs a Dropbox RPC call, posting args as JSON.
+func (S *DropboxSession) Call(path string, args PostJSON, output interface{}) error {
+	header := make(http.Header)
+	S.headers(header)
+	return S.APIClient.Call(APIRequest{
+		Username: "dropbox_api_user",
+		Method:   "POST",
+		Path:     "/2" + path,
+		Header:   header,
+		Params:   SetParams(args),
+		Output:   output,
+	})
+}
+
+// AuthenticatedAdmin returns the team admin the app's token belongs to.
+func (S *DropboxSession) AuthenticatedAdmin() (admin DropboxMember, err error) {
+	var result struct {
+		Profile DropboxMember `json:"admin_profile"`
+	}
+	err = S.Call("/team/token/get_authenticated_admin", nil, &result)
+	return result.Profile, err
+}
+
+// Members returns the members of the team.
+func (S *DropboxSession) Members() (members []DropboxMember, err error) {
+	path, args := "/team/members/list_v2", PostJSON{"limit": dropboxPageLimit}
+	for {
+		var result struct {
+			Members []struct {
+				Profile DropboxMember `json:"profile"`
+			} `json:"members"`
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		}
+		if err = S.Call(path, args, &result); err != nil {
+			return nil, err
+		}
+		for _, m := range result.Members {
+			members = append(members, m.Profile)
+		}
+		if !result.HasMore {
+			return
+		}
+		path, args = "/team/members/list/continue_v2", PostJSON{"cursor": result.Cursor}
+	}
+}
+
+// TeamFolders returns the team's folders.
+func (S *DropboxSession) TeamFolders() (folders []DropboxTeamFolder, err error) {
+	path, args := "/team/team_folder/list", PostJSON{"limit": dropboxPageLimit}
+	for {
+		var result struct {
+			TeamFolders []DropboxTeamFolder `json:"team_folders"`
+			Cursor      string              `json:"cursor"`
+			HasMore     bool                `json:"has_more"`
+		}
+		if err = S.Call(path, args, &result); err != nil {
+			return nil, err
+		}
+		folders = append(folders, result.TeamFolders...)
+		if !result.HasMore {
+			return
+		}
+		path, args = "/team/team_folder/list/continue", PostJSON{"cursor": result.Cursor}
+	}
+}
+
+// GroupMembers returns the emails of a team group's members.
+func (S *DropboxSession) GroupMembers(group_id string) (emails []string, err error) {
+	path := "/team/groups/members/list"
+	args := PostJSON{"group": map[string]string{".tag": "group_id", "group_id": group_id}, "limit": dropboxPageLimit}
+	for {
+		var result struct {
+			Members []struct {
+				Profile DropboxMember `json:"profile"`
+			} `json:"members"`
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		}
+		if err = S.Call(path, args, &result); err != nil {
+			return nil, err
+		}
+		for _, m := range result.Members {
+			emails = append(emails, strings.ToLower(m.Profile.Email))
+		}
+		if !result.HasMore {
+			return
+		}
+		path, args = "/team/groups/members/list/continue", PostJSON{"cursor": result.Cursor}
+	}
+}
+
+// ListFolder returns the entries of a folder, by path or id; a blank path
+// is the session's root. Shared folders mounted in it are included.
+func (S *DropboxSession) ListFolder(path string) (entries []DropboxEntry, err error) {
+	call, args := "/files/list_folder", PostJSON{"path": path, "include_mounted_folders": true, "limit": dropboxPageLimit}
+	for {
+		var result struct {
+			Entries []DropboxEntry `json:"entries"`
+			Cursor  string         `json:"cursor"`
+			HasMore bool           `json:"has_more"`
+		}
+		if err = S.Call(call, args, &result); err != nil {
+			return nil, err
+		}
+		entries = append(entries, result.Entries...)
+		if !result.HasMore {
+			return
+		}
+		call, args = "/files/list_folder/continue", PostJSON{"cursor": result.Cursor}
+	}
+}
+
+// Revisions returns the revisions of a file, by id, newest first.
+func (S *DropboxSession) Revisions(file_id string, limit int) (revisions []DropboxEntry, err error) {
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+	var result struct {
+		Entries []DropboxEntry `json:"entries"`
+	}
+	err = S.Call("/files/list_revisions", PostJSON{"path": file_id, "mode": "id", "limit": limit}, &result)
+	return result.Entries, err
+}
+
+// FolderMembers returns the members of a shared folder.
+func (S *DropboxSession) FolderMembers(shared_folder_id string) (members []DropboxPermission, err error) {
+	path, args := "/sharing/list_folder_members", PostJSON{"shared_folder_id": shared_folder_id, "limit": dropboxPageLimit}
+	for {
+		var result struct {
+			Users []struct {
+				Access dropboxTag `json:"access_type"`
+				User   struct {
+					Email string `json:"email"`
+				} `json:"user"`
+			} `json:"users"`
+			Groups []struct {
+				Access dropboxTag `json:"access_type"`
+				Group  struct {
+					ID   string `json:"group_id"`
+					Name string `json:"group_name"`
+				} `json:"group"`
+			} `json:"groups"`
+			Invitees []struct {
+				Access  dropboxTag `json:"access_type"`
+				Invitee struct {
+					Email string `json:"email"`
+				} `json:"invitee"`
+			} `json:"invitees"`
+			Cursor string `json:"cursor"`
+		}
+		if err = S.Call(path, args, &result); err != nil {
+			return nil, err
+		}
+		for _, u := range result.Users {
+			members = append(members, DropboxPermission{Email: strings.ToLower(u.User.Email), Access: u.Access.Tag})
+		}
+		for _, i := range result.Invitees {
+			members = append(members, DropboxPermission{Email: strings.ToLower(i.Invitee.Email), Access: i.Access.Tag})
+		}
+		for _, g := range result.Groups {
+			members = append(members, DropboxPermission{Group: g.Group.Name, GroupID: g.Group.ID, Access: g.Access.Tag})
+		}
+		if IsBlank(result.Cursor) {
+			return
+		}
+		path, args = "/sharing/list_folder_members/continue", PostJSON{"cursor": result.Cursor}
+	}
+}
+
+// MapAccessType maps a Dropbox access level to the name of the Kiteworks role
+// granted by default; "" grants no access.
+func MapAccessType(access string) string {
+	switch access {
+	case "owner", "editor":
+		return "Collaborator"
+	case "viewer", "viewer_no_comment":
+		return "Viewer"
+	default:
+		return NONE
+	}
+}
+
+// Download returns the content of a file, by id, or of a revision given as
+// "rev:<rev>".
+func (S *DropboxSession) Download(path string) (ReadSeekCloser, error) {
+	arg, err := json.Marshal(map[string]string{"path": path})
+	if err != nil {
+		return nil, err
+	}
+	req, err := S.APIClient.NewRequest("POST", "/2/files/download")
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Host = S.ContentServer
+	req.Host = S.ContentServer
+	req.Header.Set("Dropbox-API-Arg", string(arg))
+	S.headers(req.Header)
+	if err = S.APIClient.SetToken("dropbox_api_user", req); err != nil {
+		return nil, err
+	}
+	download := S.APIClient.WebDownload(req)
+	// Dropbox rejects the octet-stream Content-Type WebDownload sets.
+	req.Header.Del("Content-Type")
+	return download, nil
+}
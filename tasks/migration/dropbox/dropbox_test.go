@@ -0,0 +1,341 @@
+package dropbox
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// fakeCall is an RPC call received by the fake Dropbox server.
+type fakeCall struct {
+	args   map[string]interface{}
+	header http.Header
+}
+
+// fakeDropbox is a stand-in for the Dropbox API, answering each RPC path
+// with its handler. Paths without a handler answer with a 409 not_found.
+type fakeDropbox struct {
+	*httptest.Server
+	lock     sync.Mutex
+	handlers map[string]func(call fakeCall) (int, string)
+	calls    map[string][]fakeCall
+}
+
+// newFakeDropbox starts a fake Dropbox server, until the test ends.
+func newFakeDropbox(t *testing.T) *fakeDropbox {
+	f := &fakeDropbox{
+		handlers: make(map[string]func(fakeCall) (int, string)),
+		calls:    make(map[string][]fakeCall),
+	}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := fakeCall{header: r.Header}
+		json.NewDecoder(r.Body).Decode(&call.args)
+
+		f.lock.Lock()
+		f.calls[r.URL.Path] = append(f.calls[r.URL.Path], call)
+		handler, ok := f.handlers[r.URL.Path]
+		f.lock.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error_summary": "path/not_found/.."}`))
+			return
+		}
+		status, body := handler(call)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(f.Server.Close)
+	return f
+}
+
+// handle answers path with body.
+func (f *fakeDropbox) handle(path, body string) {
+	f.handleFunc(path, func(fakeCall) (int, string) { return http.StatusOK, body })
+}
+
+// handleFunc answers path with handler.
+func (f *fakeDropbox) handleFunc(path string, handler func(call fakeCall) (int, string)) {
+	f.lock.Lock()
+	f.handlers[path] = handler
+	f.lock.Unlock()
+}
+
+// received returns the calls made to path.
+func (f *fakeDropbox) received(path string) []fakeCall {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[path]
+}
+
+// api returns a client of the fake server using a fixed access token.
+func (f *fakeDropbox) api() *DropboxAPI {
+	host := strings.TrimPrefix(f.URL, "https://")
+	api := newDropboxAPI(host, host, NONE, NONE, NONE, "test-token")
+	api.SetDatabase(OpenCache())
+	api.SetLimiter(5)
+	api.SetTransferLimiter(5)
+	return api
+}
+
+func TestMemberPaging(t *testing.T) {
+	f := newFakeDropbox(t)
+	f.handle("/2/team/members/list_v2", `{"members": [
+		{"profile": {"team_member_id": "dbmid:1", "account_id": "dbid:1", "email": "Alice@Example.com", "name": {"display_name": "Alice"}, "status": {".tag": "active"}}},
+		{"profile": {"team_member_id": "dbmid:2", "account_id": "dbid:2", "email": "bob@example.com", "status": {".tag": "suspended"}}}
+	], "cursor": "page-2", "has_more": true}`)
+	f.handle("/2/team/members/list/continue_v2", `{"members": [
+		{"profile": {"team_member_id": "dbmid:3", "account_id": "dbid:3", "email": "carol@example.com", "status": {".tag": "active"}}}
+	], "cursor": "", "has_more": false}`)
+	f.handle("/2/team/token/get_authenticated_admin", `{"admin_profile": {"team_member_id": "dbmid:1", "email": "alice@example.com"}}`)
+	f.handle("/2/team/team_folder/list", `{"team_folders": [
+		{"team_folder_id": "tf1", "name": "Finance", "status": {".tag": "active"}}
+	], "cursor": "tf-2", "has_more": true}`)
+	f.handle("/2/team/team_folder/list/continue", `{"team_folders": [
+		{"team_folder_id": "tf2", "name": "Old", "status": {".tag": "archived"}}
+	], "has_more": false}`)
+
+	S := &dropboxSource{api: f.api(), team_owner: "owner@example.com"}
+	users, err := S.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, u := range users {
+		got = append(got, u.ID+"="+u.Email)
+	}
+	want := []string{"dbmid:1=alice@example.com", "dbmid:3=carol@example.com", teamFoldersID + "=owner@example.com"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("users: got %v, want %v", got, want)
+	}
+	if S.accounts["dbid:2"] != "bob@example.com" {
+		t.Errorf("inactive member missing from accounts: %v", S.accounts)
+	}
+	if S.admin != "dbmid:1" || len(S.team) != 1 {
+		t.Errorf("admin %q, team folders %v", S.admin, S.team)
+	}
+
+	calls := f.received("/2/team/members/list/continue_v2")
+	if len(calls) != 1 || calls[0].args["cursor"] != "page-2" {
+		t.Errorf("continue calls: %+v", calls)
+	}
+	if calls := f.received("/2/team/team_folder/list/continue"); len(calls) != 1 || calls[0].args["cursor"] != "tf-2" {
+		t.Errorf("team folder continue calls: %+v", calls)
+	}
+	for _, call := range f.received("/2/team/members/list_v2") {
+		if auth := call.header.Get("Authorization"); auth != "Bearer test-token" {
+			t.Errorf("Authorization: %q", auth)
+		}
+		if call.header.Get("Dropbox-API-Select-User") != NONE {
+			t.Error("team call selected a member")
+		}
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	var form string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth2/token":
+			r.ParseForm()
+			form = r.PostForm.Get("grant_type") + ":" + r.PostForm.Get("refresh_token") + ":" + r.PostForm.Get("client_id")
+			w.Write([]byte(`{"access_token": "fresh-token", "expires_in": 14400}`))
+		case "/2/team/members/list_v2":
+			if r.Header.Get("Authorization") != "Bearer fresh-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error_summary": "invalid_access_token/.."}`))
+				return
+			}
+			w.Write([]byte(`{"members": [], "has_more": false}`))
+		}
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	api := newDropboxAPI(host, host, "app-key", "app-secret", "refresh", NONE)
+	api.SetDatabase(OpenCache())
+	api.SetLimiter(5)
+	if _, err := api.Team().Members(); err != nil {
+		t.Fatal(err)
+	}
+	if form != "refresh_token:refresh:app-key" {
+		t.Errorf("token request: %q", form)
+	}
+}
+
+func TestNamespaceWalk(t *testing.T) {
+	f := newFakeDropbox(t)
+	f.handleFunc("/2/files/list_folder", func(call fakeCall) (int, string) {
+		switch {
+		case call.header.Get("Dropbox-API-Path-Root") != NONE:
+			return http.StatusOK, `{"entries": [
+				{".tag": "file", "id": "id:budget", "name": "budget.xlsx", "path_display": "/budget.xlsx", "size": 10}
+			], "has_more": false}`
+		case call.args["path"] == "":
+			return http.StatusOK, `{"entries": [
+				{".tag": "file", "id": "id:a", "name": "a.txt", "path_display": "/a.txt", "size": 5, "client_modified": "2024-03-01T10:00:00Z", "server_modified": "2024-03-02T09:00:00Z"},
+				{".tag": "folder", "id": "id:docs", "name": "Docs", "path_display": "/Docs"}
+			], "cursor": "root-2", "has_more": true}`
+		case call.args["path"] == "id:docs":
+			return http.StatusOK, `{"entries": [
+				{".tag": "file", "id": "id:paper", "name": "notes.paper", "path_display": "/Docs/notes.paper", "is_downloadable": false},
+				{".tag": "file", "id": "id:b", "name": "b.txt", "path_display": "/Docs/b.txt", "size": 7}
+			], "has_more": false}`
+		}
+		return http.StatusConflict, `{"error_summary": "path/not_found/.."}`
+	})
+	f.handle("/2/files/list_folder/continue", `{"entries": [
+		{".tag": "folder", "id": "id:mine", "name": "Mine", "path_display": "/Mine", "shared_folder_id": "sf-mine"},
+		{".tag": "folder", "id": "id:theirs", "name": "Theirs", "path_display": "/Theirs", "shared_folder_id": "sf-theirs"},
+		{".tag": "folder", "id": "id:finance", "name": "Finance", "path_display": "/Finance", "shared_folder_id": "tf1"}
+	], "has_more": false}`)
+	f.handleFunc("/2/sharing/list_folder_members", func(call fakeCall) (int, string) {
+		if call.args["shared_folder_id"] == "sf-mine" {
+			return http.StatusOK, `{"users": [
+				{"access_type": {".tag": "owner"}, "user": {"email": "Alice@Example.com"}},
+				{"access_type": {".tag": "editor"}, "user": {"email": "bob@example.com"}}
+			], "cursor": "members-2"}`
+		}
+		return http.StatusOK, `{"users": [{"access_type": {".tag": "owner"}, "user": {"email": "carol@example.com"}}]}`
+	})
+	f.handle("/2/sharing/list_folder_members/continue", `{"groups": [
+		{"access_type": {".tag": "viewer"}, "group": {"group_id": "g:1", "group_name": "Sales"}}
+	], "invitees": [
+		{"access_type": {".tag": "viewer_no_comment"}, "invitee": {"email": "dave@example.com"}}
+	]}`)
+
+	S := &dropboxSource{
+		api:        f.api(),
+		team_owner: "owner@example.com",
+		admin:      "dbmid:admin",
+		team:       map[string]DropboxTeamFolder{"tf1": {ID: "tf1", Name: "Finance"}},
+	}
+	user := MigrationUser{ID: "dbmid:1", Email: "alice@example.com"}
+
+	root, err := S.Root(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := S.Files(user, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].SrcID != "id:a" || files[0].Size != 5 || files[0].Modified.Day() != 2 || files[0].Created.Day() != 1 {
+		t.Errorf("root files: %+v", files)
+	}
+	folders, err := S.Folders(user, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, sub := range folders {
+		paths = append(paths, sub.FullPath+"="+sub.SrcID)
+	}
+	sort.Strings(paths)
+	// Theirs is another member's shared folder, and Finance a team folder.
+	if want := "Docs=id:docs,Mine=id:mine"; strings.Join(paths, ",") != want {
+		t.Errorf("folders: got %v, want %s", paths, want)
+	}
+	if n := len(f.received("/2/files/list_folder")); n != 1 {
+		t.Errorf("root listed %d times, want once", n)
+	}
+	for _, call := range f.received("/2/files/list_folder") {
+		if call.header.Get("Dropbox-API-Select-User") != "dbmid:1" {
+			t.Errorf("member listing selected %q", call.header.Get("Dropbox-API-Select-User"))
+		}
+	}
+
+	docs, err := S.Files(user, SyncFolder{SrcID: "id:docs", FullPath: "Docs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].Name != "b.txt" {
+		t.Errorf("docs files, without the Paper document: %+v", docs)
+	}
+
+	members, err := S.Members(user, SyncFolder{SrcID: "id:mine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range members {
+		got = append(got, m.User+m.GroupID+"="+m.Role)
+	}
+	if want := "bob@example.com=Collaborator,dave@example.com=Viewer,g:1=Viewer"; strings.Join(got, ",") != want {
+		t.Errorf("members: got %v, want %s", got, want)
+	}
+	if members, _ := S.Members(user, SyncFolder{SrcID: "id:docs"}); members != nil {
+		t.Errorf("members of an unshared folder: %v", members)
+	}
+
+	// The team folders' owner walks the team folders, in their namespace.
+	owner := MigrationUser{ID: teamFoldersID, Email: "owner@example.com"}
+	root, _ = S.Root(owner)
+	team, err := S.Folders(owner, root)
+	if err != nil || len(team) != 1 || team[0].SrcID != "tf1|/" {
+		t.Fatalf("team folders: %+v, %v", team, err)
+	}
+	files, err = S.Files(owner, team[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].SrcID != "tf1|id:budget" {
+		t.Errorf("team folder files: %+v", files)
+	}
+	calls := f.received("/2/files/list_folder")
+	last := calls[len(calls)-1]
+	if last.header.Get("Dropbox-API-Select-Admin") != "dbmid:admin" || !strings.Contains(last.header.Get("Dropbox-API-Path-Root"), `"tf1"`) {
+		t.Errorf("team folder listing headers: %v", last.header)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	f := newFakeDropbox(t)
+	f.handle("/2/files/list_revisions", `{"entries": [
+		{"rev": "r3", "name": "a.txt", "size": 30, "client_modified": "2024-03-03T00:00:00Z", "server_modified": "2024-03-03T01:00:00Z", "sharing_info": {"modified_by": "dbid:2"}},
+		{"rev": "r2", "name": "a.txt", "size": 20, "client_modified": "2024-03-02T00:00:00Z"},
+		{"rev": "r1", "name": "a.txt", "size": 10, "client_modified": "2024-03-01T00:00:00Z"}
+	]}`)
+
+	S := &dropboxSource{
+		api:         f.api(),
+		accounts:    map[string]string{"dbid:2": "bob@example.com"},
+		max_version: 3,
+	}
+	versions, err := S.Versions(MigrationUser{ID: "dbmid:1"}, SyncFile{SrcID: "tf1|id:a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("got %d versions, want 3", len(versions))
+	}
+	for i, v := range versions {
+		if v.Ver != i+1 || v.SrcID != []string{"r1", "r2", "r3"}[i] {
+			t.Errorf("version %d: %+v", i, v)
+		}
+	}
+	if versions[2].Uploader != "bob@example.com" || versions[2].Created.IsZero() || versions[0].Uploader != NONE {
+		t.Errorf("uploaders: %q, %q", versions[0].Uploader, versions[2].Uploader)
+	}
+
+	calls := f.received("/2/files/list_revisions")
+	if len(calls) != 1 || calls[0].args["path"] != "id:a" || calls[0].args["mode"] != "id" || calls[0].args["limit"] != float64(3) {
+		t.Errorf("list_revisions call: %+v", calls)
+	}
+}
+
+func TestErrorSummary(t *testing.T) {
+	f := newFakeDropbox(t)
+	_, err := f.api().Member("dbmid:1").ListFolder("id:missing")
+	if !IsAPIError(err, "DROPBOX_PATH_NOT_FOUND") {
+		t.Errorf("got %v, want DROPBOX_PATH_NOT_FOUND", err)
+	}
+}
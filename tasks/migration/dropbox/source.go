@@ -0,0 +1,335 @@
+package dropbox
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// dropboxRoot is the SrcID of a member's root folder.
+const dropboxRoot = "/"
+
+// teamFoldersID is the source user id holding the team folders, when their
+// owner is not a team member.
+const teamFoldersID = "team_folders"
+
+// dropboxSource is the Dropbox Business MigrationSource. Each member's
+// namespace is migrated to them; team folders are migrated to team_owner,
+// below their root.
+//
+// Objects in a team folder have SrcIDs prefixed with the team folder's id,
+// so they are read within its namespace. A folder's listing is held until
+// the walk has read its files and subfolders, rather than requested twice.
+type dropboxSource struct {
+	api         *DropboxAPI
+	team_owner  string
+	admin       string                       // Team member id of the app's admin.
+	accounts    map[string]string            // Member emails, by account id.
+	team        map[string]DropboxTeamFolder // Active team folders, by id.
+	shared      sync.Map                     // Shared folder ids, by folder SrcID.
+	owners      sync.Map                     // Shared folder owners, by shared folder id.
+	listings    sync.Map
+	max_version int
+}
+
+// Name returns the source name.
+func (S *dropboxSource) Name() string {
+	return "Dropbox"
+}
+
+// Users returns the active team members, and the team folders' owner when
+// it is not one.
+func (S *dropboxSource) Users() (users []MigrationUser, err error) {
+	team := S.api.Team()
+	members, err := team.Members()
+	if err != nil {
+		return nil, err
+	}
+	S.accounts = make(map[string]string)
+	var has_owner bool
+	for _, m := range members {
+		email := strings.ToLower(m.Email)
+		S.accounts[m.AccountID] = email
+		if m.Status.Tag != "active" {
+			continue
+		}
+		if email == S.team_owner {
+			has_owner = true
+		}
+		users = append(users, MigrationUser{
+			ID:    m.TeamMemberID,
+			Email: email,
+			Name:  m.Name.DisplayName,
+		})
+	}
+
+	if IsBlank(S.team_owner) {
+		return users, nil
+	}
+	admin, err := team.AuthenticatedAdmin()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the team admin, needed for team folders: %v", err)
+	}
+	S.admin = admin.TeamMemberID
+	folders, err := team.TeamFolders()
+	if err != nil {
+		return nil, err
+	}
+	S.team = make(map[string]DropboxTeamFolder)
+	for _, f := range folders {
+		if f.Status.Tag == "active" {
+			S.team[f.ID] = f
+		}
+	}
+	if len(S.team) > 0 && !has_owner {
+		users = append(users, MigrationUser{ID: teamFoldersID, Email: S.team_owner, Name: "Team Folders"})
+	}
+	return users, nil
+}
+
+// splitID returns the team folder and Dropbox id of a SrcID; the team folder
+// is blank for a member's own objects.
+func splitID(src_id string) (team_folder, id string) {
+	if i := strings.Index(src_id, "|"); i >= 0 {
+		return src_id[:i], src_id[i+1:]
+	}
+	return NONE, src_id
+}
+
+// session returns the session reading a user's object.
+func (S *dropboxSource) session(user MigrationUser, team_folder string) *DropboxSession {
+	if !IsBlank(team_folder) {
+		return S.api.TeamFolder(S.admin, team_folder)
+	}
+	return S.api.Member(user.ID)
+}
+
+// listing returns the entries of a folder, from the cache when it is held.
+func (S *dropboxSource) listing(user MigrationUser, src_id string) ([]DropboxEntry, error) {
+	key := user.ID + ":" + src_id
+	if entries, ok := S.listings.Load(key); ok {
+		return entries.([]DropboxEntry), nil
+	}
+	team_folder, id := splitID(src_id)
+	if id == dropboxRoot {
+		id = NONE
+	}
+	entries, err := S.session(user, team_folder).ListFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	S.listings.Store(key, entries)
+	return entries, nil
+}
+
+// Root returns the user's root folder; files at the root of a member's
+// Dropbox are migrated into a folder called Dropbox.
+func (S *dropboxSource) Root(user MigrationUser) (SyncFolder, error) {
+	if user.ID == teamFoldersID {
+		return SyncFolder{Name: "Team Folders", SrcID: teamFoldersID}, nil
+	}
+	return SyncFolder{Name: "Dropbox", SrcID: dropboxRoot, FullPath: "Dropbox", Owner: user.Email}, nil
+}
+
+// Folders returns the subfolders of a folder, and at the root of the team
+// folders' owner, the team folders. Shared folders are only returned to
+// their owner, and team folders only to theirs.
+func (S *dropboxSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	if folder.SrcID == teamFoldersID || (folder.SrcID == dropboxRoot && user.Email == S.team_owner) {
+		for _, f := range S.team {
+			src_id := f.ID + "|" + dropboxRoot
+			S.shared.Store(src_id, f.ID)
+			folders = append(folders, SyncFolder{
+				Name:     f.Name,
+				SrcID:    src_id,
+				FullPath: f.Name,
+				Owner:    S.team_owner,
+			})
+		}
+		if folder.SrcID == teamFoldersID {
+			return folders, nil
+		}
+	}
+
+	entries, err := S.listing(user, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	team_folder, _ := splitID(folder.SrcID)
+	for _, e := range entries {
+		if e.Tag != "folder" {
+			continue
+		}
+		src_id := e.ID
+		if !IsBlank(team_folder) {
+			src_id = team_folder + "|" + e.ID
+		}
+		if !IsBlank(e.SharedFolderID) {
+			if !S.ownsShared(user, team_folder, e.SharedFolderID) {
+				continue
+			}
+			S.shared.Store(src_id, e.SharedFolderID)
+		}
+		full_path := strings.TrimPrefix(e.PathDisplay, "/")
+		if !IsBlank(team_folder) {
+			full_path = S.team[team_folder].Name + "/" + full_path
+		}
+		folders = append(folders, SyncFolder{
+			Name:     e.Name,
+			SrcID:    src_id,
+			FullPath: full_path,
+			Owner:    user.Email,
+		})
+	}
+	return
+}
+
+// Release drops the folder's held listing.
+func (S *dropboxSource) Release(user MigrationUser, folder SyncFolder) {
+	S.listings.Delete(user.ID + ":" + folder.SrcID)
+}
+
+// ownsShared reports whether a shared folder is migrated with user: within a
+// team folder, or when the user owns it. Team folders mounted in a member's
+// Dropbox are migrated with the team folders.
+func (S *dropboxSource) ownsShared(user MigrationUser, team_folder, shared_folder_id string) bool {
+	if !IsBlank(team_folder) {
+		return true
+	}
+	if _, ok := S.team[shared_folder_id]; ok {
+		return false
+	}
+	if owner, ok := S.owners.Load(shared_folder_id); ok {
+		return owner.(string) == user.Email
+	}
+	members, err := S.session(user, NONE).FolderMembers(shared_folder_id)
+	if err != nil {
+		Err("[%s]: Error reading members of shared folder %s: %v", user.Email, shared_folder_id, err)
+		return false
+	}
+	var owner string
+	for _, m := range members {
+		if m.Access == "owner" {
+			owner = m.Email
+			break
+		}
+	}
+	S.owners.Store(shared_folder_id, owner)
+	return owner == user.Email
+}
+
+// Files returns the files within a folder. Files that cannot be downloaded,
+// such as Paper documents, are skipped.
+func (S *dropboxSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	if folder.SrcID == teamFoldersID {
+		return nil, nil
+	}
+	entries, err := S.listing(user, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	team_folder, _ := splitID(folder.SrcID)
+	for _, e := range entries {
+		if e.Tag != "file" {
+			continue
+		}
+		if e.IsDownloadable != nil && !*e.IsDownloadable {
+			Log("[%s]: Skipping %s, which Dropbox cannot download.", user.Email, e.PathDisplay)
+			continue
+		}
+		src_id := e.ID
+		if !IsBlank(team_folder) {
+			src_id = team_folder + "|" + e.ID
+		}
+		// server_modified changes whenever the file's content does, whereas
+		// client_modified is whatever time the uploading client supplied.
+		created, _ := readDropboxTime(e.ClientModified)
+		modified, _ := readDropboxTime(e.ServerModified)
+		files = append(files, SyncFile{
+			Name:        e.Name,
+			SrcID:       src_id,
+			SrcFolderID: folder.SrcID,
+			Created:     created,
+			Modified:    modified,
+			Size:        e.Size,
+		})
+	}
+	return
+}
+
+// Members returns the members of a shared folder, users and groups.
+func (S *dropboxSource) Members(user MigrationUser, folder SyncFolder) (members []MigrationMember, err error) {
+	shared_id, ok := S.shared.LoadAndDelete(folder.SrcID)
+	if !ok {
+		return nil, nil
+	}
+	team_folder, _ := splitID(folder.SrcID)
+	perms, err := S.session(user, team_folder).FolderMembers(shared_id.(string))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range perms {
+		if p.Access == "owner" {
+			continue
+		}
+		members = append(members, MigrationMember{
+			User:       p.Email,
+			Role:       MapAccessType(p.Access),
+			SourceRole: p.Access,
+			Group:      p.Group,
+			GroupID:    p.GroupID,
+		})
+	}
+	return
+}
+
+// GroupMembers returns the emails of a team group's members.
+func (S *dropboxSource) GroupMembers(user MigrationUser, group_id string) ([]string, error) {
+	return S.api.Team().GroupMembers(group_id)
+}
+
+// RoleNames returns the roles MapAccessType grants.
+func (S *dropboxSource) RoleNames() []string {
+	return []string{"Collaborator", "Viewer"}
+}
+
+// Versions returns the file's revisions, oldest first.
+func (S *dropboxSource) Versions(user MigrationUser, file SyncFile) (versions []SyncVersion, err error) {
+	team_folder, id := splitID(file.SrcID)
+	revisions, err := S.session(user, team_folder).Revisions(id, S.max_version)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		r := revisions[i]
+		modified, _ := readDropboxTime(r.ClientModified)
+		uploaded, _ := readDropboxTime(r.ServerModified)
+		versions = append(versions, SyncVersion{
+			SrcID:    r.Rev,
+			Ver:      len(versions) + 1,
+			Name:     r.Name,
+			Created:  uploaded,
+			Modified: modified,
+			Size:     r.Size,
+			Uploader: S.accounts[r.SharingInfo.ModifiedBy],
+		})
+	}
+	return
+}
+
+// Comments returns nil; Dropbox file comments are not available to team apps.
+func (S *dropboxSource) Comments(user MigrationUser, file SyncFile) ([]SyncComment, error) {
+	return nil, nil
+}
+
+// Open downloads a revision of the file, or its current content when the
+// version is not one of Dropbox's.
+func (S *dropboxSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	team_folder, id := splitID(file.SrcID)
+	if !IsBlank(version.SrcID) && version.SrcID != file.SrcID {
+		id = "rev:" + version.SrcID
+	}
+	return S.session(user, team_folder).Download(id)
+}
@@ -0,0 +1,276 @@
+package filesystem
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterMigrationTask(new(FilesystemMigrationTask)) }
+
+// FilesystemMigrationTask migrates a local or mounted directory tree, such as a
+// departmental NAS share, to Kiteworks.
+type FilesystemMigrationTask struct {
+	KiteBrokerTask
+	input struct {
+		src_dir     string
+		owners      string
+		identities  string
+		acl         string
+		profile     string
+		user_emails []string
+		mapping     string
+	}
+	mapping       *MigrationMapping
+	fs_db         Database
+	report        bool
+	preflight     string
+	max_file_size int
+	rollback      string
+	dry_run       bool
+	status        bool
+	retry_failed  bool
+}
+
+// Name returns the name of this task.
+func (T *FilesystemMigrationTask) Name() string {
+	return "filesystem"
+}
+
+// Desc returns a description of this task.
+func (T *FilesystemMigrationTask) Desc() string {
+	return "Migrate folders, files, and permissions from a local or mounted file share to Kiteworks."
+}
+
+// Init initializes the filesystem migration task.
+func (T *FilesystemMigrationTask) Init() (err error) {
+	T.fs_db = T.DB.Sub("filesystem")
+
+	T.Flags.StringVar(&T.input.src_dir, "src_dir", "<path/to/share>", "Source directory to migrate.")
+	T.Flags.StringVar(&T.input.owners, "owners", "<owners.csv>", "CSV mapping top-level directories to Kiteworks owners. (directory,owner)")
+	T.Flags.StringVar(&T.input.identities, "identities", "<identities.csv>", "CSV mapping POSIX owners and groups to Kiteworks users. (uid|gid,id,user)")
+	T.Flags.StringVar(&T.input.acl, "acl", "<acl.csv>", "CSV export of folder ACLs, used instead of POSIX permissions. (path,user,role)")
+	T.Flags.StringVar(&T.input.profile, "profile", "Standard", "Destination profile for migrated users. (Needs permission to create folders)")
+	T.Flags.StringVar(&T.input.mapping, "mapping", "<mapping.csv>", "CSV or YAML file remapping users, folder paths and roles.")
+	T.Flags.MultiVar(&T.input.user_emails, "users", "<user@domain.com>", "Owner(s) to migrate.")
+	migrate := T.Flags.Bool("migrate", "Perform the actual migration.")
+	T.Flags.BoolVar(&T.report, "report", "Generate a report of the source folders and files.")
+	T.Flags.StringVar(&T.preflight, "preflight", "<findings.csv>", "Check the source and destination for problems, writing findings to a CSV or JSON file.")
+	T.Flags.IntVar(&T.max_file_size, "max_file_size", 0, "Largest file (MB) the destination accepts, checked by --preflight.")
+	T.Flags.StringVar(&T.rollback, "rollback", "<run id>", "Undo the users, folders, files and grants created on Kiteworks by a migration run.")
+	T.Flags.BoolVar(&T.dry_run, "dry_run", "With --rollback, log what would be undone without changing anything.")
+	T.Flags.BoolVar(&T.status, "status", "Show each user's migration state, with throughput and an ETA.")
+	T.Flags.BoolVar(&T.retry_failed, "retry_failed", "With --migrate, migrate only the users whose last migration failed.")
+	T.Flags.Order("migrate", "report", "preflight", "rollback", "status", "src_dir", "owners")
+	if err := T.Flags.Parse(); err != nil {
+		return err
+	}
+
+	if !IsBlank(T.input.mapping) {
+		mapping, err := LoadMigrationMapping(T.input.mapping)
+		if err != nil {
+			return err
+		}
+		T.mapping = mapping
+	}
+
+	var modes int
+	for _, m := range []bool{*migrate, T.report, !IsBlank(T.preflight), !IsBlank(T.rollback), T.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("--migrate, --report, --preflight, --rollback and --status are mutually exclusive, please specify only one")
+	}
+	if modes == 0 {
+		return fmt.Errorf("must specify either --migrate, --report, --preflight, --rollback or --status")
+	}
+	if T.dry_run && IsBlank(T.rollback) {
+		return fmt.Errorf("--dry_run requires --rollback")
+	}
+	if T.retry_failed && !*migrate {
+		return fmt.Errorf("--retry_failed requires --migrate")
+	}
+	if !IsBlank(T.rollback) {
+		return nil
+	}
+	if IsBlank(T.input.src_dir) {
+		return fmt.Errorf("--src_dir is required.")
+	}
+	if IsBlank(T.input.owners) {
+		return fmt.Errorf("--owners is required.")
+	}
+	return nil
+}
+
+// Main runs the filesystem report or migration.
+func (T *FilesystemMigrationTask) Main() (err error) {
+	if !IsBlank(T.rollback) {
+		return RollbackMigration(&T.KiteBrokerTask, T.fs_db, T.rollback, T.dry_run)
+	}
+
+	src, err := T.newSource()
+	if err != nil {
+		return err
+	}
+
+	engine := NewMigrationEngine(&T.KiteBrokerTask, src, T.fs_db)
+	engine.Users = T.input.user_emails
+	engine.Mapping = T.mapping
+	engine.RetryFailed = T.retry_failed
+
+	if T.status {
+		return engine.RunStatus()
+	}
+	if T.report {
+		return engine.RunReport()
+	}
+	if err := engine.SetProfile(T.input.profile); err != nil {
+		return err
+	}
+	if !IsBlank(T.preflight) {
+		engine.Preflight.MaxFileSize = int64(T.max_file_size) * 1024 * 1024
+		return engine.RunPreflight(T.preflight)
+	}
+	return engine.Run()
+}
+
+// newSource loads the mapping files and returns the migration source.
+func (T *FilesystemMigrationTask) newSource() (*fsSource, error) {
+	root, err := filepath.Abs(T.input.src_dir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", root)
+	}
+
+	src := &fsSource{
+		root:   root,
+		owners: make(map[string]string),
+		uids:   make(map[uint32]string),
+		gids:   make(map[uint32][]string),
+	}
+
+	records, err := readCSV(T.input.owners)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if len(r) < 2 || !strings.Contains(r[1], "@") {
+			continue
+		}
+		dir := strings.Trim(filepath.ToSlash(r[0]), "/")
+		if IsBlank(dir) || strings.Contains(dir, "/") {
+			return nil, fmt.Errorf("%s: %q is not a top-level directory", T.input.owners, r[0])
+		}
+		src.owners[dir] = strings.ToLower(r[1])
+	}
+	if len(src.owners) == 0 {
+		return nil, fmt.Errorf("%s: no directories are mapped to an owner", T.input.owners)
+	}
+
+	if !IsBlank(T.input.identities) {
+		records, err := readCSV(T.input.identities)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if len(r) < 3 || !strings.Contains(r[2], "@") {
+				continue
+			}
+			id, err := strconv.ParseUint(r[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid id %q", T.input.identities, r[1])
+			}
+			email := strings.ToLower(r[2])
+			switch strings.ToLower(r[0]) {
+			case "uid":
+				src.uids[uint32(id)] = email
+			case "gid":
+				src.gids[uint32(id)] = append(src.gids[uint32(id)], email)
+			default:
+				return nil, fmt.Errorf("%s: expected uid or gid, got %q", T.input.identities, r[0])
+			}
+		}
+	}
+
+	if !IsBlank(T.input.acl) {
+		src.acl = make(map[string][]MigrationMember)
+		records, err := readCSV(T.input.acl)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if len(r) < 3 || !strings.Contains(r[1], "@") {
+				continue
+			}
+			role, ok := aclRole(r[2])
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown role %q for %s on %s", T.input.acl, r[2], r[1], r[0])
+			}
+			path := strings.Trim(filepath.ToSlash(r[0]), "/")
+			src.acl[path] = append(src.acl[path], MigrationMember{User: strings.ToLower(r[1]), Role: role})
+		}
+	}
+
+	return src, nil
+}
+
+// readCSV reads all records of a CSV file, trimming each field. Lines
+// starting with '#' are ignored.
+func readCSV(file string) (records [][]string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err = reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for _, r := range records {
+		for i := range r {
+			r[i] = strings.TrimSpace(r[i])
+		}
+	}
+	return records, nil
+}
+
+// aclRoles maps ACL export rights to Kiteworks roles.
+var aclRoles = map[string]string{
+	"read":   "downloader",
+	"list":   "viewer",
+	"write":  "uploader",
+	"modify": "collaborator",
+	"change": "collaborator",
+	"full":   "manager",
+	"none":   "",
+}
+
+// aclRole returns the Kiteworks role for an ACL export entry, which is either
+// a right from aclRoles or a Kiteworks role name.
+func aclRole(input string) (string, bool) {
+	input = strings.ToLower(input)
+	if role, ok := aclRoles[input]; ok {
+		return role, true
+	}
+	switch input {
+	case "viewer", "downloader", "uploader", "collaborator", "manager":
+		return input, true
+	}
+	return "", false
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package filesystem
+
+import (
+	"os"
+	"syscall"
+)
+
+// posixOwner returns the uid and gid owning a file.
+func posixOwner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return stat.Uid, stat.Gid, true
+}
@@ -0,0 +1,234 @@
+package filesystem
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// fsSource is a directory tree as a MigrationSource. Each top-level directory
+// is migrated as a folder of the owner it is mapped to; files directly under
+// the root are not migrated. SrcIDs are paths relative to the root, with
+// forward slashes.
+type fsSource struct {
+	root   string
+	owners map[string]string            // top-level directory -> owner email
+	uids   map[uint32]string            // POSIX uid -> email
+	gids   map[uint32][]string          // POSIX gid -> member emails
+	acl    map[string][]MigrationMember // path -> members, replaces POSIX permissions when set
+	warn   sync.Once
+}
+
+// Name returns the source name.
+func (S *fsSource) Name() string {
+	return "Filesystem"
+}
+
+// path returns the local path of a source id.
+func (S *fsSource) path(src_id string) string {
+	return filepath.Join(S.root, filepath.FromSlash(src_id))
+}
+
+// Users returns the owners named in the owners file.
+func (S *fsSource) Users() (users []MigrationUser, err error) {
+	S.warn.Do(S.warnUnmapped)
+
+	seen := make(map[string]struct{})
+	for _, email := range S.owners {
+		if _, ok := seen[email]; ok {
+			continue
+		}
+		seen[email] = struct{}{}
+		users = append(users, MigrationUser{ID: email, Email: email})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return
+}
+
+// warnUnmapped logs the top-level directories without an owner, which are
+// not migrated, and mapped directories that do not exist.
+func (S *fsSource) warnUnmapped() {
+	entries, err := os.ReadDir(S.root)
+	if err != nil {
+		Err("%s: %v", S.root, err)
+		return
+	}
+	found := make(map[string]struct{})
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		found[e.Name()] = struct{}{}
+		if _, ok := S.owners[e.Name()]; !ok {
+			Notice("%s: No owner mapped for directory, skipping.", e.Name())
+		}
+	}
+	for dir := range S.owners {
+		if _, ok := found[dir]; !ok {
+			Err("%s: Mapped directory not found in %s.", dir, S.root)
+		}
+	}
+}
+
+// Root returns the source root.
+func (S *fsSource) Root(user MigrationUser) (SyncFolder, error) {
+	return SyncFolder{Name: filepath.Base(S.root)}, nil
+}
+
+// childID returns the source id of an entry in a folder.
+func childID(src_id, name string) string {
+	return strings.TrimPrefix(src_id+"/"+name, "/")
+}
+
+// entries reads a directory, skipping symbolic links and other special files.
+func (S *fsSource) entries(src_id string) ([]fs.DirEntry, error) {
+	entries, err := os.ReadDir(S.path(src_id))
+	if err != nil {
+		return nil, err
+	}
+	var output []fs.DirEntry
+	for _, e := range entries {
+		if e.Type()&fs.ModeSymlink != 0 {
+			Debug("%s: Skipping symbolic link.", childID(src_id, e.Name()))
+			continue
+		}
+		if !e.IsDir() && !e.Type().IsRegular() {
+			continue
+		}
+		output = append(output, e)
+	}
+	return output, nil
+}
+
+// Folders returns the subdirectories of a folder; at the root, only the
+// directories mapped to the user.
+func (S *fsSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	entries, err := S.entries(folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if IsBlank(folder.SrcID) && S.owners[e.Name()] != strings.ToLower(user.Email) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			Err("%s: %v", childID(folder.SrcID, e.Name()), err)
+			continue
+		}
+		src_id := childID(folder.SrcID, e.Name())
+		folders = append(folders, SyncFolder{
+			Name:     e.Name(),
+			SrcID:    src_id,
+			Modified: info.ModTime(),
+			FullPath: src_id,
+			Owner:    user.Email,
+		})
+	}
+	return
+}
+
+// Files returns the regular files within a folder.
+func (S *fsSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	entries, err := S.entries(folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			Err("%s: %v", childID(folder.SrcID, e.Name()), err)
+			continue
+		}
+		files = append(files, SyncFile{
+			Name:        e.Name(),
+			SrcID:       childID(folder.SrcID, e.Name()),
+			Modified:    info.ModTime(),
+			Size:        info.Size(),
+			SrcFolderID: folder.SrcID,
+		})
+	}
+	return
+}
+
+// Members returns the folder's members, from the ACL export when one was
+// given, otherwise from the directory's POSIX owner and group.
+func (S *fsSource) Members(user MigrationUser, folder SyncFolder) (members []MigrationMember, err error) {
+	if S.acl != nil {
+		return S.acl[folder.SrcID], nil
+	}
+	if len(S.uids) == 0 && len(S.gids) == 0 {
+		return nil, nil
+	}
+
+	info, err := os.Stat(S.path(folder.SrcID))
+	if err != nil {
+		return nil, err
+	}
+	uid, gid, ok := posixOwner(info)
+	if !ok {
+		return nil, nil
+	}
+	perm := info.Mode().Perm()
+
+	if email, ok := S.uids[uid]; ok {
+		role := posixRole(perm >> 6)
+		if role == "collaborator" {
+			role = "manager"
+		}
+		members = append(members, MigrationMember{User: email, Role: role})
+	}
+	for _, email := range S.gids[gid] {
+		members = append(members, MigrationMember{User: email, Role: posixRole(perm >> 3)})
+	}
+	return
+}
+
+// RoleNames returns the roles folder members are given, from permission
+// bits or an ACL export.
+func (S *fsSource) RoleNames() []string {
+	return []string{"viewer", "downloader", "uploader", "collaborator", "manager"}
+}
+
+// posixRole returns the Kiteworks role for a set of rwx permission bits, in
+// the lowest three bits of perm. Without read or write there is no access.
+func posixRole(perm os.FileMode) string {
+	read := perm&4 != 0
+	write := perm&2 != 0
+	switch {
+	case read && write:
+		return "collaborator"
+	case read:
+		return "downloader"
+	case write:
+		return "uploader"
+	default:
+		return ""
+	}
+}
+
+// Versions returns nil; files are migrated at their current content.
+func (S *fsSource) Versions(user MigrationUser, file SyncFile) ([]SyncVersion, error) {
+	return nil, nil
+}
+
+// Comments returns nil; files have no comments.
+func (S *fsSource) Comments(user MigrationUser, file SyncFile) ([]SyncComment, error) {
+	return nil, nil
+}
+
+// Open opens the file.
+func (S *fsSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	return os.Open(S.path(file.SrcID))
+}
@@ -0,0 +1,183 @@
+package gdrive
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterMigrationTask(new(GDriveMigrationTask)) }
+
+// GDriveMigrationTask migrates the My Drives and Shared Drives of a Google
+// Workspace domain to Kiteworks.
+type GDriveMigrationTask struct {
+	KiteBrokerTask
+	gdrive_db           Database
+	gdrive_config       Table
+	key_json            []byte
+	admin               string
+	api                 *GDriveAPI
+	target_profile_name string
+	user_emails         []string
+	drive_owner         string
+	report              bool
+	preflight           string
+	max_file_size       int
+	rollback            string
+	max_versions        int
+	dry_run             bool
+	status              bool
+	retry_failed        bool
+	mapping_file        string
+	mapping             *MigrationMapping
+	limits              MigrationLimits
+	map_groups          bool
+}
+
+// Name returns the name of this task.
+func (T *GDriveMigrationTask) Name() string {
+	return "gdrive"
+}
+
+// Desc returns a description of this task.
+func (T *GDriveMigrationTask) Desc() string {
+	return "Migrate users, My Drives, Shared Drives, files, revisions and sharing from Google Drive to Kiteworks."
+}
+
+// Init parses the flags and loads the stored Google connection.
+func (T *GDriveMigrationTask) Init() (err error) {
+	T.gdrive_db = T.DB.Sub("gdrive")
+	T.gdrive_config = T.gdrive_db.Table("gdrive_config")
+	T.gdrive_config.Get("service_account_key", &T.key_json)
+	T.gdrive_config.Get("admin", &T.admin)
+
+	setup := T.Flags.Bool("setup", "Configure Google Drive Connection")
+	T.Flags.StringVar(&T.target_profile_name, "profile", "Standard", "Destination profile for migrated users. (Needs permission to create folders)")
+	T.Flags.StringVar(&T.mapping_file, "mapping", "<mapping.csv>", "CSV or YAML file remapping users, groups, folder paths and roles.")
+	T.Flags.BoolVar(&T.map_groups, "map_groups", "Grant source groups as the Kiteworks groups of the same name instead of their members.")
+	T.Flags.MultiVar(&T.user_emails, "users", "<user@domain.com>", "User(s) to migrate.")
+	T.Flags.StringVar(&T.drive_owner, "shared_drive_owner", "<user@domain.com>", "Owner of the migrated Shared Drives. (default: the configured admin)")
+	migrate := T.Flags.Bool("migrate", "Perform the actual migration.")
+	T.Flags.BoolVar(&T.report, "report", "Generate a report of Google Drive users, folders and files.")
+	T.Flags.StringVar(&T.preflight, "preflight", "<findings.csv>", "Check the source and destination for problems, writing findings to a CSV or JSON file.")
+	T.Flags.IntVar(&T.max_file_size, "max_file_size", 0, "Largest file (MB) the destination accepts, checked by --preflight.")
+	T.Flags.IntVar(&T.max_versions, "max_versions", 0, "Copy at most this many of each file's newest revisions. (0 copies all)")
+	T.Flags.StringVar(&T.rollback, "rollback", "<run id>", "Undo the users, folders, files, grants and keys created on Kiteworks by a migration run.")
+	T.Flags.BoolVar(&T.dry_run, "dry_run", "With --rollback, log what would be undone without changing anything.")
+	T.Flags.BoolVar(&T.status, "status", "Show each user's migration state, with throughput and an ETA.")
+	T.Flags.BoolVar(&T.retry_failed, "retry_failed", "With --migrate, migrate only the users whose last migration failed.")
+	T.limits.RegisterFlags(&T.Flags)
+	T.Flags.Order("migrate", "report", "preflight", "rollback", "status")
+	if err := T.Flags.Parse(); err != nil {
+		return err
+	}
+	if err := T.limits.Validate(); err != nil {
+		return err
+	}
+
+	if *setup || len(T.key_json) == 0 || IsBlank(T.admin) {
+		T.configureGDrive()
+	}
+
+	if !IsBlank(T.mapping_file) {
+		mapping, err := LoadMigrationMapping(T.mapping_file)
+		if err != nil {
+			return err
+		}
+		T.mapping = mapping
+	}
+
+	var modes int
+	for _, m := range []bool{*migrate, T.report, !IsBlank(T.preflight), !IsBlank(T.rollback), T.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("--migrate, --report, --preflight, --rollback and --status are mutually exclusive, please specify only one")
+	}
+	if modes == 0 {
+		return fmt.Errorf("must specify either --migrate, --report, --preflight, --rollback or --status")
+	}
+	if T.dry_run && IsBlank(T.rollback) {
+		return fmt.Errorf("--dry_run requires --rollback")
+	}
+	if T.retry_failed && !*migrate {
+		return fmt.Errorf("--retry_failed requires --migrate")
+	}
+	T.drive_owner = strings.ToLower(T.drive_owner)
+	if IsBlank(T.drive_owner) {
+		T.drive_owner = strings.ToLower(T.admin)
+	}
+	return nil
+}
+
+// configureGDrive prompts for the service account key and the admin it
+// reads the directory as, saves them and exits.
+func (T *GDriveMigrationTask) configureGDrive() {
+	key_str := string(T.key_json)
+	gdrive_auth := NewOptions("--- Google Drive Configuration ---", "(selection or 'q' to save & exit)", 'q')
+	gdrive_auth.TextAreaVar(&key_str, "Service Account Key", "Paste the service account's JSON key here...")
+	gdrive_auth.StringVar(&T.admin, "Admin Email", T.admin, "Please input a Workspace admin for the service account to read users and Shared Drives as.")
+	if gdrive_auth.Select(false) {
+		if key_str != NONE {
+			T.key_json = []byte(key_str)
+			T.gdrive_config.CryptSet("service_account_key", T.key_json)
+		}
+		T.gdrive_config.Set("admin", &T.admin)
+	}
+	Exit(0)
+}
+
+// configure_api creates and configures the Google API client.
+func (T *GDriveMigrationTask) configure_api() {
+	T.api = newGDriveAPI(gdriveServer, T.key_json)
+	T.api.VerifySSL = true
+	T.api.ProxyURI = T.KW.ProxyURI
+	T.gdrive_db.Drop("tokens")
+
+	T.api.SetDatabase(T.gdrive_db)
+	T.api.MaxChunkSize = T.KW.MaxChunkSize
+	T.api.SetLimiter(T.KW.GetLimit())
+	T.api.SetTransferLimiter(T.KW.GetTransferLimit())
+	T.api.RequestTimeout = T.KW.RequestTimeout
+	T.api.ConnectTimeout = T.KW.ConnectTimeout
+}
+
+// Main runs the Google Drive report, migration or preflight.
+func (T *GDriveMigrationTask) Main() (err error) {
+	if !IsBlank(T.rollback) {
+		return RollbackMigration(&T.KiteBrokerTask, T.gdrive_db, T.rollback, T.dry_run)
+	}
+	T.configure_api()
+
+	source := &gdriveSource{
+		api:         T.api,
+		admin:       strings.ToLower(T.admin),
+		drive_owner: T.drive_owner,
+	}
+
+	engine := NewMigrationEngine(&T.KiteBrokerTask, source, T.gdrive_db)
+	engine.Users = T.user_emails
+	engine.Mapping = T.mapping
+	engine.Limits = T.limits
+	engine.RetryFailed = T.retry_failed
+	engine.MapGroups = T.map_groups
+	engine.MaxVersions = T.max_versions
+
+	if T.status {
+		return engine.RunStatus()
+	}
+	if T.report {
+		return engine.RunReport()
+	}
+	if err := engine.SetProfile(T.target_profile_name); err != nil {
+		return err
+	}
+	if !IsBlank(T.preflight) {
+		engine.Preflight.MaxFileSize = int64(T.max_file_size) * 1024 * 1024
+		return engine.RunPreflight(T.preflight)
+	}
+	return engine.Run()
+}
@@ -0,0 +1,427 @@
+package gdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+	"github.com/cmcoffee/snugforge/jwcrypt"
+)
+
+// gdriveServer is the Google API host serving Drive and the Admin directory.
+const gdriveServer = "www.googleapis.com"
+
+// gdriveScopes are the scopes delegated to the service account.
+var gdriveScopes = []string{
+	"https://www.googleapis.com/auth/drive.readonly",
+	"https://www.googleapis.com/auth/admin.directory.user.readonly",
+	"https://www.googleapis.com/auth/admin.directory.group.readonly",
+}
+
+// Google-native MIME types.
+const (
+	gdriveFolder   = "application/vnd.google-apps.folder"
+	gdriveShortcut = "application/vnd.google-apps.shortcut"
+	gdriveNative   = "application/vnd.google-apps."
+)
+
+// gdriveExport is the Office format a Google-native type is exported to.
+type gdriveExport struct {
+	MimeType  string
+	Extension string
+}
+
+// gdriveExports maps Google-native types to the formats they are exported
+// to; native types not listed, such as forms and sites, cannot be exported.
+var gdriveExports = map[string]gdriveExport{
+	"application/vnd.google-apps.document":     {"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx"},
+	"application/vnd.google-apps.spreadsheet":  {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", ".xlsx"},
+	"application/vnd.google-apps.presentation": {"application/vnd.openxmlformats-officedocument.presentationml.presentation", ".pptx"},
+	"application/vnd.google-apps.drawing":      {"application/pdf", ".pdf"},
+}
+
+// GDriveAPI wraps an APIClient for Google Drive access as a service account
+// with domain-wide delegation. Tokens are requested per user, the APIClient
+// username being the email of the user impersonated.
+type GDriveAPI struct {
+	*APIClient
+}
+
+// GDriveUser is a user of the Google Workspace directory.
+type GDriveUser struct {
+	PrimaryEmail string `json:"primaryEmail"`
+	Suspended    bool   `json:"suspended"`
+	Name         struct {
+		FullName string `json:"fullName"`
+	} `json:"name"`
+}
+
+// GDriveSharedDrive is a Shared Drive.
+type GDriveSharedDrive struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// GDriveFile is a Drive file or folder.
+type GDriveFile struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	MimeType     string `json:"mimeType"`
+	Size         int64  `json:"size,string"`
+	MD5          string `json:"md5Checksum"`
+	CreatedTime  string `json:"createdTime"`
+	ModifiedTime string `json:"modifiedTime"`
+	DriveID      string `json:"driveId"`
+}
+
+// GDriveRevision is a revision of a Drive file.
+type GDriveRevision struct {
+	ID           string `json:"id"`
+	ModifiedTime string `json:"modifiedTime"`
+	Size         int64  `json:"size,string"`
+	User         struct {
+		Email string `json:"emailAddress"`
+	} `json:"lastModifyingUser"`
+}
+
+// GDrivePermission is a permission granted on a Drive file or folder.
+type GDrivePermission struct {
+	Type        string `json:"type"` // user, group, domain or anyone.
+	Email       string `json:"emailAddress"`
+	DisplayName string `json:"displayName"`
+	Role        string `json:"role"`
+}
+
+// gdriveError maps a Google API error to GDRIVE_<REASON>; token endpoint
+// errors, whose error is a string, map to GDRIVE_<ERROR>.
+func gdriveError(body []byte) (e APIError) {
+	var google_error struct {
+		Error json.RawMessage `json:"error"`
+		Desc  string          `json:"error_description"`
+	}
+	if json.Unmarshal(body, &google_error) != nil || len(google_error.Error) == 0 {
+		return
+	}
+
+	var code string
+	if json.Unmarshal(google_error.Error, &code) == nil {
+		e.Register(fmt.Sprintf("GDRIVE_%s", strings.ToUpper(code)), google_error.Desc)
+		return
+	}
+
+	var api_error struct {
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Errors  []struct {
+			Reason string `json:"reason"`
+		} `json:"errors"`
+	}
+	json.Unmarshal(google_error.Error, &api_error)
+	reason := api_error.Status
+	if len(api_error.Errors) > 0 && !IsBlank(api_error.Errors[0].Reason) {
+		reason = api_error.Errors[0].Reason
+	}
+	if !IsBlank(reason) {
+		e.Register(fmt.Sprintf("GDRIVE_%s", strings.ToUpper(reason)), api_error.Message)
+	}
+	return
+}
+
+// readGDriveTime parses a Drive timestamp.
+func readGDriveTime(input string) (time.Time, error) {
+	if input == NONE {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, input)
+}
+
+// gdriveNewToken returns a NewToken func exchanging a JWT signed with the
+// service account's key for a token impersonating username. The token
+// endpoint is the key file's token_uri.
+func gdriveNewToken(api *APIClient, key_json []byte) func(string) (*Auth, error) {
+	return func(username string) (*Auth, error) {
+		var account struct {
+			ClientEmail  string `json:"client_email"`
+			PrivateKeyID string `json:"private_key_id"`
+			PrivateKey   string `json:"private_key"`
+			TokenURI     string `json:"token_uri"`
+		}
+		if err := json.Unmarshal(key_json, &account); err != nil {
+			return nil, fmt.Errorf("Failed to parse service account key: %v", err)
+		}
+		if IsBlank(account.PrivateKey) {
+			return nil, fmt.Errorf("Blank private_key in service account key; download a JSON key for the service account.")
+		}
+		if IsBlank(account.TokenURI) {
+			account.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+
+		key, err := jwcrypt.ParseRSAPrivateKey([]byte(account.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse RSA private key: %v", err)
+		}
+
+		var claims struct {
+			Issuer   string `json:"iss"`
+			Subject  string `json:"sub"`
+			Scope    string `json:"scope"`
+			Audience string `json:"aud"`
+			Issued   int64  `json:"iat"`
+			Expiry   int64  `json:"exp"`
+		}
+		claims.Issuer = account.ClientEmail
+		claims.Subject = username
+		claims.Scope = strings.Join(gdriveScopes, " ")
+		claims.Audience = account.TokenURI
+		claims.Issued = time.Now().Unix()
+		claims.Expiry = time.Now().Add(time.Hour).Unix()
+
+		tokenStr, err := jwcrypt.SignRS256(key, claims, map[string]string{"kid": account.PrivateKeyID})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to sign JWT: %v", err)
+		}
+		Debug("[gdrive]: Requesting token for %s.", username)
+
+		values := url.Values{}
+		values.Add("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		values.Add("assertion", tokenStr)
+
+		req, err := http.NewRequest(http.MethodPost, account.TokenURI, strings.NewReader(values.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		token := new(Auth)
+		if err := api.Fulfill(NONE, req, token); err != nil {
+			return nil, fmt.Errorf("Failed to request Google token for %s: %v", username, err)
+		}
+		token.RefreshToken = NONE
+		token.Expires = time.Now().Add(time.Duration(token.Expires) * time.Second).Unix()
+		return token, nil
+	}
+}
+
+// newGDriveAPI returns a client of the Google APIs at server, authenticating
+// with a service account's JSON key.
+func newGDriveAPI(server string, key_json []byte) *GDriveAPI {
+	api := &GDriveAPI{new(APIClient)}
+	api.Server = server
+	api.NewToken = gdriveNewToken(api.APIClient, key_json)
+	api.ErrorScanner = gdriveError
+	api.TokenErrorCodes = []string{"GDRIVE_AUTHERROR", "GDRIVE_UNAUTHENTICATED"}
+	api.RetryErrorCodes = []string{"GDRIVE_RATELIMITEXCEEDED", "GDRIVE_USERRATELIMITEXCEEDED", "GDRIVE_BACKENDERROR", "GDRIVE_INTERNALERROR", "HTTP_STATUS_500", "HTTP_STATUS_503"}
+	api.ReaquireToken = true
+	api.Retries = 3
+	return api
+}
+
+// get performs a GET as user.
+func (G *GDriveAPI) get(user, path string, query Query, output interface{}) error {
+	return G.Call(APIRequest{
+		Username: user,
+		Method:   "GET",
+		Path:     path,
+		Params:   SetParams(query),
+		Output:   output,
+	})
+}
+
+// Users returns the users of the admin's Google Workspace account.
+func (G *GDriveAPI) Users(admin string) (users []GDriveUser, err error) {
+	query := Query{"customer": "my_customer", "maxResults": 500}
+	for {
+		var result struct {
+			Users     []GDriveUser `json:"users"`
+			NextToken string       `json:"nextPageToken"`
+		}
+		if err = G.get(admin, "/admin/directory/v1/users", query, &result); err != nil {
+			return nil, err
+		}
+		users = append(users, result.Users...)
+		if IsBlank(result.NextToken) {
+			return
+		}
+		query["pageToken"] = result.NextToken
+	}
+}
+
+// GroupMembers returns the emails of a group's user members.
+func (G *GDriveAPI) GroupMembers(admin, group string) (emails []string, err error) {
+	query := Query{"maxResults": 200}
+	for {
+		var result struct {
+			Members []struct {
+				Email string `json:"email"`
+				Type  string `json:"type"`
+			} `json:"members"`
+			NextToken string `json:"nextPageToken"`
+		}
+		if err = G.get(admin, fmt.Sprintf("/admin/directory/v1/groups/%s/members", url.PathEscape(group)), query, &result); err != nil {
+			return nil, err
+		}
+		for _, m := range result.Members {
+			if m.Type == "USER" {
+				emails = append(emails, strings.ToLower(m.Email))
+			}
+		}
+		if IsBlank(result.NextToken) {
+			return
+		}
+		query["pageToken"] = result.NextToken
+	}
+}
+
+// SharedDrives returns all the Shared Drives of the domain.
+func (G *GDriveAPI) SharedDrives(admin string) (drives []GDriveSharedDrive, err error) {
+	query := Query{"useDomainAdminAccess": true, "pageSize": 100}
+	for {
+		var result struct {
+			Drives    []GDriveSharedDrive `json:"drives"`
+			NextToken string              `json:"nextPageToken"`
+		}
+		if err = G.get(admin, "/drive/v3/drives", query, &result); err != nil {
+			return nil, err
+		}
+		drives = append(drives, result.Drives...)
+		if IsBlank(result.NextToken) {
+			return
+		}
+		query["pageToken"] = result.NextToken
+	}
+}
+
+// Permissions returns the permissions on a file or folder. With
+// admin_access, they are read with the admin's domain-wide access, which
+// Shared Drives allow.
+func (G *GDriveAPI) Permissions(user, id string, admin_access bool) (perms []GDrivePermission, err error) {
+	query := Query{
+		"supportsAllDrives": true,
+		"pageSize":          100,
+		"fields":            "nextPageToken,permissions(type,emailAddress,displayName,role)",
+	}
+	if admin_access {
+		query["useDomainAdminAccess"] = true
+	}
+	for {
+		var result struct {
+			Permissions []GDrivePermission `json:"permissions"`
+			NextToken   string             `json:"nextPageToken"`
+		}
+		if err = G.get(user, fmt.Sprintf("/drive/v3/files/%s/permissions", id), query, &result); err != nil {
+			return nil, err
+		}
+		perms = append(perms, result.Permissions...)
+		if IsBlank(result.NextToken) {
+			return
+		}
+		query["pageToken"] = result.NextToken
+	}
+}
+
+// List returns the children of a folder, read as user. drive_id is the
+// Shared Drive holding the folder, or blank for the user's My Drive.
+func (G *GDriveAPI) List(user, drive_id, folder_id string) (files []GDriveFile, err error) {
+	query := Query{
+		"q":                         fmt.Sprintf("'%s' in parents and trashed = false", folder_id),
+		"pageSize":                  1000,
+		"supportsAllDrives":         true,
+		"includeItemsFromAllDrives": true,
+		"fields":                    "nextPageToken,files(id,name,mimeType,size,md5Checksum,createdTime,modifiedTime,driveId)",
+	}
+	if !IsBlank(drive_id) {
+		query["corpora"] = "drive"
+		query["driveId"] = drive_id
+	}
+	for {
+		var result struct {
+			Files     []GDriveFile `json:"files"`
+			NextToken string       `json:"nextPageToken"`
+		}
+		if err = G.get(user, "/drive/v3/files", query, &result); err != nil {
+			return nil, err
+		}
+		files = append(files, result.Files...)
+		if IsBlank(result.NextToken) {
+			return
+		}
+		query["pageToken"] = result.NextToken
+	}
+}
+
+// Revisions returns the revisions of a file, oldest first.
+func (G *GDriveAPI) Revisions(user, file_id string) (revisions []GDriveRevision, err error) {
+	query := Query{
+		"pageSize": 200,
+		"fields":   "nextPageToken,revisions(id,modifiedTime,size,lastModifyingUser(emailAddress))",
+	}
+	for {
+		var result struct {
+			Revisions []GDriveRevision `json:"revisions"`
+			NextToken string           `json:"nextPageToken"`
+		}
+		if err = G.get(user, fmt.Sprintf("/drive/v3/files/%s/revisions", file_id), query, &result); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, result.Revisions...)
+		if IsBlank(result.NextToken) {
+			return
+		}
+		query["pageToken"] = result.NextToken
+	}
+}
+
+// download returns the content at path, read as user.
+func (G *GDriveAPI) download(user, path string, query url.Values) (ReadSeekCloser, error) {
+	req, err := G.NewRequest("GET", path)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+	if err = G.SetToken(user, req); err != nil {
+		return nil, err
+	}
+	return G.WebDownload(req), nil
+}
+
+// Download returns the content of a file, or of one of its revisions when
+// revision_id is not blank.
+func (G *GDriveAPI) Download(user, file_id, revision_id string) (ReadSeekCloser, error) {
+	path := fmt.Sprintf("/drive/v3/files/%s", file_id)
+	if !IsBlank(revision_id) {
+		path = fmt.Sprintf("%s/revisions/%s", path, revision_id)
+	}
+	return G.download(user, path, url.Values{"alt": {"media"}, "supportsAllDrives": {"true"}})
+}
+
+// Export returns a Google-native file exported to mime_type.
+func (G *GDriveAPI) Export(user, file_id, mime_type string) (ReadSeekCloser, error) {
+	return G.download(user, fmt.Sprintf("/drive/v3/files/%s/export", file_id), url.Values{"mimeType": {mime_type}})
+}
+
+// MapDriveRole maps a Drive permission role to the name of the Kiteworks
+// role granted by default; "" grants no access.
+func MapDriveRole(role string) string {
+	switch role {
+	case "organizer", "fileOrganizer":
+		return "Manager"
+	case "writer":
+		return "Collaborator"
+	case "commenter", "reader":
+		return "Viewer"
+	default:
+		return NONE
+	}
+}
+
+// exportName returns the name of a file exported with extension ext.
+func exportName(name, ext string) string {
+	if strings.HasSuffix(strings.ToLower(name), ext) {
+		return name
+	}
+	return name + ext
+}
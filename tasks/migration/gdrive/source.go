@@ -0,0 +1,323 @@
+package gdrive
+
+import (
+	"strings"
+	"sync"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// myDriveRoot is the Drive alias of a user's My Drive folder.
+const myDriveRoot = "root"
+
+// sharedDrivesID is the source user id holding the Shared Drives, when their
+// owner is not a directory user.
+const sharedDrivesID = "shared_drives"
+
+// gdriveSource is the Google Drive MigrationSource. Each user's My Drive is
+// migrated to them; Shared Drives are migrated to drive_owner, below their
+// root.
+//
+// Objects in a Shared Drive have SrcIDs prefixed with the drive's id, and
+// are read as one of the drive's organizers, since the admin may not be a
+// member. Google-native files are exported to Office formats as they are
+// transferred.
+type gdriveSource struct {
+	api         *GDriveAPI
+	admin       string
+	drive_owner string
+	drives      map[string]GDriveSharedDrive // Shared Drives, by id.
+	readers     map[string]string            // Organizers read as, by Shared Drive id.
+	exports     sync.Map                     // Export formats of Google-native files, by SrcID.
+	listings    sync.Map
+}
+
+// Name returns the source name.
+func (S *gdriveSource) Name() string {
+	return "Google Drive"
+}
+
+// Users returns the active directory users, and the Shared Drives' owner
+// when they are not one.
+func (S *gdriveSource) Users() (users []MigrationUser, err error) {
+	directory, err := S.api.Users(S.admin)
+	if err != nil {
+		return nil, err
+	}
+	var has_owner bool
+	for _, u := range directory {
+		if u.Suspended {
+			continue
+		}
+		email := strings.ToLower(u.PrimaryEmail)
+		if email == S.drive_owner {
+			has_owner = true
+		}
+		users = append(users, MigrationUser{
+			ID:    email,
+			Email: email,
+			Name:  u.Name.FullName,
+			Home:  myDriveRoot,
+		})
+	}
+
+	drives, err := S.api.SharedDrives(S.admin)
+	if err != nil {
+		return nil, err
+	}
+	S.drives = make(map[string]GDriveSharedDrive)
+	S.readers = make(map[string]string)
+	for _, d := range drives {
+		perms, err := S.api.Permissions(S.admin, d.ID, true)
+		if err != nil {
+			Err("Error reading members of Shared Drive %s: %v", d.Name, err)
+			continue
+		}
+		for _, p := range perms {
+			if p.Type == "user" && p.Role == "organizer" {
+				S.readers[d.ID] = strings.ToLower(p.Email)
+				break
+			}
+		}
+		if IsBlank(S.readers[d.ID]) {
+			Notice("Shared Drive %s has no organizer to read it as, skipping.", d.Name)
+			continue
+		}
+		S.drives[d.ID] = d
+	}
+	if len(S.drives) > 0 && !has_owner {
+		users = append(users, MigrationUser{ID: sharedDrivesID, Email: S.drive_owner, Name: "Shared Drives"})
+	}
+	return users, nil
+}
+
+// splitID returns the Shared Drive and Drive id of a SrcID; the drive is
+// blank for objects in a My Drive.
+func splitID(src_id string) (drive_id, id string) {
+	if i := strings.Index(src_id, "|"); i >= 0 {
+		return src_id[:i], src_id[i+1:]
+	}
+	return NONE, src_id
+}
+
+// reader returns the user an object of user's is read as.
+func (S *gdriveSource) reader(user MigrationUser, drive_id string) string {
+	if !IsBlank(drive_id) {
+		return S.readers[drive_id]
+	}
+	return user.Email
+}
+
+// listing returns the children of a folder, from the cache when it is held.
+func (S *gdriveSource) listing(user MigrationUser, src_id string) ([]GDriveFile, error) {
+	key := user.ID + ":" + src_id
+	if entries, ok := S.listings.Load(key); ok {
+		return entries.([]GDriveFile), nil
+	}
+	drive_id, id := splitID(src_id)
+	entries, err := S.api.List(S.reader(user, drive_id), drive_id, id)
+	if err != nil {
+		return nil, err
+	}
+	S.listings.Store(key, entries)
+	return entries, nil
+}
+
+// Root returns the user's My Drive, migrated into a folder of that name.
+func (S *gdriveSource) Root(user MigrationUser) (SyncFolder, error) {
+	if user.ID == sharedDrivesID {
+		return SyncFolder{Name: "Shared Drives", SrcID: sharedDrivesID}, nil
+	}
+	return SyncFolder{Name: "My Drive", SrcID: myDriveRoot, FullPath: "My Drive", Owner: user.Email}, nil
+}
+
+// Folders returns the subfolders of a folder, and at the root of the Shared
+// Drives' owner, the Shared Drives. Shortcuts are skipped.
+func (S *gdriveSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	if folder.SrcID == sharedDrivesID || (folder.SrcID == myDriveRoot && user.Email == S.drive_owner) {
+		for _, d := range S.drives {
+			folders = append(folders, SyncFolder{
+				Name:     d.Name,
+				SrcID:    d.ID + "|" + d.ID,
+				FullPath: d.Name,
+				Owner:    S.drive_owner,
+			})
+		}
+		if folder.SrcID == sharedDrivesID {
+			return folders, nil
+		}
+	}
+
+	entries, err := S.listing(user, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	drive_id, _ := splitID(folder.SrcID)
+	for _, e := range entries {
+		if e.MimeType != gdriveFolder {
+			continue
+		}
+		src_id := e.ID
+		if !IsBlank(drive_id) {
+			src_id = drive_id + "|" + e.ID
+		}
+		created, _ := readGDriveTime(e.CreatedTime)
+		modified, _ := readGDriveTime(e.ModifiedTime)
+		folders = append(folders, SyncFolder{
+			Name:     e.Name,
+			SrcID:    src_id,
+			FullPath: strings.TrimPrefix(folder.FullPath+"/"+e.Name, "/"),
+			Owner:    folder.Owner,
+			Created:  created,
+			Modified: modified,
+		})
+	}
+	return
+}
+
+// Release drops the folder's held listing.
+func (S *gdriveSource) Release(user MigrationUser, folder SyncFolder) {
+	S.listings.Delete(user.ID + ":" + folder.SrcID)
+}
+
+// Files returns the files within a folder. Google-native files are named
+// for the Office format they are exported to; those with no export format,
+// such as forms, are skipped.
+func (S *gdriveSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	if folder.SrcID == sharedDrivesID {
+		return nil, nil
+	}
+	entries, err := S.listing(user, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	drive_id, _ := splitID(folder.SrcID)
+	for _, e := range entries {
+		if e.MimeType == gdriveFolder || e.MimeType == gdriveShortcut {
+			continue
+		}
+		src_id := e.ID
+		if !IsBlank(drive_id) {
+			src_id = drive_id + "|" + e.ID
+		}
+		name := e.Name
+		if strings.HasPrefix(e.MimeType, gdriveNative) {
+			export, ok := gdriveExports[e.MimeType]
+			if !ok {
+				Log("[%s]: Skipping %s/%s, which Google Drive cannot export. (%s)", user.Email, folder.FullPath, e.Name, e.MimeType)
+				continue
+			}
+			S.exports.Store(src_id, export)
+			name = exportName(e.Name, export.Extension)
+		}
+		created, _ := readGDriveTime(e.CreatedTime)
+		modified, _ := readGDriveTime(e.ModifiedTime)
+		files = append(files, SyncFile{
+			Name:        name,
+			SrcID:       src_id,
+			SrcFolderID: folder.SrcID,
+			Created:     created,
+			Modified:    modified,
+			Size:        e.Size,
+		})
+	}
+	return
+}
+
+// Members returns the users and groups with access to a folder. Owners,
+// and domain or public links, are skipped.
+func (S *gdriveSource) Members(user MigrationUser, folder SyncFolder) (members []MigrationMember, err error) {
+	if folder.SrcID == myDriveRoot || folder.SrcID == sharedDrivesID {
+		return nil, nil
+	}
+	drive_id, id := splitID(folder.SrcID)
+	perms, err := S.api.Permissions(S.reader(user, drive_id), id, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range perms {
+		if p.Role == "owner" {
+			continue
+		}
+		switch p.Type {
+		case "user":
+			members = append(members, MigrationMember{
+				User:       strings.ToLower(p.Email),
+				Role:       MapDriveRole(p.Role),
+				SourceRole: p.Role,
+			})
+		case "group":
+			members = append(members, MigrationMember{
+				Role:       MapDriveRole(p.Role),
+				SourceRole: p.Role,
+				Group:      p.DisplayName,
+				GroupID:    strings.ToLower(p.Email),
+			})
+		default:
+			Debug("[%s]: %s - Skipping %s permission.", user.Email, folder.FullPath, p.Type)
+		}
+	}
+	return
+}
+
+// GroupMembers returns the emails of a group's user members.
+func (S *gdriveSource) GroupMembers(user MigrationUser, group_id string) ([]string, error) {
+	return S.api.GroupMembers(S.admin, group_id)
+}
+
+// RoleNames returns the roles MapDriveRole grants.
+func (S *gdriveSource) RoleNames() []string {
+	return []string{"Manager", "Collaborator", "Viewer"}
+}
+
+// Versions returns the file's revisions, oldest first. Google-native files
+// are exported as a single version, of a size only known once exported.
+func (S *gdriveSource) Versions(user MigrationUser, file SyncFile) (versions []SyncVersion, err error) {
+	if _, ok := S.exports.Load(file.SrcID); ok {
+		return []SyncVersion{{
+			SrcID:    file.SrcID,
+			Ver:      1,
+			Name:     file.Name,
+			Created:  file.Created,
+			Modified: file.Modified,
+			Size:     UnknownSize,
+		}}, nil
+	}
+	drive_id, id := splitID(file.SrcID)
+	revisions, err := S.api.Revisions(S.reader(user, drive_id), id)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range revisions {
+		modified, _ := readGDriveTime(r.ModifiedTime)
+		versions = append(versions, SyncVersion{
+			SrcID:    r.ID,
+			Ver:      i + 1,
+			Name:     file.Name,
+			Created:  modified,
+			Modified: modified,
+			Size:     r.Size,
+			Uploader: strings.ToLower(r.User.Email),
+		})
+	}
+	return
+}
+
+// Comments returns nil; Drive comments are not migrated.
+func (S *gdriveSource) Comments(user MigrationUser, file SyncFile) ([]SyncComment, error) {
+	return nil, nil
+}
+
+// Open downloads a revision of the file, or exports a Google-native file.
+func (S *gdriveSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	drive_id, id := splitID(file.SrcID)
+	reader := S.reader(user, drive_id)
+	if export, ok := S.exports.Load(file.SrcID); ok {
+		return S.api.Export(reader, id, export.(gdriveExport).MimeType)
+	}
+	var revision_id string
+	if !IsBlank(version.SrcID) && version.SrcID != file.SrcID {
+		revision_id = version.SrcID
+	}
+	return S.api.Download(reader, id, revision_id)
+}
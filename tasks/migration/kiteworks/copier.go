@@ -23,6 +23,7 @@ type CopyOptions struct {
 	SrcProfileName    string
 	UserEmails        []string
 	CloneProfiles     bool
+	Mapping           *MigrationMapping // User, folder path and role remapping; nil for none.
 	Observer          Observer
 	// DstFolderResolver, when set, maps a source folder id to its known
 	// destination folder id (from persisted sync state). It lets folder cloning
@@ -55,10 +56,10 @@ func NewCopier(parent *KiteBrokerTask, src KWAPI, src_admin string, opts CopyOpt
 		SRC:            src,
 		src_admin:      src_admin,
 		opts:           opts,
-		failed_users:   make(map[string]any),
 		users:          make(map[string]struct{}),
-		limiter:        NewLimitGroup(50),
 	}
+	t.source = newSource(t)
+	t.engine = t.newEngine(parent.DB.Sub("kiteworks_migration"))
 	t.users_count = parent.Report.Tally("Synced Users")
 	t.FailedUsers = parent.Report.Tally("Failed Users")
 	t.folders_count = parent.Report.Tally("Synced Folders")
@@ -122,6 +123,21 @@ func (T *KW_TO_KWTask) RunCopy() (err error) {
 		return err
 	}
 
+	if T.retry_failed {
+		var retry []KiteUser
+		for _, u := range all_users {
+			if T.engine.LastFailed(u.Email) {
+				retry = append(retry, u)
+			}
+		}
+		if len(retry) == 0 {
+			Log("No failed users to retry.")
+			return nil
+		}
+		Log("Retrying %d failed user(s).", len(retry))
+		all_users = retry
+	}
+
 	// Clone custom profiles onto the destination before mapping/creating users,
 	// so freshly-synced profiles are available for name-based mapping and no
 	// user falls through to a missing profile.
@@ -190,9 +206,12 @@ func (T *KW_TO_KWTask) RunCopy() (err error) {
 		wg.Add(1)
 		go func(user KiteUser) {
 			defer wg.Done()
-			if err := T.CopyUser(user); err != nil {
+			T.engine.StartUser(user.Email)
+			err := T.CopyUser(user)
+			if err != nil {
 				Err("%s: %v", user.Email, err)
 			}
+			T.engine.FinishUser(user.Email, err)
 		}(u)
 	}
 	wg.Wait()
@@ -256,56 +275,18 @@ func (T *KW_TO_KWTask) createDestUser(user KiteUser) {
 		pin_profile_id = mapped_profile_id
 	}
 
-	kw_user, err := T.KW.Admin().FindUser(username, true)
-	if err != nil && err != ERR_NO_USER_FOUND {
-		Err("Error finding user %s: %v", username, err)
+	// pin_profile_id == 0 => the user's profile is left alone, and a new user
+	// is created without one so the appliance auto-maps them.
+	kw_user, err := T.engine.EnsureUser(username, pin_profile_id)
+	if err != nil {
+		Err("[%s]: %v (skipping)", username, err)
 		T.setIgnoreUser(user.Email)
 		return
 	}
-	if kw_user == nil {
-		Log("[%s]: Creating user on Kiteworks..", username)
-		// pin_profile_id == 0 => omit userTypeId => appliance auto-maps.
-		if kw_user, err = T.KW.Admin().NewUser(username, pin_profile_id, true, false); err != nil {
-			if !IsAPIError(err, "ERR_ENTITY_EXISTS") {
-				Err("[%s]: Failed to create user: %v (skipping)", username, err)
-				T.setIgnoreUser(user.Email)
-				return
-			}
-		}
-	} else {
-		Log("[%s]: User already exists on Kiteworks.", username)
-	}
-	if kw_user != nil && (kw_user.Suspended || !kw_user.Verified) {
-		if kw_user.Suspended {
-			Log("[%s]: User suspended on Kiteworks, reactivating.", username)
-		}
-		if !kw_user.Verified {
-			Log("[%s]: User unverified on Kiteworks source, verifying.", username)
-		}
-		if err := T.KW.Admin().UpdateUser(kw_user.ID, SetParams(PostJSON{"suspended": false, "verified": true})); err != nil {
-			Err("Error updating user %s: %v (skipping)", username, err)
-			T.setIgnoreUser(user.Email)
-			return
-		}
-	}
 
-	// Apply a manual profile override, if any — for both newly created and
-	// existing users (existing active users were previously never corrected).
-	if pin_profile_id > 0 && kw_user != nil {
-		if err := T.KW.Admin().UpdateUserProfile(pin_profile_id, []string{kw_user.ID}); err != nil {
-			Err("Error setting profile override for %s: %v", username, err)
-		}
-	}
-
-	if kw_user != nil {
-		// Record the profile the user actually ended up on: the pinned override
-		// when set, otherwise whatever the appliance auto-mapped (kw_user's type).
-		observed_profile := kw_user.UserTypeID
-		if pin_profile_id > 0 {
-			observed_profile = pin_profile_id
-		}
-		T.notifyUserMapped(user, *kw_user, observed_profile)
-	}
+	// Record the profile the user actually ended up on: the pinned override
+	// when set, otherwise whatever the appliance auto-mapped (kw_user's type).
+	T.notifyUserMapped(user, *kw_user, kw_user.UserTypeID)
 }
 
 func (T *KW_TO_KWTask) notifyUserMapped(src, dst KiteUser, dst_profile_id int) {
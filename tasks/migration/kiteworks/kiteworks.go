@@ -2,8 +2,8 @@ package kiteworks
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
-	"sync"
 
 	. "github.com/cmcoffee/kitebroker/core"
 )
@@ -26,7 +26,10 @@ type KW_TO_KWTask struct {
 		setup               bool
 		src_domain          string
 		new_domain          string
+		mapping             string
 	}
+	mapping             *MigrationMapping
+	limits              MigrationLimits
 	opts                CopyOptions
 	dst_profile_id      int
 	src_admin           string
@@ -34,9 +37,8 @@ type KW_TO_KWTask struct {
 	src_kw_config       Table
 	SRC                 KWAPI
 	users               map[string]struct{}
-	failed_users        map[string]any
-	failed_lock         sync.RWMutex
-	limiter             LimitGroup
+	source              *kwSource
+	engine              *MigrationEngine
 	users_count         Tally
 	folders_count       Tally
 	files_count         Tally
@@ -47,24 +49,24 @@ type KW_TO_KWTask struct {
 	FailedUsers         Tally
 	src_dst_profile_map map[int]int
 	report              bool
-	report_data         struct {
-		users map[string]*userReport
-		lock  sync.Mutex
-	}
+	preflight           string
+	max_file_size       int
+	verify              string
+	requeue             bool
+	rollback            string
+	dry_run             bool
+	status              bool
+	retry_failed        bool
 	// Required for all tasks
 	KiteBrokerTask
 }
 
 func (T *KW_TO_KWTask) ignoreUser(email string) bool {
-	T.failed_lock.RLock()
-	defer T.failed_lock.RUnlock()
-	return T.failed_users[email] != nil
+	return T.engine.IgnoreUser(email)
 }
 
 func (T *KW_TO_KWTask) setIgnoreUser(email string) {
-	T.failed_lock.Lock()
-	T.failed_users[email] = nil
-	T.failed_lock.Unlock()
+	T.engine.SetIgnoreUser(email)
 	T.FailedUsers.Add(1)
 }
 
@@ -75,7 +77,7 @@ func (T KW_TO_KWTask) Name() string {
 
 // Desc returns the description of the task.
 func (T KW_TO_KWTask) Desc() string {
-	return "Migrate users, folders, files, permissions from a remote Kiteworks server."
+	return "Migrate users, folders, files, versions, permissions, comments, and tasks from a remote Kiteworks server."
 }
 
 func (T KW_TO_KWTask) testAPI() bool {
@@ -131,6 +133,7 @@ func (T *KW_TO_KWTask) Init() (err error) {
 	T.Flags.MultiVar(&T.input.user_emails, "users", "<user@domain.com>", "User(s) to copy.")
 	T.Flags.BoolVar(&T.input.delete_user_first, "delete_user_first", "Delete destination user prior to migration.")
 	T.Flags.StringVar(&T.input.new_domain, "new_domain", "<new_domain.com>", "Replace users domain with domain specified.")
+	T.Flags.StringVar(&T.input.mapping, "mapping", "<mapping.csv>", "CSV or YAML file remapping users, folder paths and roles.")
 	T.Flags.BoolVar(&T.input.cleanup, "cleanup", "Remove source files if they exist on destination already.")
 	T.Flags.BoolVar(&T.input.deactivate_src_user, "deactivate", "Deactivate Users after copy command")
 	T.Flags.BoolVar(&T.input.no_files, "no_files", "Do not copy files.")
@@ -140,13 +143,31 @@ func (T *KW_TO_KWTask) Init() (err error) {
 	migrate := T.Flags.Bool("migrate", "Perform the actual migration.")
 	T.Flags.BoolVar(&T.report, "report", "Generate a report of source Kiteworks users, folders and files.")
 	T.Flags.BoolVar(&T.input.setup, "setup", "Configuration Remote Source Kiteworks Connection.")
-	T.Flags.Order("migrate", "report")
+	T.Flags.StringVar(&T.preflight, "preflight", "<findings.csv>", "Check the source and destination for problems, writing findings to a CSV or JSON file.")
+	T.Flags.IntVar(&T.max_file_size, "max_file_size", 0, "Largest file (MB) the destination accepts, checked by --preflight.")
+	T.Flags.StringVar(&T.verify, "verify", "<discrepancies.csv>", "Compare the migrated users with the source, writing discrepancies to a CSV or JSON file.")
+	T.Flags.BoolVar(&T.requeue, "requeue", "With --verify, re-queue mismatched folders and files for the next --migrate.")
+	T.Flags.StringVar(&T.rollback, "rollback", "<run id>", "Undo the users, folders, files, grants and SSH keys created on the destination by a migration run.")
+	T.Flags.BoolVar(&T.dry_run, "dry_run", "With --rollback, log what would be undone without changing anything.")
+	T.Flags.BoolVar(&T.status, "status", "Show each user's migration state, with throughput and an ETA.")
+	T.Flags.BoolVar(&T.retry_failed, "retry_failed", "With --migrate, migrate only the users whose last migration failed.")
+	T.limits.RegisterFlags(&T.Flags)
+	T.Flags.Order("migrate", "report", "preflight", "verify", "rollback", "status")
 	if err := T.Flags.Parse(); err != nil {
 		return err
 	}
+	if err := T.limits.Validate(); err != nil {
+		return err
+	}
 
-	if *migrate && T.report {
-		return fmt.Errorf("--migrate and --report are mutually exclusive, please specify only one")
+	var modes int
+	for _, m := range []bool{*migrate, T.report, !IsBlank(T.preflight), !IsBlank(T.verify), !IsBlank(T.rollback), T.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("--migrate, --report, --preflight, --verify, --rollback and --status are mutually exclusive, please specify only one")
 	}
 
 	if T.input.setup {
@@ -159,8 +180,28 @@ func (T *KW_TO_KWTask) Init() (err error) {
 		T.apiSetup()
 	}
 
-	if !*migrate && !T.report {
-		return fmt.Errorf("must specify either --migrate or --report")
+	if modes == 0 {
+		return fmt.Errorf("must specify either --migrate, --report, --preflight, --verify, --rollback or --status")
+	}
+
+	if T.requeue && IsBlank(T.verify) {
+		return fmt.Errorf("--requeue requires --verify")
+	}
+
+	if T.dry_run && IsBlank(T.rollback) {
+		return fmt.Errorf("--dry_run requires --rollback")
+	}
+
+	if T.retry_failed && !*migrate {
+		return fmt.Errorf("--retry_failed requires --migrate")
+	}
+
+	if !IsBlank(T.input.mapping) {
+		mapping, err := LoadMigrationMapping(T.input.mapping)
+		if err != nil {
+			return err
+		}
+		T.mapping = mapping
 	}
 
 	/*if len(T.input.user_emails) == 0 && IsBlank(T.input.src_profile_name) {
@@ -298,6 +339,10 @@ func (T *KW_TO_KWTask) FindDestProfileID(id int) int {
 
 // Main is the main function of the task.
 func (T *KW_TO_KWTask) Main() (err error) {
+	if !IsBlank(T.rollback) {
+		return RollbackMigration(&T.KiteBrokerTask, T.src_kw_db, T.rollback, T.dry_run)
+	}
+
 	if err = T.configAPI(); err != nil {
 		return err
 	}
@@ -315,6 +360,24 @@ func (T *KW_TO_KWTask) Main() (err error) {
 		SrcProfileName:    T.input.src_profile_name,
 		UserEmails:        T.input.user_emails,
 		CloneProfiles:     !T.input.dont_clone_profiles,
+		Mapping:           T.mapping,
+	}
+
+	T.users = make(map[string]struct{})
+	T.source = newSource(T)
+	T.engine = T.newEngine(T.src_kw_db)
+
+	if T.status {
+		return T.engine.RunStatus()
+	}
+	if T.report {
+		return T.engine.RunReport()
+	}
+	if !IsBlank(T.preflight) {
+		return T.runPreflight()
+	}
+	if !IsBlank(T.verify) {
+		return T.engine.RunVerify(T.verify, T.requeue)
 	}
 
 	T.users_count = T.Report.Tally("Synced Users")
@@ -326,18 +389,6 @@ func (T *KW_TO_KWTask) Main() (err error) {
 	T.ssh_keys_count = T.Report.Tally("SSH Keys Copied")
 	T.transfer_counter = T.Report.Tally("Data Transferred", HumanSize)
 
-	T.limiter = NewLimitGroup(50)
-	T.users = make(map[string]struct{})
-	T.failed_users = make(map[string]any)
-
-	if T.report {
-		all_users, err := T.getSourceUsers()
-		if err != nil {
-			return err
-		}
-		return T.RunReport(all_users)
-	}
-
 	message := func() string {
 		return fmt.Sprintf("Working .. [ Folders: %d | Files: %d | Files Transferred: %d (%s) ]",
 			T.folders_count.Value(), T.files_count.Value(), T.files_copied.Value(), HumanSize(T.transfer_counter.Value()))
@@ -346,9 +397,23 @@ func (T *KW_TO_KWTask) Main() (err error) {
 	PleaseWait.Show()
 
 	Log("Starting Kiteworks Migration...")
+	T.engine.BeginRun()
 	return T.RunCopy()
 }
 
+// runPreflight checks the source users against the destination without
+// migrating. With --dest_profile Auto, each user keeps the profile the
+// destination gives them.
+func (T *KW_TO_KWTask) runPreflight() error {
+	if !IsBlank(T.opts.DstProfileName) && !strings.EqualFold(T.opts.DstProfileName, "auto") {
+		if err := T.engine.SetProfile(T.opts.DstProfileName); err != nil {
+			return err
+		}
+	}
+	T.engine.Preflight.MaxFileSize = int64(T.max_file_size) * 1024 * 1024
+	return T.engine.RunPreflight(T.preflight)
+}
+
 // MigrateUser represents a user to be migrated.
 type MigrateUser struct {
 	src      *KiteUser
@@ -357,8 +422,21 @@ type MigrateUser struct {
 	dst_sess KWSession
 }
 
-// SwapEmails swaps the domain of an email address.
+// newEngine returns the migration engine, keeping resume state in db.
+func (T *KW_TO_KWTask) newEngine(db Database) *MigrationEngine {
+	engine := NewMigrationEngine(&T.KiteBrokerTask, T.source, db)
+	engine.DestEmail = T.SwapEmails
+	engine.Mapping = T.opts.Mapping
+	engine.Limits = T.limits
+	return engine
+}
+
+// SwapEmails returns the destination email of a source user: as remapped by
+// the mapping file, otherwise with its domain swapped.
 func (T *KW_TO_KWTask) SwapEmails(input string) string {
+	if T.opts.Mapping.MapsUser(input) {
+		return T.opts.Mapping.User(input)
+	}
 	if IsBlank(T.opts.NewDomain) {
 		return input
 	}
@@ -390,10 +468,6 @@ func (T *KW_TO_KWTask) CopyUser(src_user KiteUser) (err error) {
 	}
 
 	Debug("[%s]: Source base folder ID: %s", src_user.Email, src_user.BaseDirID)
-	src_folder, err := T.SRC.Session(src_user.Email).Folder(src_user.BaseDirID).Info()
-	if err != nil {
-		return err
-	}
 
 	if !IsBlank(T.opts.SrcDomain) && (T.opts.SrcDomain != T.opts.NewDomain) {
 		Log("Source User: %s, Destination User: %s", src_user.Email, dst_user.Email)
@@ -414,8 +488,17 @@ func (T *KW_TO_KWTask) CopyUser(src_user KiteUser) (err error) {
 		}
 	}
 
-	T.ProcessFolder(&migration_user, &src_folder)
-	T.limiter.Wait()
+	user := migrationUser(src_user)
+	clone := func(folder *SyncFolder) error {
+		obj, err := T.source.object(user, folder.SrcID)
+		if err != nil {
+			return err
+		}
+		return T.CloneFolder(&migration_user, &obj)
+	}
+	if err = T.engine.Walk(user, clone, nil); err != nil {
+		return err
+	}
 
 	if T.opts.DeactivateSrcUser {
 		err = T.SRC.Session(T.src_admin).Admin().DeactivateUser(src_user.ID)
@@ -511,33 +594,15 @@ func (T *KW_TO_KWTask) RunFolderCopy(changed map[string][]string) (err error) {
 // fires for every source-side perm (whether newly added or already present
 // on destination) so observers can keep their state map fresh.
 func (T *KW_TO_KWTask) SetPerms(migration_users *MigrateUser, src_folder_id string, folder *KiteObject, members []KiteMember) (err error) {
-	perm_map := make(map[int][]string)
-	var counter int
+	var perms []MigrationMember
 	for _, m := range members {
 		if m.User.Email == migration_users.dst.Email {
 			continue
 		}
-		email := T.SwapEmails(m.User.Email)
-		perm_map[m.RoleID] = append(perm_map[m.RoleID], email)
-		counter++
-		T.notifyPermissionGranted(src_folder_id, email, m.RoleID, migration_users.src.Email)
+		perms = append(perms, MigrationMember{User: m.User.Email, Role: m.Role.Name, SourceRole: m.Role.Name})
+		T.notifyPermissionGranted(src_folder_id, T.SwapEmails(m.User.Email), m.RoleID, migration_users.src.Email)
 	}
-	existingPerms, _ := migration_users.dst_sess.Folder(folder.ID).Members()
-	counter -= SkipExistingPerms(perm_map, existingPerms)
-	if counter > 0 {
-		Log("[%s]: %s - Adding %d permissions to folder.", migration_users.dst.Email, folder.Path, counter)
-	}
-	for role_id, emails := range perm_map {
-		err = migration_users.dst_sess.Folder(folder.ID).AddUsersToFolder(emails, role_id, false, true)
-		if err != nil {
-			if IsAPIError(err, "ERR_ENTITY_ROLE_IS_ASSIGNED") {
-				Debug("[%s]: %s - Role %d already assigned to %v, skipping.", migration_users.dst.Email, folder.Path, role_id, emails)
-			} else {
-				Err(err)
-			}
-		}
-	}
-	return
+	return T.engine.SyncMembers(migration_users.dst_sess, migration_users.dst.Email, folder, T.engine.DestMembers(perms))
 }
 
 // CloneFolder clones a folder from the source to the destination.
@@ -573,12 +638,12 @@ func (T *KW_TO_KWTask) CloneFolder(migration_users *MigrateUser, folder *KiteObj
 
 	if !mapped {
 		if !T.opts.Cleanup {
-			dest_folder, err = migration_users.dst_sess.Folder(migration_users.dst.BaseDirID).ResolvePath(folder.Path)
+			dest_folder, err = T.engine.ResolveFolder(migration_users.dst_sess, migration_users.dst.BaseDirID, T.engine.DestPath(folder.Path))
 			if err != nil {
 				return err
 			}
 		} else {
-			dest_folder, err = migration_users.dst_sess.Folder(migration_users.dst.BaseDirID).Find(folder.Path)
+			dest_folder, err = migration_users.dst_sess.Folder(migration_users.dst.BaseDirID).Find(T.engine.DestPath(folder.Path))
 			if err != nil {
 				return err
 			}
@@ -629,11 +694,15 @@ func (T *KW_TO_KWTask) CloneFolder(migration_users *MigrateUser, folder *KiteObj
 		file_map[v.Name] = v
 	}
 
+	user := migrationUser(*migration_users.src)
+	sync_folder := SyncFolder{Name: folder.Name, SrcID: folder.ID, FullPath: folder.Path}
+
 	for _, f := range children {
 		if f.Type != "f" {
 			continue
 		}
 		T.files_count.Add(1)
+		sync_file := syncFile(f, folder.ID)
 		//if IsBlank(f.ClientModified) {
 		f.ClientModified = f.Modified
 		//}
@@ -650,6 +719,7 @@ func (T *KW_TO_KWTask) CloneFolder(migration_users *MigrateUser, folder *KiteObj
 					if err := migration_users.dst_sess.File(v.ID).Delete(); err != nil {
 						Err("%s: %v", v.Name, err)
 					}
+					T.engine.ResetFile(user, migration_users.dst_sess, &sync_file)
 				} else {
 					if T.opts.Cleanup {
 						if v.ClientModified == f.ClientModified && v.Fingerprint == f.Fingerprint {
@@ -662,6 +732,9 @@ func (T *KW_TO_KWTask) CloneFolder(migration_users *MigrateUser, folder *KiteObj
 					} else {
 						Debug("%s: Skipping file, already uploaded.", f.Name)
 						T.notifyFileUploaded(f, v, folder.ID, migration_users.src.Email)
+						if !T.opts.NoFiles {
+							T.syncFileExtras(user, migration_users, &dest_folder, &sync_folder, &sync_file, &v)
+						}
 					}
 					continue
 				}
@@ -679,48 +752,30 @@ func (T *KW_TO_KWTask) CloneFolder(migration_users *MigrateUser, folder *KiteObj
 			continue
 		}
 
-		source_info := fmt.Sprintf("%s - download - %s/%s", migration_users.src_sess.Username, dest_folder.Name, f.Name)
-		dest_info := fmt.Sprintf("%s - upload - %s/%s", migration_users.dst_sess.Username, dest_folder.Name, f.Name)
-
-		retry_download := T.KW.InitRetry(migration_users.src_sess.Username, source_info)
-		retry_upload := T.KW.InitRetry(migration_users.dst_sess.Username, dest_info)
-		for {
-			down, err := migration_users.src_sess.QDownload(&f)
-			if err != nil {
-				if retry_download.CheckForRetry(err) {
-					continue
-				} else {
-					Err("%s: %s", source_info, err.Error())
-					break
-				}
-			}
-
-			modtime, err := ReadKWTime(f.ClientModified)
-			if err != nil {
-				Err("%s: %s", f.Name, err.Error())
-			}
-
-			uploaded, err := migration_users.dst_sess.Upload(f.Name, f.Size, modtime, false, false, true, dest_folder, down)
-			if err != nil {
-				if retry_upload.CheckForRetry(err) {
-					continue
-				} else {
-					Err("%s: %s", dest_info, err.Error())
-					break
-				}
-			}
-			if uploaded != nil {
-				T.files_copied.Add(1)
-				T.transfer_counter.Add64(uploaded.Size)
-				T.notifyFileUploaded(f, *uploaded, folder.ID, migration_users.src.Email)
-			}
-			break
+		uploaded, err := T.engine.SyncFile(user, migration_users.dst_sess, &dest_folder, &sync_folder, &sync_file)
+		if err != nil {
+			Err("%s - upload - %s/%s: %v", migration_users.dst_sess.Username, dest_folder.Name, f.Name, err)
+		}
+		if uploaded != nil {
+			T.notifyFileUploaded(f, *uploaded, folder.ID, migration_users.src.Email)
 		}
 	}
 
 	return
 }
 
+// syncFileExtras copies the comments and tasks of a file whose content is
+// already on the destination.
+func (T *KW_TO_KWTask) syncFileExtras(user MigrationUser, migration_users *MigrateUser, dest_folder *KiteObject, folder *SyncFolder, file *SyncFile, dest_file *KiteObject) {
+	if err := T.engine.AdoptFile(user, migration_users.dst_sess, folder, file, dest_file); err != nil {
+		Err("[%s]: %s: %v", migration_users.dst.Email, file.Name, err)
+		return
+	}
+	if _, err := T.engine.SyncFile(user, migration_users.dst_sess, dest_folder, folder, file); err != nil {
+		Err("[%s]: %s: %v", migration_users.dst.Email, file.Name, err)
+	}
+}
+
 // CopyUserSshKeys mirrors the source user's SSH public keys onto the destination
 // account. Dedup is by key name (Kiteworks enforces uniqueness per user). Private
 // keys cannot be migrated — only public keys are stored server-side, so any
@@ -774,6 +829,7 @@ func (T *KW_TO_KWTask) CopyUserSshKeys(mu *MigrateUser) error {
 		Log("[%s]: Copied SSH key '%s'.", mu.dst.Email, sk.Name)
 		T.ssh_keys_count.Add(1)
 		if created.ID > 0 {
+			T.engine.Journal(MigrationJournalEntry{Kind: JournalSSHKey, Owner: strings.ToLower(mu.dst.Email), ID: strconv.Itoa(created.ID), Name: sk.Name})
 			T.notifySshKeyCopied(mu.src.Email, sk, created)
 		} else {
 			Debug("[%s]: SSH key '%s' created but response carried no id; skipping mapping.", mu.dst.Email, sk.Name)
@@ -809,58 +865,3 @@ func (T *KW_TO_KWTask) ArchiveUserMail(src_user KiteUser) error {
 
 	return nil
 }
-
-// ProcessFolder processes a folder and its subfolders.
-func (T *KW_TO_KWTask) ProcessFolder(migration_users *MigrateUser, folder *KiteObject) {
-	// Folder is already complete, return to caller.
-	var folders []*KiteObject
-
-	folders = append(folders, folder)
-
-	var n int
-	var next []*KiteObject
-
-	for {
-		if len(folders) < n+1 {
-			folders = folders[0:0]
-			if len(next) > 0 {
-				for i, o := range next {
-					if T.limiter.Try() {
-						go func(migration_users *MigrateUser, folder *KiteObject) {
-							defer T.limiter.Done()
-							T.ProcessFolder(migration_users, folder)
-						}(migration_users, o)
-					} else {
-						folders = append(folders, next[i])
-					}
-				}
-				next = next[0:0]
-				n = 0
-				if len(folders) == 0 {
-					break
-				}
-			} else {
-				break
-			}
-		}
-		if folders[n].Type == "d" {
-			if err := T.CloneFolder(migration_users, folders[n]); err != nil {
-				Err("%s - %s: %v", migration_users.src_sess.Username, folders[n].Path, err)
-				n++
-				continue
-			}
-			childs, err := migration_users.src_sess.Folder(folders[n].ID).Folders()
-			if err == nil {
-				for i := 0; i < len(childs); i++ {
-					if childs[i].Type == "d" {
-						next = append(next, &childs[i])
-					}
-				}
-			} else {
-				Err("%s - %s: %v", migration_users.src_sess.Username, folders[n].Path, err)
-			}
-		}
-		n++
-	}
-	return
-}
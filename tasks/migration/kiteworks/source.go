@@ -0,0 +1,289 @@
+package kiteworks
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// kwSource is the source Kiteworks server as a MigrationSource.
+//
+// Folders are described to the engine as SyncFolders; the source KiteObjects
+// are held until cloned, since CloneFolder and the Observer need them whole.
+type kwSource struct {
+	*KW_TO_KWTask
+	objects sync.Map // folder id -> KiteObject
+	emails  sync.Map // source user id -> email
+}
+
+// newSource returns the copier's MigrationSource.
+func newSource(T *KW_TO_KWTask) *kwSource {
+	return &kwSource{KW_TO_KWTask: T}
+}
+
+// Name returns the source name.
+func (S *kwSource) Name() string {
+	return "Kiteworks"
+}
+
+// Users returns the source users selected by the copy options.
+func (S *kwSource) Users() (users []MigrationUser, err error) {
+	src_users, err := S.getSourceUsers()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range src_users {
+		users = append(users, migrationUser(u))
+	}
+	return
+}
+
+// migrationUser describes a source Kiteworks user.
+func migrationUser(user KiteUser) MigrationUser {
+	return MigrationUser{
+		ID:    user.ID,
+		Email: user.Email,
+		Name:  user.Name,
+		Home:  user.BaseDirID,
+	}
+}
+
+// syncFolder describes a source Kiteworks folder, and holds it for object.
+func (S *kwSource) syncFolder(folder KiteObject) SyncFolder {
+	S.objects.Store(folder.ID, folder)
+	return SyncFolder{
+		Name:        folder.Name,
+		Description: folder.Description,
+		SrcID:       folder.ID,
+		FullPath:    folder.Path,
+	}
+}
+
+// object returns a held source folder, releasing it.
+func (S *kwSource) object(user MigrationUser, id string) (KiteObject, error) {
+	if f, ok := S.objects.LoadAndDelete(id); ok {
+		return f.(KiteObject), nil
+	}
+	return S.SRC.Session(user.Email).Folder(id).Info()
+}
+
+// Root returns the user's base folder, whose files are not copied.
+func (S *kwSource) Root(user MigrationUser) (SyncFolder, error) {
+	if IsBlank(user.Home) {
+		return SyncFolder{}, fmt.Errorf("user has no base folder")
+	}
+	return SyncFolder{SrcID: user.Home}, nil
+}
+
+// Folders returns the subfolders of a folder that the user owns.
+func (S *kwSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	children, err := S.SRC.Session(user.Email).Folder(folder.SrcID).Folders()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range children {
+		if c.Type != "d" || c.CurrentUserRole.ID != 5 || c.Path == "basedir" {
+			continue
+		}
+		folders = append(folders, S.syncFolder(c))
+	}
+	return
+}
+
+// Files returns the files within a folder.
+func (S *kwSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	children, err := S.SRC.Session(user.Email).Folder(folder.SrcID).Files()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range children {
+		if c.Type != "f" {
+			continue
+		}
+		files = append(files, syncFile(c, folder.SrcID))
+	}
+	return
+}
+
+// syncFile describes a source Kiteworks file.
+func syncFile(file KiteObject, folder_id string) SyncFile {
+	modified, _ := ReadKWTime(file.Modified)
+	created, _ := ReadKWTime(file.Created)
+	return SyncFile{
+		Name:        file.Name,
+		Description: file.Description,
+		SrcID:       file.ID,
+		Created:     created,
+		Modified:    modified,
+		Size:        file.Size,
+		Fingerprint: file.Fingerprint,
+		SrcFolderID: folder_id,
+	}
+}
+
+// email returns the email of a source user, or NONE when the user cannot be
+// found. The engine maps it to the destination.
+func (S *kwSource) email(user_id string) string {
+	if IsBlank(user_id) {
+		return NONE
+	}
+	if v, ok := S.emails.Load(user_id); ok {
+		return v.(string)
+	}
+	user, err := S.SRC.Session(S.src_admin).Admin().UserByID(user_id)
+	if err != nil {
+		Debug("Source user %s: %v", user_id, err)
+		return NONE
+	}
+	email := strings.ToLower(user.Email)
+	S.emails.Store(user_id, email)
+	return email
+}
+
+// Members returns the folder's members.
+func (S *kwSource) Members(user MigrationUser, folder SyncFolder) (members []MigrationMember, err error) {
+	src_members, err := S.SRC.Session(user.Email).Folder(folder.SrcID).Members()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range src_members {
+		if IsBlank(m.User.Email) || strings.EqualFold(m.User.Email, user.Email) {
+			continue
+		}
+		members = append(members, MigrationMember{
+			User:       m.User.Email,
+			Role:       m.Role.Name,
+			SourceRole: m.Role.Name,
+		})
+	}
+	return
+}
+
+// RoleNames returns the folder roles defined on the source server.
+func (S *kwSource) RoleNames() (names []string) {
+	roles, err := S.SRC.Session(S.src_admin).FolderRoles()
+	if err != nil {
+		Err("Source folder roles: %v", err)
+		return nil
+	}
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	return
+}
+
+// Versions returns the file's version chain, oldest first, each uploaded by
+// its original uploader where they exist on the destination.
+func (S *kwSource) Versions(user MigrationUser, file SyncFile) (versions []SyncVersion, err error) {
+	src_versions, err := S.SRC.Session(user.Email).File(file.SrcID).Versions()
+	if err != nil {
+		return nil, err
+	}
+	if len(src_versions) < 2 {
+		return nil, nil
+	}
+	for _, v := range src_versions {
+		created, _ := ReadKWTime(v.Created)
+		modified, err := ReadKWTime(v.ClientModified)
+		if err != nil {
+			if modified, err = ReadKWTime(v.Modified); err != nil {
+				modified = created
+			}
+		}
+		versions = append(versions, SyncVersion{
+			SrcID:    v.ID,
+			Uploader: S.email(v.UserID),
+			Name:     file.Name,
+			Created:  created,
+			Modified: modified,
+			Size:     v.Size,
+		})
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Created.Before(versions[j].Created) })
+	for i := range versions {
+		versions[i].Ver = i + 1
+	}
+	// The current version keeps the file's modified time, which is what
+	// CloneFolder compares to find files already copied.
+	versions[len(versions)-1].Modified = file.Modified
+	return
+}
+
+// Comments returns the file's comments, oldest first, with replies linked to
+// the comment they reply to.
+func (S *kwSource) Comments(user MigrationUser, file SyncFile) (comments []SyncComment, err error) {
+	src_comments, err := S.SRC.Session(user.Email).File(file.SrcID).Comments()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(src_comments, func(i, j int) bool { return src_comments[i].ID < src_comments[j].ID })
+	for _, c := range src_comments {
+		creator := strings.ToLower(c.User.Email)
+		if IsBlank(creator) {
+			creator = S.email(c.UserID)
+		}
+		created, _ := ReadKWTime(c.Created)
+		comment := SyncComment{
+			ID:       strconv.Itoa(c.ID),
+			Created:  created,
+			Creator:  creator,
+			Message:  fmt.Sprintf("[%s] kiteworks comment created by (%s): %s", created.UTC().Format("2006-01-02"), creator, c.Contents),
+			Original: c.Contents,
+		}
+		if c.ParentID > 0 {
+			comment.ParentID = strconv.Itoa(c.ParentID)
+		}
+		comments = append(comments, comment)
+	}
+	return
+}
+
+// Tasks returns the file's tasks, oldest first.
+func (S *kwSource) Tasks(user MigrationUser, file SyncFile) (tasks []SyncTask, err error) {
+	src_tasks, err := S.SRC.Session(user.Email).File(file.SrcID).Tasks()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(src_tasks, func(i, j int) bool { return src_tasks[i].ID < src_tasks[j].ID })
+	for _, t := range src_tasks {
+		created, _ := ReadKWTime(t.Created)
+		task := SyncTask{
+			ID:        strconv.Itoa(t.ID),
+			Created:   created,
+			Creator:   S.email(t.UserID),
+			Completed: t.Completed(),
+			Message:   t.Contents,
+		}
+		if due, err := time.Parse("2006-01-02", t.Due); err == nil {
+			task.Due = due
+		} else if due, err := ReadKWTime(t.Due); err == nil {
+			task.Due = due
+		}
+		if assignee := S.email(t.AssigneeID); !IsBlank(assignee) {
+			task.AssignedTo = []string{assignee}
+		}
+		if task.Completed {
+			task.CompletedOn, _ = ReadKWTime(t.Modified)
+		}
+		tasks = append(tasks, task)
+	}
+	return
+}
+
+// Open downloads a version of the file, or its current content.
+func (S *kwSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	sess := S.SRC.Session(user.Email)
+	if !IsBlank(version.SrcID) && version.SrcID != file.SrcID {
+		return sess.QDownloadVersion(file.SrcID, &KiteFileVersion{ID: version.SrcID})
+	}
+	f, err := sess.File(file.SrcID).Info()
+	if err != nil {
+		return nil, err
+	}
+	return sess.QDownload(&f)
+}
@@ -3,7 +3,7 @@ package quatrix
 import (
 	"encoding/json"
 	"fmt"
-	"sync/atomic"
+	"strings"
 
 	. "github.com/cmcoffee/kitebroker/core"
 )
@@ -176,6 +176,29 @@ type QPerms struct {
 		Operations          int64  `json:"operations"`
 		InheritedOperations int64  `json:"default"`
 	} `json:"users"`
+	Groups []struct {
+		ID         string `json:"id"`
+		Name       string `json:"name"`
+		Operations int64  `json:"operations"`
+	} `json:"groups"`
+}
+
+// GroupMembers returns the emails of the members of a Quatrix group.
+func (Q *QSession) GroupMembers(group_id string) (emails []string, err error) {
+	var group struct {
+		Users []struct {
+			Email string `json:"email"`
+		} `json:"users"`
+	}
+	err = Q.Call(APIRequest{
+		Path:   "/api/1.0/group/" + group_id,
+		Method: "GET",
+		Output: &group,
+	})
+	for _, u := range group.Users {
+		emails = append(emails, strings.ToLower(u.Email))
+	}
+	return
 }
 
 // / QInfo is a struct that represents the information of a file object in Quatrix API.
@@ -336,195 +359,3 @@ func (Q QObject) Download() (ReadSeekCloser, error) {
 	}
 	return Q.APIClient.WebDownload(req), nil
 }
-
-// folderCrawler represents a crawler that traverses through provided 'folders' and processes their contents.
-// It maintains concurrency by limiting the number of operations to 50 using the LimitGroup package.
-// If it encounters an error or needs to stop, it signals this via the all_stop variable.
-type folderCrawler struct {
-	processor      func(*QSession, *QObject) error
-	folder_limiter LimitGroup
-	file_chan      chan *QObject
-	all_stop       int32
-}
-
-// abortError represents a custom error type used to convey the occurrence of an abort signal during a certain process or operation.
-// It holds an underlying error for more detailed information if required.
-type abortError struct {
-	err error
-}
-
-// Error returns the error message if an underlying error exists.
-func (e abortError) Error() string {
-	if e.err != nil {
-		return e.err.Error()
-	}
-	return ""
-}
-
-// abortCheck checks if an error is of type `abortError` and returns a boolean value indicating whether it was or not.
-// If the error is not an `abortError`, the function simply returns the original error.
-func abortCheck(err error) (error, bool) {
-	if err == nil {
-		return nil, false
-	}
-	if e, ok := err.(abortError); !ok {
-		return err, false
-	} else {
-		return e.err, true
-	}
-}
-
-// FolderCrawler starts a new folder crawler to process files in the provided folders using the provided processor function.
-// The processor function is called for each file that is found and is responsible for processing it.
-// It also takes care of limiting the number of simultaneous file and folder operations to avoid overwhelming the system with too many requests at once.
-func (K *QSession) FolderCrawler(processor func(*QSession, *QObject) error, folders ...*QObject) {
-	crawler := new(folderCrawler)
-	crawler.folder_limiter = NewLimitGroup(50)
-	file_limiter := NewLimitGroup(50)
-	crawler.processor = processor
-	crawler.file_chan = make(chan *QObject, 1000)
-
-	file_limiter.Add(1)
-	go func(user *QSession) {
-		defer file_limiter.Done()
-		for m := range crawler.file_chan {
-			if m.Type != "F" {
-				continue
-			}
-			if atomic.LoadInt32(&crawler.all_stop) > 0 || crawler.processor == nil {
-				continue
-			}
-			if file_limiter.Try() {
-				go func(user *QSession, object *QObject) {
-					defer file_limiter.Done()
-					err, abort := abortCheck(processor(user, object))
-					if err != nil {
-						Err("%s - %s: %v", user.Username, object.Name, err)
-					}
-					if abort {
-						atomic.StoreInt32(&crawler.all_stop, 1)
-					}
-				}(K, m)
-			} else {
-				err, abort := abortCheck(processor(user, m))
-				if err != nil {
-					Err("%s - %s: %v", user.Username, m.Name, err)
-				}
-				if abort {
-					atomic.StoreInt32(&crawler.all_stop, 1)
-				}
-			}
-		}
-	}(K)
-
-	for _, f := range folders {
-		crawler.folder_limiter.Add(1)
-		go func(user *QSession, folder *QObject) {
-			defer crawler.folder_limiter.Done()
-			crawler.process(K, folder)
-		}(K, f)
-	}
-	crawler.folder_limiter.Wait()
-	close(crawler.file_chan)
-	file_limiter.Wait()
-	return
-}
-
-// process is a method of the folderCrawler struct that processes the content of a given folder.
-// It fetches all files and subfolders from a specified directory, processes them using a provided function, and recursively traverses any subdirectories found.
-func (F *folderCrawler) process(user *QSession, folder *QObject) {
-	// Folder is already complete, return to caller.
-	var folders []*QObject
-
-	folders = append(folders, folder)
-
-	var n int
-	var next []*QObject
-
-	if folder == nil {
-		Err("Cannot process 'nil' folder.")
-		return
-	}
-
-	if folder.Type != "D" && folder.Type != "S" {
-		Err("%s is not a folder.", folder.Name)
-		return
-	}
-
-	for {
-		if atomic.LoadInt32(&F.all_stop) > 0 {
-			return
-		}
-		if len(folders) < n+1 {
-			folders = folders[0:0]
-			if len(next) > 0 {
-				for i, o := range next {
-					if o.IsSystemFolder() {
-						continue
-					}
-					if F.folder_limiter.Try() {
-						go func(user *QSession, folder *QObject) {
-							defer F.folder_limiter.Done()
-							f, err := user.File(folder.ID)
-							if err != nil {
-								Err("%s: %v", folder.Name, err)
-								return
-							}
-							F.process(user, &f)
-						}(user, o)
-					} else {
-						for _, o := range next[i:] {
-							f, err := user.File(o.ID)
-							if err != nil {
-								Err("%s:  %v", o.Name, err)
-								continue
-							}
-							folders = append(folders, &f)
-						}
-					}
-				}
-				next = next[0:0]
-				n = 0
-				if len(folders) == 0 {
-					break
-				}
-			} else {
-				break
-			}
-		}
-		if folders[n].Type == "D" || folders[n].Type == "S" {
-			if F.processor != nil {
-				if atomic.LoadInt32(&F.all_stop) > 0 {
-					return
-				}
-				if err := F.processor(user, folders[n]); err != nil {
-					err, abort := abortCheck(err)
-					if err != nil {
-						Err("%s - %s: %v", user.Username, folders[n].Name, err)
-					}
-					if abort {
-						atomic.StoreInt32(&F.all_stop, 1)
-						return
-					}
-				}
-			}
-			childs := folders[n].Content
-			for i := 0; i < len(childs); i++ {
-				childs[i].QSession = folder.QSession
-				switch childs[i].Type {
-				case "S":
-					next = append(next, &childs[i])
-				case "D":
-					next = append(next, &childs[i])
-				default:
-					if atomic.LoadInt32(&F.all_stop) > 0 {
-						return
-					}
-					F.file_chan <- &childs[i]
-				}
-			}
-		}
-		n++
-	}
-	return
-}
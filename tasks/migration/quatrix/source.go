@@ -0,0 +1,192 @@
+package quatrix
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// quatrixSource is the Quatrix MigrationSource.
+//
+// A folder's metadata carries its children, so each folder fetched for its
+// files is held until the walk releases it.
+type quatrixSource struct {
+	*QuatrixMigrationTask
+	users    sync.Map // email -> Userdata
+	contents sync.Map // folder id -> QObject
+	shared   sync.Map // ids of shared ("S") folders
+}
+
+// Name returns the source name.
+func (S *quatrixSource) Name() string {
+	return "Quatrix"
+}
+
+// Users returns all Quatrix users.
+func (S *quatrixSource) Users() (users []MigrationUser, err error) {
+	q_users, err := S.qsess.Users()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range q_users {
+		email := strings.ToLower(u.Email)
+		S.users.Store(email, u)
+		users = append(users, MigrationUser{
+			ID:    u.ID,
+			Email: email,
+			Name:  u.Name,
+			Home:  u.HomeID,
+		})
+	}
+	return
+}
+
+// UserReady applies the custom login settings, when configured.
+func (S *quatrixSource) UserReady(user MigrationUser, dst *KiteUser) error {
+	if auxConfig.setCustom == nil {
+		return nil
+	}
+	u, ok := S.users.Load(user.Email)
+	if !ok {
+		return nil
+	}
+	return auxConfig.setCustom(RawString(u.(Userdata).UniqueLogin), dst)
+}
+
+// folder returns a folder's metadata, from the cache when it is held.
+func (S *quatrixSource) folder(id string) (QObject, error) {
+	if f, ok := S.contents.Load(id); ok {
+		return f.(QObject), nil
+	}
+	f, err := S.qsess.File(id)
+	if err != nil {
+		return f, err
+	}
+	S.contents.Store(id, f)
+	return f, nil
+}
+
+// Root returns the user's home folder. Files in the home folder itself are
+// not migrated.
+func (S *quatrixSource) Root(user MigrationUser) (SyncFolder, error) {
+	home, err := S.folder(user.Home)
+	if err != nil {
+		return SyncFolder{}, err
+	}
+	return SyncFolder{
+		Name:  home.Name,
+		SrcID: home.ID,
+	}, nil
+}
+
+// Folders returns the subfolders of a folder, other than system folders.
+func (S *quatrixSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	f, err := S.folder(folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range f.Content {
+		if (c.Type != "D" && c.Type != "S") || c.IsSystemFolder() {
+			continue
+		}
+		if c.Type == "S" {
+			S.shared.Store(c.ID, struct{}{})
+		}
+		folders = append(folders, SyncFolder{
+			Name:     c.Name,
+			SrcID:    c.ID,
+			Created:  time.Unix(c.Created, 0),
+			Modified: time.Unix(c.ModTime, 0),
+			FullPath: strings.TrimPrefix(folder.FullPath+"/"+c.Name, "/"),
+		})
+	}
+	return
+}
+
+// Release drops the folder's held metadata.
+func (S *quatrixSource) Release(user MigrationUser, folder SyncFolder) {
+	S.contents.Delete(folder.SrcID)
+}
+
+// Files returns the files within a folder.
+func (S *quatrixSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	f, err := S.folder(folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range f.Content {
+		if c.Type != "F" {
+			continue
+		}
+		files = append(files, SyncFile{
+			Name:        c.Name,
+			SrcID:       c.ID,
+			Created:     time.Unix(c.Created, 0),
+			Modified:    time.Unix(c.ModTime, 0),
+			Size:        c.Size,
+			SrcFolderID: folder.SrcID,
+		})
+	}
+	return
+}
+
+// RoleNames returns the roles MapPermissions grants.
+func (S *quatrixSource) RoleNames() []string {
+	return []string{"viewer", "downloader", "uploader", "collaborator", "manager"}
+}
+
+// Members returns the members of a shared folder. Folders are known to be
+// shared once listed, and stay known, so verify and delta passes in the same
+// run see the same members.
+func (S *quatrixSource) Members(user MigrationUser, folder SyncFolder) (members []MigrationMember, err error) {
+	if _, ok := S.shared.Load(folder.SrcID); !ok {
+		return nil, nil
+	}
+	perms, err := QObject{ID: folder.SrcID, QSession: S.qsess}.Permissions()
+	if err != nil {
+		if IsAPIError(err, "QUATRIX_CODE_20") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, p := range perms.Users {
+		members = append(members, MigrationMember{
+			User:       strings.ToLower(p.Email),
+			Role:       S.MapPermissions(p.Operations),
+			SourceRole: strconv.FormatInt(p.Operations, 10),
+		})
+	}
+	for _, g := range perms.Groups {
+		members = append(members, MigrationMember{
+			Group:      g.Name,
+			GroupID:    g.ID,
+			Role:       S.MapPermissions(g.Operations),
+			SourceRole: strconv.FormatInt(g.Operations, 10),
+		})
+	}
+	return
+}
+
+// GroupMembers returns the emails of a Quatrix group's members.
+func (S *quatrixSource) GroupMembers(user MigrationUser, group_id string) ([]string, error) {
+	return S.qsess.GroupMembers(group_id)
+}
+
+// Versions returns nil; Quatrix files are migrated at their current version.
+func (S *quatrixSource) Versions(user MigrationUser, file SyncFile) ([]SyncVersion, error) {
+	return nil, nil
+}
+
+// Comments returns nil; Quatrix files have no comments.
+func (S *quatrixSource) Comments(user MigrationUser, file SyncFile) ([]SyncComment, error) {
+	return nil, nil
+}
+
+// Open downloads the file.
+func (S *quatrixSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	return QObject{ID: file.SrcID, QSession: S.qsess}.Download()
+}
@@ -0,0 +1,113 @@
+package s3
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// exportedFile records a file exported to the bucket, so unchanged files are
+// skipped on the next export.
+type exportedFile struct {
+	ID       string `json:"id"`
+	Modified string `json:"modified"`
+	Size     int64  `json:"size"`
+}
+
+// runExport streams the folders owned by each user into the bucket, as
+// <prefix>/<user>/<folder path>/<file>.
+func (T *S3MigrationTask) runExport() (err error) {
+	exported := T.s3_db.Table("s3_export")
+	files := T.Report.Tally("Files Exported")
+	data := T.Report.Tally("Data Exported", HumanSize)
+	users := T.Report.Tally("Users Exported")
+
+	user_getter, err := T.KW.Admin().Users(T.user_emails, 0, Query{"deleted": false})
+	if err != nil {
+		return err
+	}
+
+	export_file := func(sess *KWSession, file *KiteObject) error {
+		key := strings.TrimPrefix(path.Join(T.prefix, sess.Username, file.Path), "/")
+
+		var prev exportedFile
+		if exported.Get(T.bucket+":"+key, &prev) && prev.ID == file.ID && prev.Modified == file.Modified && prev.Size == file.Size {
+			Debug("[%s]: %s unchanged since last export, skipping.", sess.Username, file.Path)
+			return nil
+		}
+
+		meta := map[string]string{
+			"kw-id":       file.ID,
+			"kw-modified": file.Modified,
+		}
+		if !IsBlank(T.desc_meta) && !IsBlank(file.Description) {
+			meta[T.desc_meta] = file.Description
+		}
+
+		dl, err := sess.QDownload(file)
+		if err != nil {
+			return err
+		}
+		defer dl.Close()
+
+		if _, err := T.api.Put(T.bucket, key, TransferCounter(dl, data.Add), meta); err != nil {
+			return fmt.Errorf("s3://%s/%s: %v", T.bucket, key, err)
+		}
+		Log("[%s]: Exported %s to s3://%s/%s.", sess.Username, file.Path, T.bucket, key)
+		exported.Set(T.bucket+":"+key, &exportedFile{
+			ID:       file.ID,
+			Modified: file.Modified,
+			Size:     file.Size,
+		})
+		files.Add(1)
+		return nil
+	}
+
+	for {
+		kw_users, err := user_getter.Next()
+		if err != nil {
+			return err
+		}
+		if len(kw_users) == 0 {
+			break
+		}
+		for _, user := range kw_users {
+			sess := T.KW.Session(user.Email)
+
+			var top []KiteObject
+			if err := sess.DataCall(APIRequest{
+				Method: "GET",
+				Path:   "/rest/folders/top",
+				Params: SetParams(Query{"deleted": false, "with": "(currentUserRole)"}),
+				Output: &top,
+			}, -1, 1000); err != nil {
+				Err("[%s]: %v", user.Email, err)
+				continue
+			}
+
+			// Only export folders this user owns.
+			var owned []KiteObject
+			for _, f := range top {
+				if f.CurrentUserRole.ID == 5 {
+					owned = append(owned, f)
+				}
+			}
+			if len(owned) == 0 {
+				Log("[%s]: No owned folders to export.", user.Email)
+				continue
+			}
+
+			Log("[%s]: Exporting %d folder(s) to s3://%s ..", user.Email, len(owned), T.bucket)
+			sess.FolderCrawler(func(sess *KWSession, obj *KiteObject) error {
+				if obj.Type != "f" {
+					return nil
+				}
+				return export_file(sess, obj)
+			}, owned...)
+			users.Add(1)
+		}
+	}
+	return nil
+}
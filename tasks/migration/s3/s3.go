@@ -0,0 +1,252 @@
+package s3
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterMigrationTask(new(S3MigrationTask)) }
+
+// S3MigrationTask migrates prefixes of an S3-compatible bucket to Kiteworks
+// folders, or exports Kiteworks folders to a bucket.
+type S3MigrationTask struct {
+	KiteBrokerTask
+	s3_db         Database
+	s3_config     Table
+	api           *S3API
+	endpoint      string
+	region        string
+	access_key    string
+	secret_key    string
+	path_style    bool
+	bucket        string
+	prefix_map    string
+	desc_meta     string
+	prefix        string
+	profile       string
+	user_emails   []string
+	report        bool
+	export        bool
+	preflight     string
+	max_file_size int
+	rollback      string
+	dry_run       bool
+	status        bool
+	retry_failed  bool
+	mapping_file  string
+	mapping       *MigrationMapping
+	limits        MigrationLimits
+}
+
+// Name returns the name of this task.
+func (T *S3MigrationTask) Name() string {
+	return "s3"
+}
+
+// Desc returns a description of this task.
+func (T *S3MigrationTask) Desc() string {
+	return "Migrate S3-compatible bucket prefixes to Kiteworks, or export Kiteworks folders to a bucket."
+}
+
+// Init initializes the S3 migration task.
+func (T *S3MigrationTask) Init() (err error) {
+	T.s3_db = T.DB.Sub("s3")
+	T.s3_config = T.s3_db.Table("s3_config")
+
+	T.s3_config.Get("endpoint", &T.endpoint)
+	T.s3_config.Get("region", &T.region)
+	T.s3_config.Get("access_key", &T.access_key)
+	T.s3_config.Get("secret_key", &T.secret_key)
+	T.s3_config.Get("path_style", &T.path_style)
+
+	setup := T.Flags.Bool("setup", "Configure S3 Connection")
+	T.Flags.StringVar(&T.bucket, "bucket", "<bucket>", "Bucket to migrate from, or export to.")
+	T.Flags.StringVar(&T.prefix_map, "map", "<prefixes.csv>", "CSV mapping bucket prefixes to Kiteworks owners. (prefix,owner[,folder])")
+	T.Flags.StringVar(&T.desc_meta, "desc_meta", "description", "Object metadata key migrated as the file description. (x-amz-meta-<key>)")
+	T.Flags.StringVar(&T.prefix, "prefix", "<prefix>", "Prefix to export Kiteworks folders under.")
+	T.Flags.StringVar(&T.profile, "profile", "Standard", "Destination profile for migrated users. (Needs permission to create folders)")
+	T.Flags.StringVar(&T.mapping_file, "mapping", "<mapping.csv>", "CSV or YAML file remapping users, folder paths and roles.")
+	T.Flags.MultiVar(&T.user_emails, "users", "<user@domain.com>", "User(s) to migrate or export.")
+	migrate := T.Flags.Bool("migrate", "Perform the actual migration.")
+	T.Flags.BoolVar(&T.report, "report", "Generate a report of the bucket folders and files.")
+	T.Flags.BoolVar(&T.export, "export", "Export the users' Kiteworks folders to the bucket.")
+	T.Flags.StringVar(&T.preflight, "preflight", "<findings.csv>", "Check the source and destination for problems, writing findings to a CSV or JSON file.")
+	T.Flags.IntVar(&T.max_file_size, "max_file_size", 0, "Largest file (MB) the destination accepts, checked by --preflight.")
+	T.Flags.StringVar(&T.rollback, "rollback", "<run id>", "Undo the users, folders, files and grants created on Kiteworks by a migration run.")
+	T.Flags.BoolVar(&T.dry_run, "dry_run", "With --rollback, log what would be undone without changing anything.")
+	T.Flags.BoolVar(&T.status, "status", "Show each user's migration state, with throughput and an ETA.")
+	T.Flags.BoolVar(&T.retry_failed, "retry_failed", "With --migrate, migrate only the users whose last migration failed.")
+	T.limits.RegisterFlags(&T.Flags)
+	T.Flags.Order("migrate", "report", "export", "preflight", "rollback", "status", "bucket", "map")
+	if err := T.Flags.Parse(); err != nil {
+		return err
+	}
+	if err := T.limits.Validate(); err != nil {
+		return err
+	}
+
+	if !IsBlank(T.mapping_file) {
+		mapping, err := LoadMigrationMapping(T.mapping_file)
+		if err != nil {
+			return err
+		}
+		T.mapping = mapping
+	}
+
+	if *setup || IsBlank(T.endpoint) || IsBlank(T.access_key) {
+		T.configureS3()
+	}
+
+	var modes int
+	for _, m := range []bool{*migrate, T.report, T.export, !IsBlank(T.preflight), !IsBlank(T.rollback), T.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("--migrate, --report, --export, --preflight, --rollback and --status are mutually exclusive, please specify only one")
+	}
+	if modes == 0 {
+		return fmt.Errorf("must specify either --migrate, --report, --export, --preflight, --rollback or --status")
+	}
+	if T.dry_run && IsBlank(T.rollback) {
+		return fmt.Errorf("--dry_run requires --rollback")
+	}
+	if T.retry_failed && !*migrate {
+		return fmt.Errorf("--retry_failed requires --migrate")
+	}
+	if !IsBlank(T.rollback) {
+		return nil
+	}
+	if IsBlank(T.bucket) {
+		return fmt.Errorf("--bucket is required.")
+	}
+	if !T.export && IsBlank(T.prefix_map) {
+		return fmt.Errorf("--map is required.")
+	}
+	if T.export && len(T.user_emails) == 0 {
+		return fmt.Errorf("--users is required for --export.")
+	}
+	T.desc_meta = strings.ToLower(T.desc_meta)
+	return nil
+}
+
+// configureS3 prompts for the S3 connection settings, saves them and exits.
+func (T *S3MigrationTask) configureS3() {
+	s3_auth := NewOptions("--- S3 Configuration ---", "(selection or 'q' to save & exit)", 'q')
+	s3_auth.StringVar(&T.endpoint, "S3 Endpoint", T.endpoint, "Please input the S3 endpoint URL. (e.g. https://s3.us-east-1.amazonaws.com or http://minio:9000)")
+	s3_auth.StringVar(&T.region, "S3 Region", T.region, "Please input the bucket region. (leave blank for us-east-1)")
+	s3_auth.StringVar(&T.access_key, "Access Key ID", T.access_key, "Please input the access key id.")
+	s3_auth.SecretVar(&T.secret_key, "Secret Access Key", T.secret_key, "Please input the secret access key.")
+	// Most S3-compatible servers, such as MinIO, need buckets addressed by path.
+	path_style := s3_auth.Bool("Path-Style Addressing", T.path_style)
+	if s3_auth.Select(false) {
+		T.path_style = *path_style
+		T.s3_config.Set("endpoint", &T.endpoint)
+		T.s3_config.Set("region", &T.region)
+		T.s3_config.Set("access_key", &T.access_key)
+		T.s3_config.CryptSet("secret_key", &T.secret_key)
+		T.s3_config.Set("path_style", &T.path_style)
+	}
+	Exit(0)
+}
+
+// Main runs the S3 report, migration or export.
+func (T *S3MigrationTask) Main() (err error) {
+	if !IsBlank(T.rollback) {
+		return RollbackMigration(&T.KiteBrokerTask, T.s3_db, T.rollback, T.dry_run)
+	}
+
+	T.api, err = NewS3API(T.endpoint, T.region, T.access_key, T.secret_key, T.path_style, T.KW.ProxyURI, T.KW.VerifySSL, T.KW.ConnectTimeout)
+	if err != nil {
+		return fmt.Errorf("[%s]: %v", T.endpoint, err)
+	}
+
+	if T.export {
+		return T.runExport()
+	}
+
+	src := &s3Source{S3MigrationTask: T}
+	if src.prefixes, err = T.readPrefixMap(); err != nil {
+		return err
+	}
+
+	engine := NewMigrationEngine(&T.KiteBrokerTask, src, T.s3_db)
+	engine.Users = T.user_emails
+	engine.Mapping = T.mapping
+	engine.Limits = T.limits
+	engine.RetryFailed = T.retry_failed
+
+	if T.status {
+		return engine.RunStatus()
+	}
+	if T.report {
+		return engine.RunReport()
+	}
+	if err := engine.SetProfile(T.profile); err != nil {
+		return err
+	}
+	if !IsBlank(T.preflight) {
+		engine.Preflight.MaxFileSize = int64(T.max_file_size) * 1024 * 1024
+		return engine.RunPreflight(T.preflight)
+	}
+	return engine.Run()
+}
+
+// readPrefixMap reads the prefix map CSV. A prefix's folder defaults to the
+// prefix's last element, or the bucket name for the whole bucket ("/").
+func (T *S3MigrationTask) readPrefixMap() (prefixes []s3Prefix, err error) {
+	f, err := os.Open(T.prefix_map)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", T.prefix_map, err)
+	}
+
+	folders := make(map[string]string)
+	for _, r := range records {
+		for i := range r {
+			r[i] = strings.TrimSpace(r[i])
+		}
+		// Skips the header, and any line without a Kiteworks owner.
+		if len(r) < 2 || IsBlank(r[0]) || !strings.Contains(r[1], "@") {
+			continue
+		}
+		p := s3Prefix{
+			prefix: strings.Trim(r[0], "/"),
+			owner:  strings.ToLower(r[1]),
+		}
+		if IsBlank(p.prefix) {
+			p.folder = T.bucket
+		} else {
+			p.folder = path.Base(p.prefix)
+			p.prefix = p.prefix + "/"
+		}
+		if len(r) > 2 && !IsBlank(r[2]) {
+			p.folder = r[2]
+		}
+		p.folder = FilterInvalidChars(p.folder)
+		key := p.owner + "/" + strings.ToLower(p.folder)
+		if prev, ok := folders[key]; ok {
+			return nil, fmt.Errorf("%s: prefixes '%s' and '%s' both map to folder '%s' of %s", T.prefix_map, prev, r[0], p.folder, p.owner)
+		}
+		folders[key] = r[0]
+		prefixes = append(prefixes, p)
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("%s: no prefixes mapped to Kiteworks owners", T.prefix_map)
+	}
+	return prefixes, nil
+}
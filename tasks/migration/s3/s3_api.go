@@ -0,0 +1,445 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// s3PartSize is the part size of multipart uploads; parts are held in memory
+// while they are sent.
+const s3PartSize = 16 << 20
+
+// S3API is a client for an S3-compatible object store, signing requests with
+// AWS Signature Version 4.
+type S3API struct {
+	Endpoint   *url.URL // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Region     string
+	AccessKey  string
+	SecretKey  string
+	PathStyle  bool // Address buckets as endpoint/bucket rather than bucket.endpoint.
+	httpClient *http.Client
+}
+
+// NewS3API returns a client for the endpoint.
+func NewS3API(endpoint, region, access_key, secret_key string, path_style bool, proxy_uri string, verify_ssl bool, timeout time.Duration) (*S3API, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if IsBlank(region) {
+		region = "us-east-1"
+	}
+
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if !verify_ssl {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if proxy_uri != NONE {
+		proxyURL, err := url.Parse(proxy_uri)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &S3API{
+		Endpoint:   u,
+		Region:     region,
+		AccessKey:  access_key,
+		SecretKey:  secret_key,
+		PathStyle:  path_style,
+		httpClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+// S3Error is an error response from the object store.
+type S3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e S3Error) Error() string {
+	if IsBlank(e.Code) {
+		return fmt.Sprintf("HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// isS3Error reports whether err is an S3 error with one of the codes.
+func isS3Error(err error, codes ...string) bool {
+	e, ok := err.(S3Error)
+	if !ok {
+		return false
+	}
+	for _, c := range codes {
+		if e.Code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// s3Escape escapes a string as Signature Version 4 requires: everything
+// but unreserved characters, and '/' unless escape_slash is false.
+func s3Escape(input string, escape_slash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(input) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escape_slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// url returns the request URL for an object, or the bucket when key is blank.
+func (s *S3API) url(bucket, key string, query url.Values) *url.URL {
+	u := *s.Endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.PathStyle {
+		path = path + "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	path = path + "/" + key
+
+	u.Path = path
+	u.RawPath = s3Escape(path, false)
+
+	var q []string
+	for k, vs := range query {
+		for _, v := range vs {
+			q = append(q, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(q)
+	u.RawQuery = strings.Join(q, "&")
+	return &u
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign signs a request. Payloads are sent unsigned, so bodies can be streamed.
+func (s *S3API) sign(req *http.Request) {
+	now := time.Now().UTC()
+	amz_date := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amz_date)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-type" || k == "content-md5" || k == "range" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical_headers strings.Builder
+	for _, k := range names {
+		canonical_headers.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed_headers := strings.Join(names, ";")
+
+	canonical_request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonical_headers.String(),
+		signed_headers,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical_request))
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	string_to_sign := "AWS4-HMAC-SHA256\n" + amz_date + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, string_to_sign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signed_headers, signature))
+}
+
+// do sends a signed request, returning an S3Error for error responses.
+func (s *S3API) do(method, bucket, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(bucket, key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req)
+
+	Trace("--> S3 %s %s", method, req.URL.String())
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := S3Error{Status: resp.StatusCode}
+		if data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); len(data) > 0 {
+			xml.Unmarshal(data, &e)
+		}
+		if IsBlank(e.Code) && resp.StatusCode == http.StatusNotFound {
+			e.Code = "NoSuchKey"
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+// call sends a request and decodes its XML response into output, when set.
+func (s *S3API) call(method, bucket, key string, query url.Values, header http.Header, body []byte, output interface{}) (http.Header, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	resp, err := s.do(method, bucket, key, query, header, r, int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if output != nil {
+		if err := xml.NewDecoder(resp.Body).Decode(output); err != nil {
+			return nil, err
+		}
+	} else {
+		io.Copy(io.Discard, resp.Body)
+	}
+	return resp.Header, nil
+}
+
+// S3Object is an object in a listing.
+type S3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+	ETag         string    `xml:"ETag"`
+}
+
+// List returns the objects and common prefixes directly below prefix, using
+// "/" as the delimiter.
+func (s *S3API) List(bucket, prefix string) (objects []S3Object, prefixes []string, err error) {
+	var token string
+	for {
+		var result struct {
+			Contents       []S3Object `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if !IsBlank(token) {
+			query.Set("continuation-token", token)
+		}
+		if _, err := s.call("GET", bucket, "", query, nil, nil, &result); err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, result.Contents...)
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !result.IsTruncated || IsBlank(result.NextContinuationToken) {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return
+}
+
+// Metadata returns an object's user metadata (x-amz-meta-*), keyed by
+// lowercase name without the prefix.
+func (s *S3API) Metadata(bucket, key string) (map[string]string, error) {
+	header, err := s.call("HEAD", bucket, key, nil, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]string)
+	for k, v := range header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-meta-") && len(v) > 0 {
+			if d, err := url.PathUnescape(v[0]); err == nil {
+				meta[strings.TrimPrefix(k, "x-amz-meta-")] = d
+			} else {
+				meta[strings.TrimPrefix(k, "x-amz-meta-")] = v[0]
+			}
+		}
+	}
+	return meta, nil
+}
+
+// Open returns a reader of an object. Reads are streamed, and a seek reopens
+// the object at the new offset with a ranged request.
+func (s *S3API) Open(bucket, key string, size int64) ReadSeekCloser {
+	return &s3Reader{api: s, bucket: bucket, key: key, size: size}
+}
+
+// s3Reader streams an object.
+type s3Reader struct {
+	api    *S3API
+	bucket string
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (n int, err error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.offset)}}
+		resp, err := r.api.do("GET", r.bucket, r.key, nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err = r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("%s: negative seek position", r.key)
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// metaHeader returns the headers setting an object's user metadata.
+func metaHeader(meta map[string]string) http.Header {
+	header := make(http.Header)
+	for k, v := range meta {
+		header.Set("x-amz-meta-"+k, url.PathEscape(v))
+	}
+	return header
+}
+
+// Put streams src into an object, with a single request when it fits in one
+// part and a multipart upload otherwise.
+func (s *S3API) Put(bucket, key string, src io.Reader, meta map[string]string) (size int64, err error) {
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	if n < s3PartSize {
+		_, err = s.call("PUT", bucket, key, nil, metaHeader(meta), buf[:n], nil)
+		return int64(n), err
+	}
+
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if _, err := s.call("POST", bucket, key, url.Values{"uploads": {""}}, metaHeader(meta), nil, &upload); err != nil {
+		return 0, err
+	}
+	abort := func(err error) (int64, error) {
+		s.call("DELETE", bucket, key, url.Values{"uploadId": {upload.UploadID}}, nil, nil, nil)
+		return size, err
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+
+	for num := 1; n > 0; num++ {
+		query := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {upload.UploadID}}
+		header, err := s.call("PUT", bucket, key, query, nil, buf[:n], nil)
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, part{num, header.Get("ETag")})
+		size += int64(n)
+
+		n, err = io.ReadFull(src, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return abort(err)
+		}
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	if _, err := s.call("POST", bucket, key, url.Values{"uploadId": {upload.UploadID}}, nil, complete, nil); err != nil {
+		return abort(err)
+	}
+	return size, nil
+}
@@ -0,0 +1,154 @@
+package s3
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// s3Source is a bucket as a MigrationSource. Each mapped prefix is migrated
+// as a folder of the owner it is mapped to; objects outside the mapped
+// prefixes are not migrated. SrcIDs are object keys, and listing prefixes
+// (ending in "/") for folders.
+type s3Source struct {
+	*S3MigrationTask
+	prefixes []s3Prefix
+	subdirs  sync.Map // prefix -> []string, common prefixes from the last Files listing.
+}
+
+// s3Prefix is a line of the prefix map.
+type s3Prefix struct {
+	prefix string // Listing prefix, "" for the whole bucket.
+	owner  string
+	folder string // Kiteworks folder name.
+}
+
+// Name returns the source name.
+func (S *s3Source) Name() string {
+	return "S3"
+}
+
+// Users returns the owners named in the prefix map.
+func (S *s3Source) Users() (users []MigrationUser, err error) {
+	seen := make(map[string]struct{})
+	for _, p := range S.prefixes {
+		if _, ok := seen[p.owner]; ok {
+			continue
+		}
+		seen[p.owner] = struct{}{}
+		users = append(users, MigrationUser{ID: p.owner, Email: p.owner})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return
+}
+
+// Root returns the bucket. Its folders are the prefixes mapped to the user.
+func (S *s3Source) Root(user MigrationUser) (SyncFolder, error) {
+	return SyncFolder{Name: S.bucket}, nil
+}
+
+// Folders returns the prefixes directly below a folder; at the root, the
+// prefixes mapped to the user.
+func (S *s3Source) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	if IsBlank(folder.FullPath) {
+		for _, p := range S.prefixes {
+			if p.owner != strings.ToLower(user.Email) {
+				continue
+			}
+			folders = append(folders, SyncFolder{
+				Name:     p.folder,
+				SrcID:    p.prefix,
+				FullPath: p.folder,
+				Owner:    user.Email,
+			})
+		}
+		return
+	}
+
+	var prefixes []string
+	if v, ok := S.subdirs.LoadAndDelete(folder.SrcID); ok {
+		prefixes = v.([]string)
+	} else if _, prefixes, err = S.api.List(S.bucket, folder.SrcID); err != nil {
+		return nil, err
+	}
+	for _, p := range prefixes {
+		name := path.Base(p)
+		if IsBlank(strings.Trim(p[len(folder.SrcID):], "/")) {
+			continue
+		}
+		folders = append(folders, SyncFolder{
+			Name:     name,
+			SrcID:    p,
+			FullPath: path.Join(folder.FullPath, name),
+			Owner:    user.Email,
+		})
+	}
+	return
+}
+
+// Files returns the objects directly below a folder. When migrating, each
+// object's metadata is read for its description.
+func (S *s3Source) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	if IsBlank(folder.FullPath) {
+		return nil, nil
+	}
+
+	objects, prefixes, err := S.api.List(S.bucket, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	S.subdirs.Store(folder.SrcID, prefixes)
+
+	for _, o := range objects {
+		// Skips folder markers.
+		if strings.HasSuffix(o.Key, "/") {
+			continue
+		}
+		f := SyncFile{
+			Name:        path.Base(o.Key),
+			SrcID:       o.Key,
+			Created:     o.LastModified,
+			Modified:    o.LastModified,
+			Size:        o.Size,
+			SrcFolderID: folder.SrcID,
+		}
+		if !S.report && !IsBlank(S.desc_meta) {
+			meta, err := S.api.Metadata(S.bucket, o.Key)
+			if err != nil {
+				Err("[%s]: Error reading metadata of %s: %v", user.Email, o.Key, err)
+			} else {
+				f.Description = meta[S.desc_meta]
+			}
+		}
+		files = append(files, f)
+	}
+	return
+}
+
+// Members returns nil; bucket policies are not mapped to folder members.
+func (S *s3Source) Members(user MigrationUser, folder SyncFolder) ([]MigrationMember, error) {
+	return nil, nil
+}
+
+// RoleNames returns nil; no roles are granted.
+func (S *s3Source) RoleNames() []string {
+	return nil
+}
+
+// Versions returns nil; objects are migrated at their current content.
+func (S *s3Source) Versions(user MigrationUser, file SyncFile) ([]SyncVersion, error) {
+	return nil, nil
+}
+
+// Comments returns nil; objects have no comments.
+func (S *s3Source) Comments(user MigrationUser, file SyncFile) ([]SyncComment, error) {
+	return nil, nil
+}
+
+// Open streams the object from the bucket.
+func (S *s3Source) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	return S.api.Open(S.bucket, file.SrcID, file.Size), nil
+}
@@ -0,0 +1,245 @@
+package sftp
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterMigrationTask(new(SFTPMigrationTask)) }
+
+// SFTPMigrationTask migrates user home directories from an SFTP server to Kiteworks.
+type SFTPMigrationTask struct {
+	KiteBrokerTask
+	sftp_db             Database
+	sftp_config         Table
+	conn                sftpConfig
+	home_root           string
+	user_map            string
+	dest_folder         string
+	target_profile_name string
+	user_emails         []string
+	ssh_keys            bool
+	hidden              bool
+	report              bool
+	preflight           string
+	max_file_size       int
+	rollback            string
+	dry_run             bool
+	status              bool
+	retry_failed        bool
+	mapping_file        string
+	mapping             *MigrationMapping
+	limits              MigrationLimits
+	keys_copied         Tally
+	engine              *MigrationEngine
+}
+
+// Name returns the name of this task.
+func (T *SFTPMigrationTask) Name() string {
+	return "sftp"
+}
+
+// Desc returns a description of this task.
+func (T *SFTPMigrationTask) Desc() string {
+	return "Migrate user home directories and SSH keys from an SFTP server to Kiteworks."
+}
+
+// Init initializes the SFTP migration task.
+func (T *SFTPMigrationTask) Init() (err error) {
+	T.sftp_db = T.DB.Sub("sftp")
+	T.sftp_config = T.sftp_db.Table("sftp_config")
+
+	T.sftp_config.Get("host", &T.conn.host)
+	T.sftp_config.Get("username", &T.conn.username)
+	T.sftp_config.Get("password", &T.conn.password)
+	T.sftp_config.Get("private_key", &T.conn.private_key)
+	T.sftp_config.Get("passphrase", &T.conn.passphrase)
+	T.sftp_config.Get("host_key", &T.conn.host_key)
+	T.sftp_config.Get("home_root", &T.home_root)
+	if IsBlank(T.home_root) {
+		T.home_root = "/home"
+	}
+
+	setup := T.Flags.Bool("setup", "Configure SFTP Connection")
+	T.Flags.StringVar(&T.user_map, "user_map", "<users.csv>", "CSV mapping SFTP logins to Kiteworks users. (login,user[,home directory])")
+	T.Flags.StringVar(&T.dest_folder, "dest_folder", "SFTP", "Kiteworks folder to migrate each home directory into.")
+	T.Flags.StringVar(&T.target_profile_name, "profile", "Standard", "Destination profile for migrated users. (Needs permission to create folders)")
+	T.Flags.StringVar(&T.mapping_file, "mapping", "<mapping.csv>", "CSV or YAML file remapping users, folder paths and roles.")
+	T.Flags.MultiVar(&T.user_emails, "users", "<user@domain.com>", "User(s) to migrate.")
+	T.Flags.BoolVar(&T.ssh_keys, "ssh_keys", "Copy each user's authorized_keys to Kiteworks.")
+	T.Flags.BoolVar(&T.hidden, "hidden", "Include hidden files and folders.")
+	migrate := T.Flags.Bool("migrate", "Perform the actual migration.")
+	T.Flags.BoolVar(&T.report, "report", "Generate a report of SFTP users, folders and files.")
+	T.Flags.StringVar(&T.preflight, "preflight", "<findings.csv>", "Check the source and destination for problems, writing findings to a CSV or JSON file.")
+	T.Flags.IntVar(&T.max_file_size, "max_file_size", 0, "Largest file (MB) the destination accepts, checked by --preflight.")
+	T.Flags.StringVar(&T.rollback, "rollback", "<run id>", "Undo the users, folders, files, grants and SSH keys created on Kiteworks by a migration run.")
+	T.Flags.BoolVar(&T.dry_run, "dry_run", "With --rollback, log what would be undone without changing anything.")
+	T.Flags.BoolVar(&T.status, "status", "Show each user's migration state, with throughput and an ETA.")
+	T.Flags.BoolVar(&T.retry_failed, "retry_failed", "With --migrate, migrate only the users whose last migration failed.")
+	T.limits.RegisterFlags(&T.Flags)
+	T.Flags.Order("migrate", "report", "preflight", "rollback", "status", "user_map")
+	if err := T.Flags.Parse(); err != nil {
+		return err
+	}
+	if err := T.limits.Validate(); err != nil {
+		return err
+	}
+
+	if !IsBlank(T.mapping_file) {
+		mapping, err := LoadMigrationMapping(T.mapping_file)
+		if err != nil {
+			return err
+		}
+		T.mapping = mapping
+	}
+
+	if *setup || IsBlank(T.conn.host) || IsBlank(T.conn.username) {
+		T.configureSFTP()
+	}
+
+	var modes int
+	for _, m := range []bool{*migrate, T.report, !IsBlank(T.preflight), !IsBlank(T.rollback), T.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("--migrate, --report, --preflight, --rollback and --status are mutually exclusive, please specify only one")
+	}
+	if modes == 0 {
+		return fmt.Errorf("must specify either --migrate, --report, --preflight, --rollback or --status")
+	}
+	if T.dry_run && IsBlank(T.rollback) {
+		return fmt.Errorf("--dry_run requires --rollback")
+	}
+	if T.retry_failed && !*migrate {
+		return fmt.Errorf("--retry_failed requires --migrate")
+	}
+	if !IsBlank(T.rollback) {
+		return nil
+	}
+	if IsBlank(T.user_map) {
+		return fmt.Errorf("--user_map is required.")
+	}
+	if IsBlank(T.dest_folder) {
+		return fmt.Errorf("--dest_folder cannot be blank.")
+	}
+	return nil
+}
+
+// configureSFTP prompts for the SFTP connection settings, saves them and exits.
+func (T *SFTPMigrationTask) configureSFTP() {
+	host_key := T.conn.host_key
+
+	sftp_auth := NewOptions("--- SFTP Server Configuration ---", "(selection or 'q' to save & exit)", 'q')
+	sftp_auth.StringVar(&T.conn.host, "SFTP Host", T.conn.host, "Please input the SFTP server host, with the port when it is not 22. (host:port)")
+	sftp_auth.StringVar(&T.conn.username, "SFTP Username", T.conn.username, "Please input an account able to read all user home directories.")
+	sftp_auth.SecretVar(&T.conn.password, "SFTP Password", T.conn.password, "Password for the SFTP account. (leave blank for key authentication)")
+	sftp_auth.TextAreaVar(&T.conn.private_key, "SFTP Private Key", "Paste SSH Private Key Here...")
+	sftp_auth.SecretVar(&T.conn.passphrase, "Private Key Passphrase", T.conn.passphrase, "Passphrase for the private key, if any.")
+	sftp_auth.StringVar(&T.home_root, "Home Directory Root", T.home_root, "Directory containing user home directories.")
+	sftp_auth.StringVar(&host_key, "Host Key Fingerprint", host_key, "SHA256 fingerprint of the server's host key. (leave blank to trust the key on first connect)")
+	if sftp_auth.Select(false) {
+		T.sftp_config.Set("host", &T.conn.host)
+		T.sftp_config.Set("username", &T.conn.username)
+		T.sftp_config.CryptSet("password", &T.conn.password)
+		T.sftp_config.CryptSet("private_key", &T.conn.private_key)
+		T.sftp_config.CryptSet("passphrase", &T.conn.passphrase)
+		T.sftp_config.Set("home_root", &T.home_root)
+		T.sftp_config.Set("host_key", &host_key)
+	}
+	Exit(0)
+}
+
+// Main runs the SFTP report or migration.
+func (T *SFTPMigrationTask) Main() (err error) {
+	if !IsBlank(T.rollback) {
+		return RollbackMigration(&T.KiteBrokerTask, T.sftp_db, T.rollback, T.dry_run)
+	}
+
+	users, err := T.readUserMap()
+	if err != nil {
+		return err
+	}
+
+	T.conn.timeout = T.KW.ConnectTimeout
+	client, err := T.conn.connect(func(fingerprint string) {
+		T.sftp_config.Set("host_key", &fingerprint)
+	})
+	if err != nil {
+		return fmt.Errorf("[%s]: %v", T.conn.host, err)
+	}
+	defer client.Close()
+
+	src := &sftpSource{SFTPMigrationTask: T, client: client, users: users}
+	engine := NewMigrationEngine(&T.KiteBrokerTask, src, T.sftp_db)
+	engine.Users = T.user_emails
+	engine.Mapping = T.mapping
+	engine.Limits = T.limits
+	engine.RetryFailed = T.retry_failed
+	T.engine = engine
+
+	if T.status {
+		return engine.RunStatus()
+	}
+	if T.report {
+		return engine.RunReport()
+	}
+	if err := engine.SetProfile(T.target_profile_name); err != nil {
+		return err
+	}
+	if !IsBlank(T.preflight) {
+		engine.Preflight.MaxFileSize = int64(T.max_file_size) * 1024 * 1024
+		return engine.RunPreflight(T.preflight)
+	}
+	if T.ssh_keys {
+		T.keys_copied = T.Report.Tally("SSH Keys Copied")
+	}
+	return engine.Run()
+}
+
+// readUserMap reads the user map CSV. A login's home directory defaults to
+// the login under the home directory root.
+func (T *SFTPMigrationTask) readUserMap() (users []sftpUser, err error) {
+	f, err := os.Open(T.user_map)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", T.user_map, err)
+	}
+
+	for _, r := range records {
+		for i := range r {
+			r[i] = strings.TrimSpace(r[i])
+		}
+		// Skips the header, and any line without a Kiteworks user.
+		if len(r) < 2 || IsBlank(r[0]) || !strings.Contains(r[1], "@") {
+			continue
+		}
+		u := sftpUser{
+			login: r[0],
+			email: strings.ToLower(r[1]),
+			home:  path.Join(T.home_root, r[0]),
+		}
+		if len(r) > 2 && !IsBlank(r[2]) {
+			u.home = path.Clean(r[2])
+		}
+		users = append(users, u)
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no SFTP logins mapped to Kiteworks users", T.user_map)
+	}
+	return users, nil
+}
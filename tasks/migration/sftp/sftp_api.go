@@ -0,0 +1,122 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+	gosftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpConfig is the connection to the SFTP server.
+type sftpConfig struct {
+	host        string // host[:port]
+	username    string
+	password    string
+	private_key string
+	passphrase  string
+	host_key    string // SHA256 fingerprint of the server's host key.
+	timeout     time.Duration
+}
+
+// address returns the host with the default port added when none was given.
+func (c *sftpConfig) address() string {
+	if _, _, err := net.SplitHostPort(c.host); err == nil {
+		return c.host
+	}
+	return net.JoinHostPort(c.host, "22")
+}
+
+// auth returns the configured authentication methods: the private key, when
+// set, and the password, when set.
+func (c *sftpConfig) auth() (methods []ssh.AuthMethod, err error) {
+	if !IsBlank(c.private_key) {
+		var signer ssh.Signer
+		if IsBlank(c.passphrase) {
+			signer, err = ssh.ParsePrivateKey([]byte(c.private_key))
+		} else {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(c.private_key), []byte(c.passphrase))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading private key: %v", err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if !IsBlank(c.password) {
+		methods = append(methods, ssh.Password(c.password))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("No password or private key configured.")
+	}
+	return methods, nil
+}
+
+// connect opens an SFTP session. When no host key has been recorded, the
+// server's key is accepted and passed to save_host_key; otherwise it must match.
+func (c *sftpConfig) connect(save_host_key func(fingerprint string)) (*gosftp.Client, error) {
+	auth, err := c.auth()
+	if err != nil {
+		return nil, err
+	}
+
+	check_host_key := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if IsBlank(c.host_key) {
+			Log("[%s]: Trusting host key %s.", c.host, fingerprint)
+			c.host_key = fingerprint
+			save_host_key(fingerprint)
+			return nil
+		}
+		if fingerprint != c.host_key {
+			return fmt.Errorf("host key mismatch: got %s, expected %s", fingerprint, c.host_key)
+		}
+		return nil
+	}
+
+	conn, err := ssh.Dial("tcp", c.address(), &ssh.ClientConfig{
+		User:            c.username,
+		Auth:            auth,
+		HostKeyCallback: check_host_key,
+		Timeout:         c.timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := gosftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// authorizedKey is a public key from an authorized_keys file.
+type authorizedKey struct {
+	Name      string
+	PublicKey string
+}
+
+// parseAuthorizedKeys parses an authorized_keys file. Keys are named by their
+// comment, or default_name and their position when they have none.
+func parseAuthorizedKeys(data []byte, default_name string) (keys []authorizedKey) {
+	for n := 1; len(bytes.TrimSpace(data)) > 0; n++ {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+		name := strings.TrimSpace(comment)
+		if IsBlank(name) {
+			name = fmt.Sprintf("%s-%d", default_name, n)
+		}
+		keys = append(keys, authorizedKey{
+			Name:      name,
+			PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		})
+	}
+	return
+}
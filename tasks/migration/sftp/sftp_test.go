@@ -0,0 +1,356 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+	gosftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process SFTP server serving the local filesystem.
+type testServer struct {
+	addr        string
+	fingerprint string
+}
+
+// startServer starts an SFTP server accepting the given password, until the
+// test ends.
+func startServer(t *testing.T, password string) *testServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) != password {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config)
+		}
+	}()
+	return &testServer{
+		addr:        ln.Addr().String(),
+		fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+	}
+}
+
+// serveConn serves the sftp subsystem on each session of an SSH connection.
+func serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}(requests)
+		go func() {
+			server, err := gosftp.NewServer(ch)
+			if err != nil {
+				ch.Close()
+				return
+			}
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+// writeFile writes a file below root, creating its directories.
+func writeFile(t *testing.T, root, name, content string) {
+	t.Helper()
+	p := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newSource connects a source to the server, for the users given.
+func newSource(t *testing.T, srv *testServer, users ...sftpUser) *sftpSource {
+	t.Helper()
+	conn := sftpConfig{host: srv.addr, username: "migrator", password: "secret", timeout: 5 * time.Second}
+	client, err := conn.connect(func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return &sftpSource{
+		SFTPMigrationTask: &SFTPMigrationTask{dest_folder: "SFTP"},
+		client:            client,
+		users:             users,
+	}
+}
+
+func TestConnectHostKey(t *testing.T) {
+	srv := startServer(t, "secret")
+
+	var saved string
+	conn := sftpConfig{host: srv.addr, username: "migrator", password: "secret", timeout: 5 * time.Second}
+	client, err := conn.connect(func(fingerprint string) { saved = fingerprint })
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if saved != srv.fingerprint || conn.host_key != srv.fingerprint {
+		t.Fatalf("trusted host key %q, saved %q, want %q", conn.host_key, saved, srv.fingerprint)
+	}
+
+	// A recorded key must match on later connections.
+	client, err = conn.connect(func(string) { t.Fatal("host key saved again") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	conn.host_key = "SHA256:not-the-servers-key"
+	if _, err := conn.connect(func(string) {}); err == nil || !strings.Contains(err.Error(), "host key mismatch") {
+		t.Fatalf("connect with the wrong host key: %v", err)
+	}
+
+	conn = sftpConfig{host: srv.addr, username: "migrator", password: "wrong", host_key: srv.fingerprint, timeout: 5 * time.Second}
+	if _, err := conn.connect(func(string) {}); err == nil {
+		t.Fatal("connect with the wrong password succeeded")
+	}
+}
+
+func TestReadUserMap(t *testing.T) {
+	dir := t.TempDir()
+	user_map := filepath.Join(dir, "users.csv")
+	data := "login,email,home\n# comment\nalice, Alice@Example.com\nbob,bob@example.com,/data/bob/\ncarol,not-an-email\n"
+	if err := os.WriteFile(user_map, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	T := &SFTPMigrationTask{user_map: user_map, home_root: "/home"}
+	users, err := T.readUserMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sftpUser{
+		{login: "alice", email: "alice@example.com", home: "/home/alice"},
+		{login: "bob", email: "bob@example.com", home: "/data/bob"},
+	}
+	if len(users) != len(want) {
+		t.Fatalf("got %d users, want %d: %+v", len(users), len(want), users)
+	}
+	for i := range want {
+		if users[i] != want[i] {
+			t.Errorf("user %d: got %+v, want %+v", i, users[i], want[i])
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	srv := startServer(t, "secret")
+	home := filepath.ToSlash(t.TempDir())
+
+	writeFile(t, home, "top.txt", "top")
+	writeFile(t, home, "docs/a.txt", "alpha")
+	writeFile(t, home, "docs/reports/b.txt", "bravo")
+	writeFile(t, home, "docs/.hidden", "hidden")
+	writeFile(t, home, ".ssh/authorized_keys", "")
+	writeFile(t, home, "empty/.keep", "")
+	if err := os.Symlink(filepath.Join(home, "docs"), filepath.Join(home, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	S := newSource(t, srv, sftpUser{login: "alice", email: "alice@example.com", home: home})
+	users, err := S.Users()
+	if err != nil || len(users) != 1 {
+		t.Fatalf("Users: %v, %v", users, err)
+	}
+	user := users[0]
+
+	root, err := S.Root(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.SrcID != home || root.FullPath != "SFTP" {
+		t.Fatalf("root: %+v", root)
+	}
+
+	// Walk the tree the way the migration walker does: files, then
+	// subfolders, of every folder.
+	var folders, files []string
+	sizes := make(map[string]int64)
+	var walk func(folder SyncFolder)
+	walk = func(folder SyncFolder) {
+		fs, err := S.Files(user, folder)
+		if err != nil {
+			t.Fatalf("Files(%s): %v", folder.SrcID, err)
+		}
+		for _, f := range fs {
+			if f.SrcFolderID != folder.SrcID || f.SrcID != folder.SrcID+"/"+f.Name {
+				t.Errorf("file %+v in %s", f, folder.SrcID)
+			}
+			files = append(files, folder.FullPath+"/"+f.Name)
+			sizes[f.Name] = f.Size
+		}
+		subs, err := S.Folders(user, folder)
+		if err != nil {
+			t.Fatalf("Folders(%s): %v", folder.SrcID, err)
+		}
+		for _, sub := range subs {
+			if sub.Owner != user.Email {
+				t.Errorf("folder %s owner %q", sub.FullPath, sub.Owner)
+			}
+			folders = append(folders, sub.FullPath)
+			walk(sub)
+		}
+	}
+	walk(root)
+
+	sort.Strings(folders)
+	sort.Strings(files)
+	want_folders := []string{"SFTP/docs", "SFTP/docs/reports", "SFTP/empty"}
+	want_files := []string{"SFTP/docs/a.txt", "SFTP/docs/reports/b.txt", "SFTP/top.txt"}
+	if strings.Join(folders, ",") != strings.Join(want_folders, ",") {
+		t.Errorf("folders: got %v, want %v", folders, want_folders)
+	}
+	if strings.Join(files, ",") != strings.Join(want_files, ",") {
+		t.Errorf("files: got %v, want %v", files, want_files)
+	}
+	if sizes["a.txt"] != 5 || sizes["top.txt"] != 3 {
+		t.Errorf("sizes: %v", sizes)
+	}
+
+	// Hidden entries are migrated when enabled; .ssh never is.
+	S.hidden = true
+	docs, err := S.Files(user, SyncFolder{SrcID: home + "/docs", FullPath: "SFTP/docs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Errorf("with hidden: got %d files in docs, want 2", len(docs))
+	}
+	subs, err := S.Folders(user, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range subs {
+		if sub.Name == ".ssh" {
+			t.Error(".ssh was listed as a folder")
+		}
+	}
+
+	if _, err := S.Root(MigrationUser{Email: "bob@example.com", Home: home + "/top.txt"}); err == nil {
+		t.Error("Root of a file succeeded")
+	}
+}
+
+func TestOpenResume(t *testing.T) {
+	srv := startServer(t, "secret")
+	home := filepath.ToSlash(t.TempDir())
+	content := strings.Repeat("0123456789", 10000)
+	writeFile(t, home, "big.bin", content)
+
+	S := newSource(t, srv)
+	user := MigrationUser{Email: "alice@example.com", Home: home}
+	file := SyncFile{Name: "big.bin", SrcID: home + "/big.bin", Size: int64(len(content))}
+
+	f, err := S.Open(user, file, SyncVersion{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// An interrupted transfer resumes by seeking past what was sent.
+	head := make([]byte, 4096)
+	if _, err := io.ReadFull(f, head); err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(len(content) - 1234)
+	if n, err := f.Seek(offset, io.SeekStart); err != nil || n != offset {
+		t.Fatalf("Seek: %d, %v", n, err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(head)+string(rest) != content[:4096]+content[offset:] {
+		t.Error("resumed content does not match the file")
+	}
+
+	if _, err := S.Open(user, SyncFile{SrcID: home + "/missing"}, SyncVersion{}); !os.IsNotExist(err) {
+		t.Errorf("Open of a missing file: %v", err)
+	}
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	var lines []string
+	for _, comment := range []string{"alice@laptop", ""} {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		if comment != "" {
+			line += " " + comment
+		}
+		lines = append(lines, line)
+	}
+	data := "# keys\n" + lines[0] + "\n\n" + lines[1] + "\n"
+
+	keys := parseAuthorizedKeys([]byte(data), "alice")
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	if keys[0].Name != "alice@laptop" || keys[1].Name != "alice-2" {
+		t.Errorf("names: %q, %q", keys[0].Name, keys[1].Name)
+	}
+	if keys[0].PublicKey != keyMaterial(lines[0]) {
+		t.Errorf("key material: %q", keys[0].PublicKey)
+	}
+}
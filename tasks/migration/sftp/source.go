@@ -0,0 +1,234 @@
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+	gosftp "github.com/pkg/sftp"
+)
+
+// sftpSource is an SFTP server as a MigrationSource. Each user's home
+// directory is migrated into a folder of that user, and SrcIDs are absolute
+// paths on the server.
+type sftpSource struct {
+	*SFTPMigrationTask
+	client *gosftp.Client
+	users  []sftpUser
+}
+
+// sftpUser is a line of the user map.
+type sftpUser struct {
+	login string
+	email string
+	home  string
+}
+
+// Name returns the source name.
+func (S *sftpSource) Name() string {
+	return "SFTP"
+}
+
+// Users returns the users in the user map.
+func (S *sftpSource) Users() (users []MigrationUser, err error) {
+	for _, u := range S.users {
+		users = append(users, MigrationUser{
+			ID:    u.login,
+			Email: u.email,
+			Name:  u.login,
+			Home:  u.home,
+		})
+	}
+	return
+}
+
+// Root returns the user's home directory, which is migrated into the
+// destination folder.
+func (S *sftpSource) Root(user MigrationUser) (SyncFolder, error) {
+	info, err := S.client.Stat(user.Home)
+	if err != nil {
+		return SyncFolder{}, err
+	}
+	if !info.IsDir() {
+		return SyncFolder{}, fmt.Errorf("%s: not a directory", user.Home)
+	}
+	return SyncFolder{
+		Name:     S.dest_folder,
+		SrcID:    user.Home,
+		FullPath: S.dest_folder,
+	}, nil
+}
+
+// entries reads a directory, skipping hidden entries unless enabled, symbolic
+// links and special files.
+func (S *sftpSource) entries(dir string) ([]os.FileInfo, error) {
+	entries, err := S.client.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var output []os.FileInfo
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") && !S.hidden {
+			continue
+		}
+		if e.Mode()&os.ModeSymlink != 0 {
+			Debug("%s: Skipping symbolic link.", path.Join(dir, e.Name()))
+			continue
+		}
+		if !e.IsDir() && !e.Mode().IsRegular() {
+			continue
+		}
+		output = append(output, e)
+	}
+	return output, nil
+}
+
+// Folders returns the subdirectories of a folder.
+func (S *sftpSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	entries, err := S.entries(folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == ".ssh" {
+			continue
+		}
+		folders = append(folders, SyncFolder{
+			Name:     e.Name(),
+			SrcID:    path.Join(folder.SrcID, e.Name()),
+			Modified: e.ModTime(),
+			FullPath: path.Join(folder.FullPath, e.Name()),
+			Owner:    user.Email,
+		})
+	}
+	return
+}
+
+// Files returns the regular files within a folder.
+func (S *sftpSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	entries, err := S.entries(folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		files = append(files, SyncFile{
+			Name:        e.Name(),
+			SrcID:       path.Join(folder.SrcID, e.Name()),
+			Modified:    e.ModTime(),
+			Size:        e.Size(),
+			SrcFolderID: folder.SrcID,
+		})
+	}
+	return
+}
+
+// Members returns nil; home directories are private to their user.
+func (S *sftpSource) Members(user MigrationUser, folder SyncFolder) ([]MigrationMember, error) {
+	return nil, nil
+}
+
+// RoleNames returns nil; no roles are granted.
+func (S *sftpSource) RoleNames() []string {
+	return nil
+}
+
+// Versions returns nil; files are migrated at their current content.
+func (S *sftpSource) Versions(user MigrationUser, file SyncFile) ([]SyncVersion, error) {
+	return nil, nil
+}
+
+// Comments returns nil; files have no comments.
+func (S *sftpSource) Comments(user MigrationUser, file SyncFile) ([]SyncComment, error) {
+	return nil, nil
+}
+
+// Open opens the file on the server.
+func (S *sftpSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	return S.client.Open(file.SrcID)
+}
+
+// UserReady copies the user's authorized_keys to their Kiteworks account,
+// when enabled.
+func (S *sftpSource) UserReady(user MigrationUser, dst *KiteUser) error {
+	if !S.ssh_keys {
+		return nil
+	}
+
+	f, err := S.client.Open(path.Join(user.Home, ".ssh", "authorized_keys"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	keys := parseAuthorizedKeys(data, user.ID)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sess := S.KW.Session(dst.Email)
+	existing, err := sess.MySshPublicKeys()
+	if err != nil {
+		if IsAPIError(err, "ERR_PROFILE_SFTP_DISABLED", "ERR_SYSTEM_ROLE_SFTP_DISABLED", "ERR_ACCESS_USER") {
+			Err("[%s]: SFTP not enabled on Kiteworks — cannot copy SSH keys.", dst.Email)
+			return nil
+		}
+		return err
+	}
+	names := make(map[string]struct{})
+	material := make(map[string]struct{})
+	for _, k := range existing {
+		names[k.Name] = struct{}{}
+		material[keyMaterial(k.PublicKey)] = struct{}{}
+	}
+
+	for _, k := range keys {
+		if _, ok := material[k.PublicKey]; ok {
+			Debug("[%s]: SSH key '%s' already on Kiteworks, skipping.", dst.Email, k.Name)
+			continue
+		}
+		if _, ok := names[k.Name]; ok {
+			Debug("[%s]: An SSH key named '%s' already exists on Kiteworks, skipping.", dst.Email, k.Name)
+			continue
+		}
+		created, err := sess.CreateMySshPublicKey(k.Name, k.PublicKey)
+		if err != nil {
+			if IsAPIError(err, "ERR_SSH_PUBLIC_KEY_EXISTS") {
+				continue
+			}
+			Err("[%s]: Failed to register SSH key '%s': %v", dst.Email, k.Name, err)
+			continue
+		}
+		Log("[%s]: Copied SSH key '%s'.", dst.Email, k.Name)
+		if created.ID > 0 {
+			S.engine.Journal(MigrationJournalEntry{Kind: JournalSSHKey, Owner: strings.ToLower(dst.Email), ID: strconv.Itoa(created.ID), Name: k.Name})
+		}
+		names[k.Name] = struct{}{}
+		material[k.PublicKey] = struct{}{}
+		S.keys_copied.Add(1)
+	}
+	return nil
+}
+
+// keyMaterial returns the key type and data of an authorized key line,
+// without its comment.
+func keyMaterial(public_key string) string {
+	fields := strings.Fields(public_key)
+	if len(fields) > 2 {
+		fields = fields[:2]
+	}
+	return strings.Join(fields, " ")
+}
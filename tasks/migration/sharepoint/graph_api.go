@@ -0,0 +1,365 @@
+package sharepoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// Microsoft Graph and sign-in hosts.
+const (
+	graphServer = "graph.microsoft.com"
+	graphLogin  = "login.microsoftonline.com"
+)
+
+// graphUser is the APIClient username of the app's token.
+const graphUser = "graph_app"
+
+// GraphAPI wraps an APIClient for Microsoft Graph access with an app's client
+// credentials. Requests are made as the app, not as a user.
+type GraphAPI struct {
+	*APIClient
+}
+
+// GraphUser is a user of the tenant.
+type GraphUser struct {
+	ID                string `json:"id"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+	DisplayName       string `json:"displayName"`
+	AccountEnabled    *bool  `json:"accountEnabled"`
+}
+
+// Email returns the user's mail address, or their principal name when they
+// have none.
+func (u GraphUser) Email() string {
+	if !IsBlank(u.Mail) {
+		return strings.ToLower(u.Mail)
+	}
+	return strings.ToLower(u.UserPrincipalName)
+}
+
+// GraphSite is a SharePoint site.
+type GraphSite struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	WebURL      string `json:"webUrl"`
+}
+
+// GraphDrive is a OneDrive or a SharePoint document library.
+type GraphDrive struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	DriveType string `json:"driveType"`
+}
+
+// GraphIdentity is a user, group or SharePoint site group.
+type GraphIdentity struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+	Email       string `json:"email"`
+	LoginName   string `json:"loginName"`
+}
+
+// GraphIdentitySet is who an action was taken by, or a permission granted to.
+type GraphIdentitySet struct {
+	User      *GraphIdentity `json:"user"`
+	SiteUser  *GraphIdentity `json:"siteUser"`
+	Group     *GraphIdentity `json:"group"`
+	SiteGroup *GraphIdentity `json:"siteGroup"`
+}
+
+// GraphItem is a file or folder of a drive.
+type GraphItem struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Created  string    `json:"createdDateTime"`
+	Modified string    `json:"lastModifiedDateTime"`
+	Folder   *struct{} `json:"folder"`
+	File     *struct{} `json:"file"`
+	Package  *struct {
+		Type string `json:"type"`
+	} `json:"package"`
+	FileSystemInfo struct {
+		Created  string `json:"createdDateTime"`
+		Modified string `json:"lastModifiedDateTime"`
+	} `json:"fileSystemInfo"`
+}
+
+// GraphVersion is a version of a file.
+type GraphVersion struct {
+	ID         string           `json:"id"`
+	Modified   string           `json:"lastModifiedDateTime"`
+	Size       int64            `json:"size"`
+	ModifiedBy GraphIdentitySet `json:"lastModifiedBy"`
+}
+
+// GraphPermission is a permission on a file or folder, granted directly, by
+// a sharing link, or inherited from a parent.
+type GraphPermission struct {
+	ID            string             `json:"id"`
+	Roles         []string           `json:"roles"`
+	GrantedTo     *GraphIdentitySet  `json:"grantedToV2"`
+	GrantedToLink []GraphIdentitySet `json:"grantedToIdentitiesV2"`
+	InheritedFrom *struct{}          `json:"inheritedFrom"`
+	Link          *struct {
+		Scope string `json:"scope"`
+	} `json:"link"`
+}
+
+// graphError maps a Graph error to GRAPH_<CODE>; sign-in errors, whose error
+// is a string, map to GRAPH_<ERROR>.
+func graphError(body []byte) (e APIError) {
+	var graph_error struct {
+		Error json.RawMessage `json:"error"`
+		Desc  string          `json:"error_description"`
+	}
+	if json.Unmarshal(body, &graph_error) != nil || len(graph_error.Error) == 0 {
+		return
+	}
+
+	var code string
+	if json.Unmarshal(graph_error.Error, &code) == nil {
+		e.Register(fmt.Sprintf("GRAPH_%s", strings.ToUpper(code)), graph_error.Desc)
+		return
+	}
+
+	var api_error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(graph_error.Error, &api_error)
+	if !IsBlank(api_error.Code) {
+		e.Register(fmt.Sprintf("GRAPH_%s", strings.ToUpper(api_error.Code)), api_error.Message)
+	}
+	return
+}
+
+// readGraphTime parses a Graph timestamp.
+func readGraphTime(input string) (time.Time, error) {
+	if input == NONE {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, input)
+}
+
+// newGraphAPI returns a client of Microsoft Graph at server, signing in to
+// the tenant at login_server with the app's client id and secret.
+func newGraphAPI(server, login_server, tenant_id, client_id, client_secret string) *GraphAPI {
+	api := &GraphAPI{new(APIClient)}
+	api.Server = server
+	api.ErrorScanner = graphError
+	api.TokenErrorCodes = []string{"GRAPH_INVALIDAUTHENTICATIONTOKEN"}
+	// Graph throttles with 429s and 503s; they are retried with the client's
+	// backoff.
+	api.RetryErrorCodes = []string{"GRAPH_TOOMANYREQUESTS", "GRAPH_ACTIVITYLIMITREACHED", "GRAPH_SERVICENOTAVAILABLE", "GRAPH_GENERALEXCEPTION", "HTTP_STATUS_429", "HTTP_STATUS_500", "HTTP_STATUS_503", "HTTP_STATUS_504"}
+	api.ReaquireToken = true
+	api.Retries = 5
+
+	login := &APIClient{Server: login_server, ErrorScanner: graphError}
+	api.NewToken = func(username string) (*Auth, error) {
+		Debug("[sharepoint]: Requesting Graph token.")
+		login.VerifySSL = api.VerifySSL
+		login.ProxyURI = api.ProxyURI
+		login.ConnectTimeout = api.ConnectTimeout
+		login.RequestTimeout = api.RequestTimeout
+		token := new(Auth)
+		err := login.Call(APIRequest{
+			Method: "POST",
+			Path:   fmt.Sprintf("/%s/oauth2/v2.0/token", url.PathEscape(tenant_id)),
+			Params: SetParams(PostForm{
+				"grant_type":    "client_credentials",
+				"client_id":     client_id,
+				"client_secret": client_secret,
+				"scope":         fmt.Sprintf("https://%s/.default", graphServer),
+			}),
+			Output: token,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to request Graph token: %v", err)
+		}
+		token.RefreshToken = NONE
+		token.Expires = time.Now().Add(time.Duration(token.Expires) * time.Second).Unix()
+		return token, nil
+	}
+	return api
+}
+
+// list reads every page of a Graph collection, passing each page's values
+// to page.
+func (G *GraphAPI) list(path string, query Query, page func(values json.RawMessage) error) error {
+	for {
+		var result struct {
+			Values json.RawMessage `json:"value"`
+			Next   string          `json:"@odata.nextLink"`
+		}
+		err := G.Call(APIRequest{
+			Username: graphUser,
+			Method:   "GET",
+			Path:     path,
+			Params:   SetParams(query),
+			Output:   &result,
+		})
+		if err != nil {
+			return err
+		}
+		if len(result.Values) > 0 {
+			if err = page(result.Values); err != nil {
+				return err
+			}
+		}
+		if IsBlank(result.Next) {
+			return nil
+		}
+		next, err := url.Parse(result.Next)
+		if err != nil {
+			return err
+		}
+		path, query = next.RequestURI(), nil
+	}
+}
+
+// get reads a single Graph object.
+func (G *GraphAPI) get(path string, query Query, output interface{}) error {
+	return G.Call(APIRequest{
+		Username: graphUser,
+		Method:   "GET",
+		Path:     path,
+		Params:   SetParams(query),
+		Output:   output,
+	})
+}
+
+// Users returns the users of the tenant.
+func (G *GraphAPI) Users() (users []GraphUser, err error) {
+	err = G.list("/v1.0/users", Query{"$select": "id,mail,userPrincipalName,displayName,accountEnabled", "$top": 999}, func(values json.RawMessage) error {
+		var page []GraphUser
+		err := json.Unmarshal(values, &page)
+		users = append(users, page...)
+		return err
+	})
+	return
+}
+
+// GroupMembers returns the emails of a group's user members.
+func (G *GraphAPI) GroupMembers(group_id string) (emails []string, err error) {
+	err = G.list(fmt.Sprintf("/v1.0/groups/%s/members", group_id), Query{"$select": "id,mail,userPrincipalName"}, func(values json.RawMessage) error {
+		var page []GraphUser
+		err := json.Unmarshal(values, &page)
+		for _, u := range page {
+			if email := u.Email(); !IsBlank(email) {
+				emails = append(emails, email)
+			}
+		}
+		return err
+	})
+	return
+}
+
+// UserDrive returns a user's OneDrive.
+func (G *GraphAPI) UserDrive(user_id string) (drive GraphDrive, err error) {
+	err = G.get(fmt.Sprintf("/v1.0/users/%s/drive", user_id), nil, &drive)
+	return
+}
+
+// Site returns a SharePoint site by its URL, such as
+// contoso.sharepoint.com/sites/Finance; the scheme is optional.
+func (G *GraphAPI) Site(site_url string) (site GraphSite, err error) {
+	host := strings.TrimPrefix(strings.TrimPrefix(site_url, "https://"), "http://")
+	var path string
+	if i := strings.Index(host, "/"); i >= 0 {
+		host, path = host[:i], strings.Trim(host[i:], "/")
+	}
+	if IsBlank(path) {
+		err = G.get(fmt.Sprintf("/v1.0/sites/%s", host), nil, &site)
+	} else {
+		err = G.get(fmt.Sprintf("/v1.0/sites/%s:/%s", host, path), nil, &site)
+	}
+	return
+}
+
+// Libraries returns the document libraries of a site.
+func (G *GraphAPI) Libraries(site_id string) (drives []GraphDrive, err error) {
+	err = G.list(fmt.Sprintf("/v1.0/sites/%s/drives", site_id), nil, func(values json.RawMessage) error {
+		var page []GraphDrive
+		err := json.Unmarshal(values, &page)
+		for _, d := range page {
+			if d.DriveType == "documentLibrary" {
+				drives = append(drives, d)
+			}
+		}
+		return err
+	})
+	return
+}
+
+// Children returns the children of a folder.
+func (G *GraphAPI) Children(drive_id, item_id string) (items []GraphItem, err error) {
+	err = G.list(fmt.Sprintf("/v1.0/drives/%s/items/%s/children", drive_id, item_id), Query{"$top": 999}, func(values json.RawMessage) error {
+		var page []GraphItem
+		err := json.Unmarshal(values, &page)
+		items = append(items, page...)
+		return err
+	})
+	return
+}
+
+// Versions returns the versions of a file, newest first.
+func (G *GraphAPI) Versions(drive_id, item_id string) (versions []GraphVersion, err error) {
+	err = G.list(fmt.Sprintf("/v1.0/drives/%s/items/%s/versions", drive_id, item_id), nil, func(values json.RawMessage) error {
+		var page []GraphVersion
+		err := json.Unmarshal(values, &page)
+		versions = append(versions, page...)
+		return err
+	})
+	return
+}
+
+// Permissions returns the permissions on a file or folder.
+func (G *GraphAPI) Permissions(drive_id, item_id string) (perms []GraphPermission, err error) {
+	err = G.list(fmt.Sprintf("/v1.0/drives/%s/items/%s/permissions", drive_id, item_id), nil, func(values json.RawMessage) error {
+		var page []GraphPermission
+		err := json.Unmarshal(values, &page)
+		perms = append(perms, page...)
+		return err
+	})
+	return
+}
+
+// Download returns the content of a file, or of one of its versions when
+// version_id is not blank. Graph redirects to a pre-authenticated URL.
+func (G *GraphAPI) Download(drive_id, item_id, version_id string) (ReadSeekCloser, error) {
+	path := fmt.Sprintf("/v1.0/drives/%s/items/%s/content", drive_id, item_id)
+	if !IsBlank(version_id) {
+		path = fmt.Sprintf("/v1.0/drives/%s/items/%s/versions/%s/content", drive_id, item_id, version_id)
+	}
+	req, err := G.NewRequest("GET", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = G.SetToken(graphUser, req); err != nil {
+		return nil, err
+	}
+	return G.WebDownload(req), nil
+}
+
+// MapGraphRole maps a Graph permission role to the name of the Kiteworks
+// role granted by default; "" grants no access.
+func MapGraphRole(role string) string {
+	switch role {
+	case "owner":
+		return "Manager"
+	case "write":
+		return "Collaborator"
+	case "read":
+		return "Viewer"
+	default:
+		return NONE
+	}
+}
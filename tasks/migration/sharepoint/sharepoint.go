@@ -0,0 +1,201 @@
+package sharepoint
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterMigrationTask(new(SharePointMigrationTask)) }
+
+// SharePointMigrationTask migrates OneDrive accounts and SharePoint document
+// libraries to Kiteworks through Microsoft Graph.
+type SharePointMigrationTask struct {
+	KiteBrokerTask
+	sp_db               Database
+	sp_config           Table
+	tenant_id           string
+	client_id           string
+	client_secret       string
+	api                 *GraphAPI
+	target_profile_name string
+	user_emails         []string
+	sites               []string
+	libraries           []string
+	site_owner          string
+	report              bool
+	preflight           string
+	max_file_size       int
+	verify              string
+	requeue             bool
+	rollback            string
+	max_versions        int
+	dry_run             bool
+	status              bool
+	retry_failed        bool
+	mapping_file        string
+	mapping             *MigrationMapping
+	limits              MigrationLimits
+	map_groups          bool
+}
+
+// Name returns the name of this task.
+func (T *SharePointMigrationTask) Name() string {
+	return "sharepoint"
+}
+
+// Desc returns a description of this task.
+func (T *SharePointMigrationTask) Desc() string {
+	return "Migrate users, OneDrives, SharePoint libraries, files, versions and permissions from Microsoft 365 to Kiteworks."
+}
+
+// Init parses the flags and loads the stored Graph app credentials.
+func (T *SharePointMigrationTask) Init() (err error) {
+	T.sp_db = T.DB.Sub("sharepoint")
+	T.sp_config = T.sp_db.Table("sharepoint_config")
+	T.sp_config.Get("tenant_id", &T.tenant_id)
+	T.sp_config.Get("client_id", &T.client_id)
+	T.sp_config.Get("client_secret", &T.client_secret)
+
+	setup := T.Flags.Bool("setup", "Configure Microsoft Graph Connection")
+	T.Flags.StringVar(&T.target_profile_name, "profile", "Standard", "Destination profile for migrated users. (Needs permission to create folders)")
+	T.Flags.StringVar(&T.mapping_file, "mapping", "<mapping.csv>", "CSV or YAML file remapping users, groups, folder paths and roles.")
+	T.Flags.BoolVar(&T.map_groups, "map_groups", "Grant source groups as the Kiteworks groups of the same name instead of their members.")
+	T.Flags.MultiVar(&T.user_emails, "users", "<user@domain.com>", "User(s) to migrate.")
+	T.Flags.MultiVar(&T.sites, "sites", "<contoso.sharepoint.com/sites/name>", "SharePoint site(s) to migrate.")
+	T.Flags.MultiVar(&T.libraries, "libraries", "<library>", "Document libraries of the sites to migrate. (default: all)")
+	T.Flags.StringVar(&T.site_owner, "site_owner", "<user@domain.com>", "Owner of the migrated SharePoint sites.")
+	migrate := T.Flags.Bool("migrate", "Perform the actual migration.")
+	T.Flags.BoolVar(&T.report, "report", "Generate a report of OneDrive and SharePoint users, folders and files.")
+	T.Flags.StringVar(&T.preflight, "preflight", "<findings.csv>", "Check the source and destination for problems, writing findings to a CSV or JSON file.")
+	T.Flags.IntVar(&T.max_file_size, "max_file_size", 0, "Largest file (MB) the destination accepts, checked by --preflight.")
+	T.Flags.StringVar(&T.verify, "verify", "<discrepancies.csv>", "Compare the migrated users with the source, writing discrepancies to a CSV or JSON file.")
+	T.Flags.BoolVar(&T.requeue, "requeue", "With --verify, re-queue mismatched folders and files for the next --migrate.")
+	T.Flags.IntVar(&T.max_versions, "max_versions", 0, "Copy at most this many of each file's newest versions. (0 copies all)")
+	T.Flags.StringVar(&T.rollback, "rollback", "<run id>", "Undo the users, folders, files, grants and keys created on Kiteworks by a migration run.")
+	T.Flags.BoolVar(&T.dry_run, "dry_run", "With --rollback, log what would be undone without changing anything.")
+	T.Flags.BoolVar(&T.status, "status", "Show each user's migration state, with throughput and an ETA.")
+	T.Flags.BoolVar(&T.retry_failed, "retry_failed", "With --migrate, migrate only the users whose last migration failed.")
+	T.limits.RegisterFlags(&T.Flags)
+	T.Flags.Order("migrate", "report", "preflight", "verify", "rollback", "status")
+	if err := T.Flags.Parse(); err != nil {
+		return err
+	}
+	if err := T.limits.Validate(); err != nil {
+		return err
+	}
+
+	if *setup || IsBlank(T.tenant_id) || IsBlank(T.client_id) || IsBlank(T.client_secret) {
+		T.configureGraph()
+	}
+
+	if !IsBlank(T.mapping_file) {
+		mapping, err := LoadMigrationMapping(T.mapping_file)
+		if err != nil {
+			return err
+		}
+		T.mapping = mapping
+	}
+
+	var modes int
+	for _, m := range []bool{*migrate, T.report, !IsBlank(T.preflight), !IsBlank(T.verify), !IsBlank(T.rollback), T.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("--migrate, --report, --preflight, --verify, --rollback and --status are mutually exclusive, please specify only one")
+	}
+	if modes == 0 {
+		return fmt.Errorf("must specify either --migrate, --report, --preflight, --verify, --rollback or --status")
+	}
+	if T.requeue && IsBlank(T.verify) {
+		return fmt.Errorf("--requeue requires --verify")
+	}
+	if T.dry_run && IsBlank(T.rollback) {
+		return fmt.Errorf("--dry_run requires --rollback")
+	}
+	if T.retry_failed && !*migrate {
+		return fmt.Errorf("--retry_failed requires --migrate")
+	}
+	if len(T.libraries) > 0 && len(T.sites) == 0 {
+		return fmt.Errorf("--libraries requires --sites")
+	}
+	if len(T.sites) > 0 && IsBlank(T.site_owner) {
+		return fmt.Errorf("--sites requires --site_owner")
+	}
+	T.site_owner = strings.ToLower(T.site_owner)
+	return nil
+}
+
+// configureGraph prompts for the app registration's credentials, saves them
+// and exits.
+func (T *SharePointMigrationTask) configureGraph() {
+	graph_auth := NewOptions("--- Microsoft Graph Configuration ---", "(selection or 'q' to save & exit)", 'q')
+	graph_auth.StringVar(&T.tenant_id, "Tenant ID", T.tenant_id, "Please input the Microsoft 365 tenant id or domain.")
+	graph_auth.StringVar(&T.client_id, "Client ID", T.client_id, "Please input the app registration's client id.")
+	graph_auth.SecretVar(&T.client_secret, "Client Secret", T.client_secret, "Please input the app registration's client secret.")
+	if graph_auth.Select(false) {
+		T.sp_config.Set("tenant_id", &T.tenant_id)
+		T.sp_config.Set("client_id", &T.client_id)
+		T.sp_config.CryptSet("client_secret", &T.client_secret)
+	}
+	Exit(0)
+}
+
+// configure_api creates and configures the Graph API client.
+func (T *SharePointMigrationTask) configure_api() {
+	T.api = newGraphAPI(graphServer, graphLogin, T.tenant_id, T.client_id, T.client_secret)
+	T.api.VerifySSL = true
+	T.api.ProxyURI = T.KW.ProxyURI
+	T.sp_db.Drop("tokens")
+
+	T.api.SetDatabase(T.sp_db)
+	T.api.MaxChunkSize = T.KW.MaxChunkSize
+	T.api.SetLimiter(T.KW.GetLimit())
+	T.api.SetTransferLimiter(T.KW.GetTransferLimit())
+	T.api.RequestTimeout = T.KW.RequestTimeout
+	T.api.ConnectTimeout = T.KW.ConnectTimeout
+}
+
+// Main runs the SharePoint report, migration, preflight or verification.
+func (T *SharePointMigrationTask) Main() (err error) {
+	if !IsBlank(T.rollback) {
+		return RollbackMigration(&T.KiteBrokerTask, T.sp_db, T.rollback, T.dry_run)
+	}
+	T.configure_api()
+
+	source := &sharepointSource{
+		api:        T.api,
+		site_urls:  T.sites,
+		libraries:  T.libraries,
+		site_owner: T.site_owner,
+	}
+
+	engine := NewMigrationEngine(&T.KiteBrokerTask, source, T.sp_db)
+	engine.Users = T.user_emails
+	engine.Mapping = T.mapping
+	engine.Limits = T.limits
+	engine.RetryFailed = T.retry_failed
+	engine.MapGroups = T.map_groups
+	engine.MaxVersions = T.max_versions
+
+	if T.status {
+		return engine.RunStatus()
+	}
+	if T.report {
+		return engine.RunReport()
+	}
+	if !IsBlank(T.verify) {
+		return engine.RunVerify(T.verify, T.requeue)
+	}
+	if err := engine.SetProfile(T.target_profile_name); err != nil {
+		return err
+	}
+	if !IsBlank(T.preflight) {
+		engine.Preflight.MaxFileSize = int64(T.max_file_size) * 1024 * 1024
+		return engine.RunPreflight(T.preflight)
+	}
+	return engine.Run()
+}
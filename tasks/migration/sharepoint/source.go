@@ -0,0 +1,382 @@
+package sharepoint
+
+import (
+	"strings"
+	"sync"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// sitesID is the source user id holding the SharePoint sites, when their
+// owner is not a tenant user.
+const sitesID = "sharepoint_sites"
+
+// Prefixes of the SrcIDs of site folders, and of SharePoint site groups.
+const (
+	sitePrefix      = "site:"
+	siteGroupPrefix = "sitegroup:"
+)
+
+// spSite is a selected SharePoint site and its selected libraries.
+type spSite struct {
+	GraphSite
+	libraries []GraphDrive
+}
+
+// sharepointSource is the Microsoft 365 MigrationSource. Each user's
+// OneDrive is migrated to them; the selected sites are migrated to
+// site_owner, below their root, with a folder per site holding a folder per
+// document library.
+//
+// Drive objects have SrcIDs of the drive's id and the item's, so they can be
+// read from any drive. A folder's listing is held until the walk has read its
+// files and subfolders, rather than requested twice.
+type sharepointSource struct {
+	api        *GraphAPI
+	site_urls  []string
+	libraries  []string // Library names to migrate; all when empty.
+	site_owner string
+	accounts   map[string]string   // User emails, by id.
+	sites      []spSite            // Selected sites.
+	library    map[string]struct{} // Selected library drive ids.
+	newest     sync.Map            // Id of each file's newest version, by SrcID.
+	listings   sync.Map
+}
+
+// Name returns the source name.
+func (S *sharepointSource) Name() string {
+	return "SharePoint"
+}
+
+// Users returns the enabled tenant users, and the sites' owner when they are
+// not one. The selected sites and libraries are resolved.
+func (S *sharepointSource) Users() (users []MigrationUser, err error) {
+	tenant, err := S.api.Users()
+	if err != nil {
+		return nil, err
+	}
+	S.accounts = make(map[string]string)
+	var has_owner bool
+	for _, u := range tenant {
+		email := u.Email()
+		S.accounts[u.ID] = email
+		if u.AccountEnabled != nil && !*u.AccountEnabled {
+			continue
+		}
+		if email == S.site_owner {
+			has_owner = true
+		}
+		users = append(users, MigrationUser{ID: u.ID, Email: email, Name: u.DisplayName})
+	}
+
+	wanted := make(map[string]struct{})
+	for _, name := range S.libraries {
+		wanted[strings.ToLower(name)] = struct{}{}
+	}
+	S.sites = nil
+	S.library = make(map[string]struct{})
+	for _, site_url := range S.site_urls {
+		site, err := S.api.Site(site_url)
+		if err != nil {
+			return nil, err
+		}
+		libraries, err := S.api.Libraries(site.ID)
+		if err != nil {
+			return nil, err
+		}
+		s := spSite{GraphSite: site}
+		for _, l := range libraries {
+			if _, ok := wanted[strings.ToLower(l.Name)]; len(wanted) > 0 && !ok {
+				continue
+			}
+			s.libraries = append(s.libraries, l)
+			S.library[l.ID] = struct{}{}
+		}
+		S.sites = append(S.sites, s)
+	}
+	if len(S.sites) > 0 && !has_owner {
+		users = append(users, MigrationUser{ID: sitesID, Email: S.site_owner, Name: "SharePoint Sites"})
+	}
+	return users, nil
+}
+
+// splitID returns the drive and item ids of a SrcID.
+func splitID(src_id string) (drive_id, item_id string) {
+	if i := strings.Index(src_id, "|"); i >= 0 {
+		return src_id[:i], src_id[i+1:]
+	}
+	return NONE, src_id
+}
+
+// listing returns the children of a folder, from the cache when it is held.
+func (S *sharepointSource) listing(src_id string) ([]GraphItem, error) {
+	if items, ok := S.listings.Load(src_id); ok {
+		return items.([]GraphItem), nil
+	}
+	drive_id, item_id := splitID(src_id)
+	items, err := S.api.Children(drive_id, item_id)
+	if err != nil {
+		return nil, err
+	}
+	S.listings.Store(src_id, items)
+	return items, nil
+}
+
+// Root returns the user's OneDrive, migrated into a folder of that name.
+func (S *sharepointSource) Root(user MigrationUser) (SyncFolder, error) {
+	if user.ID == sitesID {
+		return SyncFolder{Name: "SharePoint Sites", SrcID: sitesID}, nil
+	}
+	drive, err := S.api.UserDrive(user.ID)
+	if err != nil {
+		return SyncFolder{}, err
+	}
+	return SyncFolder{Name: "OneDrive", SrcID: drive.ID + "|root", FullPath: "OneDrive", Owner: user.Email}, nil
+}
+
+// Folders returns the subfolders of a folder: at the root of the sites'
+// owner, the sites, and within a site, its libraries. OneNote notebooks are
+// skipped.
+func (S *sharepointSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	_, item_id := splitID(folder.SrcID)
+	if folder.SrcID == sitesID || (item_id == "root" && user.Email == S.site_owner && !S.isLibrary(folder.SrcID)) {
+		for _, s := range S.sites {
+			folders = append(folders, SyncFolder{
+				Name:     s.DisplayName,
+				SrcID:    sitePrefix + s.ID,
+				FullPath: s.DisplayName,
+				Owner:    S.site_owner,
+			})
+		}
+		if folder.SrcID == sitesID {
+			return folders, nil
+		}
+	}
+	if strings.HasPrefix(folder.SrcID, sitePrefix) {
+		for _, s := range S.sites {
+			if sitePrefix+s.ID != folder.SrcID {
+				continue
+			}
+			for _, l := range s.libraries {
+				folders = append(folders, SyncFolder{
+					Name:     l.Name,
+					SrcID:    l.ID + "|root",
+					FullPath: folder.FullPath + "/" + l.Name,
+					Owner:    folder.Owner,
+				})
+			}
+		}
+		return folders, nil
+	}
+
+	items, err := S.listing(folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	drive_id, _ := splitID(folder.SrcID)
+	for _, i := range items {
+		if i.Package != nil {
+			Log("[%s]: Skipping %s/%s, a %s package.", user.Email, folder.FullPath, i.Name, i.Package.Type)
+			continue
+		}
+		if i.Folder == nil {
+			continue
+		}
+		created, _ := readGraphTime(i.FileSystemInfo.Created)
+		modified, _ := readGraphTime(i.FileSystemInfo.Modified)
+		folders = append(folders, SyncFolder{
+			Name:     i.Name,
+			SrcID:    drive_id + "|" + i.ID,
+			FullPath: strings.TrimPrefix(folder.FullPath+"/"+i.Name, "/"),
+			Owner:    folder.Owner,
+			Created:  created,
+			Modified: modified,
+		})
+	}
+	return
+}
+
+// Release drops the folder's held listing.
+func (S *sharepointSource) Release(user MigrationUser, folder SyncFolder) {
+	S.listings.Delete(folder.SrcID)
+}
+
+// isLibrary reports whether src_id is the root of a selected library.
+func (S *sharepointSource) isLibrary(src_id string) bool {
+	drive_id, item_id := splitID(src_id)
+	_, ok := S.library[drive_id]
+	return ok && item_id == "root"
+}
+
+// Files returns the files within a folder.
+func (S *sharepointSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	if folder.SrcID == sitesID || strings.HasPrefix(folder.SrcID, sitePrefix) {
+		return nil, nil
+	}
+	items, err := S.listing(folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	drive_id, _ := splitID(folder.SrcID)
+	for _, i := range items {
+		if i.File == nil || i.Package != nil {
+			continue
+		}
+		created, _ := readGraphTime(i.FileSystemInfo.Created)
+		modified, _ := readGraphTime(i.FileSystemInfo.Modified)
+		files = append(files, SyncFile{
+			Name:        i.Name,
+			SrcID:       drive_id + "|" + i.ID,
+			SrcFolderID: folder.SrcID,
+			Created:     created,
+			Modified:    modified,
+			Size:        i.Size,
+		})
+	}
+	return
+}
+
+// Members returns the users and groups granted access to a folder directly
+// or by a sharing link for specific people. Inherited permissions, and links
+// open to the organization or anyone, are skipped.
+func (S *sharepointSource) Members(user MigrationUser, folder SyncFolder) (members []MigrationMember, err error) {
+	drive_id, item_id := splitID(folder.SrcID)
+	if IsBlank(drive_id) || (item_id == "root" && !S.isLibrary(folder.SrcID)) {
+		return nil, nil
+	}
+	perms, err := S.api.Permissions(drive_id, item_id)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range perms {
+		if p.InheritedFrom != nil {
+			continue
+		}
+		role := graphRole(p.Roles)
+		var grantees []GraphIdentitySet
+		switch {
+		case p.Link != nil && p.Link.Scope != "users":
+			Debug("[%s]: %s - Skipping %s sharing link.", user.Email, folder.FullPath, p.Link.Scope)
+			continue
+		case p.Link != nil:
+			grantees = p.GrantedToLink
+		case p.GrantedTo != nil:
+			grantees = []GraphIdentitySet{*p.GrantedTo}
+		}
+		for _, g := range grantees {
+			if m, ok := S.member(g); ok {
+				m.Role, m.SourceRole = MapGraphRole(role), role
+				members = append(members, m)
+			}
+		}
+	}
+	return
+}
+
+// RoleNames returns the roles MapGraphRole grants.
+func (S *sharepointSource) RoleNames() []string {
+	return []string{"Manager", "Collaborator", "Viewer"}
+}
+
+// graphRole returns the greatest of a permission's roles.
+func graphRole(roles []string) (role string) {
+	rank := map[string]int{"read": 1, "write": 2, "owner": 3}
+	for _, r := range roles {
+		if rank[r] > rank[role] {
+			role = r
+		}
+	}
+	return
+}
+
+// member returns the member a permission is granted to: a site group, a
+// group or a user.
+func (S *sharepointSource) member(grantee GraphIdentitySet) (MigrationMember, bool) {
+	switch {
+	case grantee.SiteGroup != nil:
+		return MigrationMember{Group: grantee.SiteGroup.DisplayName, GroupID: siteGroupPrefix + grantee.SiteGroup.ID}, true
+	case grantee.Group != nil:
+		return MigrationMember{Group: grantee.Group.DisplayName, GroupID: grantee.Group.ID}, true
+	}
+	var email string
+	if grantee.SiteUser != nil {
+		email = grantee.SiteUser.Email
+	}
+	if grantee.User != nil {
+		if IsBlank(email) {
+			email = grantee.User.Email
+		}
+		if IsBlank(email) {
+			email = S.accounts[grantee.User.ID]
+		}
+	}
+	if IsBlank(email) {
+		return MigrationMember{}, false
+	}
+	return MigrationMember{User: strings.ToLower(email)}, true
+}
+
+// GroupMembers returns the emails of a Microsoft 365 or security group's
+// members. Graph cannot list the members of SharePoint site groups; they
+// are only granted when mapped to a Kiteworks group, and pre-flight reports
+// those that are not.
+func (S *sharepointSource) GroupMembers(user MigrationUser, group_id string) ([]string, error) {
+	if strings.HasPrefix(group_id, siteGroupPrefix) {
+		return nil, ErrGroupNotExpandable
+	}
+	return S.api.GroupMembers(group_id)
+}
+
+// Versions returns the file's versions, oldest first, uploaded as the user
+// who last modified each.
+func (S *sharepointSource) Versions(user MigrationUser, file SyncFile) (versions []SyncVersion, err error) {
+	drive_id, item_id := splitID(file.SrcID)
+	graph_versions, err := S.api.Versions(drive_id, item_id)
+	if err != nil {
+		return nil, err
+	}
+	if len(graph_versions) > 0 {
+		S.newest.Store(file.SrcID, graph_versions[0].ID)
+	}
+	for i := len(graph_versions) - 1; i >= 0; i-- {
+		v := graph_versions[i]
+		modified, _ := readGraphTime(v.Modified)
+		var uploader string
+		if u := v.ModifiedBy.User; u != nil {
+			uploader = strings.ToLower(u.Email)
+			if IsBlank(uploader) {
+				uploader = S.accounts[u.ID]
+			}
+		}
+		versions = append(versions, SyncVersion{
+			SrcID:    v.ID,
+			Ver:      len(versions) + 1,
+			Name:     file.Name,
+			Created:  modified,
+			Modified: modified,
+			Size:     v.Size,
+			Uploader: uploader,
+		})
+	}
+	// The newest version carries the file's own times.
+	if n := len(versions); n > 0 {
+		versions[n-1].Modified = file.Modified
+	}
+	return
+}
+
+// Comments returns nil; SharePoint comments are not available through Graph.
+func (S *sharepointSource) Comments(user MigrationUser, file SyncFile) ([]SyncComment, error) {
+	return nil, nil
+}
+
+// Open downloads a version of the file; the newest is downloaded as the
+// file's current content.
+func (S *sharepointSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	drive_id, item_id := splitID(file.SrcID)
+	version_id := version.SrcID
+	if newest, ok := S.newest.Load(file.SrcID); (ok && newest.(string) == version_id) || version_id == file.SrcID {
+		version_id = NONE
+	}
+	return S.api.Download(drive_id, item_id, version_id)
+}
@@ -0,0 +1,239 @@
+package webdav
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// webdavSource is a WebDAV server as a MigrationSource. Each user's home
+// collection is migrated into a folder of that user, and SrcIDs are
+// unescaped absolute paths on the server. Nextcloud shares are read through
+// the OCS share API when the server has one.
+type webdavSource struct {
+	*WebDAVMigrationTask
+	users  []webdavUser
+	logins map[string]string // Login to Kiteworks user.
+	shares sync.Map          // Login to the user's shares, by path.
+}
+
+// webdavUser is a line of the user map.
+type webdavUser struct {
+	login    string
+	email    string
+	password string
+	home     string
+}
+
+// Name returns the source name.
+func (S *webdavSource) Name() string {
+	return "WebDAV"
+}
+
+// Users returns the users in the user map.
+func (S *webdavSource) Users() (users []MigrationUser, err error) {
+	for _, u := range S.users {
+		users = append(users, MigrationUser{
+			ID:    u.login,
+			Email: u.email,
+			Name:  u.login,
+			Home:  u.home,
+		})
+	}
+	return
+}
+
+// creds returns the credentials a user's files are read with: their own app
+// password when mapped, otherwise the configured account.
+func (S *webdavSource) creds(user MigrationUser) WebDAVCredentials {
+	for _, u := range S.users {
+		if u.login == user.ID && !IsBlank(u.password) {
+			return WebDAVCredentials{Username: u.login, Password: u.password}
+		}
+	}
+	return S.account
+}
+
+// Root returns the user's home collection, which is migrated into the
+// destination folder.
+func (S *webdavSource) Root(user MigrationUser) (SyncFolder, error) {
+	if err := S.api.Stat(S.creds(user), user.Home); err != nil {
+		return SyncFolder{}, err
+	}
+	return SyncFolder{
+		Name:     S.dest_folder,
+		SrcID:    user.Home,
+		FullPath: S.dest_folder,
+	}, nil
+}
+
+// entries lists a collection, skipping hidden entries unless enabled.
+func (S *webdavSource) entries(user MigrationUser, dir string) ([]WebDAVEntry, error) {
+	entries, err := S.api.List(S.creds(user), dir)
+	if err != nil {
+		return nil, err
+	}
+	var output []WebDAVEntry
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name, ".") && !S.hidden {
+			continue
+		}
+		output = append(output, e)
+	}
+	return output, nil
+}
+
+// Folders returns the subcollections of a folder.
+func (S *webdavSource) Folders(user MigrationUser, folder SyncFolder) (folders []SyncFolder, err error) {
+	entries, err := S.entries(user, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.Collection {
+			continue
+		}
+		folders = append(folders, SyncFolder{
+			Name:     e.Name,
+			SrcID:    e.Path,
+			Modified: e.Modified,
+			FullPath: path.Join(folder.FullPath, e.Name),
+			Owner:    user.Email,
+		})
+	}
+	return
+}
+
+// Files returns the files within a folder, dated by getlastmodified.
+func (S *webdavSource) Files(user MigrationUser, folder SyncFolder) (files []SyncFile, err error) {
+	entries, err := S.entries(user, folder.SrcID)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Collection {
+			continue
+		}
+		files = append(files, SyncFile{
+			Name:        e.Name,
+			SrcID:       e.Path,
+			Modified:    e.Modified,
+			Size:        e.Size,
+			SrcFolderID: folder.SrcID,
+		})
+	}
+	return
+}
+
+// userShares returns the folder shares made by a user, keyed by their path
+// relative to the user's home.
+func (S *webdavSource) userShares(user MigrationUser) (map[string][]WebDAVShare, error) {
+	if cached, ok := S.shares.Load(user.ID); ok {
+		return cached.(map[string][]WebDAVShare), nil
+	}
+	shares, err := S.api.Shares(S.creds(user))
+	if err != nil {
+		return nil, err
+	}
+	by_path := make(map[string][]WebDAVShare)
+	for _, s := range shares {
+		if s.ItemType != "folder" {
+			Debug("[%s]: Skipping share of file %s; only folders are shared on Kiteworks.", user.Email, s.Path)
+			continue
+		}
+		p := path.Clean("/" + s.Path)
+		by_path[p] = append(by_path[p], s)
+	}
+	S.shares.Store(user.ID, by_path)
+	return by_path, nil
+}
+
+// Members returns the user and group shares of a folder. Shares are read as
+// the folder's owner, so they are only found for users mapped with their own
+// app password.
+func (S *webdavSource) Members(user MigrationUser, folder SyncFolder) (members []MigrationMember, err error) {
+	by_path, err := S.userShares(user)
+	if err != nil {
+		return nil, err
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(folder.SrcID, user.Home))
+	for _, s := range by_path[rel] {
+		role := MapSharePermissions(s.Permissions)
+		if IsBlank(role) {
+			continue
+		}
+		member := MigrationMember{
+			Role:       role,
+			SourceRole: strconv.Itoa(s.Permissions),
+		}
+		switch s.ShareType {
+		case shareUser:
+			member.User = S.userEmail(s.ShareWith)
+			if IsBlank(member.User) {
+				Notice("[%s]: %s is shared with '%s', who is not in the user map; skipping.", user.Email, folder.FullPath, s.ShareWith)
+				continue
+			}
+		case shareEmail:
+			member.User = strings.ToLower(s.ShareWith)
+		case shareGroup:
+			member.Group = s.ShareWith
+			member.GroupID = s.ShareWith
+		default:
+			continue
+		}
+		members = append(members, member)
+	}
+	return
+}
+
+// userEmail returns the Kiteworks user of a login, or the login itself when
+// it is an email address.
+func (S *webdavSource) userEmail(login string) string {
+	if email, ok := S.logins[login]; ok {
+		return email
+	}
+	if strings.Contains(login, "@") {
+		return strings.ToLower(login)
+	}
+	return NONE
+}
+
+// GroupMembers returns the users of a Nextcloud group, read through the OCS
+// provisioning API as the configured account, which must be an admin.
+func (S *webdavSource) GroupMembers(user MigrationUser, group_id string) (emails []string, err error) {
+	logins, err := S.api.GroupUsers(S.account, group_id)
+	if err != nil {
+		return nil, err
+	}
+	for _, login := range logins {
+		if email := S.userEmail(login); !IsBlank(email) {
+			emails = append(emails, email)
+		} else {
+			Notice("[%s]: Group '%s' member '%s' is not in the user map; skipping.", user.Email, group_id, login)
+		}
+	}
+	return
+}
+
+// RoleNames returns the roles MapSharePermissions grants.
+func (S *webdavSource) RoleNames() []string {
+	return []string{"Collaborator", "Uploader", "Viewer"}
+}
+
+// Versions returns nil; files are migrated at their current content.
+func (S *webdavSource) Versions(user MigrationUser, file SyncFile) ([]SyncVersion, error) {
+	return nil, nil
+}
+
+// Comments returns nil; comments are not read over WebDAV.
+func (S *webdavSource) Comments(user MigrationUser, file SyncFile) ([]SyncComment, error) {
+	return nil, nil
+}
+
+// Open downloads the file from the server.
+func (S *webdavSource) Open(user MigrationUser, file SyncFile, version SyncVersion) (ReadSeekCloser, error) {
+	return S.api.Download(S.creds(user), file.SrcID)
+}
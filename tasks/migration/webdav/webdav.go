@@ -0,0 +1,247 @@
+package webdav
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+func init() { RegisterMigrationTask(new(WebDAVMigrationTask)) }
+
+// WebDAVMigrationTask migrates user home collections from a WebDAV server,
+// such as Nextcloud, to Kiteworks.
+type WebDAVMigrationTask struct {
+	KiteBrokerTask
+	webdav_db           Database
+	webdav_config       Table
+	server              string
+	account             WebDAVCredentials
+	home_root           string
+	api                 *WebDAVAPI
+	user_map            string
+	dest_folder         string
+	target_profile_name string
+	user_emails         []string
+	hidden              bool
+	report              bool
+	preflight           string
+	max_file_size       int
+	rollback            string
+	dry_run             bool
+	status              bool
+	retry_failed        bool
+	mapping_file        string
+	mapping             *MigrationMapping
+	limits              MigrationLimits
+	map_groups          bool
+}
+
+// Name returns the name of this task.
+func (T *WebDAVMigrationTask) Name() string {
+	return "webdav"
+}
+
+// Desc returns a description of this task.
+func (T *WebDAVMigrationTask) Desc() string {
+	return "Migrate user files, folders and Nextcloud shares from a WebDAV server to Kiteworks."
+}
+
+// Init parses the flags and loads the stored WebDAV connection.
+func (T *WebDAVMigrationTask) Init() (err error) {
+	T.webdav_db = T.DB.Sub("webdav")
+	T.webdav_config = T.webdav_db.Table("webdav_config")
+	T.webdav_config.Get("server", &T.server)
+	T.webdav_config.Get("username", &T.account.Username)
+	T.webdav_config.Get("password", &T.account.Password)
+	T.webdav_config.Get("home_root", &T.home_root)
+	if IsBlank(T.home_root) {
+		T.home_root = "/remote.php/dav/files"
+	}
+
+	setup := T.Flags.Bool("setup", "Configure WebDAV Connection")
+	T.Flags.StringVar(&T.user_map, "user_map", "<users.csv>", "CSV mapping WebDAV logins to Kiteworks users. (login,user[,app password])")
+	T.Flags.StringVar(&T.dest_folder, "dest_folder", "WebDAV", "Kiteworks folder to migrate each home collection into.")
+	T.Flags.StringVar(&T.target_profile_name, "profile", "Standard", "Destination profile for migrated users. (Needs permission to create folders)")
+	T.Flags.StringVar(&T.mapping_file, "mapping", "<mapping.csv>", "CSV or YAML file remapping users, groups, folder paths and roles.")
+	T.Flags.BoolVar(&T.map_groups, "map_groups", "Grant source groups as the Kiteworks groups of the same name instead of their members.")
+	T.Flags.MultiVar(&T.user_emails, "users", "<user@domain.com>", "User(s) to migrate.")
+	T.Flags.BoolVar(&T.hidden, "hidden", "Include hidden files and folders.")
+	migrate := T.Flags.Bool("migrate", "Perform the actual migration.")
+	T.Flags.BoolVar(&T.report, "report", "Generate a report of WebDAV users, folders and files.")
+	T.Flags.StringVar(&T.preflight, "preflight", "<findings.csv>", "Check the source and destination for problems, writing findings to a CSV or JSON file.")
+	T.Flags.IntVar(&T.max_file_size, "max_file_size", 0, "Largest file (MB) the destination accepts, checked by --preflight.")
+	T.Flags.StringVar(&T.rollback, "rollback", "<run id>", "Undo the users, folders, files, grants and keys created on Kiteworks by a migration run.")
+	T.Flags.BoolVar(&T.dry_run, "dry_run", "With --rollback, log what would be undone without changing anything.")
+	T.Flags.BoolVar(&T.status, "status", "Show each user's migration state, with throughput and an ETA.")
+	T.Flags.BoolVar(&T.retry_failed, "retry_failed", "With --migrate, migrate only the users whose last migration failed.")
+	T.limits.RegisterFlags(&T.Flags)
+	T.Flags.Order("migrate", "report", "preflight", "rollback", "status", "user_map")
+	if err := T.Flags.Parse(); err != nil {
+		return err
+	}
+	if err := T.limits.Validate(); err != nil {
+		return err
+	}
+
+	if *setup || IsBlank(T.server) || IsBlank(T.account.Username) {
+		T.configureWebDAV()
+	}
+
+	if !IsBlank(T.mapping_file) {
+		mapping, err := LoadMigrationMapping(T.mapping_file)
+		if err != nil {
+			return err
+		}
+		T.mapping = mapping
+	}
+
+	var modes int
+	for _, m := range []bool{*migrate, T.report, !IsBlank(T.preflight), !IsBlank(T.rollback), T.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("--migrate, --report, --preflight, --rollback and --status are mutually exclusive, please specify only one")
+	}
+	if modes == 0 {
+		return fmt.Errorf("must specify either --migrate, --report, --preflight, --rollback or --status")
+	}
+	if T.dry_run && IsBlank(T.rollback) {
+		return fmt.Errorf("--dry_run requires --rollback")
+	}
+	if T.retry_failed && !*migrate {
+		return fmt.Errorf("--retry_failed requires --migrate")
+	}
+	if !IsBlank(T.rollback) {
+		return nil
+	}
+	if IsBlank(T.user_map) {
+		return fmt.Errorf("--user_map is required.")
+	}
+	if IsBlank(T.dest_folder) {
+		return fmt.Errorf("--dest_folder cannot be blank.")
+	}
+	return nil
+}
+
+// configureWebDAV prompts for the WebDAV connection settings, saves them and
+// exits.
+func (T *WebDAVMigrationTask) configureWebDAV() {
+	webdav_auth := NewOptions("--- WebDAV Server Configuration ---", "(selection or 'q' to save & exit)", 'q')
+	webdav_auth.StringVar(&T.server, "WebDAV Server", T.server, "Please input the WebDAV server host, with the port when it is not 443. (host:port)")
+	webdav_auth.StringVar(&T.account.Username, "WebDAV Username", T.account.Username, "Please input an account able to read user collections. (a Nextcloud admin to expand groups)")
+	webdav_auth.SecretVar(&T.account.Password, "WebDAV Password", T.account.Password, "Password or app password for the WebDAV account.")
+	webdav_auth.StringVar(&T.home_root, "Home Collection Root", T.home_root, "Collection containing user home collections.")
+	if webdav_auth.Select(false) {
+		T.webdav_config.Set("server", &T.server)
+		T.webdav_config.Set("username", &T.account.Username)
+		T.webdav_config.CryptSet("password", &T.account.Password)
+		T.webdav_config.Set("home_root", &T.home_root)
+	}
+	Exit(0)
+}
+
+// configure_api creates and configures the WebDAV API client.
+func (T *WebDAVMigrationTask) configure_api() {
+	T.api = newWebDAVAPI(T.server)
+	T.api.VerifySSL = true
+	T.api.ProxyURI = T.KW.ProxyURI
+	T.webdav_db.Drop("tokens")
+
+	T.api.SetDatabase(T.webdav_db)
+	T.api.MaxChunkSize = T.KW.MaxChunkSize
+	T.api.SetLimiter(T.KW.GetLimit())
+	T.api.SetTransferLimiter(T.KW.GetTransferLimit())
+	T.api.RequestTimeout = T.KW.RequestTimeout
+	T.api.ConnectTimeout = T.KW.ConnectTimeout
+}
+
+// Main runs the WebDAV report, migration or preflight.
+func (T *WebDAVMigrationTask) Main() (err error) {
+	if !IsBlank(T.rollback) {
+		return RollbackMigration(&T.KiteBrokerTask, T.webdav_db, T.rollback, T.dry_run)
+	}
+
+	users, err := T.readUserMap()
+	if err != nil {
+		return err
+	}
+	T.configure_api()
+
+	source := &webdavSource{
+		WebDAVMigrationTask: T,
+		users:               users,
+		logins:              make(map[string]string),
+	}
+	for _, u := range users {
+		source.logins[u.login] = u.email
+	}
+
+	engine := NewMigrationEngine(&T.KiteBrokerTask, source, T.webdav_db)
+	engine.Users = T.user_emails
+	engine.Mapping = T.mapping
+	engine.Limits = T.limits
+	engine.RetryFailed = T.retry_failed
+	engine.MapGroups = T.map_groups
+
+	if T.status {
+		return engine.RunStatus()
+	}
+	if T.report {
+		return engine.RunReport()
+	}
+	if err := engine.SetProfile(T.target_profile_name); err != nil {
+		return err
+	}
+	if !IsBlank(T.preflight) {
+		engine.Preflight.MaxFileSize = int64(T.max_file_size) * 1024 * 1024
+		return engine.RunPreflight(T.preflight)
+	}
+	return engine.Run()
+}
+
+// readUserMap reads the user map CSV. A login's home collection is the login
+// under the home collection root.
+func (T *WebDAVMigrationTask) readUserMap() (users []webdavUser, err error) {
+	f, err := os.Open(T.user_map)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", T.user_map, err)
+	}
+
+	for _, r := range records {
+		for i := range r {
+			r[i] = strings.TrimSpace(r[i])
+		}
+		// Skips the header, and any line without a Kiteworks user.
+		if len(r) < 2 || IsBlank(r[0]) || !strings.Contains(r[1], "@") {
+			continue
+		}
+		u := webdavUser{
+			login: r[0],
+			email: strings.ToLower(r[1]),
+			home:  path.Join("/", T.home_root, r[0]),
+		}
+		if len(r) > 2 {
+			u.password = r[2]
+		}
+		users = append(users, u)
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no WebDAV logins mapped to Kiteworks users", T.user_map)
+	}
+	return users, nil
+}
@@ -0,0 +1,304 @@
+package webdav
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// propfindBody requests the properties read from each entry of a collection.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+    <d:getetag/>
+  </d:prop>
+</d:propfind>`
+
+// WebDAVAPI wraps an APIClient for WebDAV access with basic authentication.
+// Requests are made with the credentials they are given, rather than the
+// APIClient's tokens, so each user can be read with their own app password.
+type WebDAVAPI struct {
+	*APIClient
+	ocs_missing int32 // Set once the server is found to have no OCS API.
+}
+
+// WebDAVCredentials are the basic authentication credentials of a request.
+type WebDAVCredentials struct {
+	Username string
+	Password string
+}
+
+// WebDAVEntry is a file or collection on the server.
+type WebDAVEntry struct {
+	Path       string // Unescaped absolute path.
+	Name       string
+	Collection bool
+	Size       int64
+	Modified   time.Time
+	ETag       string
+}
+
+// WebDAVShare is a Nextcloud share of a file or folder.
+type WebDAVShare struct {
+	ShareType   int    `json:"share_type"` // 0 user, 1 group, 3 link, 4 email.
+	ShareWith   string `json:"share_with"`
+	Permissions int    `json:"permissions"`
+	Path        string `json:"path"` // Relative to the owner's files.
+	ItemType    string `json:"item_type"`
+}
+
+// Nextcloud share types.
+const (
+	shareUser  = 0
+	shareGroup = 1
+	shareEmail = 4
+)
+
+// Nextcloud share permission bits.
+const (
+	permRead   = 1
+	permUpdate = 2
+	permCreate = 4
+	permDelete = 8
+)
+
+// ocsResult is an OCS API response envelope.
+type ocsResult struct {
+	OCS struct {
+		Meta struct {
+			Status     string `json:"status"`
+			StatusCode int    `json:"statuscode"`
+			Message    string `json:"message"`
+		} `json:"meta"`
+		Data json.RawMessage `json:"data"`
+	} `json:"ocs"`
+}
+
+// webdavError maps a Sabre DAV error to WEBDAV_<EXCEPTION>, and a failed OCS
+// response to OCS_<STATUSCODE>.
+func webdavError(body []byte) (e APIError) {
+	var dav_error struct {
+		XMLName   xml.Name
+		Exception string `xml:"exception"`
+		Message   string `xml:"message"`
+	}
+	if xml.Unmarshal(body, &dav_error) == nil && dav_error.XMLName.Local == "error" {
+		exception := dav_error.Exception
+		if i := strings.LastIndex(exception, "\\"); i >= 0 {
+			exception = exception[i+1:]
+		}
+		if IsBlank(exception) {
+			exception = "ERROR"
+		}
+		e.Register(fmt.Sprintf("WEBDAV_%s", strings.ToUpper(exception)), dav_error.Message)
+		return
+	}
+
+	var ocs ocsResult
+	if json.Unmarshal(body, &ocs) == nil && ocs.OCS.Meta.Status == "failure" {
+		e.Register(fmt.Sprintf("OCS_%d", ocs.OCS.Meta.StatusCode), ocs.OCS.Meta.Message)
+	}
+	return
+}
+
+// newWebDAVAPI returns a client of the WebDAV server at server.
+func newWebDAVAPI(server string) *WebDAVAPI {
+	api := &WebDAVAPI{APIClient: new(APIClient)}
+	api.Server = server
+	api.ErrorScanner = webdavError
+	api.RetryErrorCodes = []string{"WEBDAV_SERVICEUNAVAILABLE", "HTTP_STATUS_429", "HTTP_STATUS_500", "HTTP_STATUS_502", "HTTP_STATUS_503", "HTTP_STATUS_504"}
+	api.Retries = 3
+	return api
+}
+
+// escapePath escapes an absolute path for a request URL.
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// send sends a request as creds, retrying transient errors. body, when not
+// blank, is sent with each attempt.
+func (W *WebDAVAPI) send(creds WebDAVCredentials, method, p string, header http.Header, body string) (resp *http.Response, err error) {
+	retry := W.InitRetry(creds.Username, fmt.Sprintf("%s %s", method, p))
+	for {
+		var req *http.Request
+		req, err = W.NewRequest(method, p)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.SetBasicAuth(creds.Username, creds.Password)
+		if !IsBlank(body) {
+			req.Body = io.NopCloser(strings.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		resp, err = W.SendRequest(NONE, req)
+		if retry.CheckForRetry(err) {
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+			continue
+		}
+		return resp, err
+	}
+}
+
+// List returns the entries of the collection at dir, not including itself.
+func (W *WebDAVAPI) List(creds WebDAVCredentials, dir string) (entries []WebDAVEntry, err error) {
+	header := make(http.Header)
+	header.Set("Depth", "1")
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := W.send(creds, "PROPFIND", escapePath(strings.TrimSuffix(dir, "/")+"/"), header, propfindBody)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Responses []struct {
+			Href      string `xml:"href"`
+			Propstats []struct {
+				Status string `xml:"status"`
+				Prop   struct {
+					ResourceType struct {
+						Collection *struct{} `xml:"collection"`
+					} `xml:"resourcetype"`
+					Length   string `xml:"getcontentlength"`
+					Modified string `xml:"getlastmodified"`
+					ETag     string `xml:"getetag"`
+				} `xml:"prop"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("I cannot understand what %s is saying: %v", W.Server, err)
+	}
+
+	self := path.Clean(dir)
+	for _, r := range result.Responses {
+		href := r.Href
+		if u, err := url.Parse(href); err == nil {
+			href = u.Path
+		}
+		href = path.Clean(href)
+		if href == self {
+			continue
+		}
+		entry := WebDAVEntry{Path: href, Name: path.Base(href)}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			entry.Collection = entry.Collection || ps.Prop.ResourceType.Collection != nil
+			if size, err := strconv.ParseInt(ps.Prop.Length, 10, 64); err == nil {
+				entry.Size = size
+			}
+			if modified, err := http.ParseTime(ps.Prop.Modified); err == nil {
+				entry.Modified = modified
+			}
+			if !IsBlank(ps.Prop.ETag) {
+				entry.ETag = strings.Trim(ps.Prop.ETag, `"`)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// Stat reports whether the collection at dir exists.
+func (W *WebDAVAPI) Stat(creds WebDAVCredentials, dir string) error {
+	header := make(http.Header)
+	header.Set("Depth", "0")
+	resp, err := W.send(creds, "PROPFIND", escapePath(strings.TrimSuffix(dir, "/")+"/"), header, NONE)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Download returns the content of the file at p.
+func (W *WebDAVAPI) Download(creds WebDAVCredentials, p string) (ReadSeekCloser, error) {
+	req, err := W.NewRequest("GET", escapePath(p))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(creds.Username, creds.Password)
+	return W.WebDownload(req), nil
+}
+
+// ocs performs an OCS API call as creds, decoding its data into output. It
+// returns false when the server has no OCS API.
+func (W *WebDAVAPI) ocs(creds WebDAVCredentials, p string, query url.Values, output interface{}) (found bool, err error) {
+	if atomic.LoadInt32(&W.ocs_missing) > 0 {
+		return false, nil
+	}
+	query.Set("format", "json")
+	header := make(http.Header)
+	header.Set("OCS-APIRequest", "true")
+	header.Set("Accept", "application/json")
+	resp, err := W.send(creds, "GET", p+"?"+query.Encode(), header, NONE)
+	if err != nil {
+		if IsAPIError(err, "HTTP_STATUS_404", "WEBDAV_NOTFOUND") {
+			if atomic.CompareAndSwapInt32(&W.ocs_missing, 0, 1) {
+				Notice("%s has no OCS share API; shares will not be migrated.", W.Server)
+			}
+			return false, nil
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	var result ocsResult
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return true, fmt.Errorf("I cannot understand what %s is saying: %v", W.Server, err)
+	}
+	if len(result.OCS.Data) > 0 && output != nil {
+		err = json.Unmarshal(result.OCS.Data, output)
+	}
+	return true, err
+}
+
+// Shares returns the shares made by the user of creds.
+func (W *WebDAVAPI) Shares(creds WebDAVCredentials) (shares []WebDAVShare, err error) {
+	_, err = W.ocs(creds, "/ocs/v2.php/apps/files_sharing/api/v1/shares", url.Values{}, &shares)
+	return
+}
+
+// GroupUsers returns the logins of a group's members, read as an admin.
+func (W *WebDAVAPI) GroupUsers(admin WebDAVCredentials, group string) (logins []string, err error) {
+	var data struct {
+		Users []string `json:"users"`
+	}
+	_, err = W.ocs(admin, fmt.Sprintf("/ocs/v2.php/cloud/groups/%s/users", url.PathEscape(group)), url.Values{}, &data)
+	return data.Users, err
+}
+
+// MapSharePermissions maps Nextcloud share permissions to the name of the
+// Kiteworks role granted by default.
+func MapSharePermissions(perms int) string {
+	switch {
+	case perms&(permUpdate|permDelete) != 0:
+		return "Collaborator"
+	case perms&permCreate != 0 && perms&permRead == 0:
+		return "Uploader"
+	case perms&permRead != 0:
+		return "Viewer"
+	default:
+		return NONE
+	}
+}
@@ -0,0 +1,325 @@
+package webdav
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/cmcoffee/kitebroker/core"
+)
+
+// davResponse is a response element of a fake PROPFIND multistatus.
+type davResponse struct {
+	href       string
+	collection bool
+	size       int64
+	modified   string
+}
+
+// fakeNextcloud is a stand-in for a Nextcloud server: PROPFIND listings of
+// collections, and the OCS share and group APIs. Requests must carry the
+// password of their user.
+type fakeNextcloud struct {
+	*httptest.Server
+	passwords   map[string]string
+	collections map[string][]davResponse // Multistatus responses, by escaped collection path.
+	shares      map[string]string        // OCS share data, by user.
+	groups      map[string]string        // OCS group data, by group.
+	no_ocs      bool
+	lock        sync.Mutex
+	requests    []string
+}
+
+// newFakeNextcloud starts a fake Nextcloud server, until the test ends.
+func newFakeNextcloud(t *testing.T) *fakeNextcloud {
+	f := &fakeNextcloud{
+		passwords:   make(map[string]string),
+		collections: make(map[string][]davResponse),
+		shares:      make(map[string]string),
+		groups:      make(map[string]string),
+	}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Server.Close)
+	return f
+}
+
+func (f *fakeNextcloud) serve(w http.ResponseWriter, r *http.Request) {
+	user, pass, _ := r.BasicAuth()
+	f.lock.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.EscapedPath()+" "+user)
+	f.lock.Unlock()
+
+	if p, ok := f.passwords[user]; !ok || p != pass {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `<?xml version="1.0"?><d:error xmlns:d="DAV:" xmlns:s="http://sabredav.org/ns"><s:exception>Sabre\DAV\Exception\NotAuthenticated</s:exception><s:message>No password</s:message></d:error>`)
+		return
+	}
+
+	switch {
+	case r.Method == "PROPFIND":
+		responses, ok := f.collections[r.URL.EscapedPath()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0"?><d:error xmlns:d="DAV:" xmlns:s="http://sabredav.org/ns"><s:exception>Sabre\DAV\Exception\NotFound</s:exception><s:message>Not found</s:message></d:error>`)
+			return
+		}
+		if r.Header.Get("Depth") == "0" {
+			responses = responses[:1]
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+		for _, e := range responses {
+			fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop>`, e.href)
+			if e.collection {
+				fmt.Fprint(w, `<d:resourcetype><d:collection/></d:resourcetype>`)
+			} else {
+				fmt.Fprintf(w, `<d:resourcetype/><d:getcontentlength>%d</d:getcontentlength><d:getetag>"etag-%d"</d:getetag>`, e.size, e.size)
+			}
+			fmt.Fprintf(w, `<d:getlastmodified>%s</d:getlastmodified></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>`, e.modified)
+			// Nextcloud reports properties a collection lacks as not found.
+			fmt.Fprint(w, `<d:propstat><d:prop><d:getcontentlength/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat></d:response>`)
+		}
+		fmt.Fprint(w, `</d:multistatus>`)
+	case f.no_ocs:
+		w.WriteHeader(http.StatusNotFound)
+	case r.URL.Path == "/ocs/v2.php/apps/files_sharing/api/v1/shares":
+		if r.Header.Get("OCS-APIRequest") != "true" || r.URL.Query().Get("format") != "json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"ocs": {"meta": {"status": "ok", "statuscode": 200}, "data": %s}}`, f.shares[user])
+	case strings.HasPrefix(r.URL.Path, "/ocs/v2.php/cloud/groups/"):
+		group := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/ocs/v2.php/cloud/groups/"), "/users")
+		data, ok := f.groups[group]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"ocs": {"meta": {"status": "failure", "statuscode": 404, "message": "Group does not exist"}, "data": []}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"ocs": {"meta": {"status": "ok", "statuscode": 200}, "data": %s}}`, data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// source returns a source reading the fake server, with its user map.
+func (f *fakeNextcloud) source(users ...webdavUser) *webdavSource {
+	api := newWebDAVAPI(strings.TrimPrefix(f.URL, "https://"))
+	api.SetDatabase(OpenCache())
+	api.SetLimiter(5)
+	api.SetTransferLimiter(5)
+	api.Retries = 0
+
+	S := &webdavSource{
+		WebDAVMigrationTask: &WebDAVMigrationTask{
+			api:         api,
+			account:     WebDAVCredentials{Username: "admin", Password: "admin-pass"},
+			dest_folder: "Nextcloud",
+		},
+		users:  users,
+		logins: make(map[string]string),
+	}
+	for _, u := range users {
+		S.logins[u.login] = u.email
+	}
+	return S
+}
+
+const (
+	aliceHome = "/remote.php/dav/files/alice"
+	modified  = "Tue, 05 Mar 2024 14:30:00 GMT"
+)
+
+var alice = webdavUser{login: "alice", email: "alice@example.com", password: "alice-pass", home: aliceHome}
+
+func TestCollectionWalk(t *testing.T) {
+	f := newFakeNextcloud(t)
+	f.passwords["alice"] = "alice-pass"
+	f.collections[aliceHome+"/"] = []davResponse{
+		{href: aliceHome + "/", collection: true, modified: modified},
+		{href: aliceHome + "/notes.txt", size: 12, modified: modified},
+		{href: aliceHome + "/.hidden", size: 1, modified: modified},
+		{href: "https://cloud.example.com" + aliceHome + "/Project%20Files/", collection: true, modified: "Wed, 06 Mar 2024 09:00:00 GMT"},
+	}
+	f.collections[aliceHome+"/Project%20Files/"] = []davResponse{
+		{href: aliceHome + "/Project%20Files/", collection: true, modified: modified},
+		{href: aliceHome + "/Project%20Files/r%C3%A9sum%C3%A9.pdf", size: 2048, modified: "not a date"},
+	}
+
+	S := f.source(alice)
+	user := MigrationUser{ID: "alice", Email: "alice@example.com", Home: aliceHome}
+
+	root, err := S.Root(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.SrcID != aliceHome || root.FullPath != "Nextcloud" {
+		t.Fatalf("root: %+v", root)
+	}
+
+	files, err := S.Files(user, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].SrcID != aliceHome+"/notes.txt" || files[0].Size != 12 {
+		t.Fatalf("root files: %+v", files)
+	}
+	want := time.Date(2024, time.March, 5, 14, 30, 0, 0, time.UTC)
+	if !files[0].Modified.Equal(want) {
+		t.Errorf("getlastmodified: got %v, want %v", files[0].Modified, want)
+	}
+
+	folders, err := S.Folders(user, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 1 {
+		t.Fatalf("folders: %+v", folders)
+	}
+	project := folders[0]
+	if project.Name != "Project Files" || project.SrcID != aliceHome+"/Project Files" || project.FullPath != "Nextcloud/Project Files" {
+		t.Errorf("absolute, escaped href: %+v", project)
+	}
+	if project.Modified.Day() != 6 {
+		t.Errorf("folder modified: %v", project.Modified)
+	}
+
+	files, err = S.Files(user, project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "résumé.pdf" || files[0].Size != 2048 || !files[0].Modified.IsZero() {
+		t.Errorf("project files: %+v", files)
+	}
+
+	// Hidden entries are migrated when enabled.
+	S.hidden = true
+	if files, _ := S.Files(user, root); len(files) != 2 {
+		t.Errorf("with hidden: got %d root files, want 2", len(files))
+	}
+
+	// A user without their own password is read with the configured account.
+	f.passwords["admin"] = "admin-pass"
+	f.collections["/remote.php/dav/files/bob/"] = []davResponse{{href: "/remote.php/dav/files/bob/", collection: true, modified: modified}}
+	if _, err := S.Root(MigrationUser{ID: "bob", Home: "/remote.php/dav/files/bob"}); err != nil {
+		t.Fatal(err)
+	}
+	last := f.requests[len(f.requests)-1]
+	if last != "PROPFIND /remote.php/dav/files/bob/ admin" {
+		t.Errorf("request as the account: %q", last)
+	}
+
+	if _, err := S.Root(MigrationUser{ID: "alice", Home: aliceHome + "/missing"}); !IsAPIError(err, "WEBDAV_NOTFOUND") {
+		t.Errorf("missing home: %v", err)
+	}
+	delete(f.passwords, "alice")
+	if _, err := S.Files(user, root); !IsAPIError(err, "WEBDAV_NOTAUTHENTICATED") {
+		t.Errorf("bad password: %v", err)
+	}
+}
+
+func TestShareMapping(t *testing.T) {
+	f := newFakeNextcloud(t)
+	f.passwords["alice"] = "alice-pass"
+	f.passwords["admin"] = "admin-pass"
+	f.shares["alice"] = `[
+		{"share_type": 0, "share_with": "bob", "permissions": 31, "path": "/Project Files", "item_type": "folder"},
+		{"share_type": 0, "share_with": "mallory", "permissions": 1, "path": "/Project Files", "item_type": "folder"},
+		{"share_type": 1, "share_with": "sales", "permissions": 1, "path": "/Project Files/", "item_type": "folder"},
+		{"share_type": 4, "share_with": "Partner@Example.net", "permissions": 4, "path": "/Project Files", "item_type": "folder"},
+		{"share_type": 3, "share_with": "", "permissions": 1, "path": "/Project Files", "item_type": "folder"},
+		{"share_type": 0, "share_with": "bob", "permissions": 0, "path": "/Project Files", "item_type": "folder"},
+		{"share_type": 0, "share_with": "bob", "permissions": 19, "path": "/notes.txt", "item_type": "file"}
+	]`
+	f.groups["sales"] = `{"users": ["bob", "carol", "dave@example.com"]}`
+
+	bob := webdavUser{login: "bob", email: "bob@example.com", home: "/remote.php/dav/files/bob"}
+	S := f.source(alice, bob)
+	user := MigrationUser{ID: "alice", Email: "alice@example.com", Home: aliceHome}
+
+	members, err := S.Members(user, SyncFolder{SrcID: aliceHome + "/Project Files", FullPath: "Nextcloud/Project Files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range members {
+		got = append(got, fmt.Sprintf("%s%s=%s(%s)", m.User, m.Group, m.Role, m.SourceRole))
+	}
+	want := []string{"bob@example.com=Collaborator(31)", "sales=Viewer(1)", "partner@example.net=Uploader(4)"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("members: got %v, want %v", got, want)
+	}
+
+	// Shares are read once per user.
+	if _, err := S.Members(user, SyncFolder{SrcID: aliceHome, FullPath: "Nextcloud"}); err != nil {
+		t.Fatal(err)
+	}
+	var share_calls int
+	for _, r := range f.requests {
+		if strings.Contains(r, "/shares") {
+			share_calls++
+		}
+	}
+	if share_calls != 1 {
+		t.Errorf("shares requested %d times, want once", share_calls)
+	}
+
+	emails, err := S.GroupMembers(user, "sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(emails)
+	if strings.Join(emails, ",") != "bob@example.com,dave@example.com" {
+		t.Errorf("group members: %v", emails)
+	}
+	if _, err := S.GroupMembers(user, "missing"); !IsAPIError(err, "OCS_404") {
+		t.Errorf("missing group: %v", err)
+	}
+}
+
+func TestNoOCS(t *testing.T) {
+	f := newFakeNextcloud(t)
+	f.passwords["alice"] = "alice-pass"
+	f.no_ocs = true
+
+	S := f.source(alice)
+	user := MigrationUser{ID: "alice", Email: "alice@example.com", Home: aliceHome}
+	for i := 0; i < 2; i++ {
+		members, err := S.Members(user, SyncFolder{SrcID: aliceHome + "/Project Files"})
+		if err != nil || members != nil {
+			t.Fatalf("members without OCS: %v, %v", members, err)
+		}
+		S.shares.Delete("alice")
+	}
+	var ocs_calls int
+	for _, r := range f.requests {
+		if strings.Contains(r, "/ocs/") {
+			ocs_calls++
+		}
+	}
+	if ocs_calls != 1 {
+		t.Errorf("OCS requested %d times after it was found missing, want once", ocs_calls)
+	}
+}
+
+func TestMapSharePermissions(t *testing.T) {
+	for perms, want := range map[int]string{
+		permRead:                        "Viewer",
+		permRead | permCreate:           "Viewer",
+		permCreate:                      "Uploader",
+		permRead | permUpdate:           "Collaborator",
+		permDelete:                      "Collaborator",
+		0:                               NONE,
+		permRead | permCreate | 16 | 32: "Viewer",
+	} {
+		if got := MapSharePermissions(perms); got != want {
+			t.Errorf("MapSharePermissions(%d) = %q, want %q", perms, got, want)
+		}
+	}
+}